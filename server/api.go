@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/wbrefvem/go-bitbucket"
 	"golang.org/x/oauth2"
 
@@ -93,6 +94,23 @@ func (p *Plugin) writeAPIError(w http.ResponseWriter, apiErr *APIErrorResponse)
 	}
 }
 
+// decodeDialogSubmission reads the submission of an interactive dialog. The submission must come
+// from the user, in a channel they can post in, as the dialogs act and post there on their behalf.
+// If not, the error response is written and nil is returned.
+func (p *Plugin) decodeDialogSubmission(w http.ResponseWriter, r *http.Request, userID string) *model.SubmitDialogRequest {
+	var request model.SubmitDialogRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		p.writeAPIError(w, &APIErrorResponse{Message: "Invalid dialog submission.", StatusCode: http.StatusBadRequest})
+		return nil
+	}
+	if request.UserId != userID || !p.API.HasPermissionToChannel(userID, request.ChannelId, model.PermissionCreatePost) {
+		p.writeAPIError(w, &APIErrorResponse{Message: "Not authorized.", StatusCode: http.StatusUnauthorized})
+		return nil
+	}
+
+	return &request
+}
+
 func (p *Plugin) initializeAPI() {
 	p.router = mux.NewRouter()
 
@@ -111,18 +129,39 @@ func (p *Plugin) initializeAPI() {
 	apiRouter.HandleFunc("/prsdetails", p.extractUserMiddleWare(p.getPrsDetails, ResponseTypePlain)).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/searchissues", p.extractUserMiddleWare(p.searchIssues, ResponseTypePlain)).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/yourassignments", p.extractUserMiddleWare(p.getYourAssignments, ResponseTypePlain)).Methods(http.MethodGet)
-	apiRouter.HandleFunc("/createissue", p.extractUserMiddleWare(p.createIssue, ResponseTypePlain)).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/createissuecomment", p.extractUserMiddleWare(p.createIssueComment, ResponseTypePlain)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/createissue", p.extractUserMiddleWare(p.requireIssueTracker(p.createIssue), ResponseTypePlain)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/createissuecomment", p.extractUserMiddleWare(p.requireIssueTracker(p.createIssueComment), ResponseTypePlain)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/createprcomment", p.extractUserMiddleWare(p.createPullRequestCommentFromPost, ResponseTypePlain)).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/repositories", p.extractUserMiddleWare(p.getRepositories, ResponseTypePlain)).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/settings", p.extractUserMiddleWare(p.updateSettings, ResponseTypePlain)).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/user", p.extractUserMiddleWare(p.getBitbucketUser, ResponseTypeJSON)).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/issue", p.extractUserMiddleWare(p.getIssueByID, ResponseTypePlain)).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/issue", p.extractUserMiddleWare(p.requireIssueTracker(p.getIssueByID), ResponseTypePlain)).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/pr", p.extractUserMiddleWare(p.getPrByID, ResponseTypePlain)).Methods(http.MethodGet)
+	for _, action := range []string{pullRequestActionApprove, pullRequestActionRequestChanges, pullRequestActionComment, pullRequestActionMerge} {
+		apiRouter.HandleFunc("/pr/"+action, p.extractUserMiddleWare(p.handlePullRequestAction(action), ResponseTypeJSON)).Methods(http.MethodPost)
+	}
+	for _, action := range []string{pullRequestActionComment, pullRequestActionMerge} {
+		apiRouter.HandleFunc("/pr/"+action+"/submit", p.extractUserMiddleWare(p.handlePullRequestActionDialog(action), ResponseTypeJSON)).Methods(http.MethodPost)
+	}
+	apiRouter.HandleFunc("/pr/"+pullRequestActionCreate+"/submit", p.extractUserMiddleWare(p.handleCreatePullRequestDialog, ResponseTypeJSON)).Methods(http.MethodPost)
 
 	apiRouter.HandleFunc("/config", checkPluginRequest(p.getConfig)).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/token", checkPluginRequest(p.getToken)).Methods(http.MethodGet)
 }
 
+// requireIssueTracker rejects requests to issue endpoints when connected to Bitbucket Data Center,
+// which has no built-in issue tracker.
+func (p *Plugin) requireIssueTracker(handler HTTPHandlerFuncWithUser) HTTPHandlerFuncWithUser {
+	return func(w http.ResponseWriter, r *http.Request, userID string) {
+		if p.isDataCenter() {
+			p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Issues are not supported by Bitbucket Data Center.", StatusCode: http.StatusNotImplemented})
+			return
+		}
+
+		handler(w, r, userID)
+	}
+}
+
 func (p *Plugin) extractUserMiddleWare(handler HTTPHandlerFuncWithUser, responseType ResponseType) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Header.Get("Mattermost-User-ID")
@@ -241,11 +280,7 @@ func (p *Plugin) completeConnectUserToBitbucket(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*tok)
-	bitbucketUser, httpResponse, err := bitbucketClient.UsersApi.UserGet(ctx)
-	if httpResponse != nil {
-		_ = httpResponse.Body.Close()
-	}
+	bitbucketUser, err := p.getCurrentBitbucketUser(ctx, *tok)
 	if err != nil {
 		p.API.LogError("Error converting authorization code int token", "err", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -305,6 +340,9 @@ func (p *Plugin) completeConnectUserToBitbucket(w http.ResponseWriter, r *http.R
 			"bitbucket_username":  userInfo.BitbucketUsername,
 			"bitbucket_client_id": config.BitbucketOAuthClientID,
 			"organization":        config.BitbucketOrg,
+			"organizations":       config.getOrganizations(),
+			"denied_repositories": config.getDeniedRepositories(),
+			"enterprise_base_url": p.getEnterpriseBaseURL(),
 		},
 		&model.WebsocketBroadcast{UserId: state.UserID},
 	)
@@ -376,16 +414,22 @@ func (p *Plugin) getConnected(w http.ResponseWriter, r *http.Request) {
 	config := p.getConfiguration()
 
 	type ConnectedResponse struct {
-		Connected         bool          `json:"connected"`
-		BitbucketUsername string        `json:"bitbucket_username"`
-		BitbucketClientID string        `json:"bitbucket_client_id"`
-		Organization      string        `json:"organization"`
-		Settings          *UserSettings `json:"settings"`
+		Connected          bool          `json:"connected"`
+		BitbucketUsername  string        `json:"bitbucket_username"`
+		BitbucketClientID  string        `json:"bitbucket_client_id"`
+		Organization       string        `json:"organization"`
+		Organizations      []string      `json:"organizations"`
+		DeniedRepositories []string      `json:"denied_repositories"`
+		EnterpriseBaseURL  string        `json:"enterprise_base_url,omitempty"`
+		Settings           *UserSettings `json:"settings"`
 	}
 
 	resp := &ConnectedResponse{
-		Connected:    false,
-		Organization: config.BitbucketOrg,
+		Connected:          false,
+		Organization:       config.BitbucketOrg,
+		Organizations:      config.getOrganizations(),
+		DeniedRepositories: config.getDeniedRepositories(),
+		EnterpriseBaseURL:  p.getEnterpriseBaseURL(),
 	}
 
 	userID := r.Header.Get("Mattermost-User-ID")
@@ -437,9 +481,9 @@ func (p *Plugin) getReviews(w http.ResponseWriter, _ *http.Request, userID strin
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*userInfo.Token)
+	bitbucketClient := p.bitbucketConnect(userInfo)
 
-	userRepos, err := p.getUserRepositories(context.Background(), bitbucketClient)
+	userRepos, err := p.getUserRepositories(context.Background(), userInfo, bitbucketClient)
 	if err != nil {
 		p.API.LogError("Error occurred while searching for repositories", "err", err.Error())
 		return
@@ -461,9 +505,9 @@ func (p *Plugin) getYourPrs(w http.ResponseWriter, _ *http.Request, userID strin
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*userInfo.Token)
+	bitbucketClient := p.bitbucketConnect(userInfo)
 
-	userRepos, err := p.getUserRepositories(context.Background(), bitbucketClient)
+	userRepos, err := p.getUserRepositories(context.Background(), userInfo, bitbucketClient)
 	if err != nil {
 		p.API.LogError("error occurred while searching for repositories", "err", err)
 		return
@@ -485,7 +529,7 @@ func (p *Plugin) getPrsDetails(w http.ResponseWriter, r *http.Request, userID st
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
 	var prList []*PRDetails
 	if err := json.NewDecoder(r.Body).Decode(&prList); err != nil {
@@ -503,7 +547,7 @@ func (p *Plugin) getPrsDetails(w http.ResponseWriter, r *http.Request, userID st
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			prDetail := p.fetchPRDetails(ctx, bitbucketClient, pr.URL, pr.ID)
+			prDetail := p.fetchPRDetails(ctx, info, bitbucketClient, pr.URL, pr.ID)
 			prDetails[i] = prDetail
 		}()
 	}
@@ -513,13 +557,10 @@ func (p *Plugin) getPrsDetails(w http.ResponseWriter, r *http.Request, userID st
 	p.writeJSON(w, prDetails)
 }
 
-func (p *Plugin) fetchPRDetails(ctx context.Context, client *bitbucket.APIClient, prURL string, prID int) *PRDetails {
+func (p *Plugin) fetchPRDetails(ctx context.Context, info *BitbucketUserInfo, client *bitbucket.APIClient, prURL string, prID int) *PRDetails {
 	repoOwner, repoName := getRepoOwnerAndNameFromURL(prURL)
 
-	prInfo, httpResponse, err := client.PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdGet(ctx, repoOwner, repoName, int32(prID))
-	if httpResponse != nil {
-		_ = httpResponse.Body.Close()
-	}
+	prInfo, err := p.getPullRequest(ctx, info, client, repoOwner, repoName, int64(prID))
 	if err != nil {
 		p.API.LogError("Error fetching pull request", "prID", prID, "err", err.Error())
 		return nil
@@ -539,11 +580,11 @@ func (p *Plugin) searchIssues(w http.ResponseWriter, r *http.Request, userID str
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
 	searchTerm := r.FormValue("term")
 
-	result, err := p.getIssuesWithTerm(bitbucketClient, searchTerm)
+	result, err := p.getIssuesWithTerm(info, bitbucketClient, searchTerm)
 	if err != nil {
 		p.API.LogError("Error fetching issues with term", "searchTerm", searchTerm, "err", err.Error())
 		return
@@ -623,7 +664,7 @@ func (p *Plugin) createIssueComment(w http.ResponseWriter, r *http.Request, user
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
 	post, appErr := p.API.GetPost(req.PostID)
 	if appErr != nil {
@@ -702,6 +743,116 @@ func (p *Plugin) createIssueComment(w http.ResponseWriter, r *http.Request, user
 	p.writeJSON(w, issueComment)
 }
 
+// createPullRequestCommentFromPost attaches a post to a pull request as a comment, optionally
+// anchored to a file and line, and replies with a link to the comment.
+func (p *Plugin) createPullRequestCommentFromPost(w http.ResponseWriter, r *http.Request, userID string) {
+	type CreatePullRequestCommentRequest struct {
+		PostID  string `json:"post_id"`
+		Owner   string `json:"owner"`
+		Repo    string `json:"repo"`
+		Number  int64  `json:"number"`
+		Comment string `json:"comment"`
+		Path    string `json:"path"`
+		Line    int64  `json:"line"`
+	}
+
+	req := &CreatePullRequestCommentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		p.API.LogError("Error decoding CreatePullRequestCommentRequest JSON body", "err", err.Error())
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a JSON object.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	if req.PostID == "" {
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a valid post id", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	if req.Owner == "" {
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a valid repo owner.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	if req.Repo == "" {
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a valid repo.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	if req.Number <= 0 {
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a valid pull request number.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	if req.Comment == "" {
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a valid non empty comment.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	req.Path = strings.Trim(strings.TrimSpace(req.Path), "/")
+	if req.Line < 0 || (req.Line > 0 && req.Path == "") {
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a file path for the line to comment on.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	info, apiErr := p.getBitbucketUserInfo(userID)
+	if apiErr != nil {
+		p.writeAPIError(w, apiErr)
+		return
+	}
+
+	post, appErr := p.API.GetPost(req.PostID)
+	if appErr != nil {
+		p.API.LogError("failed to load post", "postID", req.PostID)
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "failed to load post " + req.PostID, StatusCode: http.StatusInternalServerError})
+		return
+	}
+	if post == nil {
+		p.API.LogError("failed to load post: not found", "postID", req.PostID)
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "failed to load post " + req.PostID + ": not found", StatusCode: http.StatusNotFound})
+		return
+	}
+
+	commentUsername, err := p.getUsername(post.UserId)
+	if err != nil {
+		p.API.LogError("failed to load post", "UserId", post.UserId)
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "failed to get username", StatusCode: http.StatusInternalServerError})
+		return
+	}
+
+	permalink := p.getPermaLink(req.PostID)
+	permalinkMessage := fmt.Sprintf("*@%s attached a* [message](%s) *from %s*\n\n", info.BitbucketUsername, permalink, commentUsername)
+
+	comment, err := p.createPullRequestComment(context.Background(), info, req.Owner, req.Repo, req.Number, newPullRequestComment{
+		Text: permalinkMessage + req.Comment,
+		Path: req.Path,
+		Line: req.Line,
+	})
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		var actionErr *pullRequestActionError
+		if errors.As(err, &actionErr) {
+			statusCode = actionErr.StatusCode
+		}
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: pullRequestActionFailureMessage("comment on", req.Owner, req.Repo, req.Number, info.BitbucketUsername, err), StatusCode: statusCode})
+		return
+	}
+
+	permalinkReplyMessage := fmt.Sprintf("[Message](%v) attached to Bitbucket pull request [#%v](%v)", permalink, req.Number, comment.URL)
+	reply := &model.Post{
+		Message:   permalinkReplyMessage,
+		ChannelId: post.ChannelId,
+		UserId:    userID,
+	}
+
+	_, appErr = p.API.CreatePost(reply)
+	if appErr != nil {
+		p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "failed to create notification post " + req.PostID, StatusCode: http.StatusInternalServerError})
+		return
+	}
+
+	p.writeJSON(w, comment)
+}
+
 func (p *Plugin) getYourAssignments(w http.ResponseWriter, _ *http.Request, userID string) {
 	userInfo, apiErr := p.getBitbucketUserInfo(userID)
 	if apiErr != nil {
@@ -709,9 +860,9 @@ func (p *Plugin) getYourAssignments(w http.ResponseWriter, _ *http.Request, user
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*userInfo.Token)
+	bitbucketClient := p.bitbucketConnect(userInfo)
 
-	userRepos, err := p.getUserRepositories(context.Background(), bitbucketClient)
+	userRepos, err := p.getUserRepositories(context.Background(), userInfo, bitbucketClient)
 	if err != nil {
 		p.API.LogError("Error occurred while searching for repositories", "err", err)
 		return
@@ -733,7 +884,7 @@ func (p *Plugin) postToDo(w http.ResponseWriter, _ *http.Request, userID string)
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
 	text, err := p.GetToDo(context.Background(), info, bitbucketClient)
 	if err != nil {
@@ -796,7 +947,7 @@ func (p *Plugin) getIssueByID(w http.ResponseWriter, r *http.Request, userID str
 		p.writeAPIError(w, apiErr)
 		return
 	}
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
 	result, httpResponse, err := bitbucketClient.IssueTrackerApi.RepositoriesUsernameRepoSlugIssuesIssueIdGet(context.Background(), owner, issueID, repo)
 	if httpResponse != nil {
@@ -827,12 +978,9 @@ func (p *Plugin) getPrByID(w http.ResponseWriter, r *http.Request, userID string
 		p.writeAPIError(w, apiErr)
 		return
 	}
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
-	result, httpResponse, err := bitbucketClient.PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdGet(context.Background(), owner, repo, int32(prIDInt))
-	if httpResponse != nil {
-		_ = httpResponse.Body.Close()
-	}
+	result, err := p.getPullRequest(context.Background(), info, bitbucketClient, owner, repo, prIDInt)
 	if err != nil {
 		p.API.LogDebug("Could not get pull request", "owner", owner, "repo", repo, "ID", prID, "error", err.Error())
 		p.writeAPIError(w, &APIErrorResponse{Message: "Could not get pull request", StatusCode: http.StatusInternalServerError})
@@ -849,11 +997,11 @@ func (p *Plugin) getRepositories(w http.ResponseWriter, _ *http.Request, userID
 		return
 	}
 
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
 	ctx := context.Background()
 
-	repos, err := p.getUserRepositories(ctx, bitbucketClient)
+	repos, err := p.getUserRepositories(ctx, info, bitbucketClient)
 	if err != nil {
 		p.API.LogError("Failed to fetch repositories", "err", err.Error())
 		p.writeAPIError(w, &APIErrorResponse{Message: "Failed to fetch repositories", StatusCode: http.StatusInternalServerError})
@@ -951,7 +1099,7 @@ func (p *Plugin) createIssue(w http.ResponseWriter, r *http.Request, userID stri
 	splittedRepo := strings.Split(issue.Repo, "/")
 	owner := splittedRepo[0]
 	repoName := splittedRepo[1]
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 	issuePostResult, issuePostResponse, err := bitbucketClient.IssueTrackerApi.RepositoriesUsernameRepoSlugIssuesPost(context.Background(), owner, repoName, bbIssue)
 	if err != nil {
 		if issuePostResponse != nil {
@@ -1044,5 +1192,12 @@ func (p *Plugin) getToken(w http.ResponseWriter, r *http.Request) {
 
 func getRepoOwnerAndNameFromURL(url string) (string, string) {
 	splitted := strings.Split(url, "/")
+
+	// Bitbucket Data Center repository URLs end with projects/KEY/repos/slug or users/name/repos/slug
+	if len(splitted) >= 4 && splitted[len(splitted)-2] == "repos" {
+		ownerAndRepo := normalizeDataCenterPath(strings.Join(splitted[len(splitted)-4:], "/"))
+		splitted = strings.Split(ownerAndRepo, "/")
+	}
+
 	return splitted[len(splitted)-2], splitted[len(splitted)-1]
 }
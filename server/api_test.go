@@ -3,8 +3,12 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
 
@@ -54,6 +58,19 @@ func TestPlugin_ServeHTTP(t *testing.T) {
 				Body:         "Not authorized\n",
 			},
 			userID: "",
+		}, "unauthorized pull request action": {
+			httpTest: httpTestJSON,
+			request: testutils.Request{
+				Method: http.MethodPost,
+				URL:    "/api/v1/pr/approve",
+				Body:   nil,
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode:   http.StatusUnauthorized,
+				ResponseType: testutils.ContentTypeJSON,
+				Body:         APIErrorResponse{ID: "", Message: "Not authorized.", StatusCode: http.StatusUnauthorized},
+			},
+			userID: "",
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -128,3 +145,33 @@ func TestGetToken(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeDialogSubmission(t *testing.T) {
+	for name, test := range map[string]struct {
+		body           string
+		canPost        bool
+		expectedStatus int
+	}{
+		"valid submission":   {body: `{"user_id": "user", "channel_id": "channel"}`, canPost: true, expectedStatus: http.StatusOK},
+		"invalid submission": {body: `{`, expectedStatus: http.StatusBadRequest},
+		"other user":         {body: `{"user_id": "other", "channel_id": "channel"}`, canPost: true, expectedStatus: http.StatusUnauthorized},
+		"channel without permission to post": {
+			body:           `{"user_id": "user", "channel_id": "channel"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("HasPermissionToChannel", "user", "channel", model.PermissionCreatePost).Return(test.canPost).Maybe()
+
+			p := NewPlugin()
+			p.SetAPI(api)
+
+			rr := httptest.NewRecorder()
+			request := p.decodeDialogSubmission(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body)), "user")
+
+			assert.Equal(t, test.expectedStatus, rr.Code)
+			assert.Equal(t, test.expectedStatus == http.StatusOK, request != nil)
+		})
+	}
+}
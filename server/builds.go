@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+const (
+	// KeyBuildStatus prefixes the keys of the latest build statuses of a branch.
+	KeyBuildStatus = "build_status_"
+
+	// buildStatusExpirySeconds limits how long the state of a build is remembered to detect that
+	// it recovered.
+	buildStatusExpirySeconds = 30 * 24 * 60 * 60
+
+	// buildStatusUpdateAttempts limits the compare-and-set retries of concurrent build status updates.
+	buildStatusUpdateAttempts = 10
+)
+
+// branchBuildStatus is the latest state of each build of a branch, by build key, and the commit
+// of the latest build.
+type branchBuildStatus struct {
+	Commit string
+	Builds map[string]*buildState
+}
+
+type buildState struct {
+	Commit string
+	State  string
+	// Previous is the last completed state of the build before the current one.
+	Previous string
+}
+
+type buildStatusStore struct {
+	p *Plugin
+}
+
+func buildStatusKey(repository, branch string) string {
+	hash := sha256.Sum256([]byte(repository + "/" + branch))
+	return KeyBuildStatus + hex.EncodeToString(hash[:])
+}
+
+// RecordBuildStatus stores the state of the build of the branch and returns its last completed
+// state before that. Recording the same state of the same commit again, e.g. when a delivery is
+// retried, returns the same previous state. Failures are logged and return an empty state.
+func (b *buildStatusStore) RecordBuildStatus(repository, branch string, status webhookpayload.CommitStatus) string {
+	p := b.p
+
+	previous, err := p.recordBuildStatus(buildStatusKey(repository, branch), status)
+	if err != nil {
+		p.API.LogWarn("Failed to record build status", "repository", repository, "branch", branch, "err", err.Error())
+		return ""
+	}
+
+	return previous
+}
+
+// GetBuildStatus combines the states of the builds of the latest commit of the branch, as recorded
+// from the build webhooks. Failures are logged and return an empty state.
+func (b *buildStatusStore) GetBuildStatus(repository, branch string) string {
+	p := b.p
+
+	status, _, err := p.getBranchBuildStatus(buildStatusKey(repository, branch))
+	if err != nil {
+		p.API.LogWarn("Failed to get build status", "repository", repository, "branch", branch, "err", err.Error())
+		return ""
+	}
+
+	var statuses []webhookpayload.CommitStatus
+	for _, build := range status.Builds {
+		if build.Commit == status.Commit {
+			statuses = append(statuses, webhookpayload.CommitStatus{State: build.State})
+		}
+	}
+
+	return combineBuildStatuses(statuses)
+}
+
+func (p *Plugin) recordBuildStatus(key string, status webhookpayload.CommitStatus) (string, error) {
+	for attempt := 0; attempt < buildStatusUpdateAttempts; attempt++ {
+		branch, oldValue, err := p.getBranchBuildStatus(key)
+		if err != nil {
+			return "", err
+		}
+
+		build := branch.Builds[status.Key]
+		if build == nil {
+			build = &buildState{}
+		}
+		if build.Commit == status.Commit.Hash && build.State == status.State {
+			return build.Previous, nil
+		}
+
+		previous := build.State
+		if previous == webhookpayload.CommitStatusInProgress {
+			previous = build.Previous
+		}
+		branch.Builds[status.Key] = &buildState{Commit: status.Commit.Hash, State: status.State, Previous: previous}
+		branch.Commit = status.Commit.Hash
+
+		newValue, err := json.Marshal(branch)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to encode build status")
+		}
+
+		stored, appErr := p.API.KVSetWithOptions(key, newValue, model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        oldValue,
+			ExpireInSeconds: buildStatusExpirySeconds,
+		})
+		if appErr != nil {
+			return "", errors.Wrap(appErr, "failed to store build status")
+		}
+		if stored {
+			return previous, nil
+		}
+	}
+
+	return "", errors.Errorf("could not store build status after %d attempts", buildStatusUpdateAttempts)
+}
+
+func (p *Plugin) getBranchBuildStatus(key string) (*branchBuildStatus, []byte, error) {
+	value, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to get build status")
+	}
+
+	branch := &branchBuildStatus{}
+	if value != nil {
+		if err := json.Unmarshal(value, branch); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to decode build status")
+		}
+	}
+	if branch.Builds == nil {
+		branch.Builds = map[string]*buildState{}
+	}
+
+	return branch, value, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func TestRecordBuildStatus(t *testing.T) {
+	var value []byte
+	api := &plugintest.API{}
+	api.On("KVGet", buildStatusKey("owner/repo", "main")).Return(func(string) []byte {
+		return value
+	}, nil)
+	api.On("KVSetWithOptions", buildStatusKey("owner/repo", "main"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(func(_ string, newValue []byte, options model.PluginKVSetOptions) bool {
+		assert.Equal(t, value, options.OldValue)
+		value = newValue
+		return true
+	}, nil)
+
+	p := NewPlugin()
+	p.SetAPI(api)
+	store := &buildStatusStore{p}
+
+	status := func(key, commit, state string) webhookpayload.CommitStatus {
+		status := webhookpayload.CommitStatus{Key: key, State: state}
+		status.Commit.Hash = commit
+		return status
+	}
+
+	for _, step := range []struct {
+		status   webhookpayload.CommitStatus
+		previous string
+	}{
+		{status("pipeline", "a", webhookpayload.CommitStatusFailed), ""},
+		{status("pipeline", "a", webhookpayload.CommitStatusFailed), ""},
+		{status("lint", "b", webhookpayload.CommitStatusSuccessful), ""},
+		{status("pipeline", "b", webhookpayload.CommitStatusInProgress), webhookpayload.CommitStatusFailed},
+		{status("pipeline", "b", webhookpayload.CommitStatusSuccessful), webhookpayload.CommitStatusFailed},
+		// the same status delivered again is still a recovery
+		{status("pipeline", "b", webhookpayload.CommitStatusSuccessful), webhookpayload.CommitStatusFailed},
+		{status("pipeline", "c", webhookpayload.CommitStatusSuccessful), webhookpayload.CommitStatusSuccessful},
+	} {
+		assert.Equal(t, step.previous, store.RecordBuildStatus("owner/repo", "main", step.status))
+	}
+
+	// Only the builds of the latest commit are combined
+	assert.Equal(t, webhookpayload.CommitStatusSuccessful, store.GetBuildStatus("owner/repo", "main"))
+	store.RecordBuildStatus("owner/repo", "main", status("lint", "c", webhookpayload.CommitStatusFailed))
+	assert.Equal(t, webhookpayload.CommitStatusFailed, store.GetBuildStatus("owner/repo", "main"))
+}
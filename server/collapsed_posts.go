@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	// KeyCollapsedPost prefixes the keys of the last post of a collapsible notification in a channel.
+	KeyCollapsedPost = "collapsed_post_"
+
+	// collapsedPostExpirySeconds limits how long a post is updated by later notifications.
+	collapsedPostExpirySeconds = 24 * 60 * 60
+)
+
+// collapsedPost is the last post of a collapsible notification and the number of notifications it replaced.
+type collapsedPost struct {
+	PostID string
+	Count  int
+}
+
+func collapsedPostKey(channelID, collapseKey string) string {
+	hash := sha256.Sum256([]byte(channelID + "/" + collapseKey))
+	return KeyCollapsedPost + hex.EncodeToString(hash[:])
+}
+
+// createOrCollapsePost updates the previous post with the same collapse key, if it is still the
+// latest post of the channel, and creates a new post otherwise.
+func (p *Plugin) createOrCollapsePost(post *model.Post, collapseKey string) error {
+	key := collapsedPostKey(post.ChannelId, collapseKey)
+
+	var previous collapsedPost
+	value, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to get collapsed post")
+	}
+	if value != nil {
+		if err := json.Unmarshal(value, &previous); err != nil {
+			return errors.Wrap(err, "failed to decode collapsed post")
+		}
+	}
+
+	if previous.PostID != "" && p.isLatestPost(post.ChannelId, previous.PostID) {
+		updated := post.Clone()
+		updated.Id = previous.PostID
+		updated.Message = fmt.Sprintf("%s\n_+%d earlier similar notifications_", post.Message, previous.Count+1)
+		if _, appErr = p.API.UpdatePost(updated); appErr != nil {
+			return errors.Wrap(appErr, "failed to update collapsed post")
+		}
+
+		return p.storeCollapsedPost(key, collapsedPost{PostID: previous.PostID, Count: previous.Count + 1})
+	}
+
+	created, appErr := p.API.CreatePost(post.Clone())
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to create channel post")
+	}
+
+	return p.storeCollapsedPost(key, collapsedPost{PostID: created.Id})
+}
+
+func (p *Plugin) isLatestPost(channelID, postID string) bool {
+	posts, appErr := p.API.GetPostsForChannel(channelID, 0, 1)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get latest channel post", "channelID", channelID, "err", appErr.Error())
+		return false
+	}
+
+	return len(posts.Order) > 0 && posts.Order[0] == postID
+}
+
+func (p *Plugin) storeCollapsedPost(key string, post collapsedPost) error {
+	value, err := json.Marshal(post)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode collapsed post")
+	}
+
+	if _, appErr := p.API.KVSetWithOptions(key, value, model.PluginKVSetOptions{
+		ExpireInSeconds: collapsedPostExpirySeconds,
+	}); appErr != nil {
+		return errors.Wrap(appErr, "failed to store collapsed post")
+	}
+
+	return nil
+}
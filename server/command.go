@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/mattermost/mattermost/server/public/pluginapi/experimental/command"
 	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
 )
 
 const commandHelp = `* |/bitbucket connect| - Connect your Mattermost account to your Bitbucket account
@@ -25,64 +28,68 @@ const commandHelp = `* |/bitbucket connect| - Connect your Mattermost account to
     * deletes - includes branch and tag deletions
     * issue_comments - includes new issue comments
     * pull_reviews - includes pull request reviews
+    * forks - includes forks of the repository
+    * repo_updates - includes changes of the repository name, description, website and language
+    * builds - includes failed builds and builds that pass again after a failure, Bitbucket Cloud only
+    * commit_comments - includes new comments on commits
   * Defaults to "pulls,issues,creates,deletes"
+  * Issue notifications can be filtered with one or more of the following flags, each taking a comma-delimited list of values:
+    * --kind - bug, enhancement, proposal or task
+    * --priority - trivial, minor, major, critical or blocker
+    * --component, --milestone, --version - names as configured in the repository
+  * Branch notifications can be filtered with glob patterns, e.g. |release/*|:
+    * --branch - the pushed, created, deleted or built branch or tag
+    * --target-branch - the destination branch of pull requests
+  * Notifications can be filtered by the Bitbucket account ID or nickname of the user who triggered them:
+    * --exclude-authors - ignore events of these users, e.g. bots
+    * --only-authors - only notify about events of these users
+  * --threaded - post all activity of a pull request as replies to a single post, which shows the current state of the pull request
+  * --cards - keep a single post per pull request up to date with its state, reviewers, build status and comment count, instead of posting each event
 * |/bitbucket subscriptions delete owner/repo| - Unsubscribe the current channel from a repository
+* |/bitbucket pr approve owner/repo#id| - Approve a pull request, given as |owner/repo#id| or by its URL
+* |/bitbucket pr unapprove owner/repo#id| - Remove your approval from a pull request
+* |/bitbucket pr decline owner/repo#id [reason]| - Decline a pull request, optionally leaving the reason as a comment
+* |/bitbucket pr merge owner/repo#id [--strategy=merge_commit|squash|fast_forward] [--close-branch]| - Merge a pull request
+* |/bitbucket pr create owner/repo source-branch [target-branch] "title"| - Create a pull request, targeting the main branch by default. Leave out the title, or the branches too, to fill in the pull request in a dialog
+  * --strategy - the merge strategy, defaults to the default strategy of the repository
+  * --close-branch - delete the source branch after merging, Bitbucket Cloud only
 * |/bitbucket me| - Display the connected Bitbucket account
 * |/bitbucket settings [setting] [value]| - Update your user settings
   * |setting| can be "notifications" or "reminders"
-  * |value| can be "on" or "off"`
+  * |value| can be "on" or "off"
+* |/bitbucket admin deadletters [list|retry|delete] [id]| - (System Admins only) Inspect, retry or delete webhook deliveries that failed permanently
+* |/bitbucket admin stats| - (System Admins only) Display webhook processing and permission cache statistics
+* |/bitbucket admin reencrypt| - (System Admins only) Re-encrypt the stored access tokens with the current encryption key`
 
 const (
-	featureIssues        = "issues"
-	featurePulls         = "pulls"
-	featurePushes        = "pushes"
-	featureCreates       = "creates"
-	featureDeletes       = "deletes"
-	featureIssueComments = "issue_comments"
-	featurePullReviews   = "pull_reviews"
+	// threadedFlag posts the activity of each pull request to a thread.
+	threadedFlag = "--threaded"
+	// cardsFlag keeps a card per pull request up to date instead of posting each event.
+	cardsFlag = "--cards"
+
+	// strategyFlag and closeBranchFlag are the options of the merge command.
+	strategyFlag    = "--strategy"
+	closeBranchFlag = "--close-branch"
+
+	requiredErrorMessage    = "Please specify an ogranization/repository."
+	pullRequestUsageMessage = "Usage: `/bitbucket pr [approve|unapprove|decline|merge] owner/repo#id` or `/bitbucket pr create [owner/repo] [source-branch] [target-branch] [\"title\"]`"
+	adminUsageMessage       = "Usage: `/bitbucket admin deadletters [list|retry|delete] [id]` or `/bitbucket admin stats` or `/bitbucket admin reencrypt`"
 )
 
-const (
-	requiredErrorMessage = "Please specify an ogranization/repository."
-)
-
-var validFeatures = map[string]bool{
-	featureIssues:        true,
-	featurePulls:         true,
-	featurePushes:        true,
-	featureCreates:       true,
-	featureDeletes:       true,
-	featureIssueComments: true,
-	featurePullReviews:   true,
-}
-
 // validateFeatures returns false when 1 or more given features
 // are invalid along with a list of the invalid features.
 func validateFeatures(features []string) (bool, []string) {
-	var invalidFeatures []string
-	valid := true
-	hasLabel := false
-	for _, f := range features {
-		if _, ok := validFeatures[f]; ok {
-			continue
-		}
-		if strings.HasPrefix(f, "label") {
-			hasLabel = true
-			continue
-		}
-		invalidFeatures = append(invalidFeatures, f)
-		valid = false
+	parsed, filters, invalidFeatures := subscription.ParseFeatures(strings.Join(features, ","))
+	if len(invalidFeatures) > 0 {
+		return false, invalidFeatures
 	}
-	if valid && hasLabel {
-		// must have "pulls" or "issues" in features when using a label
-		for _, f := range features {
-			if f == featurePulls || f == featureIssues {
-				return valid, invalidFeatures
-			}
-		}
-		valid = false
+
+	// must have "pulls" or "issues" in features when using a label
+	if len(filters.Labels) > 0 && !parsed.Has(subscription.FeaturePulls) && !parsed.Has(subscription.FeatureIssues) {
+		return false, nil
 	}
-	return valid, invalidFeatures
+
+	return true, nil
 }
 
 func (p *Plugin) getCommand() (*model.Command, error) {
@@ -128,7 +135,24 @@ func getAutocompleteData() *model.AutocompleteData {
 
 	subscriptionsAdd := model.NewAutocompleteData("add", "owner[/repo] features", "subscribe to org/[repo]")
 	subscriptionsAdd.AddTextArgument("Owner/repo to subscribe to", "[owner/repo]", "")
-	subscriptionsAdd.AddTextArgument("Comma-delimited list of one or more of: issues, pulls, pushes, creates, deletes, issue_comments, pull_reviews. Defaults to pulls,issues,creates,deletes", "[features] (optional)", `/[^,-\s]+(,[^,-\s]+)*/`)
+	subscriptionsAdd.AddTextArgument("Comma-delimited list of one or more of: issues, pulls, pushes, creates, deletes, issue_comments, pull_reviews, forks, repo_updates, builds, commit_comments. Defaults to pulls,issues,creates,deletes", "[features] (optional)", `/[^,-\s]+(,[^,-\s]+)*/`)
+	subscriptionsAdd.AddNamedTextArgument("kind", "Only notify about issues of these kinds: bug, enhancement, proposal, task", "[kinds]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("priority", "Only notify about issues with these priorities: trivial, minor, major, critical, blocker", "[priorities]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("component", "Only notify about issues of these components", "[components]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("milestone", "Only notify about issues of these milestones", "[milestones]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("version", "Only notify about issues of these versions", "[versions]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("branch", "Only notify about pushes and builds of branches or tags matching these glob patterns", "[patterns]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("target-branch", "Only notify about pull requests targeting branches matching these glob patterns", "[patterns]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("exclude-authors", "Ignore events triggered by these Bitbucket account IDs or nicknames", "[authors]", "", false)
+	subscriptionsAdd.AddNamedTextArgument("only-authors", "Only notify about events triggered by these Bitbucket account IDs or nicknames", "[authors]", "", false)
+	subscriptionsAdd.AddNamedStaticListArgument("threaded", "Post all activity of a pull request as replies to a single post", false, []model.AutocompleteListItem{
+		{Item: "true"},
+		{Item: "false"},
+	})
+	subscriptionsAdd.AddNamedStaticListArgument("cards", "Keep a single post per pull request up to date instead of posting each event", false, []model.AutocompleteListItem{
+		{Item: "true"},
+		{Item: "false"},
+	})
 	subscriptions.AddCommand(subscriptionsAdd)
 
 	subscriptionsDelete := model.NewAutocompleteData("delete", "[owner/repo]", "Remove subscription for org/[repo]")
@@ -136,6 +160,37 @@ func getAutocompleteData() *model.AutocompleteData {
 
 	bitbucket.AddCommand(subscriptions)
 
+	pr := model.NewAutocompleteData("pr", "[command]", "Available commands: approve, unapprove, decline, merge, create")
+	prApprove := model.NewAutocompleteData("approve", "owner/repo#id", "Approve a pull request")
+	prApprove.AddTextArgument("Pull request as owner/repo#id or URL", "owner/repo#id", "")
+	pr.AddCommand(prApprove)
+	prUnapprove := model.NewAutocompleteData("unapprove", "owner/repo#id", "Remove your approval from a pull request")
+	prUnapprove.AddTextArgument("Pull request as owner/repo#id or URL", "owner/repo#id", "")
+	pr.AddCommand(prUnapprove)
+	prDecline := model.NewAutocompleteData("decline", "owner/repo#id [reason]", "Decline a pull request")
+	prDecline.AddTextArgument("Pull request as owner/repo#id or URL", "owner/repo#id", "")
+	prDecline.AddTextArgument("Reason for declining, left as a comment", "[reason] (optional)", "")
+	pr.AddCommand(prDecline)
+	prMerge := model.NewAutocompleteData("merge", "owner/repo#id", "Merge a pull request")
+	prMerge.AddTextArgument("Pull request as owner/repo#id or URL", "owner/repo#id", "")
+	prMerge.AddNamedStaticListArgument("strategy", "Merge strategy, defaults to the default strategy of the repository", false, []model.AutocompleteListItem{
+		{Item: MergeStrategyMergeCommit},
+		{Item: MergeStrategySquash},
+		{Item: MergeStrategyFastForward},
+	})
+	prMerge.AddNamedStaticListArgument("close-branch", "Delete the source branch after merging", false, []model.AutocompleteListItem{
+		{Item: "true"},
+		{Item: "false"},
+	})
+	pr.AddCommand(prMerge)
+	prCreate := model.NewAutocompleteData("create", "[owner/repo] [source-branch] [target-branch] [\"title\"]", "Create a pull request")
+	prCreate.AddTextArgument("Repository as owner/repo", "[owner/repo] (optional)", "")
+	prCreate.AddTextArgument("Branch to merge", "[source-branch] (optional)", "")
+	prCreate.AddTextArgument("Branch to merge into, defaults to the main branch", "[target-branch] (optional)", "")
+	prCreate.AddTextArgument("Title in quotes, opens a dialog if left out", "[\"title\"] (optional)", "")
+	pr.AddCommand(prCreate)
+	bitbucket.AddCommand(pr)
+
 	settings := model.NewAutocompleteData("settings", "[setting] [value]", "Update your user settings")
 	settingNotifications := model.NewAutocompleteData("notifications", "", "Turn notifications on/off")
 	settingValue := []model.AutocompleteListItem{{
@@ -149,6 +204,21 @@ func getAutocompleteData() *model.AutocompleteData {
 	settings.AddCommand(settingNotifications)
 	bitbucket.AddCommand(settings)
 
+	admin := model.NewAutocompleteData("admin", "[command]", "Available commands: deadletters, stats, reencrypt")
+	admin.RoleID = model.SystemAdminRoleId
+	deadLetters := model.NewAutocompleteData("deadletters", "[command]", "Available commands: list, retry, delete")
+	deadLetters.AddCommand(model.NewAutocompleteData("list", "", "List webhook deliveries that failed permanently"))
+	deadLettersRetry := model.NewAutocompleteData("retry", "[id]", "Queue a failed webhook delivery again")
+	deadLettersRetry.AddTextArgument("ID of the delivery", "[id]", "")
+	deadLetters.AddCommand(deadLettersRetry)
+	deadLettersDelete := model.NewAutocompleteData("delete", "[id]", "Delete a failed webhook delivery")
+	deadLettersDelete.AddTextArgument("ID of the delivery", "[id]", "")
+	deadLetters.AddCommand(deadLettersDelete)
+	admin.AddCommand(deadLetters)
+	admin.AddCommand(model.NewAutocompleteData("stats", "", "Display webhook processing and permission cache statistics"))
+	admin.AddCommand(model.NewAutocompleteData("reencrypt", "", "Re-encrypt the stored access tokens with the current encryption key"))
+	bitbucket.AddCommand(admin)
+
 	return bitbucket
 }
 
@@ -162,7 +232,18 @@ func (p *Plugin) postCommandResponse(args *model.CommandArgs, text string) {
 }
 
 func (p *Plugin) handleSubscribe(_ *plugin.Context, args *model.CommandArgs, parameters []string, userInfo *BitbucketUserInfo) string {
-	features := "pulls,issues,creates,deletes"
+	features := subscription.DefaultFeatures.String()
+
+	if parameters[0] == "add" || parameters[0] == "delete" {
+		denial, err := p.checkCanManageSubscriptions(args.UserId, args.ChannelId)
+		if err != nil {
+			p.API.LogError("Failed to check the team subscription policy", "err", err.Error())
+			return "Encountered an error checking the subscription policy of this team."
+		}
+		if denial != "" {
+			return denial
+		}
+	}
 
 	txt := ""
 	switch parameters[0] {
@@ -182,7 +263,7 @@ func (p *Plugin) handleSubscribe(_ *plugin.Context, args *model.CommandArgs, par
 			txt = "### Subscriptions in this channel\n"
 		}
 		for _, sub := range subs {
-			txt += fmt.Sprintf("* `%s` - %s", strings.Trim(sub.Repository, "/"), sub.Features)
+			txt += fmt.Sprintf("* `%s` - %s%s%s", strings.Trim(sub.Repository, "/"), sub.FeaturesString(), formattedFilters(sub.Filters), formattedOptions(sub.Threaded, sub.Cards))
 			txt += "\n"
 		}
 		return txt
@@ -206,7 +287,44 @@ func (p *Plugin) handleSubscribe(_ *plugin.Context, args *model.CommandArgs, par
 
 		parameters = parameters[1:]
 		var optionList []string
-		optionList = append(optionList, parameters[1:]...)
+		var filters subscription.Filters
+		threaded, cards := false, false
+		options := map[string]*bool{threadedFlag: &threaded, cardsFlag: &cards}
+	parameterLoop:
+		for i := 1; i < len(parameters); i++ {
+			arg := parameters[i]
+			for flag, option := range options {
+				if arg != flag && !strings.HasPrefix(arg, flag+"=") {
+					continue
+				}
+				value, hasValue := strings.CutPrefix(arg, flag+"=")
+				if !hasValue {
+					value = "true"
+					// Accept "--threaded true" as well, which is how the autocomplete inserts these flags
+					if i+1 < len(parameters) && (parameters[i+1] == "true" || parameters[i+1] == "false") {
+						value = parameters[i+1]
+						i++
+					}
+				}
+				var err error
+				if *option, err = strconv.ParseBool(value); err != nil {
+					return fmt.Sprintf("Invalid value %q for %s, must be true or false", value, flag)
+				}
+				continue parameterLoop
+			}
+			if subscription.IsFlag(arg) {
+				// Accept "--flag value" as well, which is how the autocomplete inserts flags
+				if !strings.Contains(arg, "=") && i+1 < len(parameters) && !subscription.IsFlag(parameters[i+1]) {
+					arg += "=" + parameters[i+1]
+					i++
+				}
+				if err := filters.ParseFlag(arg); err != nil {
+					return fmt.Sprintf("Invalid filter: %s", err.Error())
+				}
+				continue
+			}
+			optionList = append(optionList, arg)
+		}
 
 		if len(optionList) > 1 {
 			return "Just one list of features is allowed"
@@ -223,15 +341,37 @@ func (p *Plugin) handleSubscribe(_ *plugin.Context, args *model.CommandArgs, par
 			}
 		}
 
+		parsedFeatures, labelFilters, _ := subscription.ParseFeatures(features)
+		filters.Labels = labelFilters.Labels
+		if filters.HasIssueFilters() && !parsedFeatures.Has(subscription.FeatureIssues) && !parsedFeatures.Has(subscription.FeatureIssueComments) {
+			return "Issue filters require the `issues` or `issue_comments` feature."
+		}
+		if len(filters.Branches) > 0 && !parsedFeatures.Has(subscription.FeaturePushes) && !parsedFeatures.Has(subscription.FeatureCreates) && !parsedFeatures.Has(subscription.FeatureDeletes) && !parsedFeatures.Has(subscription.FeatureBuilds) {
+			return "The `--branch` filter requires the `pushes`, `creates`, `deletes` or `builds` feature."
+		}
+		if len(filters.TargetBranches) > 0 && !parsedFeatures.Has(subscription.FeaturePulls) && !parsedFeatures.Has(subscription.FeaturePullReviews) {
+			return "The `--target-branch` filter requires the `pulls` or `pull_reviews` feature."
+		}
+		if threaded && !parsedFeatures.Has(subscription.FeaturePulls) && !parsedFeatures.Has(subscription.FeaturePullReviews) {
+			return "The `--threaded` option requires the `pulls` or `pull_reviews` feature."
+		}
+		if cards && !parsedFeatures.Has(subscription.FeaturePulls) && !parsedFeatures.Has(subscription.FeaturePullReviews) {
+			return "The `--cards` option requires the `pulls` or `pull_reviews` feature."
+		}
+		if threaded && cards {
+			return "The `--threaded` and `--cards` options can't be combined."
+		}
+		subscribedEvents := formattedString(subscription.FormatFeatures(parsedFeatures, filters)) + formattedFilters(filters) + formattedOptions(threaded, cards)
+
 		ctx := context.Background()
-		bitbucketClient := p.bitbucketConnect(*userInfo.Token)
-		owner, repo := parseOwnerAndRepo(parameters[0], BitbucketBaseURL)
+		bitbucketClient := p.bitbucketConnect(userInfo)
+		owner, repo := parseOwnerAndRepo(parameters[0], p.getBaseURL())
 		previousSubscribedEvents, err := p.findSubscriptionsEvents(args.ChannelId, owner, repo)
 		if err != nil {
 			return err.Error()
 		}
 
-		if previousSubscribedEvents == features {
+		if previousSubscribedEvents == subscribedEvents {
 			previousSubscribedEvents = ""
 		}
 
@@ -239,15 +379,15 @@ func (p *Plugin) handleSubscribe(_ *plugin.Context, args *model.CommandArgs, par
 			return requiredErrorMessage
 		}
 
-		if err = p.Subscribe(ctx, bitbucketClient, args.UserId, owner, repo, args.ChannelId, features); err != nil {
+		if err = p.Subscribe(ctx, userInfo, bitbucketClient, owner, repo, args.ChannelId, parsedFeatures, filters, threaded, cards); err != nil {
 			return err.Error()
 		}
 
-		repoLink := fmt.Sprintf("%s%s/%s", p.getBaseURL(), owner, repo)
+		repoLink := p.getRepositoryURL(owner, repo)
 
-		msg := fmt.Sprintf("Successfully subscribed to [%s/%s](%s) with events: %s", owner, repo, repoLink, formattedString(features))
+		msg := fmt.Sprintf("Successfully subscribed to [%s/%s](%s) with events: %s", owner, repo, repoLink, subscribedEvents)
 		if previousSubscribedEvents != "" {
-			msg += fmt.Sprintf("\nThe previous subscription with: %s was overwritten.\n", formattedString(previousSubscribedEvents))
+			msg += fmt.Sprintf("\nThe previous subscription with: %s was overwritten.\n", previousSubscribedEvents)
 		}
 
 		post := &model.Post{
@@ -280,7 +420,7 @@ func (p *Plugin) findSubscriptionsEvents(channelID, owner, repo string) (string,
 
 	for _, subscribe := range previouslySubscribed {
 		if subscribe.Repository == subscriptionName {
-			return subscribe.Features, nil
+			return formattedString(subscribe.FeaturesString()) + formattedFilters(subscribe.Filters) + formattedOptions(subscribe.Threaded, subscribe.Cards), nil
 		}
 	}
 	return "", nil
@@ -290,13 +430,36 @@ func formattedString(s string) string {
 	return "`" + strings.Join(strings.Split(s, ","), "`, `") + "`"
 }
 
+// formattedFilters renders the filter flags of a subscription, or nothing if there are none.
+func formattedFilters(filters subscription.Filters) string {
+	flags := filters.Flags()
+	if len(flags) == 0 {
+		return ""
+	}
+
+	return " and filters: `" + strings.Join(flags, "`, `") + "`"
+}
+
+// formattedOptions renders the options of a subscription, or nothing if they are off.
+func formattedOptions(threaded, cards bool) string {
+	s := ""
+	if threaded {
+		s += ", threaded"
+	}
+	if cards {
+		s += ", cards"
+	}
+
+	return s
+}
+
 func (p *Plugin) handleDisconnect(_ *plugin.Context, args *model.CommandArgs, _ []string, _ *BitbucketUserInfo) string {
 	p.disconnectBitbucketAccount(args.UserId)
 	return "Disconnected your Bitbucket account."
 }
 
 func (p *Plugin) handleTodo(_ *plugin.Context, _ *model.CommandArgs, _ []string, userInfo *BitbucketUserInfo) string {
-	bitbucketClient := p.bitbucketConnect(*userInfo.Token)
+	bitbucketClient := p.bitbucketConnect(userInfo)
 
 	text, err := p.GetToDo(context.Background(), userInfo, bitbucketClient)
 	if err != nil {
@@ -307,8 +470,7 @@ func (p *Plugin) handleTodo(_ *plugin.Context, _ *model.CommandArgs, _ []string,
 }
 
 func (p *Plugin) handleMe(_ *plugin.Context, _ *model.CommandArgs, _ []string, userInfo *BitbucketUserInfo) string {
-	bitbucketClient := p.bitbucketConnect(*userInfo.Token)
-	bitbucketUser, _, err := bitbucketClient.UsersApi.UserGet(context.Background()) //nolint:bodyclose
+	bitbucketUser, err := p.getCurrentBitbucketUser(context.Background(), *userInfo.Token)
 	if err != nil {
 		p.API.LogError("Encountered an error getting your Bitbucket profile", "err", err.Error())
 		return "Encountered an error getting your Bitbucket profile."
@@ -385,6 +547,288 @@ func (p *Plugin) handleSettings(_ *plugin.Context, _ *model.CommandArgs, paramet
 	return "Settings updated."
 }
 
+func (p *Plugin) handlePullRequest(_ *plugin.Context, args *model.CommandArgs, parameters []string, userInfo *BitbucketUserInfo) string {
+	if len(parameters) > 0 && parameters[0] == pullRequestActionCreate {
+		return p.handleCreatePullRequest(args, parameters[1:], userInfo)
+	}
+	if len(parameters) < 2 {
+		return pullRequestUsageMessage
+	}
+
+	action := parameters[0]
+	owner, repo, id, err := parsePullRequestReference(parameters[1], p.getBaseURL())
+	if err != nil {
+		return fmt.Sprintf("Invalid pull request: %s.", err.Error())
+	}
+	if err = p.checkRepository(owner, repo); err != nil {
+		return err.Error()
+	}
+
+	ctx := context.Background()
+	var done string
+	switch action {
+	case "approve":
+		err = p.approvePullRequest(ctx, userInfo, owner, repo, id)
+		done = "Approved"
+	case "unapprove":
+		err = p.unapprovePullRequest(ctx, userInfo, owner, repo, id)
+		done = "Removed your approval from"
+	case "decline":
+		err = p.declinePullRequest(ctx, userInfo, owner, repo, id, strings.Join(parameters[2:], " "))
+		done = "Declined"
+	case "merge":
+		strategy, closeBranch, parseErr := parseMergeOptions(parameters[2:])
+		if parseErr != nil {
+			return parseErr.Error()
+		}
+		err = p.mergePullRequest(ctx, userInfo, owner, repo, id, strategy, closeBranch)
+		done = "Merged"
+	default:
+		return pullRequestUsageMessage
+	}
+
+	reference := fmt.Sprintf("%s/%s#%d", owner, repo, id)
+	if err != nil {
+		p.API.LogWarn("Failed to act on pull request", "action", action, "pull_request", reference, "err", err.Error())
+		return pullRequestActionFailureMessage(action, owner, repo, id, userInfo.BitbucketUsername, err)
+	}
+
+	return fmt.Sprintf("%s pull request [%s](%s/pull-requests/%d).", done, reference, p.getRepositoryURL(owner, repo), id)
+}
+
+// handleCreatePullRequest creates a pull request when given a title, and opens the dialog to fill
+// it in otherwise.
+func (p *Plugin) handleCreatePullRequest(args *model.CommandArgs, parameters []string, userInfo *BitbucketUserInfo) string {
+	repository, sourceBranch, targetBranch, title := parseCreatePullRequestParameters(parameters)
+
+	var owner, repo string
+	if repository != "" {
+		owner, repo = parseOwnerAndRepo(repository, p.getBaseURL())
+		if owner == "" || repo == "" {
+			return fmt.Sprintf("Invalid repository %q, must be given as owner/repo.", repository)
+		}
+		if err := p.checkRepository(owner, repo); err != nil {
+			return err.Error()
+		}
+	}
+
+	if title == "" || sourceBranch == "" {
+		if err := p.openCreatePullRequestDialog(args.TriggerId, args.RootId, userInfo, owner, repo, sourceBranch, targetBranch, title); err != nil {
+			p.API.LogWarn("Failed to open the dialog to create a pull request", "repository", repository, "err", err.Error())
+			return "Failed to open the dialog to create a pull request: " + err.Error()
+		}
+		return ""
+	}
+
+	ctx := context.Background()
+	pr := newPullRequest{
+		Title:               title,
+		SourceBranch:        sourceBranch,
+		TargetBranch:        targetBranch,
+		AddDefaultReviewers: true,
+	}
+	if pr.TargetBranch == "" {
+		mainBranch, err := p.getMainBranch(ctx, userInfo, owner, repo)
+		if err != nil {
+			return createPullRequestFailureMessage(owner, repo, userInfo.BitbucketUsername, err)
+		}
+		pr.TargetBranch = mainBranch
+	}
+	pr.Description = p.getPullRequestTemplate(ctx, userInfo, owner, repo, pr.TargetBranch)
+
+	created, err := p.createPullRequest(ctx, userInfo, owner, repo, pr)
+	if err != nil {
+		p.API.LogWarn("Failed to create pull request", "repository", repository, "err", err.Error())
+		return createPullRequestFailureMessage(owner, repo, userInfo.BitbucketUsername, err)
+	}
+
+	if err := p.postCreatedPullRequest(args.UserId, args.ChannelId, args.RootId, owner, repo, title, created); err != nil {
+		p.API.LogWarn("Failed to post the created pull request", "err", err.Error())
+		return fmt.Sprintf("Created pull request [%s/%s#%d](%s).", owner, repo, created.ID, created.URL)
+	}
+
+	return ""
+}
+
+// parseCreatePullRequestParameters splits the parameters of the create command into the
+// repository, the source and target branches and the title. The title is the rest of the
+// parameters from the first one starting with a quote, or after the target branch.
+func parseCreatePullRequestParameters(parameters []string) (repository, sourceBranch, targetBranch, title string) {
+	var branches []string
+	for i, parameter := range parameters {
+		if i == 0 {
+			repository = parameter
+			continue
+		}
+		if strings.HasPrefix(parameter, `"`) || len(branches) == 2 {
+			title = strings.Join(parameters[i:], " ")
+			break
+		}
+		branches = append(branches, parameter)
+	}
+
+	if len(branches) > 0 {
+		sourceBranch = branches[0]
+	}
+	if len(branches) > 1 {
+		targetBranch = branches[1]
+	}
+	title = strings.TrimSpace(strings.Trim(title, `"`))
+
+	return repository, sourceBranch, targetBranch, title
+}
+
+// parseMergeOptions parses the --strategy and --close-branch options of the merge command.
+func parseMergeOptions(parameters []string) (strategy string, closeBranch bool, err error) {
+	for i := 0; i < len(parameters); i++ {
+		arg := parameters[i]
+		switch {
+		case arg == closeBranchFlag || strings.HasPrefix(arg, closeBranchFlag+"="):
+			value, hasValue := strings.CutPrefix(arg, closeBranchFlag+"=")
+			if !hasValue {
+				value = "true"
+				if i+1 < len(parameters) && (parameters[i+1] == "true" || parameters[i+1] == "false") {
+					value = parameters[i+1]
+					i++
+				}
+			}
+			if closeBranch, err = strconv.ParseBool(value); err != nil {
+				return "", false, errors.Errorf("Invalid value %q for %s, must be true or false.", value, closeBranchFlag)
+			}
+		case arg == strategyFlag || strings.HasPrefix(arg, strategyFlag+"="):
+			value, hasValue := strings.CutPrefix(arg, strategyFlag+"=")
+			// Accept "--strategy squash" as well, which is how the autocomplete inserts the flag
+			if !hasValue && i+1 < len(parameters) {
+				value = parameters[i+1]
+				i++
+			}
+			switch value {
+			case MergeStrategyMergeCommit, MergeStrategySquash, MergeStrategyFastForward:
+				strategy = value
+			default:
+				return "", false, errors.Errorf("Invalid merge strategy %q, must be one of %s, %s or %s.", value, MergeStrategyMergeCommit, MergeStrategySquash, MergeStrategyFastForward)
+			}
+		default:
+			return "", false, errors.Errorf("Unknown option %q.", arg)
+		}
+	}
+
+	return strategy, closeBranch, nil
+}
+
+func (p *Plugin) handleAdmin(_ *plugin.Context, args *model.CommandArgs, parameters []string, _ *BitbucketUserInfo) string {
+	if !p.API.HasPermissionTo(args.UserId, model.PermissionManageSystem) {
+		return "Only System Admins can run admin commands."
+	}
+
+	if len(parameters) == 0 {
+		return adminUsageMessage
+	}
+
+	switch parameters[0] {
+	case "deadletters":
+		return p.handleAdminDeadLetters(parameters[1:])
+	case "stats":
+		return p.handleAdminStats()
+	case "reencrypt":
+		return p.handleAdminReencrypt(args.UserId)
+	default:
+		return adminUsageMessage
+	}
+}
+
+func (p *Plugin) handleAdminDeadLetters(parameters []string) string {
+	if len(parameters) == 0 || parameters[0] == "list" {
+		jobs, err := p.getWebhookDeadLetters()
+		if err != nil {
+			p.API.LogError("Failed to list dead-lettered webhook deliveries", "err", err.Error())
+			return "Failed to list dead-lettered webhook deliveries."
+		}
+
+		if len(jobs) == 0 {
+			return "There are no failed webhook deliveries."
+		}
+
+		txt := "### Failed webhook deliveries\n"
+		txt += "| ID | Event | Repository | Received | Attempts | Last error |\n"
+		txt += "|:---|:---|:---|:---|:---|:---|\n"
+		for _, job := range jobs {
+			txt += webhookJobSummary(job) + "\n"
+		}
+
+		return txt
+	}
+
+	if len(parameters) != 2 {
+		return adminUsageMessage
+	}
+
+	jobID := parameters[1]
+	switch parameters[0] {
+	case "retry":
+		if err := p.retryWebhookDeadLetter(jobID); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("Webhook delivery `%s` was queued again.", jobID)
+	case "delete":
+		if err := p.deleteWebhookDeadLetter(jobID); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("Webhook delivery `%s` was deleted.", jobID)
+	default:
+		return adminUsageMessage
+	}
+}
+
+func (p *Plugin) handleAdminStats() string {
+	duplicates, err := p.getKVCounter(KeyWebhookDuplicatesDropped)
+	if err != nil {
+		p.API.LogError("Failed to load webhook statistics", "err", err.Error())
+		return "Failed to load webhook statistics."
+	}
+
+	pending, err := p.getKVIndex(KeyWebhookJobIndex)
+	if err != nil {
+		p.API.LogError("Failed to load webhook statistics", "err", err.Error())
+		return "Failed to load webhook statistics."
+	}
+
+	deadLetters, err := p.getKVIndex(KeyWebhookDeadLetterIndex)
+	if err != nil {
+		p.API.LogError("Failed to load webhook statistics", "err", err.Error())
+		return "Failed to load webhook statistics."
+	}
+
+	txt := "### Webhook statistics\n"
+	txt += "| Statistic | Value |\n"
+	txt += "|:---|---:|\n"
+	txt += fmt.Sprintf("| Pending deliveries | %d |\n", len(pending))
+	txt += fmt.Sprintf("| Failed deliveries | %d |\n", len(deadLetters))
+	txt += fmt.Sprintf("| Duplicate deliveries dropped | %d |\n", duplicates)
+
+	txt += "\n### Repository permission cache statistics (this server)\n"
+	txt += "| Statistic | Value |\n"
+	txt += "|:---|---:|\n"
+	txt += fmt.Sprintf("| Memory hits | %d |\n", p.permissionCache.memoryHits.Load())
+	txt += fmt.Sprintf("| KV store hits | %d |\n", p.permissionCache.kvHits.Load())
+	txt += fmt.Sprintf("| Misses | %d |\n", p.permissionCache.misses.Load())
+
+	return txt
+}
+
+func (p *Plugin) handleAdminReencrypt(userID string) string {
+	started, err := p.startReencryptingTokens(userID)
+	if err != nil {
+		p.API.LogError("Failed to start re-encrypting stored tokens", "err", err.Error())
+		return "Failed to start re-encrypting the stored tokens."
+	}
+	if !started {
+		return "The stored tokens are already being re-encrypted."
+	}
+
+	return "Re-encrypting the stored tokens in the background. You will receive a direct message when it's done."
+}
+
 type commandHandleFunc func(c *plugin.Context, args *model.CommandArgs, parameters []string, userInfo *BitbucketUserInfo) string
 
 // ExecuteCommand executes a command that has been previously registered via the RegisterCommand API.
@@ -422,6 +866,13 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		return &model.CommandResponse{}, nil
 	}
 
+	// Admin commands don't require a connected Bitbucket account
+	if action == "admin" {
+		message := p.handleAdmin(c, args, parameters, nil)
+		p.postCommandResponse(args, message)
+		return &model.CommandResponse{}, nil
+	}
+
 	info, apiErr := p.getBitbucketUserInfo(args.UserId)
 	if apiErr != nil {
 		text := "Unknown error."
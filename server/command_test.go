@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
 )
 
 func TestValidateFeatures(t *testing.T) {
@@ -83,3 +85,135 @@ func TestValidateFeatures(t *testing.T) {
 		})
 	}
 }
+
+func TestParseFilterFlag(t *testing.T) {
+	for name, test := range map[string]struct {
+		args     []string
+		expected subscription.Filters
+		wantErr  bool
+	}{
+		"issue filters": {
+			args: []string{"--kind=bug", "--priority=critical,blocker", "--component=api"},
+			expected: subscription.Filters{
+				Kinds:      []string{"bug"},
+				Priorities: []string{"critical", "blocker"},
+				Components: []string{"api"},
+			},
+		},
+		"branch filters": {
+			args: []string{"--branch=main", "--target-branch=release/*"},
+			expected: subscription.Filters{
+				Branches:       []string{"main"},
+				TargetBranches: []string{"release/*"},
+			},
+		},
+		"invalid glob": {
+			args:    []string{"--branch=[main"},
+			wantErr: true,
+		},
+		"invalid kind": {
+			args:    []string{"--kind=defect"},
+			wantErr: true,
+		},
+		"missing value": {
+			args:    []string{"--priority"},
+			wantErr: true,
+		},
+		"unknown flag": {
+			args:    []string{"--colour=red"},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var filters subscription.Filters
+			var err error
+			for _, arg := range test.args {
+				if err = filters.ParseFlag(arg); err != nil {
+					break
+				}
+			}
+
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, filters)
+			assert.Equal(t, test.args, filters.Flags())
+		})
+	}
+}
+
+func TestMatchesBranch(t *testing.T) {
+	assert.True(t, subscription.MatchesBranch(nil, "feature/x"))
+	assert.True(t, subscription.MatchesBranch([]string{"main", "release/*"}, "release/1.0"))
+	assert.False(t, subscription.MatchesBranch([]string{"release/*"}, "release/1.0/hotfix"))
+	assert.False(t, subscription.MatchesBranch([]string{"main"}, "develop"))
+}
+
+func TestMatchesAuthor(t *testing.T) {
+	excluding := subscription.Filters{ExcludeAuthors: []string{"renovate-bot", "{bot-account-id}"}}
+	assert.False(t, excluding.MatchesAuthor("other-id", "Renovate-Bot"))
+	assert.False(t, excluding.MatchesAuthor("{bot-account-id}", "someone"))
+	assert.True(t, excluding.MatchesAuthor("user-id", "user"))
+
+	only := subscription.Filters{OnlyAuthors: []string{"user"}}
+	assert.True(t, only.MatchesAuthor("user-id", "user"))
+	assert.False(t, only.MatchesAuthor("other-id", "other"))
+
+	assert.True(t, subscription.Filters{}.MatchesAuthor("", ""))
+}
+
+func TestParseMergeOptions(t *testing.T) {
+	tcs := []struct {
+		Parameters          []string
+		ExpectedStrategy    string
+		ExpectedCloseBranch bool
+		ExpectedError       bool
+	}{
+		{Parameters: nil},
+		{Parameters: []string{"--strategy=squash"}, ExpectedStrategy: "squash"},
+		{Parameters: []string{"--strategy", "fast_forward", "--close-branch"}, ExpectedStrategy: "fast_forward", ExpectedCloseBranch: true},
+		{Parameters: []string{"--close-branch", "true", "--strategy", "merge_commit"}, ExpectedStrategy: "merge_commit", ExpectedCloseBranch: true},
+		{Parameters: []string{"--close-branch=false"}},
+		{Parameters: []string{"--strategy=rebase"}, ExpectedError: true},
+		{Parameters: []string{"--close-branch=maybe"}, ExpectedError: true},
+		{Parameters: []string{"now"}, ExpectedError: true},
+	}
+
+	for _, tc := range tcs {
+		strategy, closeBranch, err := parseMergeOptions(tc.Parameters)
+
+		if tc.ExpectedError {
+			assert.Error(t, err, tc.Parameters)
+			continue
+		}
+		assert.NoError(t, err, tc.Parameters)
+		assert.Equal(t, tc.ExpectedStrategy, strategy)
+		assert.Equal(t, tc.ExpectedCloseBranch, closeBranch)
+	}
+}
+
+func TestParseCreatePullRequestParameters(t *testing.T) {
+	tcs := []struct {
+		Parameters                                []string
+		Repository, Source, Target, ExpectedTitle string
+	}{
+		{Parameters: nil},
+		{Parameters: []string{"mattermost/repo"}, Repository: "mattermost/repo"},
+		{Parameters: []string{"mattermost/repo", "feature"}, Repository: "mattermost/repo", Source: "feature"},
+		{Parameters: []string{"mattermost/repo", "feature", `"Add`, `cards"`}, Repository: "mattermost/repo", Source: "feature", ExpectedTitle: "Add cards"},
+		{Parameters: []string{"mattermost/repo", "feature", "release/1.0", `"Fix`, "the", `build"`}, Repository: "mattermost/repo", Source: "feature", Target: "release/1.0", ExpectedTitle: "Fix the build"},
+		{Parameters: []string{"mattermost/repo", "feature", "main", "Unquoted", "title"}, Repository: "mattermost/repo", Source: "feature", Target: "main", ExpectedTitle: "Unquoted title"},
+		{Parameters: []string{"mattermost/repo", `"Only`, `title"`}, Repository: "mattermost/repo", ExpectedTitle: "Only title"},
+	}
+
+	for _, tc := range tcs {
+		repository, source, target, title := parseCreatePullRequestParameters(tc.Parameters)
+
+		assert.Equal(t, tc.Repository, repository, tc.Parameters)
+		assert.Equal(t, tc.Source, source, tc.Parameters)
+		assert.Equal(t, tc.Target, target, tc.Parameters)
+		assert.Equal(t, tc.ExpectedTitle, title, tc.Parameters)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+type commitParticipantsProvider struct {
+	p *Plugin
+}
+
+// GetCommitParticipants looks up the commit author and the authors of open pull requests from the
+// branch, using the token of a user subscribed to the repository. Failures are logged, as the
+// channel notifications are sent anyway. Pull requests are only looked up on Bitbucket Cloud.
+func (c *commitParticipantsProvider) GetCommitParticipants(repository, commitHash, branch string) []string {
+	p := c.p
+
+	subscriber := p.getRepositorySubscriber(repository)
+	if subscriber == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	if p.isDataCenter() {
+		owner, repo := parseOwnerAndRepo(repository, p.getBaseURL())
+		author, err := p.dataCenterConnect(subscriber).GetCommitAuthor(ctx, owner, repo, commitHash)
+		if err != nil {
+			p.API.LogWarn("Failed to get commit", "repository", repository, "commit", commitHash, "err", err.Error())
+			return nil
+		}
+		return []string{author.AccountId}
+	}
+
+	client := p.userHTTPClient(subscriber)
+
+	var accountIDs []string
+	add := func(accountID string) {
+		if accountID == "" {
+			return
+		}
+		for _, id := range accountIDs {
+			if id == accountID {
+				return
+			}
+		}
+		accountIDs = append(accountIDs, accountID)
+	}
+
+	var commit struct {
+		Author struct {
+			User webhookpayload.Owner `json:"user"`
+		} `json:"author"`
+	}
+	if err := getJSON(ctx, client, getBaseURL()+"/repositories/"+repository+"/commit/"+url.PathEscape(commitHash), &commit); err != nil {
+		p.API.LogWarn("Failed to get commit", "repository", repository, "commit", commitHash, "err", err.Error())
+	} else {
+		add(commit.Author.User.AccountID)
+	}
+
+	if branch != "" {
+		pullRequests, err := getOpenPullRequestsFromBranch(ctx, client, repository, branch)
+		if err != nil {
+			p.API.LogWarn("Failed to get pull requests of branch", "repository", repository, "branch", branch, "err", err.Error())
+		}
+		for _, pr := range pullRequests {
+			add(pr.Author.AccountID)
+		}
+	}
+
+	return accountIDs
+}
+
+// getRepositorySubscriber returns a connected user subscribed to the repository or its
+// organization who can access the repository, so that their token can be used to look it up.
+func (p *Plugin) getRepositorySubscriber(repository string) *BitbucketUserInfo {
+	checked := map[string]bool{}
+	org := strings.Split(repository, "/")[0]
+	for _, name := range []string{repository, fullNameFromOwnerAndRepo(org, "")} {
+		subs, err := p.getRepositorySubscriptions(name)
+		if err != nil {
+			p.API.LogWarn("Failed to get subscriptions", "repository", name, "err", err.Error())
+			continue
+		}
+
+		for _, sub := range subs {
+			if checked[sub.CreatorID] {
+				continue
+			}
+			checked[sub.CreatorID] = true
+
+			info, apiErr := p.getBitbucketUserInfo(sub.CreatorID)
+			if apiErr != nil || !p.permissionToRepo(sub.CreatorID, repository) {
+				continue
+			}
+
+			return info
+		}
+	}
+
+	return nil
+}
+
+// getOpenPullRequestsFromBranch returns the open pull requests from the branch on Bitbucket Cloud,
+// including their reviewers and participants.
+func getOpenPullRequestsFromBranch(ctx context.Context, client *http.Client, repository, branch string) ([]webhookpayload.PullRequest, error) {
+	var pullRequests struct {
+		Values []webhookpayload.PullRequest `json:"values"`
+	}
+	query := url.QueryEscape(fmt.Sprintf(`source.branch.name=%s AND state="OPEN"`, bbqlString(branch)))
+	fields := url.QueryEscape("+values.reviewers,+values.participants")
+	if err := getJSON(ctx, client, getBaseURL()+"/repositories/"+repository+"/pullrequests?q="+query+"&fields="+fields, &pullRequests); err != nil {
+		return nil, err
+	}
+
+	return pullRequests.Values, nil
+}
+
+// bbqlString quotes the value as a string of the Bitbucket query language.
+func bbqlString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func getJSON(ctx context.Context, client *http.Client, urlToFetch string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlToFetch, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "failed to decode response")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
+)
+
+func TestBBQLString(t *testing.T) {
+	assert.Equal(t, `"main"`, bbqlString("main"))
+	assert.Equal(t, `"feature/\" OR state=\"MERGED\\"`, bbqlString(`feature/" OR state="MERGED\`))
+}
+
+func TestGetRepositorySubscriber(t *testing.T) {
+	const encryptionKey = "0123456789abcdef0123456789abcdef"
+	accessToken, err := encrypt([]byte(encryptionKey), "token")
+	require.NoError(t, err)
+
+	api := &plugintest.API{}
+	siteURL := "https://mattermost.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+	for _, userID := range []string{"no-access", "access"} {
+		info, err := json.Marshal(BitbucketUserInfo{UserID: userID, Token: &oauth2.Token{AccessToken: accessToken}})
+		require.NoError(t, err)
+		api.On("KVGet", userID+BitbucketTokenKey).Return(info, nil)
+	}
+
+	p := NewPlugin()
+	p.SetAPI(api)
+	p.setConfiguration(&Configuration{EncryptionKey: encryptionKey})
+	p.subscriptionCache.set("owner/repo", []*subscription.Subscription{{ChannelID: "channel1", CreatorID: "no-access"}})
+	p.subscriptionCache.set("owner/", []*subscription.Subscription{{ChannelID: "channel2", CreatorID: "no-access"}, {ChannelID: "channel3", CreatorID: "access"}})
+	p.permissionCache.set("no-access", "owner/repo", false, time.Now().Add(time.Minute))
+	p.permissionCache.set("access", "owner/repo", true, time.Now().Add(time.Minute))
+
+	subscriber := p.getRepositorySubscriber("owner/repo")
+
+	require.NotNil(t, subscriber)
+	assert.Equal(t, "access", subscriber.UserID)
+}
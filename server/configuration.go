@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net/url"
 	"reflect"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -19,10 +21,15 @@ import (
 // copy appropriate for your types.
 type Configuration struct {
 	BitbucketOrg               string
+	BitbucketDeniedRepos       string
+	TeamSubscriptionPolicies   string
+	BitbucketSelfHostedURL     string
 	BitbucketOAuthClientID     string
 	BitbucketOAuthClientSecret string
 	WebhookSecret              string
+	PreviousWebhookSecret      string
 	EncryptionKey              string
+	PreviousEncryptionKey      string
 }
 
 // Clone shallow copies the Configuration. Your implementation may require a deep copy if
@@ -49,9 +56,48 @@ func (c *Configuration) IsValid() error {
 	if c.WebhookSecret == "" {
 		return errors.New("must have a webhook secret")
 	}
+
+	for _, repo := range c.getDeniedRepositories() {
+		if owner, name, ok := strings.Cut(repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+			return errors.Errorf("the denied repository %q must be given as organization/repository", repo)
+		}
+	}
+
+	if _, err := parseTeamSubscriptionPolicies(c.TeamSubscriptionPolicies); err != nil {
+		return errors.Wrap(err, "the team subscription policies must be a JSON object of policies by team name")
+	}
+
+	if c.BitbucketSelfHostedURL != "" {
+		u, err := url.Parse(c.BitbucketSelfHostedURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("the Bitbucket Data Center URL must be an absolute http or https URL")
+		}
+	}
 	return nil
 }
 
+// getOrganizations returns the organizations the plugin is restricted to, or nil if it isn't.
+func (c *Configuration) getOrganizations() []string {
+	return splitCommaSeparatedList(c.BitbucketOrg)
+}
+
+// getDeniedRepositories returns the repositories of the allowed organizations that the plugin
+// ignores, as organization/repository.
+func (c *Configuration) getDeniedRepositories() []string {
+	return splitCommaSeparatedList(c.BitbucketDeniedRepos)
+}
+
+func splitCommaSeparatedList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
 // getConfiguration retrieves the active Configuration under lock, making it safe to use
 // concurrently. The active Configuration may change underneath the client of this method, but
 // the struct returned by this API call is considered immutable.
@@ -0,0 +1,468 @@
+// Package datacenter is a small adapter for the Bitbucket Data Center (formerly Bitbucket Server)
+// REST API. Responses are converted to the go-bitbucket models used for Bitbucket Cloud, so the
+// rest of the plugin doesn't need to care which backend it talks to.
+package datacenter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wbrefvem/go-bitbucket"
+)
+
+const (
+	apiPath              = "rest/api/1.0/"
+	defaultReviewersPath = "rest/default-reviewers/1.0/"
+	whoAmIPath           = "plugins/servlet/applinks/whoami"
+
+	// pageLimit is the page size requested from paged endpoints.
+	pageLimit = 100
+
+	// RoleAuthor selects pull requests authored by the current user.
+	RoleAuthor = "AUTHOR"
+	// RoleReviewer selects pull requests the current user is a reviewer of.
+	RoleReviewer = "REVIEWER"
+)
+
+// Error is returned when the Data Center API answers with a non-successful status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("bitbucket data center returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Client talks to a single Bitbucket Data Center instance on behalf of one user.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the instance at baseURL. The given HTTP client
+// is expected to authenticate the requests, e.g. one returned by oauth2.NewClient.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + "/",
+		httpClient: httpClient,
+	}
+}
+
+// BaseURL returns the base URL of the instance, always ending with a slash.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, v interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal request body")
+		}
+		reader = strings.NewReader(string(b))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request to %s failed", path)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response body")
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	if s, ok := v.(*string); ok {
+		*s = string(data)
+		return nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.Wrapf(err, "failed to decode response of %s", path)
+	}
+
+	return nil
+}
+
+func getAllPages[T any](ctx context.Context, c *Client, path string, query url.Values) ([]T, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("limit", strconv.Itoa(pageLimit))
+
+	var result []T
+	start := 0
+	for {
+		query.Set("start", strconv.Itoa(start))
+
+		var p page[T]
+		if err := c.do(ctx, http.MethodGet, path, query, nil, &p); err != nil {
+			return nil, err
+		}
+
+		result = append(result, p.Values...)
+
+		if p.IsLastPage || len(p.Values) == 0 {
+			return result, nil
+		}
+		start = p.NextPageStart
+	}
+}
+
+// GetCurrentUser returns the user the client is authenticated as.
+func (c *Client) GetCurrentUser(ctx context.Context) (*bitbucket.User, error) {
+	var username string
+	if err := c.do(ctx, http.MethodGet, whoAmIPath, nil, nil, &username); err != nil {
+		return nil, errors.Wrap(err, "failed to get the authenticated user")
+	}
+
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("the access token is not associated with a user")
+	}
+
+	var user User
+	if err := c.do(ctx, http.MethodGet, apiPath+"users/"+url.PathEscape(username), nil, nil, &user); err != nil {
+		return nil, errors.Wrapf(err, "failed to get user %s", username)
+	}
+
+	return user.ToBitbucketUser(), nil
+}
+
+// GetProject returns the project with the given key.
+func (c *Client) GetProject(ctx context.Context, projectKey string) (*bitbucket.Project, error) {
+	var project Project
+	if err := c.do(ctx, http.MethodGet, apiPath+"projects/"+url.PathEscape(projectKey), nil, nil, &project); err != nil {
+		return nil, errors.Wrapf(err, "failed to get project %s", projectKey)
+	}
+
+	return project.ToBitbucketProject(), nil
+}
+
+// GetRepository returns a repository of a project.
+func (c *Client) GetRepository(ctx context.Context, projectKey, repoSlug string) (*bitbucket.Repository, error) {
+	var repo Repository
+	if err := c.do(ctx, http.MethodGet, repositoryPath(projectKey, repoSlug), nil, nil, &repo); err != nil {
+		return nil, errors.Wrapf(err, "failed to get repository %s/%s", projectKey, repoSlug)
+	}
+
+	return repo.ToBitbucketRepository(), nil
+}
+
+// ListRepositories returns the repositories the user can read. If projectKey is
+// not empty, only the repositories of that project are returned.
+func (c *Client) ListRepositories(ctx context.Context, projectKey string) ([]bitbucket.Repository, error) {
+	path := apiPath + "repos"
+	query := url.Values{"permission": []string{"REPO_READ"}}
+	if projectKey != "" {
+		path = apiPath + "projects/" + url.PathEscape(projectKey) + "/repos"
+		query = nil
+	}
+
+	repos, err := getAllPages[Repository](ctx, c, path, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list repositories")
+	}
+
+	result := make([]bitbucket.Repository, 0, len(repos))
+	for _, repo := range repos {
+		result = append(result, *repo.ToBitbucketRepository())
+	}
+
+	return result, nil
+}
+
+// ListDashboardPullRequests returns the open pull requests in which the user has the given role.
+func (c *Client) ListDashboardPullRequests(ctx context.Context, role string) ([]bitbucket.Pullrequest, error) {
+	query := url.Values{
+		"role":  []string{role},
+		"state": []string{"OPEN"},
+	}
+
+	prs, err := getAllPages[PullRequest](ctx, c, apiPath+"dashboard/pull-requests", query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list pull requests")
+	}
+
+	result := make([]bitbucket.Pullrequest, 0, len(prs))
+	for _, pr := range prs {
+		result = append(result, *pr.ToBitbucketPullRequest())
+	}
+
+	return result, nil
+}
+
+// GetPullRequest returns a single pull request.
+func (c *Client) GetPullRequest(ctx context.Context, projectKey, repoSlug string, id int64) (*bitbucket.Pullrequest, error) {
+	var pr PullRequest
+	path := repositoryPath(projectKey, repoSlug) + "/pull-requests/" + strconv.FormatInt(id, 10)
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &pr); err != nil {
+		return nil, errors.Wrapf(err, "failed to get pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return pr.ToBitbucketPullRequest(), nil
+}
+
+// GetCommitAuthor returns the author of a commit.
+func (c *Client) GetCommitAuthor(ctx context.Context, projectKey, repoSlug, commitID string) (*bitbucket.User, error) {
+	var commit Commit
+	path := repositoryPath(projectKey, repoSlug) + "/commits/" + url.PathEscape(commitID)
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &commit); err != nil {
+		return nil, errors.Wrapf(err, "failed to get commit %s of %s/%s", commitID, projectKey, repoSlug)
+	}
+
+	return commit.Author.ToBitbucketUser(), nil
+}
+
+// ApprovePullRequest approves a pull request as the current user.
+func (c *Client) ApprovePullRequest(ctx context.Context, projectKey, repoSlug string, id int64) error {
+	if err := c.do(ctx, http.MethodPost, pullRequestPath(projectKey, repoSlug, id)+"/approve", nil, nil, nil); err != nil {
+		return errors.Wrapf(err, "failed to approve pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return nil
+}
+
+// UnapprovePullRequest removes the approval of the current user from a pull request.
+func (c *Client) UnapprovePullRequest(ctx context.Context, projectKey, repoSlug string, id int64) error {
+	if err := c.do(ctx, http.MethodDelete, pullRequestPath(projectKey, repoSlug, id)+"/approve", nil, nil, nil); err != nil {
+		return errors.Wrapf(err, "failed to unapprove pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return nil
+}
+
+// DeclinePullRequest declines a pull request, optionally leaving a comment with the reason.
+func (c *Client) DeclinePullRequest(ctx context.Context, projectKey, repoSlug string, id int64, comment string) error {
+	version, err := c.getPullRequestVersion(ctx, projectKey, repoSlug, id)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]string{}
+	if comment != "" {
+		body["comment"] = comment
+	}
+
+	query := url.Values{"version": {strconv.Itoa(version)}}
+	if err := c.do(ctx, http.MethodPost, pullRequestPath(projectKey, repoSlug, id)+"/decline", query, body, nil); err != nil {
+		return errors.Wrapf(err, "failed to decline pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return nil
+}
+
+// MergePullRequest merges a pull request. The strategy is the ID of a merge strategy enabled for
+// the repository, e.g. "no-ff" or "squash", or empty for the default strategy.
+func (c *Client) MergePullRequest(ctx context.Context, projectKey, repoSlug string, id int64, strategy string) error {
+	version, err := c.getPullRequestVersion(ctx, projectKey, repoSlug, id)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]string{}
+	if strategy != "" {
+		body["strategyId"] = strategy
+	}
+
+	query := url.Values{"version": {strconv.Itoa(version)}}
+	if err := c.do(ctx, http.MethodPost, pullRequestPath(projectKey, repoSlug, id)+"/merge", query, body, nil); err != nil {
+		return errors.Wrapf(err, "failed to merge pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return nil
+}
+
+// RequestChangesOnPullRequest marks a pull request as needing work by the current user, whose slug is given.
+func (c *Client) RequestChangesOnPullRequest(ctx context.Context, projectKey, repoSlug string, id int64, userSlug string) error {
+	body := map[string]interface{}{
+		"user":     map[string]string{"name": userSlug},
+		"approved": false,
+		"status":   "NEEDS_WORK",
+	}
+
+	path := pullRequestPath(projectKey, repoSlug, id) + "/participants/" + url.PathEscape(userSlug)
+	if err := c.do(ctx, http.MethodPut, path, nil, body, nil); err != nil {
+		return errors.Wrapf(err, "failed to request changes on pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return nil
+}
+
+// CreatePullRequestComment adds a general comment to a pull request, a reply if a parent comment
+// ID is given, or a file or line comment if an anchor is given.
+func (c *Client) CreatePullRequestComment(ctx context.Context, projectKey, repoSlug string, id int64, text string, parentID int64, anchor *CommentAnchor) (*Comment, error) {
+	var comment Comment
+	body := map[string]interface{}{"text": text}
+	if parentID != 0 {
+		body["parent"] = map[string]int64{"id": parentID}
+	}
+	if anchor != nil {
+		body["anchor"] = anchor
+	}
+	if err := c.do(ctx, http.MethodPost, pullRequestPath(projectKey, repoSlug, id)+"/comments", nil, body, &comment); err != nil {
+		return nil, errors.Wrapf(err, "failed to comment on pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return &comment, nil
+}
+
+// ListBranches returns the names of the most recently modified branches of a repository, up to a
+// page of them.
+func (c *Client) ListBranches(ctx context.Context, projectKey, repoSlug string) ([]string, error) {
+	query := url.Values{
+		"orderBy": []string{"MODIFICATION"},
+		"limit":   []string{strconv.Itoa(pageLimit)},
+	}
+	var refs page[Ref]
+	if err := c.do(ctx, http.MethodGet, repositoryPath(projectKey, repoSlug)+"/branches", query, nil, &refs); err != nil {
+		return nil, errors.Wrapf(err, "failed to list branches of %s/%s", projectKey, repoSlug)
+	}
+
+	branches := make([]string, 0, len(refs.Values))
+	for _, ref := range refs.Values {
+		branches = append(branches, ref.DisplayID)
+	}
+
+	return branches, nil
+}
+
+// GetDefaultBranch returns the name of the default branch of a repository.
+func (c *Client) GetDefaultBranch(ctx context.Context, projectKey, repoSlug string) (string, error) {
+	var ref Ref
+	if err := c.do(ctx, http.MethodGet, repositoryPath(projectKey, repoSlug)+"/default-branch", nil, nil, &ref); err != nil {
+		return "", errors.Wrapf(err, "failed to get the default branch of %s/%s", projectKey, repoSlug)
+	}
+
+	return ref.DisplayID, nil
+}
+
+// GetFileContent returns the raw content of a file of a repository at the given branch.
+func (c *Client) GetFileContent(ctx context.Context, projectKey, repoSlug, path, branch string) (string, error) {
+	var content string
+	query := url.Values{"at": []string{"refs/heads/" + branch}}
+	if err := c.do(ctx, http.MethodGet, repositoryPath(projectKey, repoSlug)+"/raw/"+path, query, nil, &content); err != nil {
+		return "", errors.Wrapf(err, "failed to get %s of %s/%s", path, projectKey, repoSlug)
+	}
+
+	return content, nil
+}
+
+// GetDefaultReviewers returns the names of the default reviewers of pull requests between two
+// branches of a repository.
+func (c *Client) GetDefaultReviewers(ctx context.Context, projectKey, repoSlug, sourceBranch, targetBranch string) ([]string, error) {
+	var repo Repository
+	if err := c.do(ctx, http.MethodGet, repositoryPath(projectKey, repoSlug), nil, nil, &repo); err != nil {
+		return nil, errors.Wrapf(err, "failed to get repository %s/%s", projectKey, repoSlug)
+	}
+
+	repoID := strconv.FormatInt(repo.ID, 10)
+	query := url.Values{
+		"sourceRepoId": []string{repoID},
+		"targetRepoId": []string{repoID},
+		"sourceRefId":  []string{"refs/heads/" + sourceBranch},
+		"targetRefId":  []string{"refs/heads/" + targetBranch},
+	}
+	path := defaultReviewersPath + "projects/" + url.PathEscape(projectKey) + "/repos/" + url.PathEscape(repoSlug) + "/reviewers"
+
+	var users []User
+	if err := c.do(ctx, http.MethodGet, path, query, nil, &users); err != nil {
+		return nil, errors.Wrapf(err, "failed to get the default reviewers of %s/%s", projectKey, repoSlug)
+	}
+
+	names := make([]string, 0, len(users))
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+
+	return names, nil
+}
+
+// CreatePullRequest opens a pull request between two branches of a repository, with the users of
+// the given names as reviewers.
+func (c *Client) CreatePullRequest(ctx context.Context, projectKey, repoSlug, title, description, sourceBranch, targetBranch string, reviewers []string) (*bitbucket.Pullrequest, error) {
+	ref := func(branch string) map[string]interface{} {
+		return map[string]interface{}{
+			"id": "refs/heads/" + branch,
+			"repository": map[string]interface{}{
+				"slug":    repoSlug,
+				"project": map[string]string{"key": projectKey},
+			},
+		}
+	}
+
+	reviewerList := make([]map[string]interface{}, 0, len(reviewers))
+	for _, name := range reviewers {
+		reviewerList = append(reviewerList, map[string]interface{}{"user": map[string]string{"name": name}})
+	}
+
+	body := map[string]interface{}{
+		"title":       title,
+		"description": description,
+		"fromRef":     ref(sourceBranch),
+		"toRef":       ref(targetBranch),
+		"reviewers":   reviewerList,
+	}
+
+	var pr PullRequest
+	if err := c.do(ctx, http.MethodPost, repositoryPath(projectKey, repoSlug)+"/pull-requests", nil, body, &pr); err != nil {
+		return nil, errors.Wrapf(err, "failed to create pull request in %s/%s", projectKey, repoSlug)
+	}
+
+	return pr.ToBitbucketPullRequest(), nil
+}
+
+// getPullRequestVersion returns the current version of a pull request, which state changes must
+// be made against.
+func (c *Client) getPullRequestVersion(ctx context.Context, projectKey, repoSlug string, id int64) (int, error) {
+	var pr PullRequest
+	if err := c.do(ctx, http.MethodGet, pullRequestPath(projectKey, repoSlug, id), nil, nil, &pr); err != nil {
+		return 0, errors.Wrapf(err, "failed to get pull request %s/%s#%d", projectKey, repoSlug, id)
+	}
+
+	return pr.Version, nil
+}
+
+func pullRequestPath(projectKey, repoSlug string, id int64) string {
+	return repositoryPath(projectKey, repoSlug) + "/pull-requests/" + strconv.FormatInt(id, 10)
+}
+
+func repositoryPath(projectKey, repoSlug string) string {
+	return apiPath + "projects/" + url.PathEscape(projectKey) + "/repos/" + url.PathEscape(repoSlug)
+}
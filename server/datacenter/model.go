@@ -0,0 +1,272 @@
+package datacenter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/wbrefvem/go-bitbucket"
+)
+
+// Link is a single entry of a Data Center "links" collection.
+type Link struct {
+	Href string `json:"href"`
+	Name string `json:"name,omitempty"`
+}
+
+// Links is the common Data Center links object.
+type Links struct {
+	Self []Link `json:"self"`
+}
+
+// Href returns the first self link, if any.
+func (l Links) Href() string {
+	if len(l.Self) == 0 {
+		return ""
+	}
+
+	return l.Self[0].Href
+}
+
+// User is a Bitbucket Data Center user.
+type User struct {
+	Name         string `json:"name"`
+	EmailAddress string `json:"emailAddress"`
+	ID           int64  `json:"id"`
+	DisplayName  string `json:"displayName"`
+	Active       bool   `json:"active"`
+	Slug         string `json:"slug"`
+	Type         string `json:"type"`
+	Links        Links  `json:"links"`
+}
+
+// Project is a Bitbucket Data Center project, the equivalent of a Bitbucket Cloud workspace.
+type Project struct {
+	Key         string `json:"key"`
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Public      bool   `json:"public"`
+	Type        string `json:"type"`
+	Links       Links  `json:"links"`
+}
+
+// Repository is a Bitbucket Data Center repository.
+type Repository struct {
+	Slug        string  `json:"slug"`
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	ScmID       string  `json:"scmId"`
+	State       string  `json:"state"`
+	Project     Project `json:"project"`
+	Public      bool    `json:"public"`
+	Links       Links   `json:"links"`
+}
+
+// FullName returns the repository name in the "PROJECT/repo" form used as the
+// repository full name everywhere else in the plugin.
+func (r Repository) FullName() string {
+	return r.Project.Key + "/" + r.Slug
+}
+
+// WebURL returns the browsable URL of the repository.
+func (r Repository) WebURL() string {
+	return strings.TrimSuffix(r.Links.Href(), "/browse")
+}
+
+// Ref is a branch or tag reference.
+type Ref struct {
+	ID           string     `json:"id"`
+	DisplayID    string     `json:"displayId"`
+	LatestCommit string     `json:"latestCommit"`
+	Type         string     `json:"type"`
+	Repository   Repository `json:"repository"`
+}
+
+// Participant is an author, reviewer or participant of a pull request.
+type Participant struct {
+	User     User   `json:"user"`
+	Role     string `json:"role"`
+	Approved bool   `json:"approved"`
+	Status   string `json:"status"`
+}
+
+// PullRequest is a Bitbucket Data Center pull request.
+type PullRequest struct {
+	ID           int64         `json:"id"`
+	Version      int           `json:"version"`
+	Title        string        `json:"title"`
+	Description  string        `json:"description"`
+	State        string        `json:"state"`
+	Open         bool          `json:"open"`
+	Closed       bool          `json:"closed"`
+	CreatedDate  int64         `json:"createdDate"`
+	UpdatedDate  int64         `json:"updatedDate"`
+	FromRef      Ref           `json:"fromRef"`
+	ToRef        Ref           `json:"toRef"`
+	Author       Participant   `json:"author"`
+	Reviewers    []Participant `json:"reviewers"`
+	Participants []Participant `json:"participants"`
+	Properties   struct {
+		CommentCount int64 `json:"commentCount"`
+	} `json:"properties"`
+	Links Links `json:"links"`
+}
+
+// CommentAnchor locates an inline comment in the diff.
+type CommentAnchor struct {
+	Path     string `json:"path"`
+	Line     int64  `json:"line,omitempty"`
+	LineType string `json:"lineType,omitempty"`
+	FileType string `json:"fileType,omitempty"`
+}
+
+// Comment is a pull request or commit comment.
+type Comment struct {
+	ID          int64          `json:"id"`
+	Version     int            `json:"version"`
+	Text        string         `json:"text"`
+	Author      User           `json:"author"`
+	CreatedDate int64          `json:"createdDate"`
+	UpdatedDate int64          `json:"updatedDate"`
+	Anchor      *CommentAnchor `json:"anchor,omitempty"`
+}
+
+// Commit is a commit of a repository.
+type Commit struct {
+	ID        string `json:"id"`
+	DisplayID string `json:"displayId"`
+	Author    User   `json:"author"`
+	Message   string `json:"message"`
+}
+
+// RefChange is a single ref update of a repo:refs_changed event.
+type RefChange struct {
+	Ref struct {
+		ID        string `json:"id"`
+		DisplayID string `json:"displayId"`
+		Type      string `json:"type"`
+	} `json:"ref"`
+	RefID    string `json:"refId"`
+	FromHash string `json:"fromHash"`
+	ToHash   string `json:"toHash"`
+	Type     string `json:"type"`
+}
+
+// page is the envelope of every paged Data Center API response.
+type page[T any] struct {
+	Size          int  `json:"size"`
+	Limit         int  `json:"limit"`
+	IsLastPage    bool `json:"isLastPage"`
+	Values        []T  `json:"values"`
+	Start         int  `json:"start"`
+	NextPageStart int  `json:"nextPageStart"`
+}
+
+// Time converts a Data Center millisecond timestamp.
+func Time(millis int64) time.Time {
+	if millis == 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(millis).UTC()
+}
+
+// ToBitbucketUser converts the user to the Bitbucket Cloud model.
+func (u User) ToBitbucketUser() *bitbucket.User {
+	return &bitbucket.User{
+		Type_:       "user",
+		Username:    u.Name,
+		Nickname:    u.Name,
+		DisplayName: u.DisplayName,
+		AccountId:   u.Name,
+		Links: &bitbucket.AccountLinks{
+			Html: &bitbucket.SubjectTypesRepositoryEvents{Href: u.Links.Href()},
+		},
+	}
+}
+
+func (u User) toBitbucketAccount() *bitbucket.Account {
+	return &bitbucket.Account{
+		Type_:       "user",
+		Username:    u.Name,
+		Nickname:    u.Name,
+		DisplayName: u.DisplayName,
+		Links: &bitbucket.AccountLinks{
+			Html: &bitbucket.SubjectTypesRepositoryEvents{Href: u.Links.Href()},
+		},
+	}
+}
+
+// ToBitbucketProject converts the project to the Bitbucket Cloud model.
+func (p Project) ToBitbucketProject() *bitbucket.Project {
+	return &bitbucket.Project{
+		Type_:       "project",
+		Key:         p.Key,
+		Name:        p.Name,
+		Description: p.Description,
+		IsPrivate:   !p.Public,
+	}
+}
+
+// ToBitbucketRepository converts the repository to the Bitbucket Cloud model.
+func (r Repository) ToBitbucketRepository() *bitbucket.Repository {
+	return &bitbucket.Repository{
+		Type_:     "repository",
+		FullName:  r.FullName(),
+		Name:      r.Name,
+		Scm:       r.ScmID,
+		IsPrivate: !r.Public && !r.Project.Public,
+		Project:   r.Project.ToBitbucketProject(),
+		Links: &bitbucket.RepositoryLinks{
+			Html: &bitbucket.SubjectTypesRepositoryEvents{Href: r.WebURL()},
+		},
+	}
+}
+
+func (ref Ref) toBitbucketEndpoint() *bitbucket.PullrequestEndpoint {
+	return &bitbucket.PullrequestEndpoint{
+		Repository: ref.Repository.ToBitbucketRepository(),
+		Branch:     &bitbucket.PullrequestEndpointBranch{Name: ref.DisplayID},
+		Commit:     &bitbucket.PullrequestMergeCommit{Hash: ref.LatestCommit},
+	}
+}
+
+// ToBitbucketPullRequest converts the pull request to the Bitbucket Cloud model.
+func (pr PullRequest) ToBitbucketPullRequest() *bitbucket.Pullrequest {
+	result := &bitbucket.Pullrequest{
+		Type_:       "pullrequest",
+		Id:          int32(pr.ID),
+		Title:       pr.Title,
+		State:       pr.State,
+		Author:      pr.Author.User.toBitbucketAccount(),
+		Source:      pr.FromRef.toBitbucketEndpoint(),
+		Destination: pr.ToRef.toBitbucketEndpoint(),
+		CreatedOn:   Time(pr.CreatedDate),
+		UpdatedOn:   Time(pr.UpdatedDate),
+		Summary:     &bitbucket.IssueContent{Raw: pr.Description},
+		Links: &bitbucket.PullrequestLinks{
+			Html: &bitbucket.SubjectTypesRepositoryEvents{Href: strings.TrimSuffix(pr.Links.Href(), "/overview")},
+		},
+	}
+
+	for _, reviewer := range pr.Reviewers {
+		result.Reviewers = append(result.Reviewers, *reviewer.User.toBitbucketAccount())
+		result.Participants = append(result.Participants, reviewer.toBitbucketParticipant())
+	}
+
+	for _, participant := range pr.Participants {
+		result.Participants = append(result.Participants, participant.toBitbucketParticipant())
+	}
+
+	return result
+}
+
+func (p Participant) toBitbucketParticipant() bitbucket.Participant {
+	return bitbucket.Participant{
+		Type_:    "participant",
+		User:     p.User.ToBitbucketUser(),
+		Role:     p.Role,
+		Approved: p.Approved,
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	reencryptMutexKey = "reencrypt_tokens"
+
+	// reencryptLockTimeout is how long the admin command waits for a re-encryption running on
+	// another node before reporting it as already in progress.
+	reencryptLockTimeout = time.Second
+
+	// reencryptAttempts limits the compare-and-set retries when tokens are refreshed concurrently.
+	reencryptAttempts = 10
+)
+
+// encryptSecret encrypts a secret for the KV store with the current encryption key.
+func (p *Plugin) encryptSecret(text string) (string, error) {
+	return encrypt([]byte(p.getConfiguration().EncryptionKey), text)
+}
+
+// decryptSecret decrypts a secret read from the KV store. While the encryption key is rotated,
+// secrets encrypted with the previous key can still be decrypted.
+func (p *Plugin) decryptSecret(text string) (string, error) {
+	config := p.getConfiguration()
+	current := []byte(config.EncryptionKey)
+	if config.PreviousEncryptionKey == "" {
+		return decrypt(current, text)
+	}
+	previous := []byte(config.PreviousEncryptionKey)
+
+	keyID, _, ok := parseCiphertext(text)
+	if ok {
+		if keyID == encryptionKeyID(previous) {
+			return decrypt(previous, text)
+		}
+		return decrypt(current, text)
+	}
+
+	// Legacy ciphertexts carry no key ID and aren't authenticated. They were all written before
+	// the first rotation, so the previous key is the likely one.
+	if plaintext, err := decrypt(previous, text); err == nil {
+		return plaintext, nil
+	}
+	return decrypt(current, text)
+}
+
+// needsReencryption reports whether a ciphertext wasn't produced by encrypt with the current key.
+func (p *Plugin) needsReencryption(text string) bool {
+	keyID, _, ok := parseCiphertext(text)
+	return !ok || keyID != encryptionKeyID([]byte(p.getConfiguration().EncryptionKey))
+}
+
+type reencryptResult struct {
+	Reencrypted int
+	UpToDate    int
+	Failed      int
+}
+
+// startReencryptingTokens re-encrypts the stored tokens in the background and reports the result
+// to the admin who asked for it. It returns false if a re-encryption is already running.
+func (p *Plugin) startReencryptingTokens(adminUserID string) (bool, error) {
+	mutex, err := cluster.NewMutex(p.API, reencryptMutexKey)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create re-encryption mutex")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reencryptLockTimeout)
+	defer cancel()
+	if err := mutex.LockWithContext(ctx); err != nil {
+		return false, nil
+	}
+
+	go func() {
+		defer mutex.Unlock()
+
+		result, err := p.reencryptTokens()
+		if err != nil {
+			p.API.LogError("Failed to re-encrypt stored tokens", "err", err.Error())
+			p.CreateBotDMPost(adminUserID, "Failed to re-encrypt the stored Bitbucket tokens. Check the server logs for details.", "custom_bitbucket_reencrypt")
+			return
+		}
+
+		message := fmt.Sprintf("Finished re-encrypting the stored Bitbucket tokens: %d re-encrypted, %d already up to date, %d failed.", result.Reencrypted, result.UpToDate, result.Failed)
+		if result.Failed > 0 {
+			message += " Check the server logs for the users whose tokens couldn't be re-encrypted, and keep the previous encryption key until they reconnect."
+		}
+		p.CreateBotDMPost(adminUserID, message, "custom_bitbucket_reencrypt")
+	}()
+
+	return true, nil
+}
+
+// reencryptTokens encrypts the tokens of all connected users with the current encryption key.
+func (p *Plugin) reencryptTokens() (*reencryptResult, error) {
+	keys, err := p.listKVKeysWithSuffix(BitbucketTokenKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &reencryptResult{}
+	for _, key := range keys {
+		reencrypted, err := p.reencryptUserInfo(key)
+		switch {
+		case err != nil:
+			p.API.LogWarn("Failed to re-encrypt stored token", "key", key, "err", err.Error())
+			result.Failed++
+		case reencrypted:
+			result.Reencrypted++
+		default:
+			result.UpToDate++
+		}
+	}
+
+	return result, nil
+}
+
+// reencryptUserInfo encrypts the stored tokens of a user with the current key, and reports whether
+// they needed it.
+func (p *Plugin) reencryptUserInfo(key string) (bool, error) {
+	for attempt := 0; attempt < reencryptAttempts; attempt++ {
+		infoBytes, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to get user info")
+		}
+		if infoBytes == nil {
+			return false, nil
+		}
+
+		var stored BitbucketUserInfo
+		if err := json.Unmarshal(infoBytes, &stored); err != nil || stored.Token == nil {
+			return false, errors.New("failed to parse user info")
+		}
+
+		if !p.needsReencryption(stored.Token.AccessToken) &&
+			(stored.Token.RefreshToken == "" || (stored.RefreshTokenEncrypted && !p.needsReencryption(stored.Token.RefreshToken))) {
+			return false, nil
+		}
+
+		userInfo, apiErr := p.decodeBitbucketUserInfo(infoBytes)
+		if apiErr != nil {
+			return false, errors.New(apiErr.Message)
+		}
+
+		newInfoBytes, err := p.encodeBitbucketUserInfo(userInfo)
+		if err != nil {
+			return false, err
+		}
+
+		saved, appErr := p.API.KVCompareAndSet(key, infoBytes, newInfoBytes)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to store user info")
+		}
+		if saved {
+			return true, nil
+		}
+
+		// The token was refreshed in the meantime, so check the stored one again: a node still
+		// running with the previous key may have written it.
+	}
+
+	return false, errors.Errorf("could not store user info after %d attempts", reencryptAttempts)
+}
+
+func (p *Plugin) listKVKeysWithSuffix(suffix string) ([]string, error) {
+	keys, err := p.listKVKeysWithPrefix("")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, suffix) {
+			result = append(result, key)
+		}
+	}
+
+	return result, nil
+}
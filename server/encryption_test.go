@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+)
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	const (
+		oldKey = "0123456789abcdef0123456789abcdef"
+		newKey = "fedcba9876543210fedcba9876543210"
+	)
+
+	setup := func(t *testing.T) (*Plugin, map[string][]byte) {
+		kv := map[string][]byte{}
+		api := &plugintest.API{}
+		api.On("KVSet", mock.Anything, mock.Anything).Return(func(key string, value []byte) *model.AppError {
+			kv[key] = value
+			return nil
+		}).Maybe()
+		api.On("KVGet", mock.Anything).Return(func(key string) []byte {
+			return kv[key]
+		}, nil).Maybe()
+		api.On("KVCompareAndSet", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, oldValue, newValue []byte) bool {
+			if !bytes.Equal(kv[key], oldValue) {
+				return false
+			}
+			kv[key] = newValue
+			return true
+		}, nil).Maybe()
+		api.On("KVList", mock.Anything, mock.Anything).Return(func(page, _ int) []string {
+			if page > 0 {
+				return nil
+			}
+			var keys []string
+			for key := range kv {
+				keys = append(keys, key)
+			}
+			return keys
+		}, nil).Maybe()
+		api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Maybe()
+		api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.setConfiguration(&Configuration{EncryptionKey: oldKey})
+
+		return p, kv
+	}
+
+	storeUser := func(t *testing.T, p *Plugin, userID string) {
+		require.NoError(t, p.storeBitbucketUserInfo(&BitbucketUserInfo{
+			UserID: userID,
+			Token:  &oauth2.Token{AccessToken: userID + "-access", RefreshToken: userID + "-refresh"},
+		}))
+	}
+
+	rotate := func(p *Plugin) {
+		p.setConfiguration(&Configuration{EncryptionKey: newKey, PreviousEncryptionKey: oldKey})
+	}
+
+	t.Run("tokens encrypted with the previous key are read", func(t *testing.T) {
+		p, _ := setup(t)
+		storeUser(t, p, "user")
+		rotate(p)
+
+		loaded, apiErr := p.getBitbucketUserInfo("user")
+		require.Nil(t, apiErr)
+		assert.Equal(t, "user-access", loaded.Token.AccessToken)
+		assert.Equal(t, "user-refresh", loaded.Token.RefreshToken)
+	})
+
+	t.Run("legacy tokens encrypted with the previous key are read", func(t *testing.T) {
+		p, kv := setup(t)
+		legacy, err := json.Marshal(BitbucketUserInfo{
+			UserID:                "user",
+			Token:                 &oauth2.Token{AccessToken: encryptLegacy(t, []byte(oldKey), "user-access")},
+			RefreshTokenEncrypted: true,
+		})
+		require.NoError(t, err)
+		kv["user"+BitbucketTokenKey] = legacy
+		rotate(p)
+
+		loaded, apiErr := p.getBitbucketUserInfo("user")
+		require.Nil(t, apiErr)
+		assert.Equal(t, "user-access", loaded.Token.AccessToken)
+	})
+
+	t.Run("tokens are unreadable once the previous key is cleared", func(t *testing.T) {
+		p, _ := setup(t)
+		storeUser(t, p, "user")
+		p.setConfiguration(&Configuration{EncryptionKey: newKey})
+
+		_, apiErr := p.getBitbucketUserInfo("user")
+		require.NotNil(t, apiErr)
+		assert.Equal(t, "Unable to decrypt access token.", apiErr.Message)
+	})
+
+	t.Run("stored tokens are re-encrypted with the new key", func(t *testing.T) {
+		p, kv := setup(t)
+		storeUser(t, p, "user1")
+		storeUser(t, p, "user2")
+		kv["unrelated"] = []byte("value")
+		rotate(p)
+		storeUser(t, p, "user2")
+
+		result, err := p.reencryptTokens()
+		require.NoError(t, err)
+		assert.Equal(t, &reencryptResult{Reencrypted: 1, UpToDate: 1}, result)
+		assert.Equal(t, []byte("value"), kv["unrelated"])
+
+		p.setConfiguration(&Configuration{EncryptionKey: newKey})
+		for _, userID := range []string{"user1", "user2"} {
+			loaded, apiErr := p.getBitbucketUserInfo(userID)
+			require.Nil(t, apiErr)
+			assert.Equal(t, userID+"-access", loaded.Token.AccessToken)
+			assert.Equal(t, userID+"-refresh", loaded.Token.RefreshToken)
+		}
+	})
+
+	t.Run("tokens refreshed during the re-encryption are checked again", func(t *testing.T) {
+		p, kv := setup(t)
+		storeUser(t, p, "refreshed")
+		refreshed := bytes.Replace(kv["refreshed"+BitbucketTokenKey], []byte(`"refreshed"`), []byte(`"user"`), 1)
+		delete(kv, "refreshed"+BitbucketTokenKey)
+		storeUser(t, p, "user")
+		rotate(p)
+
+		// Another node, still using the previous key, stores a refreshed token before the first
+		// re-encrypted one
+		raced := false
+		api := &plugintest.API{}
+		api.On("KVGet", mock.Anything).Return(func(key string) []byte {
+			return kv[key]
+		}, nil)
+		api.On("KVList", mock.Anything, mock.Anything).Return(func(page, _ int) []string {
+			if page > 0 {
+				return nil
+			}
+			return []string{"user" + BitbucketTokenKey}
+		}, nil)
+		api.On("KVCompareAndSet", "user"+BitbucketTokenKey, mock.Anything, mock.Anything).Return(func(key string, oldValue, newValue []byte) bool {
+			if !raced {
+				raced = true
+				kv[key] = refreshed
+			}
+			if !bytes.Equal(kv[key], oldValue) {
+				return false
+			}
+			kv[key] = newValue
+			return true
+		}, nil)
+		p.SetAPI(api)
+
+		result, err := p.reencryptTokens()
+		require.NoError(t, err)
+		assert.Equal(t, &reencryptResult{Reencrypted: 1}, result)
+
+		p.setConfiguration(&Configuration{EncryptionKey: newKey})
+		loaded, apiErr := p.getBitbucketUserInfo("user")
+		require.Nil(t, apiErr)
+		assert.Equal(t, "refreshed-access", loaded.Token.AccessToken)
+	})
+
+	t.Run("tokens that can't be decrypted are reported", func(t *testing.T) {
+		p, _ := setup(t)
+		storeUser(t, p, "user")
+		p.setConfiguration(&Configuration{EncryptionKey: newKey})
+
+		result, err := p.reencryptTokens()
+		require.NoError(t, err)
+		assert.Equal(t, &reencryptResult{Failed: 1}, result)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// An index is a KV value listing the IDs of a set of keys, e.g. the pending webhook jobs, so the
+// set can be read without listing all the keys of the plugin's KV store.
+
+// getKVIndex returns the IDs listed in the index.
+func (p *Plugin) getKVIndex(key string) ([]string, error) {
+	ids, _, err := p.readKVIndex(key)
+	return ids, err
+}
+
+func (p *Plugin) readKVIndex(key string) ([]string, []byte, error) {
+	value, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to load index")
+	}
+	if value == nil {
+		return nil, nil, nil
+	}
+
+	var ids []string
+	if err := json.Unmarshal(value, &ids); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode index")
+	}
+
+	return ids, value, nil
+}
+
+// addToKVIndex adds the IDs to the index, creating it if needed.
+func (p *Plugin) addToKVIndex(key string, ids ...string) error {
+	return p.updateKVIndex(key, func(indexed map[string]bool) bool {
+		changed := false
+		for _, id := range ids {
+			if !indexed[id] {
+				indexed[id] = true
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// removeFromKVIndex removes the IDs from the index.
+func (p *Plugin) removeFromKVIndex(key string, ids ...string) error {
+	return p.updateKVIndex(key, func(indexed map[string]bool) bool {
+		changed := false
+		for _, id := range ids {
+			if indexed[id] {
+				delete(indexed, id)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// updateKVIndex applies update to the IDs of the index with compare-and-set semantics, retrying
+// on conflicts like incrementKVCounter. The index is stored even when empty, so that its presence
+// shows it was built.
+func (p *Plugin) updateKVIndex(key string, update func(indexed map[string]bool) bool) error {
+	for {
+		ids, oldValue, err := p.readKVIndex(key)
+		if err != nil {
+			return err
+		}
+
+		indexed := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			indexed[id] = true
+		}
+		if !update(indexed) && oldValue != nil {
+			return nil
+		}
+
+		ids = make([]string, 0, len(indexed))
+		for id := range indexed {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		newValue, err := json.Marshal(ids)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode index")
+		}
+
+		updated, appErr := p.API.KVCompareAndSet(key, oldValue, newValue)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to update index")
+		}
+		if updated {
+			return nil
+		}
+	}
+}
+
+// migrateKVIndex builds the index from the IDs returned by list, unless it was built before. Keys
+// stored before the index existed are only found this way.
+func (p *Plugin) migrateKVIndex(key string, list func() ([]string, error)) error {
+	_, value, err := p.readKVIndex(key)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		return nil
+	}
+
+	ids, err := list()
+	if err != nil {
+		return err
+	}
+
+	return p.addToKVIndex(key, ids...)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// mockKVIndex stores the index under key in memory, starting with the given IDs.
+func mockKVIndex(api *plugintest.API, key string, ids ...string) func() []string {
+	value, _ := json.Marshal(ids)
+	api.On("KVGet", key).Return(func(string) []byte {
+		return value
+	}, nil)
+	api.On("KVCompareAndSet", key, mock.Anything, mock.Anything).Return(func(_ string, oldValue, newValue []byte) bool {
+		if !bytes.Equal(oldValue, value) {
+			return false
+		}
+		value = newValue
+		return true
+	}, nil)
+
+	return func() []string {
+		var indexed []string
+		_ = json.Unmarshal(value, &indexed)
+		return indexed
+	}
+}
+
+func TestKVIndex(t *testing.T) {
+	api := &plugintest.API{}
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	t.Run("index is created", func(t *testing.T) {
+		api.On("KVGet", "created").Return(nil, nil).Once()
+		api.On("KVCompareAndSet", "created", []byte(nil), []byte(`["a","b"]`)).Return(true, nil).Once()
+
+		require.NoError(t, p.addToKVIndex("created", "b", "a"))
+	})
+
+	t.Run("IDs are added and removed", func(t *testing.T) {
+		indexed := mockKVIndex(api, "index", "a", "c")
+
+		require.NoError(t, p.addToKVIndex("index", "b", "c"))
+		assert.Equal(t, []string{"a", "b", "c"}, indexed())
+
+		require.NoError(t, p.removeFromKVIndex("index", "a", "b", "c"))
+		assert.Equal(t, []string{}, indexed())
+
+		ids, err := p.getKVIndex("index")
+		require.NoError(t, err)
+		assert.Empty(t, ids)
+	})
+
+	t.Run("existing indexes aren't migrated again", func(t *testing.T) {
+		mockKVIndex(api, "migrated")
+
+		err := p.migrateKVIndex("migrated", func() ([]string, error) {
+			t.Fatal("the keys should not be listed")
+			return nil, nil
+		})
+		require.NoError(t, err)
+	})
+}
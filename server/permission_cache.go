@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeyRepoPermission prefixes the cached results of repository permission checks.
+	KeyRepoPermission = "repo_permission_"
+
+	// KeyRepoPermissionGeneration prefixes the per-user counter that is part of the keys of the
+	// cached permissions. Incrementing it drops all the cached permissions of the user at once.
+	KeyRepoPermissionGeneration = "repo_permission_generation_"
+
+	// ClusterEventRepoPermissionsInvalidated notifies the other plugin instances that the cached
+	// permissions of the user in the event data must be dropped.
+	ClusterEventRepoPermissionsInvalidated = "repo_permissions_invalidated"
+
+	// permissionCacheSize limits the number of permissions kept in memory by each plugin instance.
+	permissionCacheSize = 10000
+
+	// permissionCacheTTL is how long the result of a permission check is reused, so losing access
+	// to a repository takes up to that long to apply to notifications.
+	permissionCacheTTL = 10 * time.Minute
+)
+
+// permissionCache keeps the results of recent repository permission checks in memory, and evicts
+// the least recently used ones when full.
+type permissionCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// order holds the entries from the most to the least recently used.
+	order *list.List
+
+	memoryHits atomic.Int64
+	kvHits     atomic.Int64
+	misses     atomic.Int64
+}
+
+type permissionCacheEntry struct {
+	key       string
+	userID    string
+	allowed   bool
+	expiresAt time.Time
+}
+
+// cachedRepoPermission is the value stored in the KV store.
+type cachedRepoPermission struct {
+	Allowed   bool  `json:"allowed"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+func newPermissionCache(size int) *permissionCache {
+	return &permissionCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func permissionCacheKey(userID, repo string) string {
+	return userID + "/" + strings.ToLower(repo)
+}
+
+func (c *permissionCache) get(userID, repo string, now time.Time) (allowed, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[permissionCacheKey(userID, repo)]
+	if !ok {
+		return false, false
+	}
+
+	entry := element.Value.(*permissionCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.remove(element)
+		return false, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.allowed, true
+}
+
+func (c *permissionCache) set(userID, repo string, allowed bool, expiresAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := permissionCacheKey(userID, repo)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*permissionCacheEntry)
+		entry.allowed = allowed
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&permissionCacheEntry{key: key, userID: userID, allowed: allowed, expiresAt: expiresAt})
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidateUser drops the cached permissions of the user.
+func (c *permissionCache) invalidateUser(userID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, element := range c.entries {
+		if element.Value.(*permissionCacheEntry).userID == userID {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *permissionCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*permissionCacheEntry).key)
+}
+
+// getCachedRepoPermission returns the cached result of checking the user's permission to the
+// repository, looking in memory first and then in the KV store shared by the cluster.
+func (p *Plugin) getCachedRepoPermission(userID, repo string) (allowed, ok bool) {
+	now := time.Now()
+	if allowed, ok := p.permissionCache.get(userID, repo, now); ok {
+		p.permissionCache.memoryHits.Add(1)
+		return allowed, true
+	}
+
+	key, err := p.repoPermissionKey(userID, repo)
+	if err != nil {
+		p.API.LogWarn("Failed to get cached repository permission", "userID", userID, "repository", repo, "err", err.Error())
+		p.permissionCache.misses.Add(1)
+		return false, false
+	}
+
+	value, appErr := p.API.KVGet(key)
+	if appErr != nil || value == nil {
+		p.permissionCache.misses.Add(1)
+		return false, false
+	}
+
+	var cached cachedRepoPermission
+	if err := json.Unmarshal(value, &cached); err != nil || now.UnixMilli() >= cached.ExpiresAt {
+		p.permissionCache.misses.Add(1)
+		return false, false
+	}
+
+	p.permissionCache.set(userID, repo, cached.Allowed, time.UnixMilli(cached.ExpiresAt))
+	p.permissionCache.kvHits.Add(1)
+	return cached.Allowed, true
+}
+
+// cacheRepoPermission stores the result of checking the user's permission to the repository.
+func (p *Plugin) cacheRepoPermission(userID, repo string, allowed bool) {
+	expiresAt := time.Now().Add(permissionCacheTTL)
+	p.permissionCache.set(userID, repo, allowed, expiresAt)
+
+	key, err := p.repoPermissionKey(userID, repo)
+	if err != nil {
+		p.API.LogWarn("Failed to cache repository permission", "userID", userID, "repository", repo, "err", err.Error())
+		return
+	}
+
+	value, err := json.Marshal(cachedRepoPermission{Allowed: allowed, ExpiresAt: expiresAt.UnixMilli()})
+	if err != nil {
+		return
+	}
+
+	if _, appErr := p.API.KVSetWithOptions(key, value, model.PluginKVSetOptions{
+		ExpireInSeconds: int64(permissionCacheTTL / time.Second),
+	}); appErr != nil {
+		p.API.LogWarn("Failed to cache repository permission", "userID", userID, "repository", repo, "err", appErr.Error())
+	}
+}
+
+// invalidateRepoPermissions drops the cached permissions of the user on all plugin instances.
+func (p *Plugin) invalidateRepoPermissions(userID string) {
+	if err := p.incrementKVCounter(KeyRepoPermissionGeneration + userID); err != nil {
+		p.API.LogWarn("Failed to invalidate cached repository permissions", "userID", userID, "err", err.Error())
+	}
+
+	p.permissionCache.invalidateUser(userID)
+
+	err := p.API.PublishPluginClusterEvent(model.PluginClusterEvent{
+		Id:   ClusterEventRepoPermissionsInvalidated,
+		Data: []byte(userID),
+	}, model.PluginClusterEventSendOptions{
+		SendType: model.PluginClusterEventSendTypeReliable,
+	})
+	if err != nil {
+		p.API.LogWarn("Failed to publish repository permissions invalidation", "userID", userID, "err", err.Error())
+	}
+}
+
+// repoPermissionKey returns the KV key of the user's cached permission to the repository. The key
+// is hashed, as user IDs and repository names together may exceed the maximum key length.
+func (p *Plugin) repoPermissionKey(userID, repo string) (string, error) {
+	generation, err := p.getKVCounter(KeyRepoPermissionGeneration + userID)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get permission cache generation")
+	}
+
+	hash := sha256.Sum256([]byte(strconv.FormatInt(generation, 10) + "/" + permissionCacheKey(userID, repo)))
+	return KeyRepoPermission + hex.EncodeToString(hash[:]), nil
+}
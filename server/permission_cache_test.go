@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+)
+
+func TestPermissionCache(t *testing.T) {
+	now := time.Now()
+
+	t.Run("least recently used entries are evicted", func(t *testing.T) {
+		c := newPermissionCache(2)
+		c.set("user", "acme/one", true, now.Add(time.Minute))
+		c.set("user", "acme/two", false, now.Add(time.Minute))
+
+		_, ok := c.get("user", "acme/one", now)
+		require.True(t, ok)
+		c.set("user", "acme/three", true, now.Add(time.Minute))
+
+		_, ok = c.get("user", "acme/two", now)
+		assert.False(t, ok)
+		allowed, ok := c.get("user", "ACME/One", now)
+		assert.True(t, ok)
+		assert.True(t, allowed)
+		_, ok = c.get("user", "acme/three", now)
+		assert.True(t, ok)
+	})
+
+	t.Run("expired entries are dropped", func(t *testing.T) {
+		c := newPermissionCache(2)
+		c.set("user", "acme/one", true, now.Add(time.Minute))
+
+		_, ok := c.get("user", "acme/one", now.Add(time.Minute))
+		assert.False(t, ok)
+		assert.Zero(t, c.order.Len())
+	})
+
+	t.Run("users are invalidated", func(t *testing.T) {
+		c := newPermissionCache(10)
+		c.set("user", "acme/one", true, now.Add(time.Minute))
+		c.set("other", "acme/one", true, now.Add(time.Minute))
+
+		c.invalidateUser("user")
+
+		_, ok := c.get("user", "acme/one", now)
+		assert.False(t, ok)
+		_, ok = c.get("other", "acme/one", now)
+		assert.True(t, ok)
+	})
+}
+
+func TestCheckPermissionToRepoIsCached(t *testing.T) {
+	const encryptionKey = "0123456789abcdef0123456789abcdef"
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/rest/api/1.0/projects/MM/repos/secret" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": [{"message": "Repository MM/secret does not exist."}]}`))
+			return
+		}
+		assert.Equal(t, "/rest/api/1.0/projects/MM/repos/repo", r.URL.Path)
+		_, _ = w.Write([]byte(`{"slug": "repo", "project": {"key": "MM"}}`))
+	}))
+	defer server.Close()
+
+	kv := map[string][]byte{}
+	api := &plugintest.API{}
+	siteURL := "https://mattermost.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}})
+	api.On("KVGet", mock.Anything).Return(func(key string) []byte {
+		return kv[key]
+	}, nil)
+	api.On("KVSetWithOptions", mock.Anything, mock.Anything, model.PluginKVSetOptions{ExpireInSeconds: 600}).Return(func(key string, value []byte, _ model.PluginKVSetOptions) bool {
+		kv[key] = value
+		return true
+	}, nil)
+	api.On("KVCompareAndSet", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, oldValue, newValue []byte) bool {
+		if !bytes.Equal(kv[key], oldValue) {
+			return false
+		}
+		kv[key] = newValue
+		return true
+	}, nil)
+	api.On("PublishPluginClusterEvent", model.PluginClusterEvent{Id: ClusterEventRepoPermissionsInvalidated, Data: []byte("user")}, mock.Anything).Return(nil)
+
+	newPlugin := func() *Plugin {
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.setConfiguration(&Configuration{EncryptionKey: encryptionKey, BitbucketSelfHostedURL: server.URL})
+		return p
+	}
+
+	p := newPlugin()
+	accessToken, err := encrypt([]byte(encryptionKey), "token")
+	require.NoError(t, err)
+	kv["user"+BitbucketTokenKey], err = json.Marshal(BitbucketUserInfo{UserID: "user", Token: &oauth2.Token{AccessToken: accessToken}})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		hasPermission, err := p.checkPermissionToRepo("user", "MM/repo")
+		require.NoError(t, err)
+		assert.True(t, hasPermission)
+
+		hasPermission, err = p.checkPermissionToRepo("user", "MM/secret")
+		require.NoError(t, err)
+		assert.False(t, hasPermission)
+	}
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, int64(4), p.permissionCache.memoryHits.Load())
+	assert.Equal(t, int64(2), p.permissionCache.misses.Load())
+
+	// Another plugin instance reuses the permissions cached in the KV store
+	other := newPlugin()
+	hasPermission, err := other.checkPermissionToRepo("user", "MM/repo")
+	require.NoError(t, err)
+	assert.True(t, hasPermission)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, int64(1), other.permissionCache.kvHits.Load())
+
+	p.invalidateRepoPermissions("user")
+	other.OnPluginClusterEvent(nil, model.PluginClusterEvent{Id: ClusterEventRepoPermissionsInvalidated, Data: []byte("user")})
+
+	for _, instance := range []*Plugin{p, other} {
+		hasPermission, err = instance.checkPermissionToRepo("user", "MM/repo")
+		require.NoError(t, err)
+		assert.True(t, hasPermission)
+	}
+	assert.Equal(t, 3, requests)
+}
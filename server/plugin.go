@@ -21,6 +21,7 @@ import (
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
 
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/datacenter"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/templaterenderer"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
 )
@@ -60,12 +61,24 @@ type Plugin struct {
 	// webhookHandler is responsible for handling webhook events.
 	webhookHandler webhook.Webhook
 
+	// webhookQueue processes webhook deliveries in the background.
+	webhookQueue *webhookQueue
+
+	// subscriptionCache caches the subscriptions read from the KV store.
+	subscriptionCache *subscriptionCache
+
+	// permissionCache caches the results of repository permission checks.
+	permissionCache *permissionCache
+
 	router *mux.Router
 }
 
 // NewPlugin returns an instance of a Plugin.
 func NewPlugin() *Plugin {
-	p := &Plugin{}
+	p := &Plugin{
+		subscriptionCache: newSubscriptionCache(subscriptionCacheSize, subscriptionCacheTTL),
+		permissionCache:   newPermissionCache(permissionCacheSize),
+	}
 
 	p.CommandHandlers = map[string]commandHandleFunc{
 		"subscriptions": p.handleSubscribe,
@@ -75,6 +88,7 @@ func NewPlugin() *Plugin {
 		"help":          p.handleHelp,
 		"":              p.handleHelp,
 		"settings":      p.handleSettings,
+		"pr":            p.handlePullRequest,
 	}
 
 	return p
@@ -84,13 +98,15 @@ func (p *Plugin) initializeWebhookHandler() {
 	templateRenderer := templaterenderer.MakeTemplateRenderer()
 	templateRenderer.RegisterBitBucketAccountIDToUsernameMappingCallback(
 		p.getBitBucketAccountIDToMattermostUsernameMapping)
-	p.webhookHandler = webhook.NewWebhook(&subscriptionHandler{p}, &pullRequestReviewHandler{p}, templateRenderer)
+	p.webhookHandler = webhook.NewWebhook(&subscriptionHandler{p}, &pullRequestReviewHandler{p}, &commitParticipantsProvider{p}, &pullRequestProvider{p}, &buildStatusStore{p}, templateRenderer)
 }
 
-func (p *Plugin) bitbucketConnect(token oauth2.Token) *bitbucket.APIClient {
-	// get Oauth token source and client
-	ts := p.getOAuthConfig().TokenSource(context.Background(), &token)
+// bitbucketConnect returns a Bitbucket Cloud client acting as the user.
+func (p *Plugin) bitbucketConnect(userInfo *BitbucketUserInfo) *bitbucket.APIClient {
+	return newBitbucketClient(p.userTokenSource(userInfo))
+}
 
+func newBitbucketClient(ts oauth2.TokenSource) *bitbucket.APIClient {
 	// setup Oauth context
 	auth := context.WithValue(context.Background(), bitbucket.ContextOAuth2, ts)
 
@@ -104,6 +120,17 @@ func (p *Plugin) bitbucketConnect(token oauth2.Token) *bitbucket.APIClient {
 	return bitbucket.NewAPIClient(configBb)
 }
 
+// dataCenterConnect returns a client for the configured Bitbucket Data Center instance, acting as
+// the user.
+func (p *Plugin) dataCenterConnect(userInfo *BitbucketUserInfo) *datacenter.Client {
+	return datacenter.NewClient(p.getBaseURL(), p.userHTTPClient(userInfo))
+}
+
+// userHTTPClient returns an HTTP client authenticated as the user.
+func (p *Plugin) userHTTPClient(userInfo *BitbucketUserInfo) *http.Client {
+	return oauth2.NewClient(context.Background(), p.userTokenSource(userInfo))
+}
+
 func (p *Plugin) OnActivate() error {
 	config := p.getConfiguration()
 
@@ -117,6 +144,7 @@ func (p *Plugin) OnActivate() error {
 
 	p.initializeAPI()
 	p.initializeWebhookHandler()
+	p.webhookQueue = newWebhookQueue(p)
 	commands, err := p.getCommand()
 	if err != nil {
 		return errors.Wrap(err, "failed to register command")
@@ -154,21 +182,56 @@ func (p *Plugin) OnActivate() error {
 		return errors.Wrap(appErr, "couldn't set profile image")
 	}
 
+	if err := p.migrateSubscriptions(); err != nil {
+		return errors.Wrap(err, "failed to migrate subscriptions")
+	}
+
+	if err := p.migrateWebhookJobIndexes(); err != nil {
+		return errors.Wrap(err, "failed to migrate webhook jobs")
+	}
+
+	p.webhookQueue.start()
+
 	return nil
 }
 
+func (p *Plugin) OnDeactivate() error {
+	if p.webhookQueue != nil {
+		p.webhookQueue.close()
+	}
+
+	return nil
+}
+
+// OnPluginClusterEvent drops cached data that another plugin instance changed.
+func (p *Plugin) OnPluginClusterEvent(_ *plugin.Context, ev model.PluginClusterEvent) {
+	switch ev.Id {
+	case ClusterEventSubscriptionsUpdated:
+		p.subscriptionCache.invalidate(string(ev.Data))
+	case ClusterEventRepoPermissionsInvalidated:
+		p.permissionCache.invalidateUser(string(ev.Data))
+	}
+}
+
 func (p *Plugin) getOAuthConfig() *oauth2.Config {
 	config := p.getConfiguration()
 
-	authURL, _ := url.Parse(BitbucketBaseURL)
-	tokenURL, _ := url.Parse(BitbucketBaseURL)
-	authURL.Path = path.Join(authURL.Path, "site", "oauth2", "authorize")
-	tokenURL.Path = path.Join(tokenURL.Path, "site", "oauth2", "access_token")
+	authURL, _ := url.Parse(p.getBaseURL())
+	tokenURL, _ := url.Parse(p.getBaseURL())
+	scopes := []string{"repository"}
+	if p.isDataCenter() {
+		authURL.Path = path.Join(authURL.Path, "rest", "oauth2", "latest", "authorize")
+		tokenURL.Path = path.Join(tokenURL.Path, "rest", "oauth2", "latest", "token")
+		scopes = []string{"REPO_WRITE"}
+	} else {
+		authURL.Path = path.Join(authURL.Path, "site", "oauth2", "authorize")
+		tokenURL.Path = path.Join(tokenURL.Path, "site", "oauth2", "access_token")
+	}
 
 	return &oauth2.Config{
 		ClientID:     config.BitbucketOAuthClientID,
 		ClientSecret: config.BitbucketOAuthClientSecret,
-		Scopes:       []string{"repository"},
+		Scopes:       scopes,
 		RedirectURL:  fmt.Sprintf("%s/plugins/%s/oauth/complete", *p.API.GetConfig().ServiceSettings.SiteURL, manifest.Id),
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  authURL.String(),
@@ -184,6 +247,9 @@ type BitbucketUserInfo struct {
 	BitbucketAccountID string
 	LastToDoPostAt     int64
 	Settings           *UserSettings
+	// RefreshTokenEncrypted is false for users connected before refresh tokens were encrypted
+	// and whose token hasn't been stored since.
+	RefreshTokenEncrypted bool
 }
 
 type UserSettings struct {
@@ -193,39 +259,65 @@ type UserSettings struct {
 }
 
 func (p *Plugin) storeBitbucketUserInfo(info *BitbucketUserInfo) error {
-	config := p.getConfiguration()
-
-	encryptedToken, err := encrypt([]byte(config.EncryptionKey), info.Token.AccessToken)
+	jsonInfo, err := p.encodeBitbucketUserInfo(info)
 	if err != nil {
-		return errors.Wrap(err, "error occurred while encrypting access token")
+		return err
 	}
 
-	info.Token.AccessToken = encryptedToken
+	if err := p.API.KVSet(info.UserID+BitbucketTokenKey, jsonInfo); err != nil {
+		return errors.Wrap(err, "error occurred while trying to store user info into KV store")
+	}
+
+	return nil
+}
 
-	jsonInfo, err := json.Marshal(info)
+// encodeBitbucketUserInfo encrypts the tokens of info with the current encryption key and
+// serializes it for the KV store. info isn't modified.
+func (p *Plugin) encodeBitbucketUserInfo(info *BitbucketUserInfo) ([]byte, error) {
+	token := *info.Token
+	encryptedToken, err := p.encryptSecret(token.AccessToken)
 	if err != nil {
-		return errors.Wrap(err, "error while converting user info to json")
+		return nil, errors.Wrap(err, "error occurred while encrypting access token")
 	}
+	token.AccessToken = encryptedToken
 
-	if err := p.API.KVSet(info.UserID+BitbucketTokenKey, jsonInfo); err != nil {
-		return errors.Wrap(err, "error occurred while trying to store user info into KV store")
+	if token.RefreshToken != "" {
+		encryptedRefreshToken, err := p.encryptSecret(token.RefreshToken)
+		if err != nil {
+			return nil, errors.Wrap(err, "error occurred while encrypting refresh token")
+		}
+		token.RefreshToken = encryptedRefreshToken
 	}
 
-	return nil
+	storedInfo := *info
+	storedInfo.Token = &token
+	storedInfo.RefreshTokenEncrypted = true
+
+	jsonInfo, err := json.Marshal(storedInfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while converting user info to json")
+	}
+
+	return jsonInfo, nil
 }
 
 func (p *Plugin) getBitbucketUserInfo(userID string) (*BitbucketUserInfo, *APIErrorResponse) {
-	config := p.getConfiguration()
+	infoBytes, err := p.API.KVGet(userID + BitbucketTokenKey)
+	if err != nil || infoBytes == nil {
+		return nil, &APIErrorResponse{ID: APIErrorIDNotConnected, Message: "Must connect user account to Bitbucket first.", StatusCode: http.StatusBadRequest}
+	}
 
-	var userInfo BitbucketUserInfo
+	return p.decodeBitbucketUserInfo(infoBytes)
+}
 
-	if infoBytes, err := p.API.KVGet(userID + BitbucketTokenKey); err != nil || infoBytes == nil {
-		return nil, &APIErrorResponse{ID: APIErrorIDNotConnected, Message: "Must connect user account to Bitbucket first.", StatusCode: http.StatusBadRequest}
-	} else if err := json.Unmarshal(infoBytes, &userInfo); err != nil {
+// decodeBitbucketUserInfo parses user info read from the KV store and decrypts its tokens.
+func (p *Plugin) decodeBitbucketUserInfo(infoBytes []byte) (*BitbucketUserInfo, *APIErrorResponse) {
+	var userInfo BitbucketUserInfo
+	if err := json.Unmarshal(infoBytes, &userInfo); err != nil || userInfo.Token == nil {
 		return nil, &APIErrorResponse{ID: "", Message: "Unable to parse token.", StatusCode: http.StatusInternalServerError}
 	}
 
-	unencryptedToken, err := decrypt([]byte(config.EncryptionKey), userInfo.Token.AccessToken)
+	unencryptedToken, err := p.decryptSecret(userInfo.Token.AccessToken)
 	if err != nil {
 		p.API.LogError("Unable to decrypt access token", "err", err.Error())
 		return nil, &APIErrorResponse{ID: "", Message: "Unable to decrypt access token.", StatusCode: http.StatusInternalServerError}
@@ -233,6 +325,15 @@ func (p *Plugin) getBitbucketUserInfo(userID string) (*BitbucketUserInfo, *APIEr
 
 	userInfo.Token.AccessToken = unencryptedToken
 
+	if userInfo.RefreshTokenEncrypted && userInfo.Token.RefreshToken != "" {
+		unencryptedRefreshToken, err := p.decryptSecret(userInfo.Token.RefreshToken)
+		if err != nil {
+			p.API.LogError("Unable to decrypt refresh token", "err", err.Error())
+			return nil, &APIErrorResponse{ID: "", Message: "Unable to decrypt refresh token.", StatusCode: http.StatusInternalServerError}
+		}
+		userInfo.Token.RefreshToken = unencryptedRefreshToken
+	}
+
 	return &userInfo, nil
 }
 
@@ -263,6 +364,8 @@ func (p *Plugin) disconnectBitbucketAccount(userID string) {
 			"userInfo.BitbucketAccountID", userInfo.BitbucketAccountID, "error", appErr.Error())
 	}
 
+	p.invalidateRepoPermissions(userID)
+
 	p.API.PublishWebSocketEvent(
 		WsEventDisconnect,
 		nil,
@@ -293,7 +396,7 @@ func (p *Plugin) CreateBotDMPost(userID, message, postType string) {
 }
 
 func (p *Plugin) PostToDo(info *BitbucketUserInfo) {
-	text, err := p.GetToDo(context.Background(), info, p.bitbucketConnect(*info.Token))
+	text, err := p.GetToDo(context.Background(), info, p.bitbucketConnect(info))
 	if err != nil {
 		p.API.LogWarn("Failed to get todo text", "userID", info.UserID, "error", err.Error())
 		return
@@ -303,7 +406,7 @@ func (p *Plugin) PostToDo(info *BitbucketUserInfo) {
 }
 
 func (p *Plugin) GetToDo(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient) (string, error) {
-	userRepos, err := p.getUserRepositories(ctx, bitbucketClient)
+	userRepos, err := p.getUserRepositories(ctx, userInfo, bitbucketClient)
 	if err != nil {
 		return "", errors.Wrap(err, "error occurred while searching for repositories")
 	}
@@ -331,7 +434,7 @@ func (p *Plugin) GetToDo(ctx context.Context, userInfo *BitbucketUserInfo, bitbu
 		text += fmt.Sprintf("You have %v assignments:\n", len(yourAssignments))
 
 		for _, assign := range yourAssignments {
-			text += getToDoDisplayText(BitbucketBaseURL, assign.Title, assign.Links.Html.Href, "")
+			text += getToDoDisplayText(p.getBaseURL(), assign.Title, assign.Links.Html.Href, "")
 		}
 	}
 
@@ -343,7 +446,7 @@ func (p *Plugin) GetToDo(ctx context.Context, userInfo *BitbucketUserInfo, bitbu
 		text += fmt.Sprintf("You have %v pull requests awaiting your review:\n", len(assignedPRs))
 
 		for _, assign := range assignedPRs {
-			text += getToDoDisplayText(BitbucketBaseURL, assign.Title, assign.Links.Html.Href, "")
+			text += getToDoDisplayText(p.getBaseURL(), assign.Title, assign.Links.Html.Href, "")
 		}
 	}
 
@@ -355,31 +458,57 @@ func (p *Plugin) GetToDo(ctx context.Context, userInfo *BitbucketUserInfo, bitbu
 		text += fmt.Sprintf("You have %v open pull requests:\n", len(yourOpenPrs))
 
 		for _, assign := range yourOpenPrs {
-			text += getToDoDisplayText(BitbucketBaseURL, assign.Title, assign.Links.Html.Href, "")
+			text += getToDoDisplayText(p.getBaseURL(), assign.Title, assign.Links.Html.Href, "")
 		}
 	}
 
 	return text, nil
 }
 
-func (p *Plugin) getUserRepositories(ctx context.Context, bitbucketClient *bitbucket.APIClient) ([]bitbucket.Repository, error) {
-	options := make(map[string]interface{})
-	options["role"] = "member"
+func (p *Plugin) getUserRepositories(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient) ([]bitbucket.Repository, error) {
+	orgs := p.getConfiguration().getOrganizations()
+	if len(orgs) == 0 {
+		// An empty organization stands for all of them
+		orgs = []string{""}
+	}
+
+	var userRepos []bitbucket.Repository
+	for _, org := range orgs {
+		var repos []bitbucket.Repository
+		var err error
+		switch {
+		case p.isDataCenter():
+			repos, err = p.dataCenterConnect(userInfo).ListRepositories(ctx, org)
+		case org != "":
+			repos, err = p.fetchRepositoriesWithNextPagesIfAny(ctx, getYourOrgReposSearchQuery(org), bitbucketClient)
+		default:
+			repos, err = p.fetchRepositoriesWithNextPagesIfAny(ctx, getYourAllReposSearchQuery(), bitbucketClient)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error occurred while fetching repositories")
+		}
 
-	var urlForRepos string
-	org := p.getConfiguration().BitbucketOrg
-	if org != "" {
-		urlForRepos = getYourOrgReposSearchQuery(org)
-	} else {
-		urlForRepos = getYourAllReposSearchQuery()
+		userRepos = append(userRepos, repos...)
 	}
 
-	userRepos, err := p.fetchRepositoriesWithNextPagesIfAny(ctx, urlForRepos, bitbucketClient)
-	if err != nil {
-		return nil, errors.Wrap(err, "error occurred while fetching repositories")
+	return p.filterRepositories(userRepos), nil
+}
+
+// filterRepositories drops the repositories that are denied in the configuration.
+func (p *Plugin) filterRepositories(repos []bitbucket.Repository) []bitbucket.Repository {
+	if len(p.getConfiguration().getDeniedRepositories()) == 0 {
+		return repos
+	}
+
+	var result []bitbucket.Repository
+	for _, repo := range repos {
+		if p.checkRepositoryFullName(repo.FullName) != nil {
+			continue
+		}
+		result = append(result, repo)
 	}
 
-	return userRepos, nil
+	return result
 }
 
 func (p *Plugin) fetchRepositoriesWithNextPagesIfAny(ctx context.Context, urlToFetch string, bitbucketClient *bitbucket.APIClient) ([]bitbucket.Repository, error) {
@@ -410,8 +539,13 @@ func (p *Plugin) fetchRepositoriesWithNextPagesIfAny(ctx context.Context, urlToF
 	return result, nil
 }
 
-func (p *Plugin) getIssuesWithTerm(bitbucketClient *bitbucket.APIClient, searchTerm string) ([]bitbucket.Issue, error) {
-	userRepos, err := p.getUserRepositories(context.Background(), bitbucketClient)
+func (p *Plugin) getIssuesWithTerm(userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient, searchTerm string) ([]bitbucket.Issue, error) {
+	// Bitbucket Data Center has no built-in issue tracker
+	if p.isDataCenter() {
+		return nil, nil
+	}
+
+	userRepos, err := p.getUserRepositories(context.Background(), userInfo, bitbucketClient)
 	if err != nil {
 		return nil, errors.Wrap(err, "error occurred while fetching repositories")
 	}
@@ -519,6 +653,11 @@ func (p *Plugin) fetchPRsWithNextPagesIfAny(ctx context.Context, urlToFetch stri
 }
 
 func (p *Plugin) getAssignedIssues(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient, userRepos []bitbucket.Repository) ([]bitbucket.Issue, error) {
+	// Bitbucket Data Center has no built-in issue tracker
+	if p.isDataCenter() {
+		return nil, nil
+	}
+
 	var issuesResult []bitbucket.Issue
 
 	for _, repo := range userRepos {
@@ -536,6 +675,10 @@ func (p *Plugin) getAssignedIssues(ctx context.Context, userInfo *BitbucketUserI
 }
 
 func (p *Plugin) getAssignedPRs(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient, userRepos []bitbucket.Repository) ([]bitbucket.Pullrequest, error) {
+	if p.isDataCenter() {
+		return p.getDataCenterDashboardPRs(ctx, userInfo, datacenter.RoleReviewer)
+	}
+
 	var prsResult []bitbucket.Pullrequest
 	for _, repo := range userRepos {
 		urlForPRs := getYourAssigneePRsSearchQuery(userInfo.BitbucketAccountID, repo.FullName)
@@ -552,6 +695,10 @@ func (p *Plugin) getAssignedPRs(ctx context.Context, userInfo *BitbucketUserInfo
 }
 
 func (p *Plugin) getOpenPRs(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient, userRepos []bitbucket.Repository) ([]bitbucket.Pullrequest, error) {
+	if p.isDataCenter() {
+		return p.getDataCenterDashboardPRs(ctx, userInfo, datacenter.RoleAuthor)
+	}
+
 	var prsResult []bitbucket.Pullrequest
 
 	for _, repo := range userRepos {
@@ -568,17 +715,86 @@ func (p *Plugin) getOpenPRs(ctx context.Context, userInfo *BitbucketUserInfo, bi
 	return prsResult, nil
 }
 
+// getDataCenterDashboardPRs returns the open pull requests in which the user has the given role,
+// limited to the allowed organizations and repositories.
+func (p *Plugin) getDataCenterDashboardPRs(ctx context.Context, userInfo *BitbucketUserInfo, role string) ([]bitbucket.Pullrequest, error) {
+	prs, err := p.dataCenterConnect(userInfo).ListDashboardPullRequests(ctx, role)
+	if err != nil {
+		return nil, errors.Wrap(err, "error occurred while fetching pull requests")
+	}
+
+	var prsResult []bitbucket.Pullrequest
+	for _, pr := range prs {
+		if p.checkRepositoryFullName(pr.Destination.Repository.FullName) != nil {
+			continue
+		}
+
+		prsResult = append(prsResult, pr)
+	}
+
+	return prsResult, nil
+}
+
+func (p *Plugin) getPullRequest(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient, owner, repo string, id int64) (*bitbucket.Pullrequest, error) {
+	if p.isDataCenter() {
+		return p.dataCenterConnect(userInfo).GetPullRequest(ctx, owner, repo, id)
+	}
+
+	pr, httpResponse, err := bitbucketClient.PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdGet(ctx, owner, repo, int32(id))
+	if httpResponse != nil {
+		_ = httpResponse.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pr, nil
+}
+
 func (p *Plugin) checkOrg(org string) error {
-	config := p.getConfiguration()
+	orgs := p.getConfiguration().getOrganizations()
+	if len(orgs) == 0 {
+		return nil
+	}
+
+	for _, allowed := range orgs {
+		if strings.EqualFold(allowed, org) {
+			return nil
+		}
+	}
+
+	if len(orgs) == 1 {
+		return errors.Errorf("only repositories in the %v organization are supported", orgs[0])
+	}
+	return errors.Errorf("only repositories in the %v organizations are supported", strings.Join(orgs, ", "))
+}
 
-	configOrg := strings.TrimSpace(config.BitbucketOrg)
-	if configOrg != "" && configOrg != org {
-		return errors.Errorf("only repositories in the %v organization are supported", configOrg)
+// checkRepository checks that the repository belongs to an allowed organization and isn't denied.
+// If repo is empty, only the organization is checked.
+func (p *Plugin) checkRepository(owner, repo string) error {
+	if err := p.checkOrg(owner); err != nil {
+		return err
+	}
+	if repo == "" {
+		return nil
+	}
+
+	fullName := fullNameFromOwnerAndRepo(owner, repo)
+	for _, denied := range p.getConfiguration().getDeniedRepositories() {
+		if strings.EqualFold(denied, fullName) {
+			return errors.Errorf("the %v repository is not supported", fullName)
+		}
 	}
 
 	return nil
 }
 
+// checkRepositoryFullName is checkRepository for a repository given as owner/repo.
+func (p *Plugin) checkRepositoryFullName(fullName string) error {
+	owner, repo, _ := strings.Cut(fullName, "/")
+	return p.checkRepository(owner, repo)
+}
+
 func (p *Plugin) sendRefreshEvent(userID string) {
 	p.API.PublishWebSocketEvent(
 		WsEventRefresh,
@@ -587,8 +803,67 @@ func (p *Plugin) sendRefreshEvent(userID string) {
 	)
 }
 
+// getBaseURL returns the web URL of the Bitbucket instance, always ending with a slash.
 func (p *Plugin) getBaseURL() string {
-	return "https://bitbucket.org/"
+	selfHostedURL := strings.TrimSpace(p.getConfiguration().BitbucketSelfHostedURL)
+	if selfHostedURL == "" {
+		return BitbucketBaseURL
+	}
+
+	return strings.TrimSuffix(selfHostedURL, "/") + "/"
+}
+
+// getRepositoryURL returns the web URL of a repository, or of the organization if repo is empty.
+func (p *Plugin) getRepositoryURL(owner, repo string) string {
+	if !p.isDataCenter() {
+		if repo == "" {
+			return p.getBaseURL() + owner
+		}
+		return fmt.Sprintf("%s%s/%s", p.getBaseURL(), owner, repo)
+	}
+
+	ownerPath := "projects/" + owner
+	if strings.HasPrefix(owner, "~") {
+		ownerPath = "users/" + strings.ToLower(strings.TrimPrefix(owner, "~"))
+	}
+	if repo == "" {
+		return p.getBaseURL() + ownerPath
+	}
+
+	return fmt.Sprintf("%s%s/repos/%s", p.getBaseURL(), ownerPath, repo)
+}
+
+// getEnterpriseBaseURL returns the URL of the Bitbucket Data Center instance without a trailing slash,
+// or an empty string when using Bitbucket Cloud.
+func (p *Plugin) getEnterpriseBaseURL() string {
+	if !p.isDataCenter() {
+		return ""
+	}
+
+	return strings.TrimSuffix(p.getBaseURL(), "/")
+}
+
+// isDataCenter reports whether the plugin is configured for Bitbucket Data Center instead of Bitbucket Cloud.
+func (p *Plugin) isDataCenter() bool {
+	return p.getBaseURL() != BitbucketBaseURL
+}
+
+// getCurrentBitbucketUser returns the Bitbucket user a token obtained while connecting belongs to.
+func (p *Plugin) getCurrentBitbucketUser(ctx context.Context, token oauth2.Token) (*bitbucket.User, error) {
+	ts := oauth2.StaticTokenSource(&token)
+	if p.isDataCenter() {
+		return datacenter.NewClient(p.getBaseURL(), oauth2.NewClient(ctx, ts)).GetCurrentUser(ctx)
+	}
+
+	bitbucketUser, httpResponse, err := newBitbucketClient(ts).UsersApi.UserGet(ctx)
+	if httpResponse != nil {
+		_ = httpResponse.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &bitbucketUser, nil
 }
 
 // getBitBucketAccountIDToMattermostUsernameMapping maps a BitBucket account ID to the corresponding Mattermost username, if any.
@@ -603,9 +878,9 @@ func (p *Plugin) getBitBucketAccountIDToMattermostUsernameMapping(bitbucketAccou
 
 func (p *Plugin) HasUnreads(info *BitbucketUserInfo) bool {
 	ctx := context.Background()
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	bitbucketClient := p.bitbucketConnect(info)
 
-	userRepos, err := p.getUserRepositories(ctx, bitbucketClient)
+	userRepos, err := p.getUserRepositories(ctx, info, bitbucketClient)
 	if err != nil {
 		p.API.LogError("error occurred while searching for repositories", "err", err.Error())
 		return false
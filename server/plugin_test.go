@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wbrefvem/go-bitbucket"
+)
+
+func TestCheckRepository(t *testing.T) {
+	for name, tc := range map[string]struct {
+		Organizations      string
+		DeniedRepositories string
+		Owner              string
+		Repo               string
+		ExpectedError      string
+	}{
+		"no restriction": {
+			Owner: "acme",
+			Repo:  "app",
+		},
+		"single organization": {
+			Organizations: "acme",
+			Owner:         "other",
+			Repo:          "app",
+			ExpectedError: "only repositories in the acme organization are supported",
+		},
+		"allowed organization": {
+			Organizations: "acme, beta ,gamma",
+			Owner:         "beta",
+			Repo:          "app",
+		},
+		"organizations are case insensitive": {
+			Organizations: "MM",
+			Owner:         "mm",
+			Repo:          "app",
+		},
+		"organization not in the allow-list": {
+			Organizations: "acme, beta",
+			Owner:         "other",
+			ExpectedError: "only repositories in the acme, beta organizations are supported",
+		},
+		"denied repository": {
+			Organizations:      "acme, beta",
+			DeniedRepositories: "acme/secret, beta/other",
+			Owner:              "acme",
+			Repo:               "Secret",
+			ExpectedError:      "the acme/Secret repository is not supported",
+		},
+		"denied repository of another organization": {
+			DeniedRepositories: "acme/secret",
+			Owner:              "beta",
+			Repo:               "secret",
+		},
+		"organization with denied repositories": {
+			DeniedRepositories: "acme/secret",
+			Owner:              "acme",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := NewPlugin()
+			p.setConfiguration(&Configuration{BitbucketOrg: tc.Organizations, BitbucketDeniedRepos: tc.DeniedRepositories})
+
+			err := p.checkRepository(tc.Owner, tc.Repo)
+			if tc.ExpectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.ExpectedError)
+			}
+		})
+	}
+}
+
+func TestFilterRepositories(t *testing.T) {
+	p := NewPlugin()
+	p.setConfiguration(&Configuration{BitbucketOrg: "acme,beta", BitbucketDeniedRepos: "acme/secret"})
+
+	repos := p.filterRepositories([]bitbucket.Repository{
+		{FullName: "acme/app"},
+		{FullName: "acme/secret"},
+		{FullName: "beta/secret"},
+	})
+
+	assert.Equal(t, []bitbucket.Repository{{FullName: "acme/app"}, {FullName: "beta/secret"}}, repos)
+}
+
+func TestConfigurationDeniedRepositories(t *testing.T) {
+	config := &Configuration{
+		BitbucketOAuthClientID:     "id",
+		BitbucketOAuthClientSecret: "secret",
+		EncryptionKey:              "key",
+		WebhookSecret:              "secret",
+		BitbucketDeniedRepos:       "acme/secret, beta",
+	}
+
+	assert.EqualError(t, config.IsValid(), `the denied repository "beta" must be given as organization/repository`)
+
+	config.BitbucketDeniedRepos = "acme/secret, beta/other"
+	assert.NoError(t, config.IsValid())
+	assert.Equal(t, []string{"acme/secret", "beta/other"}, config.getDeniedRepositories())
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+)
+
+// The actions offered by the buttons of pull request notifications.
+const (
+	pullRequestActionApprove        = "approve"
+	pullRequestActionRequestChanges = "requestchanges"
+	pullRequestActionComment        = "comment"
+	pullRequestActionMerge          = "merge"
+)
+
+// pullRequestActionContext identifies the pull request a button or dialog acts on. It is the
+// context of the buttons and the state of the dialogs.
+type pullRequestActionContext struct {
+	Repository    string `json:"repository"`
+	PullRequestID int64  `json:"pull_request_id"`
+	PostID        string `json:"post_id,omitempty"`
+}
+
+func pullRequestActionURL(action string) string {
+	return fmt.Sprintf("/plugins/%s/api/v1/pr/%s", manifest.Id, action)
+}
+
+// pullRequestActionsAttachment returns the attachment with the buttons to act on the pull request.
+func pullRequestActionsAttachment(actions *webhook.PullRequestActions) *model.SlackAttachment {
+	button := func(id, name, action string) *model.PostAction {
+		return &model.PostAction{
+			Id:   id,
+			Name: name,
+			Type: model.PostActionTypeButton,
+			Integration: &model.PostActionIntegration{
+				URL: pullRequestActionURL(action),
+				Context: map[string]interface{}{
+					"repository":      actions.Repository,
+					"pull_request_id": strconv.FormatInt(actions.PullRequestID, 10),
+				},
+			},
+		}
+	}
+
+	return &model.SlackAttachment{
+		Actions: []*model.PostAction{
+			button("approve", "Approve", pullRequestActionApprove),
+			button("requestchanges", "Request changes", pullRequestActionRequestChanges),
+			button("comment", "Comment", pullRequestActionComment),
+			button("merge", "Merge", pullRequestActionMerge),
+		},
+	}
+}
+
+// parsePullRequestActionContext reads the pull request from the context of a button.
+func parsePullRequestActionContext(request *model.PostActionIntegrationRequest) (*pullRequestActionContext, error) {
+	repository, _ := request.Context["repository"].(string)
+	id, _ := request.Context["pull_request_id"].(string)
+
+	pullRequestID, err := strconv.ParseInt(id, 10, 64)
+	if repository == "" || err != nil {
+		return nil, errors.New("invalid pull request")
+	}
+
+	return &pullRequestActionContext{Repository: repository, PullRequestID: pullRequestID, PostID: request.PostId}, nil
+}
+
+// handlePullRequestAction handles the buttons of pull request notifications. Approving and
+// requesting changes happen right away, commenting and merging open a dialog first.
+func (p *Plugin) handlePullRequestAction(action string) HTTPHandlerFuncWithUser {
+	return func(w http.ResponseWriter, r *http.Request, userID string) {
+		request := &model.PostActionIntegrationRequest{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			p.writeAPIError(w, &APIErrorResponse{ID: "", Message: "Please provide a JSON object.", StatusCode: http.StatusBadRequest})
+			return
+		}
+
+		respond := func(text string) {
+			p.writeJSON(w, &model.PostActionIntegrationResponse{EphemeralText: text})
+		}
+
+		actionContext, err := parsePullRequestActionContext(request)
+		if err != nil {
+			respond(err.Error())
+			return
+		}
+
+		userInfo, apiErr := p.getBitbucketUserInfo(userID)
+		if apiErr != nil {
+			respond("You must connect your account to Bitbucket first. Enter `/bitbucket connect`.")
+			return
+		}
+
+		owner, repo := parseOwnerAndRepo(actionContext.Repository, p.getBaseURL())
+		ctx := context.Background()
+
+		var verb, done string
+		switch action {
+		case pullRequestActionApprove:
+			err = p.approvePullRequest(ctx, userInfo, owner, repo, actionContext.PullRequestID)
+			verb, done = "approve", "approved"
+		case pullRequestActionRequestChanges:
+			err = p.requestChangesOnPullRequest(ctx, userInfo, owner, repo, actionContext.PullRequestID)
+			verb, done = "request changes on", "requested changes"
+		case pullRequestActionComment, pullRequestActionMerge:
+			if err = p.openPullRequestActionDialog(action, request.TriggerId, actionContext); err != nil {
+				p.API.LogWarn("Failed to open dialog", "action", action, "err", err.Error())
+				respond("Failed to open the dialog.")
+				return
+			}
+			respond("")
+			return
+		default:
+			respond("Unknown action.")
+			return
+		}
+
+		if err != nil {
+			p.API.LogWarn("Failed to act on pull request", "action", action, "repository", actionContext.Repository, "pull_request", actionContext.PullRequestID, "err", err.Error())
+			respond(pullRequestActionFailureMessage(verb, owner, repo, actionContext.PullRequestID, userInfo.BitbucketUsername, err))
+			return
+		}
+
+		p.recordPullRequestAction(actionContext, userID, done, false)
+		respond("")
+	}
+}
+
+func (p *Plugin) openPullRequestActionDialog(action, triggerID string, actionContext *pullRequestActionContext) error {
+	state, err := json.Marshal(actionContext)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal dialog state")
+	}
+
+	reference := fmt.Sprintf("%s#%d", actionContext.Repository, actionContext.PullRequestID)
+	dialog := model.Dialog{
+		CallbackId: action,
+		State:      string(state),
+	}
+
+	switch action {
+	case pullRequestActionComment:
+		dialog.Title = "Comment on pull request"
+		dialog.IntroductionText = "Comment on " + reference + "."
+		dialog.SubmitLabel = "Comment"
+		dialog.Elements = []model.DialogElement{{
+			DisplayName: "Comment",
+			Name:        "comment",
+			Type:        "textarea",
+			MaxLength:   10000,
+		}}
+	case pullRequestActionMerge:
+		dialog.Title = "Merge pull request"
+		dialog.IntroductionText = "Merge " + reference + "."
+		dialog.SubmitLabel = "Merge"
+		dialog.Elements = []model.DialogElement{{
+			DisplayName: "Merge strategy",
+			Name:        "strategy",
+			Type:        "select",
+			Optional:    true,
+			HelpText:    "Leave empty for the default strategy of the repository.",
+			Options: []*model.PostActionOptions{
+				{Text: "Merge commit", Value: MergeStrategyMergeCommit},
+				{Text: "Squash", Value: MergeStrategySquash},
+				{Text: "Fast forward", Value: MergeStrategyFastForward},
+			},
+		}}
+		if !p.isDataCenter() {
+			dialog.Elements = append(dialog.Elements, model.DialogElement{
+				DisplayName: "Close source branch",
+				Name:        "close_branch",
+				Type:        "bool",
+				Optional:    true,
+				Placeholder: "Delete the source branch after merging",
+			})
+		}
+	}
+
+	if appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: triggerID,
+		URL:       pullRequestActionURL(action + "/submit"),
+		Dialog:    dialog,
+	}); appErr != nil {
+		return errors.Wrap(appErr, "failed to open interactive dialog")
+	}
+
+	return nil
+}
+
+// handlePullRequestActionDialog handles the submission of the comment and merge dialogs.
+func (p *Plugin) handlePullRequestActionDialog(action string) HTTPHandlerFuncWithUser {
+	return func(w http.ResponseWriter, r *http.Request, userID string) {
+		request := p.decodeDialogSubmission(w, r, userID)
+		if request == nil || request.Cancelled {
+			return
+		}
+
+		respond := func(text string) {
+			p.writeJSON(w, &model.SubmitDialogResponse{Error: text})
+		}
+
+		actionContext := &pullRequestActionContext{}
+		if err := json.Unmarshal([]byte(request.State), actionContext); err != nil || actionContext.Repository == "" {
+			respond("Invalid pull request.")
+			return
+		}
+
+		userInfo, apiErr := p.getBitbucketUserInfo(userID)
+		if apiErr != nil {
+			respond("You must connect your account to Bitbucket first. Enter `/bitbucket connect`.")
+			return
+		}
+
+		owner, repo := parseOwnerAndRepo(actionContext.Repository, p.getBaseURL())
+		ctx := context.Background()
+
+		var err error
+		var done string
+		switch action {
+		case pullRequestActionComment:
+			comment, _ := request.Submission["comment"].(string)
+			if strings.TrimSpace(comment) == "" {
+				p.writeJSON(w, &model.SubmitDialogResponse{Errors: map[string]string{"comment": "Please enter a comment."}})
+				return
+			}
+			_, err = p.createPullRequestComment(ctx, userInfo, owner, repo, actionContext.PullRequestID, newPullRequestComment{Text: comment})
+			done = "commented"
+		case pullRequestActionMerge:
+			strategy, _ := request.Submission["strategy"].(string)
+			closeBranch, _ := request.Submission["close_branch"].(bool)
+			err = p.mergePullRequest(ctx, userInfo, owner, repo, actionContext.PullRequestID, strategy, closeBranch)
+			done = "merged"
+		default:
+			respond("Unknown action.")
+			return
+		}
+
+		if err != nil {
+			p.API.LogWarn("Failed to act on pull request", "action", action, "repository", actionContext.Repository, "pull_request", actionContext.PullRequestID, "err", err.Error())
+			verb := action
+			if action == pullRequestActionComment {
+				verb = "comment on"
+			}
+			respond(pullRequestActionFailureMessage(verb, owner, repo, actionContext.PullRequestID, userInfo.BitbucketUsername, err))
+			return
+		}
+
+		p.recordPullRequestAction(actionContext, userID, done, action == pullRequestActionMerge)
+	}
+}
+
+// recordPullRequestAction updates the notification the user acted on to show who did what.
+// Once the pull request is merged, the buttons are removed. The post ID of dialogs comes back
+// from the client, so only a notification with the buttons for this pull request, in a channel
+// the user can read, is updated.
+func (p *Plugin) recordPullRequestAction(actionContext *pullRequestActionContext, userID, done string, removeActions bool) {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get user", "user_id", userID, "err", appErr.Error())
+		return
+	}
+
+	post, appErr := p.API.GetPost(actionContext.PostID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get post", "post_id", actionContext.PostID, "err", appErr.Error())
+		return
+	}
+	if post.UserId != p.BotUserID {
+		return
+	}
+	if !p.API.HasPermissionToChannel(userID, post.ChannelId, model.PermissionReadChannel) {
+		return
+	}
+
+	post = post.Clone()
+	attachments := post.Attachments()
+	attachment := findPullRequestActionsAttachment(attachments, actionContext)
+	if attachment == nil {
+		return
+	}
+
+	line := fmt.Sprintf("_@%s %s_", user.Username, done)
+	if attachment.Text == "" {
+		attachment.Text = line
+	} else {
+		attachment.Text += "\n" + line
+	}
+	if removeActions {
+		attachment.Actions = nil
+	}
+
+	model.ParseSlackAttachment(post, attachments)
+	if _, appErr = p.API.UpdatePost(post); appErr != nil {
+		p.API.LogWarn("Failed to update post", "post_id", actionContext.PostID, "err", appErr.Error())
+	}
+}
+
+// findPullRequestActionsAttachment returns the attachment with the buttons to act on the pull
+// request of actionContext, or nil if there is none.
+func findPullRequestActionsAttachment(attachments []*model.SlackAttachment, actionContext *pullRequestActionContext) *model.SlackAttachment {
+	prefix := pullRequestActionURL("")
+	for _, attachment := range attachments {
+		for _, action := range attachment.Actions {
+			if action.Integration == nil || !strings.HasPrefix(action.Integration.URL, prefix) {
+				continue
+			}
+
+			buttonContext, err := parsePullRequestActionContext(&model.PostActionIntegrationRequest{Context: action.Integration.Context})
+			if err == nil && buttonContext.Repository == actionContext.Repository && buttonContext.PullRequestID == actionContext.PullRequestID {
+				return attachment
+			}
+		}
+	}
+
+	return nil
+}
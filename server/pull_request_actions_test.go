@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+)
+
+func TestPullRequestActionsAttachment(t *testing.T) {
+	attachment := pullRequestActionsAttachment(&webhook.PullRequestActions{Repository: "owner/repo", PullRequestID: 12})
+
+	require.Len(t, attachment.Actions, 4)
+	approve := attachment.Actions[0]
+	assert.Equal(t, "/plugins/bitbucket/api/v1/pr/approve", approve.Integration.URL)
+
+	actionContext, err := parsePullRequestActionContext(&model.PostActionIntegrationRequest{PostId: "post", Context: approve.Integration.Context})
+	require.NoError(t, err)
+	assert.Equal(t, &pullRequestActionContext{Repository: "owner/repo", PullRequestID: 12, PostID: "post"}, actionContext)
+
+	_, err = parsePullRequestActionContext(&model.PostActionIntegrationRequest{Context: map[string]interface{}{"repository": "owner/repo"}})
+	assert.Error(t, err)
+}
+
+func TestRecordPullRequestAction(t *testing.T) {
+	actionContext := &pullRequestActionContext{Repository: "owner/repo", PullRequestID: 12, PostID: "post"}
+	newPost := func() *model.Post {
+		post := &model.Post{Id: "post", UserId: "bot", ChannelId: "channel", Message: "PR created"}
+		model.ParseSlackAttachment(post, []*model.SlackAttachment{pullRequestActionsAttachment(&webhook.PullRequestActions{Repository: "owner/repo", PullRequestID: 12})})
+		return post
+	}
+
+	t.Run("the action is shown below the buttons", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("GetUser", "user").Return(&model.User{Username: "alice"}, nil)
+		api.On("GetPost", "post").Return(newPost(), nil)
+		api.On("HasPermissionToChannel", "user", "channel", model.PermissionReadChannel).Return(true)
+		api.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+			attachments := post.Attachments()
+			return len(attachments) == 1 && attachments[0].Text == "_@alice approved_" && len(attachments[0].Actions) == 4
+		})).Return(nil, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.BotUserID = "bot"
+
+		p.recordPullRequestAction(actionContext, "user", "approved", false)
+
+		api.AssertExpectations(t)
+	})
+
+	t.Run("merging removes the buttons", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("GetUser", "user").Return(&model.User{Username: "alice"}, nil)
+		api.On("GetPost", "post").Return(newPost(), nil)
+		api.On("HasPermissionToChannel", "user", "channel", model.PermissionReadChannel).Return(true)
+		api.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+			attachments := post.Attachments()
+			return len(attachments) == 1 && attachments[0].Text == "_@alice merged_" && len(attachments[0].Actions) == 0
+		})).Return(nil, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.BotUserID = "bot"
+
+		p.recordPullRequestAction(actionContext, "user", "merged", true)
+
+		api.AssertExpectations(t)
+	})
+
+	t.Run("posts of other users are left alone", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("GetUser", "user").Return(&model.User{Username: "alice"}, nil)
+		api.On("GetPost", "post").Return(&model.Post{Id: "post", UserId: "someone"}, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.BotUserID = "bot"
+
+		p.recordPullRequestAction(actionContext, "user", "approved", false)
+
+		api.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	})
+	t.Run("posts in channels the user can't read are left alone", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("GetUser", "user").Return(&model.User{Username: "alice"}, nil)
+		api.On("GetPost", "post").Return(newPost(), nil)
+		api.On("HasPermissionToChannel", "user", "channel", model.PermissionReadChannel).Return(false)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.BotUserID = "bot"
+
+		p.recordPullRequestAction(actionContext, "user", "merged", true)
+
+		api.AssertNotCalled(t, "UpdatePost", mock.Anything)
+	})
+
+	t.Run("posts without the buttons of the pull request are left alone", func(t *testing.T) {
+		for name, post := range map[string]*model.Post{
+			"other pull request": func() *model.Post {
+				post := &model.Post{Id: "post", UserId: "bot", ChannelId: "channel"}
+				model.ParseSlackAttachment(post, []*model.SlackAttachment{pullRequestActionsAttachment(&webhook.PullRequestActions{Repository: "owner/repo", PullRequestID: 13})})
+				return post
+			}(),
+			"no buttons": {Id: "post", UserId: "bot", ChannelId: "channel", Message: "Welcome"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				api := &plugintest.API{}
+				api.On("GetUser", "user").Return(&model.User{Username: "alice"}, nil)
+				api.On("GetPost", "post").Return(post, nil)
+				api.On("HasPermissionToChannel", "user", "channel", model.PermissionReadChannel).Return(true)
+
+				p := NewPlugin()
+				p.SetAPI(api)
+				p.BotUserID = "bot"
+
+				p.recordPullRequestAction(actionContext, "user", "approved", false)
+
+				api.AssertNotCalled(t, "UpdatePost", mock.Anything)
+			})
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+const (
+	// KeyPullRequestCard is the prefix of the keys storing the post ID of a pull request card in a channel.
+	KeyPullRequestCard = "pr_card_"
+
+	// pullRequestCardExpirySeconds limits how long later events update a card instead of creating a new one.
+	pullRequestCardExpirySeconds = 90 * 24 * 60 * 60
+
+	BitbucketPullRequestCardPostType = "custom_bb_pr_card"
+)
+
+type pullRequestProvider struct {
+	p *Plugin
+}
+
+// GetOpenPullRequests looks up the open pull requests from the branch, using the token of a user
+// subscribed to the repository. Failures are logged. Only Bitbucket Cloud is supported.
+func (pr *pullRequestProvider) GetOpenPullRequests(repository, branch string) []webhookpayload.PullRequest {
+	p := pr.p
+	if p.isDataCenter() {
+		return nil
+	}
+
+	client := p.getRepositorySubscriberClient(repository)
+	if client == nil {
+		return nil
+	}
+
+	pullRequests, err := getOpenPullRequestsFromBranch(context.Background(), client, repository, branch)
+	if err != nil {
+		p.API.LogWarn("Failed to get pull requests of branch", "repository", repository, "branch", branch, "err", err.Error())
+		return nil
+	}
+
+	return pullRequests
+}
+
+// combineBuildStatuses returns FAILED if any build failed, else INPROGRESS if any is still
+// running, else STOPPED if any was stopped, and SUCCESSFUL if all succeeded.
+func combineBuildStatuses(statuses []webhookpayload.CommitStatus) string {
+	if len(statuses) == 0 {
+		return ""
+	}
+
+	rank := map[string]int{
+		webhookpayload.CommitStatusSuccessful: 0,
+		webhookpayload.CommitStatusStopped:    1,
+		webhookpayload.CommitStatusInProgress: 2,
+		webhookpayload.CommitStatusFailed:     3,
+	}
+
+	status := webhookpayload.CommitStatusSuccessful
+	for _, s := range statuses {
+		if rank[s.State] > rank[status] {
+			status = s.State
+		}
+	}
+
+	return status
+}
+
+// getRepositorySubscriberClient returns an HTTP client authenticated as a user subscribed to the repository.
+func (p *Plugin) getRepositorySubscriberClient(repository string) *http.Client {
+	subscriber := p.getRepositorySubscriber(repository)
+	if subscriber == nil {
+		return nil
+	}
+
+	return p.userHTTPClient(subscriber)
+}
+
+func pullRequestCardKey(channelID, key string) string {
+	hash := sha256.Sum256([]byte(channelID + "/" + key))
+	return KeyPullRequestCard + hex.EncodeToString(hash[:])
+}
+
+// upsertPullRequestCard updates the card of the pull request in the channel of the post, or
+// creates it if there is none yet or it was deleted.
+func (p *Plugin) upsertPullRequestCard(post *model.Post, card *webhook.Card) error {
+	post.Type = BitbucketPullRequestCardPostType
+	for key, value := range card.Props {
+		post.AddProp(key, value)
+	}
+
+	key := pullRequestCardKey(post.ChannelId, card.Key)
+	postID, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to get pull request card")
+	}
+
+	if postID != nil {
+		existing, appErr := p.API.GetPost(string(postID))
+		if appErr != nil && appErr.StatusCode != http.StatusNotFound {
+			return errors.Wrap(appErr, "failed to get pull request card post")
+		}
+		if existing != nil && existing.DeleteAt == 0 {
+			updated := existing.Clone()
+			updated.Message = post.Message
+			updated.Type = post.Type
+			updated.SetProps(post.GetProps())
+			if _, appErr = p.API.UpdatePost(updated); appErr != nil {
+				return errors.Wrap(appErr, "failed to update pull request card post")
+			}
+			return nil
+		}
+	}
+
+	created, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to create pull request card post")
+	}
+
+	// Another delivery may have created the card concurrently. Keep the stored one and drop ours.
+	stored, appErr := p.API.KVSetWithOptions(key, []byte(created.Id), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        postID,
+		ExpireInSeconds: pullRequestCardExpirySeconds,
+	})
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store pull request card")
+	}
+	if !stored {
+		if appErr = p.API.DeletePost(created.Id); appErr != nil {
+			p.API.LogWarn("Failed to delete duplicate pull request card", "post_id", created.Id, "err", appErr.Error())
+		}
+	}
+
+	return nil
+}
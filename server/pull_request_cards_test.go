@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func TestUpsertPullRequestCard(t *testing.T) {
+	card := &webhook.Card{Key: "pr/owner/repo/1", Props: map[string]interface{}{"state": "MERGED"}}
+	key := pullRequestCardKey("channel", card.Key)
+
+	t.Run("first event creates the card", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return(nil, nil)
+		api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.Type == BitbucketPullRequestCardPostType && post.GetProp("state") == "MERGED"
+		})).Return(&model.Post{Id: "card"}, nil)
+		api.On("KVSetWithOptions", key, []byte("card"), model.PluginKVSetOptions{
+			Atomic:          true,
+			ExpireInSeconds: pullRequestCardExpirySeconds,
+		}).Return(true, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		err := p.upsertPullRequestCard(&model.Post{ChannelId: "channel", Message: "merged"}, card)
+
+		require.NoError(t, err)
+		api.AssertExpectations(t)
+	})
+
+	t.Run("later events update the card", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return([]byte("card"), nil)
+		api.On("GetPost", "card").Return(&model.Post{Id: "card", Message: "open"}, nil)
+		api.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.Id == "card" && post.Message == "merged" && post.GetProp("state") == "MERGED"
+		})).Return(&model.Post{Id: "card"}, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		err := p.upsertPullRequestCard(&model.Post{ChannelId: "channel", Message: "merged"}, card)
+
+		require.NoError(t, err)
+		api.AssertExpectations(t)
+		api.AssertNotCalled(t, "CreatePost", mock.Anything)
+	})
+
+	t.Run("deleted card is created again", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return([]byte("card"), nil)
+		api.On("GetPost", "card").Return(nil, &model.AppError{StatusCode: http.StatusNotFound})
+		api.On("CreatePost", mock.Anything).Return(&model.Post{Id: "new"}, nil)
+		api.On("KVSetWithOptions", key, []byte("new"), model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        []byte("card"),
+			ExpireInSeconds: pullRequestCardExpirySeconds,
+		}).Return(true, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		err := p.upsertPullRequestCard(&model.Post{ChannelId: "channel", Message: "merged"}, card)
+
+		require.NoError(t, err)
+		api.AssertExpectations(t)
+	})
+
+	t.Run("card created concurrently is kept", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return(nil, nil)
+		api.On("CreatePost", mock.Anything).Return(&model.Post{Id: "duplicate"}, nil)
+		api.On("KVSetWithOptions", key, []byte("duplicate"), mock.Anything).Return(false, nil)
+		api.On("DeletePost", "duplicate").Return(nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		err := p.upsertPullRequestCard(&model.Post{ChannelId: "channel", Message: "merged"}, card)
+
+		require.NoError(t, err)
+		api.AssertExpectations(t)
+	})
+}
+
+func TestCombineBuildStatuses(t *testing.T) {
+	statuses := func(states ...string) []webhookpayload.CommitStatus {
+		var res []webhookpayload.CommitStatus
+		for _, state := range states {
+			res = append(res, webhookpayload.CommitStatus{State: state})
+		}
+		return res
+	}
+
+	assert.Equal(t, "", combineBuildStatuses(nil))
+	assert.Equal(t, "SUCCESSFUL", combineBuildStatuses(statuses("SUCCESSFUL", "SUCCESSFUL")))
+	assert.Equal(t, "INPROGRESS", combineBuildStatuses(statuses("SUCCESSFUL", "INPROGRESS", "STOPPED")))
+	assert.Equal(t, "FAILED", combineBuildStatuses(statuses("INPROGRESS", "FAILED", "SUCCESSFUL")))
+}
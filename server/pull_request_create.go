@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const pullRequestActionCreate = "create"
+
+// pullRequestTemplatePaths are the files looked up in the target branch to prefill the description
+// of new pull requests, in order.
+var pullRequestTemplatePaths = []string{
+	"PULL_REQUEST_TEMPLATE.md",
+	".bitbucket/PULL_REQUEST_TEMPLATE.md",
+	"docs/PULL_REQUEST_TEMPLATE.md",
+}
+
+// newPullRequest is a pull request to open. The target branch defaults to the main branch of the
+// repository.
+type newPullRequest struct {
+	Title               string
+	Description         string
+	SourceBranch        string
+	TargetBranch        string
+	AddDefaultReviewers bool
+}
+
+// createdPullRequest identifies a pull request opened from Mattermost.
+type createdPullRequest struct {
+	ID  int64
+	URL string
+}
+
+// createPullRequestDialogState is the state of the dialog to create a pull request. The repository
+// is empty if it is chosen in the dialog.
+type createPullRequestDialogState struct {
+	Repository string `json:"repository"`
+	RootID     string `json:"root_id"`
+}
+
+// getMainBranch returns the name of the main branch of a repository.
+func (p *Plugin) getMainBranch(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string) (string, error) {
+	if p.isDataCenter() {
+		return p.dataCenterConnect(userInfo).GetDefaultBranch(ctx, owner, repo)
+	}
+
+	repository, httpResponse, err := p.bitbucketConnect(userInfo).RepositoriesApi.RepositoriesUsernameRepoSlugGet(ctx, owner, repo)
+	closeResponse(httpResponse)
+	if err != nil {
+		return "", toPullRequestActionError(httpResponse, err)
+	}
+	if repository.Mainbranch == nil {
+		return "", errors.Errorf("repository %s/%s has no main branch", owner, repo)
+	}
+
+	return repository.Mainbranch.Name, nil
+}
+
+// getBranches returns the names of the most recently updated branches of a repository.
+func (p *Plugin) getBranches(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string) ([]string, error) {
+	if p.isDataCenter() {
+		return p.dataCenterConnect(userInfo).ListBranches(ctx, owner, repo)
+	}
+
+	var branches struct {
+		Values []struct {
+			Name string `json:"name"`
+		} `json:"values"`
+	}
+	urlToGet := fmt.Sprintf("%s/repositories/%s/%s/refs/branches?pagelen=100&sort=-target.date&fields=values.name", getBaseURL(), owner, repo)
+	if err := p.doCloudRequest(ctx, userInfo, http.MethodGet, urlToGet, nil, &branches); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(branches.Values))
+	for _, branch := range branches.Values {
+		names = append(names, branch.Name)
+	}
+
+	return names, nil
+}
+
+// getPullRequestTemplate returns the content of the first pull request template found in the
+// branch, or an empty string if there is none.
+func (p *Plugin) getPullRequestTemplate(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo, branch string) string {
+	for _, path := range pullRequestTemplatePaths {
+		var content string
+		var err error
+		if p.isDataCenter() {
+			content, err = p.dataCenterConnect(userInfo).GetFileContent(ctx, owner, repo, path, branch)
+		} else {
+			urlToGet := fmt.Sprintf("%s/repositories/%s/%s/src/%s/%s", getBaseURL(), owner, repo, url.PathEscape(branch), path)
+			err = p.doCloudRequest(ctx, userInfo, http.MethodGet, urlToGet, nil, &content)
+		}
+		if err == nil {
+			return content
+		}
+		p.API.LogDebug("No pull request template found", "repository", owner+"/"+repo, "path", path, "err", err.Error())
+	}
+
+	return ""
+}
+
+// getDefaultReviewers returns the default reviewers of pull requests between two branches, other
+// than the user: account UUIDs on Bitbucket Cloud and user names on Bitbucket Data Center.
+func (p *Plugin) getDefaultReviewers(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo, sourceBranch, targetBranch string) ([]string, error) {
+	if p.isDataCenter() {
+		names, err := p.dataCenterConnect(userInfo).GetDefaultReviewers(ctx, owner, repo, sourceBranch, targetBranch)
+		if err != nil {
+			return nil, err
+		}
+
+		reviewers := make([]string, 0, len(names))
+		for _, name := range names {
+			if name != userInfo.BitbucketUsername {
+				reviewers = append(reviewers, name)
+			}
+		}
+		return reviewers, nil
+	}
+
+	var defaultReviewers struct {
+		Values []struct {
+			UUID      string `json:"uuid"`
+			AccountID string `json:"account_id"`
+		} `json:"values"`
+	}
+	urlToGet := fmt.Sprintf("%s/repositories/%s/%s/default-reviewers?pagelen=100", getBaseURL(), owner, repo)
+	if err := p.doCloudRequest(ctx, userInfo, http.MethodGet, urlToGet, nil, &defaultReviewers); err != nil {
+		return nil, err
+	}
+
+	reviewers := make([]string, 0, len(defaultReviewers.Values))
+	for _, reviewer := range defaultReviewers.Values {
+		if reviewer.AccountID != userInfo.BitbucketAccountID {
+			reviewers = append(reviewers, reviewer.UUID)
+		}
+	}
+
+	return reviewers, nil
+}
+
+// createPullRequest opens a pull request as the user.
+func (p *Plugin) createPullRequest(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, pr newPullRequest) (*createdPullRequest, error) {
+	if pr.TargetBranch == "" {
+		mainBranch, err := p.getMainBranch(ctx, userInfo, owner, repo)
+		if err != nil {
+			return nil, toPullRequestActionError(nil, err)
+		}
+		pr.TargetBranch = mainBranch
+	}
+
+	var reviewers []string
+	if pr.AddDefaultReviewers {
+		var err error
+		reviewers, err = p.getDefaultReviewers(ctx, userInfo, owner, repo, pr.SourceBranch, pr.TargetBranch)
+		if err != nil {
+			// The pull request is more useful without reviewers than not opened at all
+			p.API.LogWarn("Failed to get default reviewers", "repository", owner+"/"+repo, "err", err.Error())
+		}
+	}
+
+	if p.isDataCenter() {
+		created, err := p.dataCenterConnect(userInfo).CreatePullRequest(ctx, owner, repo, pr.Title, pr.Description, pr.SourceBranch, pr.TargetBranch, reviewers)
+		if err != nil {
+			return nil, toPullRequestActionError(nil, err)
+		}
+		return &createdPullRequest{ID: int64(created.Id), URL: created.Links.Html.Href}, nil
+	}
+
+	reviewerList := make([]map[string]string, 0, len(reviewers))
+	for _, uuid := range reviewers {
+		reviewerList = append(reviewerList, map[string]string{"uuid": uuid})
+	}
+	body := map[string]interface{}{
+		"title":       pr.Title,
+		"description": pr.Description,
+		"source":      map[string]interface{}{"branch": map[string]string{"name": pr.SourceBranch}},
+		"destination": map[string]interface{}{"branch": map[string]string{"name": pr.TargetBranch}},
+		"reviewers":   reviewerList,
+	}
+
+	var created struct {
+		ID    int64 `json:"id"`
+		Links struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	}
+	// go-bitbucket can't set the description of pull requests, so the endpoint is called directly
+	urlToPost := fmt.Sprintf("%s/repositories/%s/%s/pullrequests", getBaseURL(), owner, repo)
+	if err := p.doCloudRequest(ctx, userInfo, http.MethodPost, urlToPost, body, &created); err != nil {
+		return nil, err
+	}
+
+	return &createdPullRequest{ID: created.ID, URL: created.Links.HTML.Href}, nil
+}
+
+// postCreatedPullRequest posts a link to a pull request opened from Mattermost as the user.
+func (p *Plugin) postCreatedPullRequest(userID, channelID, rootID, owner, repo, title string, pr *createdPullRequest) error {
+	post := &model.Post{
+		UserId:    userID,
+		ChannelId: channelID,
+		RootId:    rootID,
+		Message:   fmt.Sprintf("Created pull request [%s/%s#%d](%s): %s", owner, repo, pr.ID, pr.URL, title),
+	}
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		return errors.Wrap(appErr, "failed to post the created pull request")
+	}
+
+	return nil
+}
+
+// openCreatePullRequestDialog opens the dialog to create a pull request. When the repository is
+// known, its branches are listed and the description is prefilled from its pull request template.
+// Otherwise, the repository is chosen among the ones of the user.
+func (p *Plugin) openCreatePullRequestDialog(triggerID, rootID string, userInfo *BitbucketUserInfo, owner, repo, sourceBranch, targetBranch, title string) error {
+	ctx := context.Background()
+	state := createPullRequestDialogState{RootID: rootID}
+
+	sourceElement := model.DialogElement{DisplayName: "Source branch", Name: "source_branch", Type: "text", Default: sourceBranch}
+	targetElement := model.DialogElement{
+		DisplayName: "Target branch",
+		Name:        "target_branch",
+		Type:        "text",
+		Default:     targetBranch,
+		Optional:    true,
+		HelpText:    "Leave empty for the main branch of the repository.",
+	}
+	descriptionElement := model.DialogElement{
+		DisplayName: "Description",
+		Name:        "description",
+		Type:        "textarea",
+		Optional:    true,
+		MaxLength:   10000,
+	}
+
+	var elements []model.DialogElement
+	if repo == "" {
+		repositories, err := p.getUserRepositories(ctx, userInfo, p.bitbucketConnect(userInfo))
+		if err != nil {
+			return err
+		}
+
+		repositoryElement := model.DialogElement{DisplayName: "Repository", Name: "repository", Type: "select"}
+		for _, repository := range repositories {
+			repositoryElement.Options = append(repositoryElement.Options, &model.PostActionOptions{Text: repository.FullName, Value: repository.FullName})
+		}
+		descriptionElement.HelpText = "Leave empty to use the pull request template of the repository, if any."
+		elements = append(elements, repositoryElement)
+	} else {
+		state.Repository = owner + "/" + repo
+
+		mainBranch, err := p.getMainBranch(ctx, userInfo, owner, repo)
+		if err != nil {
+			return err
+		}
+		branches, err := p.getBranches(ctx, userInfo, owner, repo)
+		if err != nil {
+			return err
+		}
+
+		if targetBranch == "" {
+			targetBranch = mainBranch
+		}
+		sourceElement.Type = "select"
+		sourceElement.Options = branchOptions(branches, sourceBranch)
+		targetElement.Type = "select"
+		targetElement.Default = targetBranch
+		targetElement.Optional = false
+		targetElement.HelpText = ""
+		targetElement.Options = branchOptions(branches, targetBranch)
+		descriptionElement.Default = p.getPullRequestTemplate(ctx, userInfo, owner, repo, targetBranch)
+	}
+
+	elements = append(elements,
+		sourceElement,
+		targetElement,
+		model.DialogElement{DisplayName: "Title", Name: "title", Type: "text", Default: title, MaxLength: 255},
+		descriptionElement,
+		model.DialogElement{
+			DisplayName: "Default reviewers",
+			Name:        "default_reviewers",
+			Type:        "bool",
+			Default:     "true",
+			Optional:    true,
+			Placeholder: "Add the default reviewers of the repository",
+		},
+	)
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal dialog state")
+	}
+
+	if appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: triggerID,
+		URL:       pullRequestActionURL(pullRequestActionCreate + "/submit"),
+		Dialog: model.Dialog{
+			CallbackId:  pullRequestActionCreate,
+			Title:       "Create pull request",
+			SubmitLabel: "Create",
+			State:       string(stateJSON),
+			Elements:    elements,
+		},
+	}); appErr != nil {
+		return errors.Wrap(appErr, "failed to open interactive dialog")
+	}
+
+	return nil
+}
+
+// branchOptions returns the dialog options for the branches, including the selected branch even
+// if it is not among the listed ones.
+func branchOptions(branches []string, selected string) []*model.PostActionOptions {
+	if selected != "" && !slices.Contains(branches, selected) {
+		branches = append([]string{selected}, branches...)
+	}
+
+	options := make([]*model.PostActionOptions, 0, len(branches))
+	for _, branch := range branches {
+		options = append(options, &model.PostActionOptions{Text: branch, Value: branch})
+	}
+
+	return options
+}
+
+// handleCreatePullRequestDialog creates the pull request submitted from the dialog.
+func (p *Plugin) handleCreatePullRequestDialog(w http.ResponseWriter, r *http.Request, userID string) {
+	request := p.decodeDialogSubmission(w, r, userID)
+	if request == nil {
+		return
+	}
+
+	var state createPullRequestDialogState
+	if err := json.Unmarshal([]byte(request.State), &state); err != nil {
+		p.writeAPIError(w, &APIErrorResponse{Message: "Invalid dialog state.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	submission := func(name string) string {
+		value, _ := request.Submission[name].(string)
+		return strings.TrimSpace(value)
+	}
+
+	repository := state.Repository
+	if repository == "" {
+		repository = submission("repository")
+	}
+	owner, repo := parseOwnerAndRepo(repository, p.getBaseURL())
+	if owner == "" || repo == "" {
+		p.writeJSON(w, &model.SubmitDialogResponse{Errors: map[string]string{"repository": "Please choose a repository."}})
+		return
+	}
+	if err := p.checkRepository(owner, repo); err != nil {
+		p.writeJSON(w, &model.SubmitDialogResponse{Error: err.Error()})
+		return
+	}
+
+	addDefaultReviewers, _ := request.Submission["default_reviewers"].(bool)
+	pr := newPullRequest{
+		Title:               submission("title"),
+		Description:         submission("description"),
+		SourceBranch:        submission("source_branch"),
+		TargetBranch:        submission("target_branch"),
+		AddDefaultReviewers: addDefaultReviewers,
+	}
+
+	errs := map[string]string{}
+	if pr.SourceBranch == "" {
+		errs["source_branch"] = "Please enter the branch to merge."
+	}
+	if pr.Title == "" {
+		errs["title"] = "Please enter a title."
+	}
+	if pr.SourceBranch != "" && pr.SourceBranch == pr.TargetBranch {
+		errs["target_branch"] = "The target branch must differ from the source branch."
+	}
+	if len(errs) > 0 {
+		p.writeJSON(w, &model.SubmitDialogResponse{Errors: errs})
+		return
+	}
+
+	info, apiErr := p.getBitbucketUserInfo(userID)
+	if apiErr != nil {
+		p.writeJSON(w, &model.SubmitDialogResponse{Error: apiErr.Message})
+		return
+	}
+
+	ctx := context.Background()
+	if state.Repository == "" && pr.Description == "" {
+		targetBranch := pr.TargetBranch
+		if targetBranch == "" {
+			if mainBranch, err := p.getMainBranch(ctx, info, owner, repo); err == nil {
+				targetBranch = mainBranch
+			}
+		}
+		if targetBranch != "" {
+			pr.Description = p.getPullRequestTemplate(ctx, info, owner, repo, targetBranch)
+		}
+	}
+
+	created, err := p.createPullRequest(ctx, info, owner, repo, pr)
+	if err != nil {
+		p.API.LogWarn("Failed to create pull request", "repository", repository, "err", err.Error())
+		p.writeJSON(w, &model.SubmitDialogResponse{Error: createPullRequestFailureMessage(owner, repo, info.BitbucketUsername, err)})
+		return
+	}
+
+	if err := p.postCreatedPullRequest(userID, request.ChannelId, state.RootID, owner, repo, pr.Title, created); err != nil {
+		p.API.LogWarn("Failed to post the created pull request", "err", err.Error())
+	}
+
+	p.writeJSON(w, &model.SubmitDialogResponse{})
+}
+
+// createPullRequestFailureMessage explains to the user why a pull request couldn't be created.
+func createPullRequestFailureMessage(owner, repo, username string, err error) string {
+	var actionErr *pullRequestActionError
+	if !errors.As(err, &actionErr) {
+		return fmt.Sprintf("Failed to create a pull request in %s/%s: %s.", owner, repo, err.Error())
+	}
+
+	reason := getFailReason(actionErr.StatusCode, repo, username)
+	if actionErr.Message != "" {
+		reason += ": " + actionErr.Message
+	}
+
+	return fmt.Sprintf("Failed to create a pull request in %s/%s. %s", owner, repo, reason)
+}
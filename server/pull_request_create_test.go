@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+)
+
+func TestCreatePullRequestOnDataCenter(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects/MM/repos/repo/default-branch":
+			_, _ = w.Write([]byte(`{"id": "refs/heads/main", "displayId": "main"}`))
+		case "/rest/api/1.0/projects/MM/repos/repo":
+			_, _ = w.Write([]byte(`{"id": 12, "slug": "repo"}`))
+		case "/rest/default-reviewers/1.0/projects/MM/repos/repo/reviewers":
+			assert.Equal(t, "refs/heads/feature", r.URL.Query().Get("sourceRefId"))
+			assert.Equal(t, "refs/heads/main", r.URL.Query().Get("targetRefId"))
+			_, _ = w.Write([]byte(`[{"name": "alice"}, {"name": "bob"}]`))
+		case "/rest/api/1.0/projects/MM/repos/repo/pull-requests":
+			require.Equal(t, http.MethodPost, r.Method)
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			_, _ = w.Write([]byte(`{"id": 5, "links": {"self": [{"href": "https://bitbucket.example.com/projects/MM/repos/repo/pull-requests/5/overview"}]}}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	api := &plugintest.API{}
+	siteURL := "https://mattermost.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}}).Maybe()
+	p := NewPlugin()
+	p.SetAPI(api)
+	p.setConfiguration(&Configuration{BitbucketSelfHostedURL: server.URL})
+
+	userInfo := &BitbucketUserInfo{Token: &oauth2.Token{AccessToken: "token"}, BitbucketUsername: "alice"}
+	created, err := p.createPullRequest(context.Background(), userInfo, "MM", "repo", newPullRequest{
+		Title:               "Add cards",
+		Description:         "Adds cards.",
+		SourceBranch:        "feature",
+		AddDefaultReviewers: true,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, &createdPullRequest{ID: 5, URL: "https://bitbucket.example.com/projects/MM/repos/repo/pull-requests/5"}, created)
+	assert.Equal(t, "Add cards", body["title"])
+	assert.Equal(t, "Adds cards.", body["description"])
+	assert.Equal(t, "refs/heads/feature", body["fromRef"].(map[string]interface{})["id"])
+	assert.Equal(t, "refs/heads/main", body["toRef"].(map[string]interface{})["id"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"user": map[string]interface{}{"name": "bob"}}}, body["reviewers"])
+}
+
+func TestBranchOptions(t *testing.T) {
+	options := branchOptions([]string{"main", "feature"}, "gone")
+
+	require.Len(t, options, 3)
+	assert.Equal(t, "gone", options[0].Value)
+	assert.Len(t, branchOptions([]string{"main", "feature"}, "main"), 2)
+}
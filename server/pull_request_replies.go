@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+)
+
+// PropPullRequestComment is the post prop identifying the pull request comment a notification is
+// about. Replies to such posts are added as replies to the comment in Bitbucket.
+const PropPullRequestComment = "bitbucket_pr_comment"
+
+func pullRequestCommentProp(comment *webhook.PullRequestComment) map[string]interface{} {
+	return map[string]interface{}{
+		"repository":      comment.Repository,
+		"pull_request_id": strconv.FormatInt(comment.PullRequestID, 10),
+		"comment_id":      strconv.FormatInt(comment.CommentID, 10),
+	}
+}
+
+// getPullRequestCommentProp returns the pull request comment a post is about, or nil if it isn't about one.
+func getPullRequestCommentProp(post *model.Post) *webhook.PullRequestComment {
+	prop, ok := post.GetProp(PropPullRequestComment).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	repository, _ := prop["repository"].(string)
+	pullRequestID, _ := prop["pull_request_id"].(string)
+	commentID, _ := prop["comment_id"].(string)
+
+	comment := &webhook.PullRequestComment{Repository: repository}
+	var err error
+	if comment.PullRequestID, err = strconv.ParseInt(pullRequestID, 10, 64); err != nil {
+		return nil
+	}
+	if comment.CommentID, err = strconv.ParseInt(commentID, 10, 64); err != nil {
+		return nil
+	}
+	if repository == "" {
+		return nil
+	}
+
+	return comment
+}
+
+// MessageHasBeenPosted turns replies to pull request comment notifications into replies to the
+// comment in Bitbucket, made with the account of the user who replied. In threaded channels, all the
+// replies have the thread's root post as root, so they aren't about a single comment and are ignored.
+func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
+	if post.RootId == "" || post.UserId == p.BotUserID || post.IsSystemMessage() || strings.TrimSpace(post.Message) == "" {
+		return
+	}
+
+	root, appErr := p.API.GetPost(post.RootId)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get root post", "post_id", post.RootId, "err", appErr.Error())
+		return
+	}
+	if root.UserId != p.BotUserID || root.GetProp(PropThreadRoot) != nil {
+		return
+	}
+
+	comment := getPullRequestCommentProp(root)
+	if comment == nil || p.isThreadRootPost(root, comment) {
+		return
+	}
+
+	userInfo, apiErr := p.getBitbucketUserInfo(post.UserId)
+	if apiErr != nil {
+		if apiErr.ID == APIErrorIDNotConnected {
+			p.sendReplyFeedback(post, "Your reply was not added to Bitbucket. Connect your account with `/bitbucket connect` to reply to pull request comments from Mattermost.")
+		}
+		return
+	}
+
+	owner, repo := parseOwnerAndRepo(comment.Repository, p.getBaseURL())
+	if _, err := p.createPullRequestComment(context.Background(), userInfo, owner, repo, comment.PullRequestID, newPullRequestComment{Text: post.Message, ParentID: comment.CommentID}); err != nil {
+		p.API.LogWarn("Failed to reply to pull request comment", "repository", comment.Repository, "pull_request", comment.PullRequestID, "comment", comment.CommentID, "err", err.Error())
+		p.sendReplyFeedback(post, "Your reply was not added to Bitbucket. "+pullRequestActionFailureMessage("comment on", owner, repo, comment.PullRequestID, userInfo.BitbucketUsername, err))
+	}
+}
+
+// isThreadRootPost reports whether the comment notification is the root post of the thread of its
+// pull request, as the first notification of a thread used to be.
+func (p *Plugin) isThreadRootPost(post *model.Post, comment *webhook.PullRequestComment) bool {
+	root, _, err := p.getThreadRoot(threadKey(post.ChannelId, webhook.PullRequestThreadKey(comment.Repository, comment.PullRequestID)))
+	if err != nil {
+		p.API.LogWarn("Failed to get thread root", "post_id", post.Id, "err", err.Error())
+		return true
+	}
+
+	return root != nil && root.PostID == post.Id
+}
+
+// sendReplyFeedback tells the author of a reply that it couldn't be added to Bitbucket.
+func (p *Plugin) sendReplyFeedback(post *model.Post, message string) {
+	p.API.SendEphemeralPost(post.UserId, &model.Post{
+		UserId:    p.BotUserID,
+		ChannelId: post.ChannelId,
+		RootId:    post.RootId,
+		Message:   message,
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+)
+
+func TestMessageHasBeenPosted(t *testing.T) {
+	const encryptionKey = "0123456789abcdef0123456789abcdef"
+
+	commentRoot := func() *model.Post {
+		root := &model.Post{Id: "root", UserId: "bot", ChannelId: "channel"}
+		root.AddProp(PropPullRequestComment, pullRequestCommentProp(&webhook.PullRequestComment{Repository: "MM/repo", PullRequestID: 3, CommentID: 42}))
+		return root
+	}
+
+	setup := func(t *testing.T, serverURL string) (*Plugin, *plugintest.API) {
+		api := &plugintest.API{}
+		siteURL := "https://mattermost.example.com"
+		api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}}).Maybe()
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.BotUserID = "bot"
+		p.setConfiguration(&Configuration{EncryptionKey: encryptionKey, BitbucketSelfHostedURL: serverURL})
+
+		return p, api
+	}
+
+	threadRootKey := threadKey("channel", webhook.PullRequestThreadKey("MM/repo", 3))
+
+	connect := func(t *testing.T, api *plugintest.API) {
+		accessToken, err := encrypt([]byte(encryptionKey), "token")
+		require.NoError(t, err)
+		info, err := json.Marshal(BitbucketUserInfo{UserID: "user", Token: &oauth2.Token{AccessToken: accessToken}, BitbucketUsername: "alice"})
+		require.NoError(t, err)
+		api.On("KVGet", "user"+BitbucketTokenKey).Return(info, nil)
+	}
+
+	t.Run("reply is added to the comment thread in Bitbucket", func(t *testing.T) {
+		var body map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/rest/api/1.0/projects/MM/repos/repo/pull-requests/3/comments", r.URL.Path)
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			_, _ = w.Write([]byte(`{"id": 43}`))
+		}))
+		defer server.Close()
+
+		p, api := setup(t, server.URL)
+		connect(t, api)
+		api.On("GetPost", "root").Return(commentRoot(), nil)
+		api.On("KVGet", threadRootKey).Return(nil, nil)
+
+		p.MessageHasBeenPosted(nil, &model.Post{UserId: "user", RootId: "root", Message: "Good point"})
+
+		assert.Equal(t, map[string]interface{}{"text": "Good point", "parent": map[string]interface{}{"id": float64(42)}}, body)
+		api.AssertNotCalled(t, "SendEphemeralPost", mock.Anything, mock.Anything)
+	})
+
+	t.Run("users who aren't connected are told", func(t *testing.T) {
+		p, api := setup(t, "")
+		api.On("GetPost", "root").Return(commentRoot(), nil)
+		api.On("KVGet", threadRootKey).Return(nil, nil)
+		api.On("KVGet", "user"+BitbucketTokenKey).Return(nil, nil)
+		api.On("SendEphemeralPost", "user", mock.MatchedBy(func(post *model.Post) bool {
+			return post.RootId == "root"
+		})).Return(nil)
+
+		p.MessageHasBeenPosted(nil, &model.Post{UserId: "user", RootId: "root", Message: "Good point"})
+
+		api.AssertExpectations(t)
+	})
+
+	t.Run("replies to other posts are ignored", func(t *testing.T) {
+		p, api := setup(t, "")
+		api.On("GetPost", "root").Return(&model.Post{Id: "root", UserId: "bot"}, nil)
+
+		p.MessageHasBeenPosted(nil, &model.Post{UserId: "user", RootId: "root", Message: "Thanks"})
+		p.MessageHasBeenPosted(nil, &model.Post{UserId: "user", Message: "Not a reply"})
+
+		api.AssertNumberOfCalls(t, "GetPost", 1)
+		api.AssertNotCalled(t, "KVGet", mock.Anything)
+	})
+	t.Run("replies in pull request threads are ignored", func(t *testing.T) {
+		p, api := setup(t, "")
+		threadRootPost := &model.Post{Id: "root", UserId: "bot", ChannelId: "channel"}
+		threadRootPost.AddProp(PropThreadRoot, webhook.PullRequestThreadKey("MM/repo", 3))
+		api.On("GetPost", "root").Return(threadRootPost, nil).Once()
+
+		p.MessageHasBeenPosted(nil, &model.Post{UserId: "user", RootId: "root", Message: "Good point"})
+
+		// Threads started by a comment notification have the comment's prop on their root post
+		api.On("GetPost", "root").Return(commentRoot(), nil).Once()
+		api.On("KVGet", threadRootKey).Return([]byte(`{"PostID":"root"}`), nil)
+
+		p.MessageHasBeenPosted(nil, &model.Post{UserId: "user", RootId: "root", Message: "Good point"})
+
+		api.AssertNotCalled(t, "KVGet", "user"+BitbucketTokenKey)
+		api.AssertNotCalled(t, "SendEphemeralPost", mock.Anything, mock.Anything)
+	})
+}
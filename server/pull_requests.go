@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wbrefvem/go-bitbucket"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/datacenter"
+)
+
+// Merge strategies accepted by the merge command, named as in Bitbucket Cloud.
+const (
+	MergeStrategyMergeCommit = "merge_commit"
+	MergeStrategySquash      = "squash"
+	MergeStrategyFastForward = "fast_forward"
+)
+
+// dataCenterMergeStrategies maps the merge strategies to the IDs used by Bitbucket Data Center.
+var dataCenterMergeStrategies = map[string]string{
+	MergeStrategyMergeCommit: "no-ff",
+	MergeStrategySquash:      "squash",
+	MergeStrategyFastForward: "ff-only",
+}
+
+// pullRequestActionError is returned when Bitbucket rejects an action on a pull request.
+type pullRequestActionError struct {
+	StatusCode int
+	// Message is the reason given by Bitbucket, if any, e.g. the merge checks that failed.
+	Message string
+}
+
+func (e *pullRequestActionError) Error() string {
+	if e.Message == "" {
+		return "bitbucket returned status " + strconv.Itoa(e.StatusCode)
+	}
+
+	return "bitbucket returned status " + strconv.Itoa(e.StatusCode) + ": " + e.Message
+}
+
+// toPullRequestActionError converts the error of a failed Bitbucket Cloud or Data Center API call.
+func toPullRequestActionError(httpResponse *http.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var dataCenterErr *datacenter.Error
+	if errors.As(err, &dataCenterErr) {
+		return &pullRequestActionError{StatusCode: dataCenterErr.StatusCode, Message: bitbucketErrorMessage(dataCenterErr.Message)}
+	}
+
+	if httpResponse != nil && httpResponse.StatusCode >= http.StatusMultipleChoices {
+		// go-bitbucket reports the response body in the error message
+		_, body, _ := strings.Cut(err.Error(), "Body: ")
+		return &pullRequestActionError{StatusCode: httpResponse.StatusCode, Message: bitbucketErrorMessage(body)}
+	}
+
+	return err
+}
+
+// bitbucketErrorMessage extracts the message from the error response of Bitbucket Cloud,
+// {"error": {"message": "..."}}, or of Bitbucket Data Center, {"errors": [{"message": "..."}]}.
+func bitbucketErrorMessage(body string) string {
+	var response struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return ""
+	}
+
+	if response.Error.Message != "" {
+		return response.Error.Message
+	}
+
+	var messages []string
+	for _, e := range response.Errors {
+		messages = append(messages, e.Message)
+	}
+
+	return strings.Join(messages, " ")
+}
+
+// pullRequestActionFailureMessage explains to the user why an action on a pull request failed.
+func pullRequestActionFailureMessage(action, owner, repo string, id int64, username string, err error) string {
+	reference := fmt.Sprintf("%s/%s#%d", owner, repo, id)
+
+	var actionErr *pullRequestActionError
+	if !errors.As(err, &actionErr) {
+		return fmt.Sprintf("Failed to %s pull request %s: %s.", action, reference, err.Error())
+	}
+
+	reason := getFailReason(actionErr.StatusCode, repo, username)
+	switch {
+	case action == "merge" && (actionErr.StatusCode == http.StatusBadRequest || actionErr.StatusCode == http.StatusConflict):
+		reason = "The merge is blocked"
+	case actionErr.StatusCode == http.StatusForbidden:
+		reason = fmt.Sprintf("Sorry, you don't have enough permissions to %s pull requests in the repo %s with the user %s", action, repo, username)
+	}
+	if actionErr.Message != "" {
+		reason += ": " + actionErr.Message
+	}
+
+	return fmt.Sprintf("Failed to %s pull request %s. %s", action, reference, reason)
+}
+
+func closeResponse(httpResponse *http.Response) {
+	if httpResponse != nil {
+		_ = httpResponse.Body.Close()
+	}
+}
+
+// approvePullRequest approves a pull request as the user.
+func (p *Plugin) approvePullRequest(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, id int64) error {
+	if p.isDataCenter() {
+		return toPullRequestActionError(nil, p.dataCenterConnect(userInfo).ApprovePullRequest(ctx, owner, repo, id))
+	}
+
+	_, httpResponse, err := p.bitbucketConnect(userInfo).PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdApprovePost(ctx, owner, strconv.FormatInt(id, 10), repo)
+	closeResponse(httpResponse)
+
+	return toPullRequestActionError(httpResponse, err)
+}
+
+// unapprovePullRequest removes the approval of the user from a pull request.
+func (p *Plugin) unapprovePullRequest(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, id int64) error {
+	if p.isDataCenter() {
+		return toPullRequestActionError(nil, p.dataCenterConnect(userInfo).UnapprovePullRequest(ctx, owner, repo, id))
+	}
+
+	httpResponse, err := p.bitbucketConnect(userInfo).PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdApproveDelete(ctx, owner, strconv.FormatInt(id, 10), repo)
+	closeResponse(httpResponse)
+
+	return toPullRequestActionError(httpResponse, err)
+}
+
+// declinePullRequest declines a pull request. Bitbucket Cloud doesn't take a reason when declining,
+// so it is left as a comment first.
+func (p *Plugin) declinePullRequest(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, id int64, reason string) error {
+	if p.isDataCenter() {
+		return toPullRequestActionError(nil, p.dataCenterConnect(userInfo).DeclinePullRequest(ctx, owner, repo, id, reason))
+	}
+
+	if reason != "" {
+		if _, err := p.createPullRequestComment(ctx, userInfo, owner, repo, id, newPullRequestComment{Text: reason}); err != nil {
+			return err
+		}
+	}
+
+	_, httpResponse, err := p.bitbucketConnect(userInfo).PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdDeclinePost(ctx, owner, strconv.FormatInt(id, 10), repo)
+	closeResponse(httpResponse)
+
+	return toPullRequestActionError(httpResponse, err)
+}
+
+// mergePullRequest merges a pull request with the given strategy, or the default strategy of the
+// repository if empty. Closing the source branch is only supported on Bitbucket Cloud.
+func (p *Plugin) mergePullRequest(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, id int64, strategy string, closeBranch bool) error {
+	if p.isDataCenter() {
+		if closeBranch {
+			return errors.New("closing the source branch is not supported on Bitbucket Data Center")
+		}
+		return toPullRequestActionError(nil, p.dataCenterConnect(userInfo).MergePullRequest(ctx, owner, repo, id, dataCenterMergeStrategies[strategy]))
+	}
+
+	parameters := bitbucket.PullrequestMergeParameters{
+		Type_:             "pullrequest_merge_parameters",
+		MergeStrategy:     strategy,
+		CloseSourceBranch: closeBranch,
+	}
+	_, httpResponse, err := p.bitbucketConnect(userInfo).PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdMergePost(ctx, owner, strconv.FormatInt(id, 10), repo, map[string]interface{}{
+		"body": parameters,
+	})
+	closeResponse(httpResponse)
+
+	return toPullRequestActionError(httpResponse, err)
+}
+
+// requestChangesOnPullRequest requests changes on a pull request as the user, which Bitbucket Data
+// Center calls "needs work".
+func (p *Plugin) requestChangesOnPullRequest(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, id int64) error {
+	if p.isDataCenter() {
+		return toPullRequestActionError(nil, p.dataCenterConnect(userInfo).RequestChangesOnPullRequest(ctx, owner, repo, id, userInfo.BitbucketUsername))
+	}
+
+	// go-bitbucket predates requesting changes, so the endpoint is called directly
+	urlToPost := fmt.Sprintf("%s/repositories/%s/%s/pullrequests/%d/request-changes", getBaseURL(), owner, repo, id)
+	return p.doCloudRequest(ctx, userInfo, http.MethodPost, urlToPost, nil, nil)
+}
+
+// doCloudRequest calls an endpoint of Bitbucket Cloud as the user, for the ones go-bitbucket
+// doesn't support. The response is decoded into v if given, or stored as is if v is a *string.
+// Error responses are returned as a *pullRequestActionError.
+func (p *Plugin) doCloudRequest(ctx context.Context, userInfo *BitbucketUserInfo, method, urlToCall string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal request body")
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, urlToCall, reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.userHTTPClient(userInfo).Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response body")
+	}
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return &pullRequestActionError{StatusCode: resp.StatusCode, Message: bitbucketErrorMessage(string(data))}
+	}
+
+	if v == nil {
+		return nil
+	}
+	if s, ok := v.(*string); ok {
+		*s = string(data)
+		return nil
+	}
+
+	return errors.Wrap(json.Unmarshal(data, v), "failed to decode response")
+}
+
+// newPullRequestComment is a comment to add to a pull request. A comment with a parent ID is a
+// reply, and one with a path is anchored to that file, or to a line of its new version if Line is
+// set.
+type newPullRequestComment struct {
+	Text     string
+	ParentID int64
+	Path     string
+	Line     int64
+}
+
+// createdPullRequestComment identifies a comment added to a pull request.
+type createdPullRequestComment struct {
+	ID  int64  `json:"id"`
+	URL string `json:"url"`
+}
+
+// createPullRequestComment adds a comment to a pull request as the user.
+func (p *Plugin) createPullRequestComment(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, id int64, comment newPullRequestComment) (*createdPullRequestComment, error) {
+	if p.isDataCenter() {
+		created, err := p.createDataCenterPullRequestComment(ctx, userInfo, owner, repo, id, comment)
+		if err != nil {
+			return nil, toPullRequestActionError(nil, err)
+		}
+		return &createdPullRequestComment{
+			ID:  created.ID,
+			URL: fmt.Sprintf("%s/pull-requests/%d/overview?commentId=%d", p.getRepositoryURL(owner, repo), id, created.ID),
+		}, nil
+	}
+
+	body := bitbucket.PullrequestComment{Content: &bitbucket.IssueContent{Raw: comment.Text}}
+	if comment.ParentID != 0 {
+		body.Parent = &bitbucket.Comment{Id: int32(comment.ParentID)}
+	}
+	if comment.Path != "" {
+		body.Inline = &bitbucket.CommentInline{Path: comment.Path, To: int32(comment.Line)}
+	}
+	created, httpResponse, err := p.bitbucketConnect(userInfo).PullrequestsApi.RepositoriesUsernameRepoSlugPullrequestsPullRequestIdCommentsPost(ctx, owner, repo, int32(id), body)
+	closeResponse(httpResponse)
+	if err != nil {
+		return nil, toPullRequestActionError(httpResponse, err)
+	}
+
+	commentURL := fmt.Sprintf("%s/pull-requests/%d#comment-%d", p.getRepositoryURL(owner, repo), id, created.Id)
+	if created.Links != nil && created.Links.Html != nil && created.Links.Html.Href != "" {
+		commentURL = created.Links.Html.Href
+	}
+
+	return &createdPullRequestComment{ID: int64(created.Id), URL: commentURL}, nil
+}
+
+// createDataCenterPullRequestComment adds a comment on Bitbucket Data Center, which needs to know
+// whether a commented line was added by the pull request or is unchanged context. The line is
+// assumed to be added, and commented as context if Bitbucket rejects that.
+func (p *Plugin) createDataCenterPullRequestComment(ctx context.Context, userInfo *BitbucketUserInfo, owner, repo string, id int64, comment newPullRequestComment) (*datacenter.Comment, error) {
+	client := p.dataCenterConnect(userInfo)
+	if comment.Path == "" {
+		return client.CreatePullRequestComment(ctx, owner, repo, id, comment.Text, comment.ParentID, nil)
+	}
+
+	anchor := &datacenter.CommentAnchor{Path: comment.Path}
+	if comment.Line == 0 {
+		return client.CreatePullRequestComment(ctx, owner, repo, id, comment.Text, comment.ParentID, anchor)
+	}
+
+	anchor.Line = comment.Line
+	anchor.FileType = "TO"
+	anchor.LineType = "ADDED"
+	created, err := client.CreatePullRequestComment(ctx, owner, repo, id, comment.Text, comment.ParentID, anchor)
+	var dataCenterErr *datacenter.Error
+	if errors.As(err, &dataCenterErr) && dataCenterErr.StatusCode == http.StatusBadRequest {
+		anchor.LineType = "CONTEXT"
+		return client.CreatePullRequestComment(ctx, owner, repo, id, comment.Text, comment.ParentID, anchor)
+	}
+
+	return created, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/datacenter"
+)
+
+func TestToPullRequestActionError(t *testing.T) {
+	assert.NoError(t, toPullRequestActionError(nil, nil))
+
+	t.Run("bitbucket cloud", func(t *testing.T) {
+		err := toPullRequestActionError(&http.Response{StatusCode: http.StatusBadRequest},
+			errors.New(`Status: 400 Bad Request, Body: {"type": "error", "error": {"message": "You can't merge until you resolve all merge checks."}}`))
+
+		assert.Equal(t, &pullRequestActionError{StatusCode: http.StatusBadRequest, Message: "You can't merge until you resolve all merge checks."}, err)
+	})
+
+	t.Run("bitbucket data center", func(t *testing.T) {
+		err := toPullRequestActionError(nil, errors.Wrap(&datacenter.Error{
+			StatusCode: http.StatusConflict,
+			Message:    `{"errors": [{"message": "The pull request has conflicts."}, {"message": "It needs 2 approvals."}]}`,
+		}, "failed to merge pull request"))
+
+		assert.Equal(t, &pullRequestActionError{StatusCode: http.StatusConflict, Message: "The pull request has conflicts. It needs 2 approvals."}, err)
+	})
+
+	t.Run("other errors are kept", func(t *testing.T) {
+		err := errors.New("connection refused")
+
+		assert.Equal(t, err, toPullRequestActionError(nil, err))
+	})
+}
+
+func TestPullRequestActionFailureMessage(t *testing.T) {
+	forbidden := &pullRequestActionError{StatusCode: http.StatusForbidden}
+
+	assert.Equal(t,
+		"Failed to approve pull request owner/repo#1. Sorry, you don't have enough permissions to approve pull requests in the repo repo with the user jdoe",
+		pullRequestActionFailureMessage("approve", "owner", "repo", 1, "jdoe", forbidden))
+	assert.Equal(t,
+		"Failed to request changes on pull request owner/repo#1. Sorry, you don't have enough permissions to request changes on pull requests in the repo repo with the user jdoe",
+		pullRequestActionFailureMessage("request changes on", "owner", "repo", 1, "jdoe", forbidden))
+	assert.Equal(t,
+		"Failed to merge pull request owner/repo#1. The merge is blocked: It needs 2 approvals.",
+		pullRequestActionFailureMessage("merge", "owner", "repo", 1, "jdoe", &pullRequestActionError{StatusCode: http.StatusConflict, Message: "It needs 2 approvals."}))
+}
+
+func TestCreatePullRequestCommentOnDataCenter(t *testing.T) {
+	var anchors []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/rest/api/1.0/projects/MM/repos/repo/pull-requests/3/comments", r.URL.Path)
+
+		var body struct {
+			Anchor map[string]interface{} `json:"anchor"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		anchors = append(anchors, body.Anchor)
+
+		if body.Anchor["lineType"] == "ADDED" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors": [{"message": "The line is not part of the diff."}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id": 7}`))
+	}))
+	defer server.Close()
+
+	api := &plugintest.API{}
+	siteURL := "https://mattermost.example.com"
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}}).Maybe()
+	p := NewPlugin()
+	p.SetAPI(api)
+	p.setConfiguration(&Configuration{BitbucketSelfHostedURL: server.URL})
+
+	userInfo := &BitbucketUserInfo{Token: &oauth2.Token{AccessToken: "token"}}
+	comment, err := p.createPullRequestComment(context.Background(), userInfo, "MM", "repo", 3, newPullRequestComment{Text: "Typo", Path: "server/api.go", Line: 12})
+	require.NoError(t, err)
+
+	assert.Equal(t, &createdPullRequestComment{ID: 7, URL: server.URL + "/projects/MM/repos/repo/pull-requests/3/overview?commentId=7"}, comment)
+	assert.Equal(t, []map[string]interface{}{
+		{"path": "server/api.go", "line": float64(12), "lineType": "ADDED", "fileType": "TO"},
+		{"path": "server/api.go", "line": float64(12), "lineType": "CONTEXT", "fileType": "TO"},
+	}, anchors)
+}
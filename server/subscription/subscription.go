@@ -1,44 +1,395 @@
 package subscription
 
 import (
+	"encoding/json"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CurrentVersion is the schema version of newly stored subscriptions.
+// Version 0 stored the features as a single comma separated string.
+const CurrentVersion = 1
+
+type Feature string
+
+const (
+	FeatureIssues         Feature = "issues"
+	FeaturePulls          Feature = "pulls"
+	FeaturePushes         Feature = "pushes"
+	FeatureCreates        Feature = "creates"
+	FeatureDeletes        Feature = "deletes"
+	FeatureIssueComments  Feature = "issue_comments"
+	FeaturePullReviews    Feature = "pull_reviews"
+	FeatureForks          Feature = "forks"
+	FeatureRepoUpdates    Feature = "repo_updates"
+	FeatureBuilds         Feature = "builds"
+	FeatureCommitComments Feature = "commit_comments"
+)
+
+// AllFeatures lists the valid features in the order they are documented.
+var AllFeatures = []Feature{
+	FeatureIssues,
+	FeaturePulls,
+	FeaturePushes,
+	FeatureCreates,
+	FeatureDeletes,
+	FeatureIssueComments,
+	FeaturePullReviews,
+	FeatureForks,
+	FeatureRepoUpdates,
+	FeatureBuilds,
+	FeatureCommitComments,
+}
+
+// DefaultFeatures are used when a subscription is added without features.
+var DefaultFeatures = Features{FeaturePulls, FeatureIssues, FeatureCreates, FeatureDeletes}
+
+func (f Feature) IsValid() bool {
+	for _, feature := range AllFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Features is a set of features, kept in the order they were given.
+type Features []Feature
+
+func (f Features) Has(feature Feature) bool {
+	for _, ff := range f {
+		if ff == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Features) String() string {
+	s := make([]string, 0, len(f))
+	for _, feature := range f {
+		s = append(s, string(feature))
+	}
+	return strings.Join(s, ",")
+}
+
+// Filters restrict the events of the subscribed features.
+type Filters struct {
+	// Labels match any of the kind, priority, component, milestone or version of an issue.
+	Labels []string `json:",omitempty"`
+
+	Kinds      []string `json:",omitempty"`
+	Priorities []string `json:",omitempty"`
+	Components []string `json:",omitempty"`
+	Milestones []string `json:",omitempty"`
+	Versions   []string `json:",omitempty"`
+
+	// Branches and TargetBranches are glob patterns, see path.Match, for the pushed or built
+	// branches or tags and the destination branches of pull requests.
+	Branches       []string `json:",omitempty"`
+	TargetBranches []string `json:",omitempty"`
+
+	// ExcludeAuthors and OnlyAuthors match the account ID or nickname of the user who triggered the event.
+	ExcludeAuthors []string `json:",omitempty"`
+	OnlyAuthors    []string `json:",omitempty"`
+}
+
+// Clone returns a deep copy of the filters.
+func (f Filters) Clone() Filters {
+	return Filters{
+		Labels:         slices.Clone(f.Labels),
+		Kinds:          slices.Clone(f.Kinds),
+		Priorities:     slices.Clone(f.Priorities),
+		Components:     slices.Clone(f.Components),
+		Milestones:     slices.Clone(f.Milestones),
+		Versions:       slices.Clone(f.Versions),
+		Branches:       slices.Clone(f.Branches),
+		TargetBranches: slices.Clone(f.TargetBranches),
+		ExcludeAuthors: slices.Clone(f.ExcludeAuthors),
+		OnlyAuthors:    slices.Clone(f.OnlyAuthors),
+	}
+}
+
+// IssueKinds and IssuePriorities are the values Bitbucket allows for issues.
+var (
+	IssueKinds      = []string{"bug", "enhancement", "proposal", "task"}
+	IssuePriorities = []string{"trivial", "minor", "major", "critical", "blocker"}
 )
 
+// filterFlag is a filter given as `--name=value1,value2` to the subscribe command.
+type filterFlag struct {
+	name   string
+	values func(f *Filters) *[]string
+	// allowed lists the valid values, or is empty if any value is valid.
+	allowed []string
+	// validate checks a value, if set.
+	validate func(value string) error
+}
+
+var filterFlags = []filterFlag{
+	{name: "kind", values: func(f *Filters) *[]string { return &f.Kinds }, allowed: IssueKinds},
+	{name: "priority", values: func(f *Filters) *[]string { return &f.Priorities }, allowed: IssuePriorities},
+	{name: "component", values: func(f *Filters) *[]string { return &f.Components }},
+	{name: "milestone", values: func(f *Filters) *[]string { return &f.Milestones }},
+	{name: "version", values: func(f *Filters) *[]string { return &f.Versions }},
+	{name: "branch", values: func(f *Filters) *[]string { return &f.Branches }, validate: validateGlob},
+	{name: "target-branch", values: func(f *Filters) *[]string { return &f.TargetBranches }, validate: validateGlob},
+	{name: "exclude-authors", values: func(f *Filters) *[]string { return &f.ExcludeAuthors }},
+	{name: "only-authors", values: func(f *Filters) *[]string { return &f.OnlyAuthors }},
+}
+
+func validateGlob(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// IsFlag reports whether a subscribe command argument is a filter flag.
+func IsFlag(arg string) bool {
+	return strings.HasPrefix(arg, "--")
+}
+
+// ParseFlag sets the filter of a `--name=value1,value2` argument.
+func (f *Filters) ParseFlag(arg string) error {
+	name, value, ok := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+	if !ok || value == "" {
+		return errors.Errorf("%s requires a value, e.g. --%s=value", arg, name)
+	}
+
+	for _, flag := range filterFlags {
+		if flag.name != name {
+			continue
+		}
+
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if len(flag.allowed) > 0 && !containsFold(flag.allowed, v) {
+				return errors.Errorf("invalid value %q for --%s, must be one of: %s", v, name, strings.Join(flag.allowed, ", "))
+			}
+			if flag.validate != nil {
+				if err := flag.validate(v); err != nil {
+					return errors.Wrapf(err, "invalid value %q for --%s", v, name)
+				}
+			}
+			values = append(values, v)
+		}
+		*flag.values(f) = values
+
+		return nil
+	}
+
+	return errors.Errorf("unknown flag --%s", name)
+}
+
+// Flags renders the filters as the flags given to the subscribe command.
+func (f Filters) Flags() []string {
+	var flags []string
+	for _, flag := range filterFlags {
+		if values := *flag.values(&f); len(values) > 0 {
+			flags = append(flags, "--"+flag.name+"="+strings.Join(values, ","))
+		}
+	}
+	return flags
+}
+
+// HasIssueFilters reports whether any filter applies to issues.
+func (f Filters) HasIssueFilters() bool {
+	return len(f.Labels) > 0 || len(f.Kinds) > 0 || len(f.Priorities) > 0 ||
+		len(f.Components) > 0 || len(f.Milestones) > 0 || len(f.Versions) > 0
+}
+
+// MatchesAuthor reports whether the author filters allow events triggered by the given user.
+func (f Filters) MatchesAuthor(accountID, nickname string) bool {
+	isAuthor := func(authors []string) bool {
+		return (accountID != "" && containsFold(authors, accountID)) || (nickname != "" && containsFold(authors, nickname))
+	}
+
+	if isAuthor(f.ExcludeAuthors) {
+		return false
+	}
+
+	return len(f.OnlyAuthors) == 0 || isAuthor(f.OnlyAuthors)
+}
+
+// MatchesBranch reports whether the patterns are empty or one of them matches the branch.
+func MatchesBranch(patterns []string, branch string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, branch); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesAny reports whether the filter values are empty or contain the value, ignoring case.
+func MatchesAny(values []string, value string) bool {
+	return len(values) == 0 || containsFold(values, value)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFeatures parses a comma separated list of features and filters, as given to the subscribe
+// command. The features and filters that couldn't be parsed are returned as invalid.
+func ParseFeatures(s string) (Features, Filters, []string) {
+	var features Features
+	var filters Filters
+	var invalid []string
+
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+
+		if strings.HasPrefix(f, "label") {
+			label := strings.TrimPrefix(strings.TrimPrefix(f, "label"), ":")
+			if unquoted, err := strconv.Unquote(label); err == nil {
+				label = unquoted
+			}
+			if label == "" {
+				invalid = append(invalid, f)
+				continue
+			}
+			filters.Labels = append(filters.Labels, label)
+			continue
+		}
+
+		feature := Feature(f)
+		if !feature.IsValid() {
+			invalid = append(invalid, f)
+			continue
+		}
+		if !features.Has(feature) {
+			features = append(features, feature)
+		}
+	}
+
+	return features, filters, invalid
+}
+
+// FormatFeatures renders features and labels the way they are given to the subscribe command.
+func FormatFeatures(features Features, filters Filters) string {
+	s := features.String()
+	for _, label := range filters.Labels {
+		s += ",label:" + strconv.Quote(label)
+	}
+	return s
+}
+
 type Subscription struct {
+	Version    int
 	ChannelID  string
 	CreatorID  string
-	Features   string
+	Features   Features
+	Filters    Filters
 	Repository string
+	// Threaded posts the activity of a pull request as replies to a single root post.
+	Threaded bool
+	// Cards keeps a single post per pull request up to date instead of posting each event.
+	Cards bool
 }
 
 type Subscriptions struct {
 	Repositories map[string][]*Subscription
 }
 
+// UnmarshalJSON also reads subscriptions stored before versioning, whose features and label
+// filters were a single string. The version is left unchanged so outdated entries can be found.
+func (s *Subscription) UnmarshalJSON(data []byte) error {
+	type subscription Subscription
+	stored := struct {
+		*subscription
+		Features json.RawMessage
+	}{subscription: (*subscription)(s)}
+
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	if len(stored.Features) == 0 || string(stored.Features) == "null" {
+		return nil
+	}
+
+	var legacyFeatures string
+	if err := json.Unmarshal(stored.Features, &legacyFeatures); err == nil {
+		s.Features, s.Filters, _ = ParseFeatures(legacyFeatures)
+		return nil
+	}
+
+	return json.Unmarshal(stored.Features, &s.Features)
+}
+
+// Clone returns a deep copy of the subscription.
+func (s *Subscription) Clone() *Subscription {
+	clone := *s
+	clone.Features = slices.Clone(s.Features)
+	clone.Filters = s.Filters.Clone()
+	return &clone
+}
+
+// FeaturesString renders the features and labels the way they are given to the subscribe command.
+func (s *Subscription) FeaturesString() string {
+	return FormatFeatures(s.Features, s.Filters)
+}
+
 func (s *Subscription) Pulls() bool {
-	return strings.Contains(s.Features, "pulls")
+	return s.Features.Has(FeaturePulls)
 }
 
 func (s *Subscription) Issues() bool {
-	return strings.Contains(s.Features, "issues")
+	return s.Features.Has(FeatureIssues)
 }
 
 func (s *Subscription) Pushes() bool {
-	return strings.Contains(s.Features, "pushes")
+	return s.Features.Has(FeaturePushes)
 }
 
 func (s *Subscription) Creates() bool {
-	return strings.Contains(s.Features, "creates")
+	return s.Features.Has(FeatureCreates)
 }
 
 func (s *Subscription) Deletes() bool {
-	return strings.Contains(s.Features, "deletes")
+	return s.Features.Has(FeatureDeletes)
 }
 
 func (s *Subscription) IssueComments() bool {
-	return strings.Contains(s.Features, "issue_comments")
+	return s.Features.Has(FeatureIssueComments)
 }
 
 func (s *Subscription) PullReviews() bool {
-	return strings.Contains(s.Features, "pull_reviews")
+	return s.Features.Has(FeaturePullReviews)
+}
+
+func (s *Subscription) Forks() bool {
+	return s.Features.Has(FeatureForks)
+}
+
+func (s *Subscription) RepoUpdates() bool {
+	return s.Features.Has(FeatureRepoUpdates)
+}
+
+func (s *Subscription) Builds() bool {
+	return s.Features.Has(FeatureBuilds)
+}
+
+func (s *Subscription) CommitComments() bool {
+	return s.Features.Has(FeatureCommitComments)
 }
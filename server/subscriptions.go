@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -16,40 +14,67 @@ import (
 )
 
 const (
+	// SubscriptionsKey is the legacy key holding all subscriptions, see migrateLegacySubscriptions.
 	SubscriptionsKey         = "subscriptions"
 	UnsubscribedErrorMessage = "Unable to unsubscribe from %s as it is not currently part of a subscription in this channel."
 )
 
-func (p *Plugin) Subscribe(ctx context.Context, bitbucketClient *bitbucket.APIClient, userID, owner, repo, channelID, features string) error {
+func (p *Plugin) Subscribe(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient, owner, repo, channelID string, features subscription.Features, filters subscription.Filters, threaded, cards bool) error {
 	if owner == "" {
 		return errors.Errorf("invalid repository")
 	}
 
-	if err := p.checkOrg(owner); err != nil {
-		return errors.Wrap(err, "organization not supported")
+	if err := p.checkRepository(owner, repo); err != nil {
+		return errors.Wrap(err, "repository not supported")
 	}
 
 	var err error
-
-	if repo == "" {
+	var repository *bitbucket.Repository
+
+	if p.isDataCenter() {
+		dataCenterClient := p.dataCenterConnect(userInfo)
+		if repo == "" {
+			if _, err = dataCenterClient.GetProject(ctx, owner); err != nil {
+				p.API.LogError("Cannot fetch project", "err", err.Error())
+				return errors.Errorf("Unknown organization %s", owner)
+			}
+		} else if repository, err = dataCenterClient.GetRepository(ctx, owner, repo); err != nil {
+			p.API.LogError("Cannot fetch repository", "err", err.Error())
+			return errors.Errorf("unknown repository %s", fullNameFromOwnerAndRepo(owner, repo))
+		}
+	} else if repo == "" {
 		_, _, err = bitbucketClient.UsersApi.UserGet(ctx) //nolint:bodyclose
 		if err != nil {
 			p.API.LogError("Cannot fetch user", "err", err.Error())
 			return errors.Errorf("Unknown organization %s", owner)
 		}
 	} else {
-		_, _, err = bitbucketClient.RepositoriesApi.RepositoriesUsernameRepoSlugGet(context.Background(), owner, repo) //nolint:bodyclose
+		var cloudRepository bitbucket.Repository
+		cloudRepository, _, err = bitbucketClient.RepositoriesApi.RepositoriesUsernameRepoSlugGet(context.Background(), owner, repo) //nolint:bodyclose
 		if err != nil {
 			p.API.LogError("Cannot fetch repository", "err", err.Error())
 			return errors.Errorf("unknown repository %s", fullNameFromOwnerAndRepo(owner, repo))
 		}
+		repository = &cloudRepository
+	}
+
+	projectKey := ""
+	if repository != nil && repository.Project != nil {
+		projectKey = repository.Project.Key
+	}
+	if err = p.checkTeamSubscriptionPolicy(channelID, owner, repo, projectKey); err != nil {
+		return err
 	}
 
 	sub := &subscription.Subscription{
+		Version:    subscription.CurrentVersion,
 		ChannelID:  channelID,
-		CreatorID:  userID,
+		CreatorID:  userInfo.UserID,
 		Features:   features,
+		Filters:    filters,
 		Repository: fullNameFromOwnerAndRepo(owner, repo),
+		Threaded:   threaded,
+		Cards:      cards,
 	}
 
 	if err := p.AddSubscription(fullNameFromOwnerAndRepo(owner, repo), sub); err != nil {
@@ -59,12 +84,12 @@ func (p *Plugin) Subscribe(ctx context.Context, bitbucketClient *bitbucket.APICl
 	return nil
 }
 
-func (p *Plugin) SubscribeOrg(ctx context.Context, bitbucketClient *bitbucket.APIClient, userID, org, channelID, features string) error {
+func (p *Plugin) SubscribeOrg(ctx context.Context, userInfo *BitbucketUserInfo, bitbucketClient *bitbucket.APIClient, org, channelID string, features subscription.Features, filters subscription.Filters, threaded, cards bool) error {
 	if org == "" {
 		return errors.New("invalid organization")
 	}
 
-	return p.Subscribe(ctx, bitbucketClient, userID, org, "", channelID, features)
+	return p.Subscribe(ctx, userInfo, bitbucketClient, org, "", channelID, features, filters, threaded, cards)
 }
 
 func (p *Plugin) GetSubscriptionsByChannel(channelID string) ([]*subscription.Subscription, error) {
@@ -94,32 +119,16 @@ func (p *Plugin) GetSubscriptionsByChannel(channelID string) ([]*subscription.Su
 }
 
 func (p *Plugin) AddSubscription(repo string, sub *subscription.Subscription) error {
-	subs, err := p.GetSubscriptions()
-	if err != nil {
-		return errors.Wrap(err, "could not get subscriptions")
-	}
-
-	repoSubs := subs.Repositories[repo]
-	if repoSubs == nil {
-		repoSubs = []*subscription.Subscription{sub}
-	} else {
-		exists := false
-		for index, s := range repoSubs {
+	_, err := p.updateRepositorySubscriptions(repo, func(subs []*subscription.Subscription) ([]*subscription.Subscription, bool) {
+		for index, s := range subs {
 			if s.ChannelID == sub.ChannelID {
-				repoSubs[index] = sub
-				exists = true
-				break
+				subs[index] = sub
+				return subs, true
 			}
 		}
 
-		if !exists {
-			repoSubs = append(repoSubs, sub)
-		}
-	}
-
-	subs.Repositories[repo] = repoSubs
-
-	err = p.StoreSubscriptions(subs)
+		return append(subs, sub), true
+	})
 	if err != nil {
 		return errors.Wrap(err, "could not store subscriptions")
 	}
@@ -127,73 +136,44 @@ func (p *Plugin) AddSubscription(repo string, sub *subscription.Subscription) er
 	return nil
 }
 
-func (p *Plugin) GetSubscriptions() (*subscription.Subscriptions, error) {
-	var subscriptions *subscription.Subscriptions
-
-	value, appErr := p.API.KVGet(SubscriptionsKey)
-	if appErr != nil {
-		return nil, errors.Wrap(appErr, "could not get subscriptions from KVStore")
-	}
-
-	if value == nil {
-		return &subscription.Subscriptions{Repositories: map[string][]*subscription.Subscription{}}, nil
-	}
-
-	err := json.NewDecoder(bytes.NewReader(value)).Decode(&subscriptions)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not properly decode subscriptions key")
-	}
-
-	return subscriptions, nil
-}
-
-func (p *Plugin) StoreSubscriptions(s *subscription.Subscriptions) error {
-	b, err := json.Marshal(s)
-	if err != nil {
-		return errors.Wrap(err, "error while converting subscriptions map to json")
-	}
-
-	if appErr := p.API.KVSet(SubscriptionsKey, b); appErr != nil {
-		return errors.Wrap(appErr, "could not store subscriptions in KV store")
-	}
-
-	return nil
-}
-
-func (p *Plugin) GetSubscribedChannelsForRepository(pl webhookpayload.Payload) []*subscription.Subscription {
+// GetSubscribedChannelsForRepository returns the subscriptions to the repository of the payload
+// and to its organization whose creators can access the repository. An error is returned when
+// this couldn't be determined, so that the delivery is retried.
+func (p *Plugin) GetSubscribedChannelsForRepository(pl webhookpayload.Payload) ([]*subscription.Subscription, error) {
 	name := pl.GetRepository().FullName
 	org := strings.Split(name, "/")[0]
-	subs, err := p.GetSubscriptions()
-	if err != nil {
-		return nil
-	}
 
 	// Add subscriptions for the specific repo
-	var subsForRepo []*subscription.Subscription
-	if subs.Repositories[name] != nil {
-		subsForRepo = append(subsForRepo, subs.Repositories[name]...)
+	subsForRepo, err := p.getRepositorySubscriptions(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get repository subscriptions")
 	}
 
 	// Add subscriptions for the organization
-	orgKey := fullNameFromOwnerAndRepo(org, "")
-	if subs.Repositories[orgKey] != nil {
-		subsForRepo = append(subsForRepo, subs.Repositories[orgKey]...)
+	orgSubs, err := p.getRepositorySubscriptions(fullNameFromOwnerAndRepo(org, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get organization subscriptions")
 	}
+	subsForRepo = append(subsForRepo, orgSubs...)
 
 	if len(subsForRepo) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	var subsToReturn []*subscription.Subscription
 
 	for _, sub := range subsForRepo {
-		if !p.permissionToRepo(sub.CreatorID, name) {
+		hasPermission, err := p.checkPermissionToRepo(sub.CreatorID, name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to check the subscription creator's access to the repository")
+		}
+		if !hasPermission {
 			continue
 		}
 		subsToReturn = append(subsToReturn, sub)
 	}
 
-	return subsToReturn
+	return subsToReturn, nil
 }
 
 func (p *Plugin) Unsubscribe(channelID, repo string) (string, error) {
@@ -207,32 +187,67 @@ func (p *Plugin) Unsubscribe(channelID, repo string) (string, error) {
 	}
 	repoWithOwner := fmt.Sprintf("%s/%s", owner, repo)
 
-	subs, err := p.GetSubscriptions()
+	removed, err := p.updateRepositorySubscriptions(repoWithOwner, func(subs []*subscription.Subscription) ([]*subscription.Subscription, bool) {
+		for index, sub := range subs {
+			if sub.ChannelID == channelID {
+				return append(subs[:index], subs[index+1:]...), true
+			}
+		}
+
+		return subs, false
+	})
 	if err != nil {
-		return "", errors.Wrap(err, "could not get subscriptions")
+		return "", errors.Wrap(err, "could not store subscriptions")
 	}
 
-	repoSubs := subs.Repositories[repoWithOwner]
-	if repoSubs == nil {
-		return fmt.Sprintf(UnsubscribedErrorMessage, repo), nil
+	if removed {
+		return fmt.Sprintf("Successfully unsubscribed from %s.", repo), nil
 	}
 
-	removed := false
-	for index, sub := range repoSubs {
-		if sub.ChannelID == channelID {
-			repoSubs = append(repoSubs[:index], repoSubs[index+1:]...)
-			removed = true
-			break
-		}
+	return fmt.Sprintf(UnsubscribedErrorMessage, repo), nil
+}
+
+// moveRepositorySubscriptions moves the subscriptions of a renamed repository to its new name.
+// Subscriptions of channels already subscribed to the new name are dropped.
+func (p *Plugin) moveRepositorySubscriptions(oldName, newName string) error {
+	if oldName == "" || newName == "" {
+		return nil
 	}
 
-	if removed {
-		subs.Repositories[repoWithOwner] = repoSubs
-		if err := p.StoreSubscriptions(subs); err != nil {
-			return "", errors.Wrap(err, "could not store subscriptions")
+	subs, _, err := p.readRepositorySubscriptions(oldName)
+	if err != nil {
+		return errors.Wrap(err, "could not get subscriptions")
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+
+	_, err = p.updateRepositorySubscriptions(newName, func(newSubs []*subscription.Subscription) ([]*subscription.Subscription, bool) {
+		changed := false
+		for _, sub := range subs {
+			if containsChannelSubscription(newSubs, sub.ChannelID) {
+				continue
+			}
+
+			movedSub := *sub
+			movedSub.Repository = newName
+			newSubs = append(newSubs, &movedSub)
+			changed = true
 		}
-		return fmt.Sprintf("Successfully unsubscribed from %s.", repo), nil
+		return newSubs, changed
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not store subscriptions")
 	}
 
-	return fmt.Sprintf(UnsubscribedErrorMessage, repo), nil
+	_, err = p.updateRepositorySubscriptions(oldName, func(oldSubs []*subscription.Subscription) ([]*subscription.Subscription, bool) {
+		return nil, len(oldSubs) > 0
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not delete subscriptions")
+	}
+
+	p.API.LogInfo("Moved subscriptions of renamed repository", "from", oldName, "to", newName)
+
+	return nil
 }
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
+)
+
+const (
+	// KeySubscriptions prefixes the per-repository (and per-organization) subscription keys.
+	KeySubscriptions = "subscriptions_"
+
+	// KeySubscribedRepositories indexes the repositories and organizations with subscriptions, see getKVIndex.
+	KeySubscribedRepositories = "subscribed_repositories"
+
+	// ClusterEventSubscriptionsUpdated notifies the other plugin instances that the subscriptions
+	// of the repository in the event data changed.
+	ClusterEventSubscriptionsUpdated = "subscriptions_updated"
+
+	subscriptionsMigrationMutexKey = "subscriptions_migration"
+
+	// subscriptionUpdateAttempts limits the compare-and-set retries of concurrent subscription updates.
+	subscriptionUpdateAttempts = 10
+
+	// subscriptionCacheSize limits the number of repositories whose subscriptions each plugin
+	// instance keeps in memory.
+	subscriptionCacheSize = 10000
+
+	// subscriptionCacheTTL is how long cached subscriptions are used. Updates are applied right
+	// away through cluster events, so this only bounds how long unused entries are kept.
+	subscriptionCacheTTL = 10 * time.Minute
+)
+
+// repositorySubscriptions is the value stored under a subscription key. The repository is kept in
+// the value, as long names are hashed in the key.
+type repositorySubscriptions struct {
+	Repository    string
+	Subscriptions []*subscription.Subscription
+}
+
+// subscriptionCache keeps the subscriptions of recently used repositories in memory, and evicts
+// the least recently used ones when full. Repositories without subscriptions are cached too, so
+// webhooks for them don't hit the KV store.
+type subscriptionCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// order holds the entries from the most to the least recently used.
+	order *list.List
+}
+
+type subscriptionCacheEntry struct {
+	repo      string
+	subs      []*subscription.Subscription
+	expiresAt time.Time
+}
+
+func newSubscriptionCache(size int, ttl time.Duration) *subscriptionCache {
+	return &subscriptionCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (c *subscriptionCache) get(repo string) ([]*subscription.Subscription, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[repo]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*subscriptionCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return copySubscriptions(entry.subs), true
+}
+
+func (c *subscriptionCache) set(repo string, subs []*subscription.Subscription) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if element, ok := c.entries[repo]; ok {
+		entry := element.Value.(*subscriptionCacheEntry)
+		entry.subs = copySubscriptions(subs)
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[repo] = c.order.PushFront(&subscriptionCacheEntry{repo: repo, subs: copySubscriptions(subs), expiresAt: expiresAt})
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *subscriptionCache) invalidate(repo string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[repo]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *subscriptionCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*subscriptionCacheEntry).repo)
+}
+
+// copySubscriptions copies the subscriptions, so callers can't modify the cached ones.
+func copySubscriptions(subs []*subscription.Subscription) []*subscription.Subscription {
+	if subs == nil {
+		return nil
+	}
+
+	result := make([]*subscription.Subscription, 0, len(subs))
+	for _, sub := range subs {
+		result = append(result, sub.Clone())
+	}
+
+	return result
+}
+
+// subscriptionsKey returns the KV key of a repository's subscriptions. Names that would exceed
+// the maximum key length are hashed.
+func subscriptionsKey(repo string) string {
+	key := KeySubscriptions + repo
+	if len(key) <= model.KeyValueKeyMaxRunes {
+		return key
+	}
+
+	hash := sha256.Sum256([]byte(repo))
+	return KeySubscriptions + hex.EncodeToString(hash[:])
+}
+
+// getRepositorySubscriptions returns the subscriptions of a repository, or of an organization
+// for names like "org/".
+func (p *Plugin) getRepositorySubscriptions(repo string) ([]*subscription.Subscription, error) {
+	if subs, ok := p.subscriptionCache.get(repo); ok {
+		return subs, nil
+	}
+
+	subs, _, err := p.readRepositorySubscriptions(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	p.subscriptionCache.set(repo, subs)
+
+	return subs, nil
+}
+
+// readRepositorySubscriptions reads the subscriptions of a repository from the KV store. The raw
+// value is returned for compare-and-set updates.
+func (p *Plugin) readRepositorySubscriptions(repo string) ([]*subscription.Subscription, []byte, error) {
+	value, appErr := p.API.KVGet(subscriptionsKey(repo))
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "could not get subscriptions from KVStore")
+	}
+
+	if value == nil {
+		return nil, nil, nil
+	}
+
+	var stored repositorySubscriptions
+	if err := json.NewDecoder(bytes.NewReader(value)).Decode(&stored); err != nil {
+		return nil, nil, errors.Wrap(err, "could not properly decode subscriptions key")
+	}
+
+	return stored.Subscriptions, value, nil
+}
+
+// updateRepositorySubscriptions applies update to the subscriptions of a repository with
+// compare-and-set semantics, so concurrent updates don't overwrite each other. The update is
+// retried on conflicts and may therefore run more than once. It reports whether anything changed.
+func (p *Plugin) updateRepositorySubscriptions(repo string, update func(subs []*subscription.Subscription) ([]*subscription.Subscription, bool)) (bool, error) {
+	key := subscriptionsKey(repo)
+
+	for attempt := 0; attempt < subscriptionUpdateAttempts; attempt++ {
+		subs, oldValue, err := p.readRepositorySubscriptions(repo)
+		if err != nil {
+			return false, err
+		}
+
+		subs, changed := update(subs)
+		if !changed {
+			return false, nil
+		}
+
+		var stored bool
+		var appErr *model.AppError
+		if len(subs) == 0 {
+			stored, appErr = p.API.KVCompareAndDelete(key, oldValue)
+		} else {
+			// Indexed before storing, so the subscriptions are always listed. Unsubscribed
+			// repositories left in the index are skipped when listing.
+			if err := p.addToKVIndex(KeySubscribedRepositories, repo); err != nil {
+				return false, errors.Wrap(err, "could not index subscriptions")
+			}
+
+			newValue, err := json.Marshal(repositorySubscriptions{
+				Repository:    repo,
+				Subscriptions: subs,
+			})
+			if err != nil {
+				return false, errors.Wrap(err, "error while converting subscriptions to json")
+			}
+
+			stored, appErr = p.API.KVCompareAndSet(key, oldValue, newValue)
+		}
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "could not store subscriptions in KV store")
+		}
+
+		if stored {
+			if len(subs) == 0 {
+				if err := p.removeFromKVIndex(KeySubscribedRepositories, repo); err != nil {
+					p.API.LogWarn("Failed to unindex subscriptions", "repository", repo, "err", err.Error())
+				}
+			}
+			p.subscriptionCache.set(repo, subs)
+			p.publishSubscriptionsUpdated(repo)
+			return true, nil
+		}
+	}
+
+	return false, errors.Errorf("could not store subscriptions of %s after %d attempts", repo, subscriptionUpdateAttempts)
+}
+
+// GetSubscriptions returns the subscriptions of all repositories and organizations.
+func (p *Plugin) GetSubscriptions() (*subscription.Subscriptions, error) {
+	repos, err := p.getKVIndex(KeySubscribedRepositories)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list subscriptions")
+	}
+
+	subs := &subscription.Subscriptions{Repositories: map[string][]*subscription.Subscription{}}
+	for _, repo := range repos {
+		repoSubs, _, err := p.readRepositorySubscriptions(repo)
+		if err != nil {
+			return nil, err
+		}
+		if len(repoSubs) == 0 {
+			continue
+		}
+
+		subs.Repositories[repo] = repoSubs
+	}
+
+	return subs, nil
+}
+
+// listSubscribedRepositories lists the repositories with subscriptions by going through all the
+// keys of the KV store. It is only used to build the index of subscribed repositories.
+func (p *Plugin) listSubscribedRepositories() ([]string, error) {
+	keys, err := p.listKVKeysWithPrefix(KeySubscriptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list subscriptions")
+	}
+
+	var repos []string
+	for _, key := range keys {
+		value, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "could not get subscriptions from KVStore")
+		}
+		if value == nil {
+			continue
+		}
+
+		var stored repositorySubscriptions
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return nil, errors.Wrap(err, "could not properly decode subscriptions key")
+		}
+
+		repos = append(repos, stored.Repository)
+	}
+
+	return repos, nil
+}
+
+func (p *Plugin) publishSubscriptionsUpdated(repo string) {
+	err := p.API.PublishPluginClusterEvent(model.PluginClusterEvent{
+		Id:   ClusterEventSubscriptionsUpdated,
+		Data: []byte(repo),
+	}, model.PluginClusterEventSendOptions{
+		SendType: model.PluginClusterEventSendTypeReliable,
+	})
+	if err != nil {
+		p.API.LogWarn("Failed to publish subscriptions update", "repository", repo, "err", err.Error())
+	}
+}
+
+// migrateSubscriptions upgrades the stored subscriptions to the current storage layout and schema.
+func (p *Plugin) migrateSubscriptions() error {
+	mutex, err := cluster.NewMutex(p.API, subscriptionsMigrationMutexKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create subscriptions migration mutex")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := p.migrateKVIndex(KeySubscribedRepositories, p.listSubscribedRepositories); err != nil {
+		return errors.Wrap(err, "failed to index subscriptions")
+	}
+
+	if err := p.migrateLegacySubscriptions(); err != nil {
+		return err
+	}
+
+	return p.migrateSubscriptionVersions()
+}
+
+// migrateLegacySubscriptions moves the subscriptions from the single legacy key into the
+// per-repository keys. Subscriptions already present in the new keys take precedence.
+func (p *Plugin) migrateLegacySubscriptions() error {
+	value, appErr := p.API.KVGet(SubscriptionsKey)
+	if appErr != nil {
+		return errors.Wrap(appErr, "could not get legacy subscriptions")
+	}
+	if value == nil {
+		return nil
+	}
+
+	var legacy subscription.Subscriptions
+	if err := json.Unmarshal(value, &legacy); err != nil {
+		return errors.Wrap(err, "could not decode legacy subscriptions")
+	}
+
+	repos := make([]string, 0, len(legacy.Repositories))
+	for repo := range legacy.Repositories {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	for _, repo := range repos {
+		legacySubs := legacy.Repositories[repo]
+		_, err := p.updateRepositorySubscriptions(repo, func(subs []*subscription.Subscription) ([]*subscription.Subscription, bool) {
+			changed := false
+			for _, legacySub := range legacySubs {
+				if containsChannelSubscription(subs, legacySub.ChannelID) {
+					continue
+				}
+
+				sub := *legacySub
+				if sub.Repository == "" {
+					sub.Repository = repo
+				}
+				subs = append(subs, &sub)
+				changed = true
+			}
+			return subs, changed
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to migrate subscriptions of %s", repo)
+		}
+	}
+
+	if appErr := p.API.KVDelete(SubscriptionsKey); appErr != nil {
+		return errors.Wrap(appErr, "could not delete legacy subscriptions")
+	}
+
+	p.API.LogInfo("Migrated subscriptions to per-repository keys", "repositories", len(repos))
+
+	return nil
+}
+
+// migrateSubscriptionVersions rewrites subscriptions stored with an older schema version. Their
+// features are already converted when they are read, see subscription.Subscription.UnmarshalJSON.
+func (p *Plugin) migrateSubscriptionVersions() error {
+	subs, err := p.GetSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for repo, repoSubs := range subs.Repositories {
+		if !hasOutdatedSubscription(repoSubs) {
+			continue
+		}
+
+		_, err := p.updateRepositorySubscriptions(repo, func(subs []*subscription.Subscription) ([]*subscription.Subscription, bool) {
+			if !hasOutdatedSubscription(subs) {
+				return subs, false
+			}
+			for _, sub := range subs {
+				sub.Version = subscription.CurrentVersion
+			}
+			return subs, true
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to migrate subscriptions of %s", repo)
+		}
+	}
+
+	return nil
+}
+
+func hasOutdatedSubscription(subs []*subscription.Subscription) bool {
+	for _, sub := range subs {
+		if sub.Version < subscription.CurrentVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsChannelSubscription(subs []*subscription.Subscription, channelID string) bool {
+	for _, sub := range subs {
+		if sub.ChannelID == channelID {
+			return true
+		}
+	}
+
+	return false
+}
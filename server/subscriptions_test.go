@@ -2,12 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
 )
 
 func CheckError(t *testing.T, wantErr bool, err error) {
@@ -23,10 +32,19 @@ func pluginWithMockedSubs(subscriptions []*subscription.Subscription) *Plugin {
 	p := NewPlugin()
 	mockPluginAPI := &plugintest.API{}
 
-	subs := subscription.Subscriptions{Repositories: map[string][]*subscription.Subscription{}}
-	subs.Repositories[""] = subscriptions
-	jsn, _ := json.Marshal(subs)
-	mockPluginAPI.On("KVGet", SubscriptionsKey).Return(jsn, nil)
+	byRepo := map[string][]*subscription.Subscription{}
+	for _, sub := range subscriptions {
+		byRepo[sub.Repository] = append(byRepo[sub.Repository], sub)
+	}
+
+	repos := []string{}
+	for repo, subs := range byRepo {
+		jsn, _ := json.Marshal(repositorySubscriptions{Repository: repo, Subscriptions: subs})
+		mockPluginAPI.On("KVGet", subscriptionsKey(repo)).Return(jsn, nil)
+		repos = append(repos, repo)
+	}
+	index, _ := json.Marshal(repos)
+	mockPluginAPI.On("KVGet", KeySubscribedRepositories).Return(index, nil)
 	p.SetAPI(mockPluginAPI)
 	return p
 }
@@ -116,3 +134,197 @@ func TestPlugin_GetSubscriptionsByChannel(t *testing.T) {
 		})
 	}
 }
+
+func TestSubscriptionsKey(t *testing.T) {
+	assert.Equal(t, KeySubscriptions+"owner/repo", subscriptionsKey("owner/repo"))
+
+	longName := strings.Repeat("a", 200)
+	key := subscriptionsKey(longName)
+	assert.True(t, strings.HasPrefix(key, KeySubscriptions))
+	assert.LessOrEqual(t, len(key), model.KeyValueKeyMaxRunes)
+	assert.Equal(t, key, subscriptionsKey(longName))
+}
+
+func TestGetSubscribedChannelsForRepositoryReturnsErrors(t *testing.T) {
+	const encryptionKey = "0123456789abcdef0123456789abcdef"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	pl := &webhookpayload.RepoForkPayload{Repository: webhookpayload.Repository{FullName: "MM/repo"}}
+	repoSubs, err := json.Marshal(repositorySubscriptions{
+		Repository:    "MM/repo",
+		Subscriptions: []*subscription.Subscription{{ChannelID: "channel", CreatorID: "user", Repository: "MM/repo"}},
+	})
+	require.NoError(t, err)
+	accessToken, err := encrypt([]byte(encryptionKey), "token")
+	require.NoError(t, err)
+	userInfo, err := json.Marshal(BitbucketUserInfo{UserID: "user", Token: &oauth2.Token{AccessToken: accessToken}})
+	require.NoError(t, err)
+
+	setup := func(orgSubsErr *model.AppError) *Plugin {
+		api := &plugintest.API{}
+		siteURL := "https://mattermost.example.com"
+		api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}}).Maybe()
+		api.On("KVGet", subscriptionsKey("MM/repo")).Return(repoSubs, nil)
+		api.On("KVGet", subscriptionsKey("MM/")).Return(nil, orgSubsErr)
+		api.On("KVGet", "user"+BitbucketTokenKey).Return(userInfo, nil).Maybe()
+		api.On("KVGet", mock.Anything).Return(nil, nil).Maybe()
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.setConfiguration(&Configuration{EncryptionKey: encryptionKey, BitbucketSelfHostedURL: server.URL})
+		return p
+	}
+
+	t.Run("subscriptions can't be loaded", func(t *testing.T) {
+		p := setup(model.NewAppError("KVGet", "", nil, "", http.StatusInternalServerError))
+
+		subs, err := p.GetSubscribedChannelsForRepository(pl)
+		assert.ErrorContains(t, err, "failed to get organization subscriptions")
+		assert.Nil(t, subs)
+	})
+
+	t.Run("permission can't be checked", func(t *testing.T) {
+		p := setup(nil)
+
+		subs, err := p.GetSubscribedChannelsForRepository(pl)
+		assert.ErrorContains(t, err, "failed to check the subscription creator's access to the repository")
+		assert.Nil(t, subs)
+	})
+}
+
+func TestSubscriptionCache(t *testing.T) {
+	t.Run("least recently used repositories are evicted", func(t *testing.T) {
+		c := newSubscriptionCache(2, time.Minute)
+		c.set("owner/one", nil)
+		c.set("owner/two", nil)
+
+		_, ok := c.get("owner/one")
+		assert.True(t, ok)
+		c.set("owner/three", nil)
+
+		_, ok = c.get("owner/two")
+		assert.False(t, ok)
+		_, ok = c.get("owner/one")
+		assert.True(t, ok)
+	})
+
+	t.Run("expired repositories are dropped", func(t *testing.T) {
+		c := newSubscriptionCache(2, -time.Second)
+		c.set("owner/one", nil)
+
+		_, ok := c.get("owner/one")
+		assert.False(t, ok)
+		assert.Zero(t, c.order.Len())
+	})
+
+	t.Run("cached subscriptions can't be modified", func(t *testing.T) {
+		c := newSubscriptionCache(2, time.Minute)
+		sub := &subscription.Subscription{
+			ChannelID: "channel",
+			Features:  subscription.Features{subscription.FeaturePulls},
+			Filters:   subscription.Filters{Branches: []string{"main"}},
+		}
+		c.set("owner/repo", []*subscription.Subscription{sub})
+		sub.Features[0] = subscription.FeatureIssues
+
+		subs, ok := c.get("owner/repo")
+		assert.True(t, ok)
+		subs[0].Filters.Branches[0] = "other"
+
+		subs, _ = c.get("owner/repo")
+		assert.Equal(t, subscription.Features{subscription.FeaturePulls}, subs[0].Features)
+		assert.Equal(t, []string{"main"}, subs[0].Filters.Branches)
+	})
+}
+
+func TestAddSubscriptionRetriesOnConflict(t *testing.T) {
+	existing := &subscription.Subscription{ChannelID: "channel1", Repository: "owner/repo"}
+	added := &subscription.Subscription{ChannelID: "channel2", Repository: "owner/repo"}
+
+	concurrentValue, _ := json.Marshal(repositorySubscriptions{
+		Repository:    "owner/repo",
+		Subscriptions: []*subscription.Subscription{existing},
+	})
+	expectedValue, _ := json.Marshal(repositorySubscriptions{
+		Repository:    "owner/repo",
+		Subscriptions: []*subscription.Subscription{existing, added},
+	})
+
+	api := &plugintest.API{}
+	indexed := mockKVIndex(api, KeySubscribedRepositories)
+	key := subscriptionsKey("owner/repo")
+	api.On("KVGet", key).Return(nil, nil).Once()
+	api.On("KVCompareAndSet", key, []byte(nil), mock.Anything).Return(false, nil).Once()
+	api.On("KVGet", key).Return(concurrentValue, nil).Once()
+	api.On("KVCompareAndSet", key, concurrentValue, expectedValue).Return(true, nil).Once()
+	api.On("PublishPluginClusterEvent", model.PluginClusterEvent{
+		Id:   ClusterEventSubscriptionsUpdated,
+		Data: []byte("owner/repo"),
+	}, mock.Anything).Return(nil)
+
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	err := p.AddSubscription("owner/repo", added)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"owner/repo"}, indexed())
+	api.AssertExpectations(t)
+
+	cached, err := p.getRepositorySubscriptions("owner/repo")
+	assert.NoError(t, err)
+	assert.Equal(t, []*subscription.Subscription{existing, added}, cached)
+}
+
+func TestSubscriptionReadsLegacyFeatures(t *testing.T) {
+	var sub subscription.Subscription
+	err := json.Unmarshal([]byte(`{"ChannelID":"1","Features":"pulls,pull_reviews,label:\"ruby\"","Repository":"owner/repo"}`), &sub)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sub.Version)
+	assert.Equal(t, subscription.Features{subscription.FeaturePulls, subscription.FeaturePullReviews}, sub.Features)
+	assert.Equal(t, []string{"ruby"}, sub.Filters.Labels)
+	assert.True(t, sub.PullReviews())
+	assert.False(t, sub.Issues())
+	assert.Equal(t, `pulls,pull_reviews,label:"ruby"`, sub.FeaturesString())
+
+	sub.Version = subscription.CurrentVersion
+	data, err := json.Marshal(&sub)
+	assert.NoError(t, err)
+
+	var roundTripped subscription.Subscription
+	assert.NoError(t, json.Unmarshal(data, &roundTripped))
+	assert.Equal(t, sub, roundTripped)
+}
+
+func TestMoveRepositorySubscriptions(t *testing.T) {
+	oldValue, _ := json.Marshal(repositorySubscriptions{
+		Repository:    "owner/old",
+		Subscriptions: []*subscription.Subscription{{ChannelID: "channel1", Repository: "owner/old"}},
+	})
+	newValue, _ := json.Marshal(repositorySubscriptions{
+		Repository:    "owner/new",
+		Subscriptions: []*subscription.Subscription{{ChannelID: "channel1", Repository: "owner/new"}},
+	})
+
+	api := &plugintest.API{}
+	indexed := mockKVIndex(api, KeySubscribedRepositories, "owner/old")
+	api.On("KVGet", subscriptionsKey("owner/old")).Return(oldValue, nil)
+	api.On("KVGet", subscriptionsKey("owner/new")).Return(nil, nil)
+	api.On("KVCompareAndSet", subscriptionsKey("owner/new"), []byte(nil), newValue).Return(true, nil).Once()
+	api.On("KVCompareAndDelete", subscriptionsKey("owner/old"), oldValue).Return(true, nil).Once()
+	api.On("PublishPluginClusterEvent", mock.Anything, mock.Anything).Return(nil)
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	err := p.moveRepositorySubscriptions("owner/old", "owner/new")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"owner/new"}, indexed())
+	api.AssertExpectations(t)
+}
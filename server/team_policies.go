@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// defaultTeamPolicy is the key of the policy applied to the teams without one of their own, and to
+// direct and group messages.
+const defaultTeamPolicy = "*"
+
+// teamSubscriptionPolicy restricts the subscriptions of the channels of a Mattermost team.
+type teamSubscriptionPolicy struct {
+	// Organizations lists the organizations that may be subscribed to. A Bitbucket Cloud entry may
+	// be limited to a project of the workspace as workspace/PROJECT. If empty, all the organizations
+	// allowed by the plugin may be subscribed to.
+	Organizations []string `json:"organizations"`
+
+	// ChannelAdminsOnly allows only channel admins to add and delete subscriptions.
+	ChannelAdminsOnly bool `json:"channel_admins_only"`
+}
+
+// parseTeamSubscriptionPolicies parses the policies configured by team name.
+func parseTeamSubscriptionPolicies(value string) (map[string]*teamSubscriptionPolicy, error) {
+	policies := map[string]*teamSubscriptionPolicy{}
+	if strings.TrimSpace(value) == "" {
+		return policies, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &policies); err != nil {
+		return nil, err
+	}
+	for team, policy := range policies {
+		if policy == nil {
+			return nil, errors.Errorf("the policy of the %s team is empty", team)
+		}
+	}
+
+	return policies, nil
+}
+
+// allowsOrganization reports whether all the repositories of the organization may be subscribed to.
+func (policy *teamSubscriptionPolicy) allowsOrganization(owner string) bool {
+	if len(policy.Organizations) == 0 {
+		return true
+	}
+
+	for _, org := range policy.Organizations {
+		if strings.EqualFold(org, owner) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsRepository reports whether a repository of the organization and project may be subscribed to.
+func (policy *teamSubscriptionPolicy) allowsRepository(owner, projectKey string) bool {
+	if policy.allowsOrganization(owner) {
+		return true
+	}
+	if projectKey == "" {
+		return false
+	}
+
+	for _, org := range policy.Organizations {
+		if strings.EqualFold(org, owner+"/"+projectKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getChannelSubscriptionPolicy returns the policy of the team of the channel, and the team's
+// display name for the denial messages. The policy is nil if there is none.
+func (p *Plugin) getChannelSubscriptionPolicy(channelID string) (*teamSubscriptionPolicy, string, error) {
+	policies, err := parseTeamSubscriptionPolicies(p.getConfiguration().TeamSubscriptionPolicies)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "invalid team subscription policies")
+	}
+	if len(policies) == 0 {
+		return nil, "", nil
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return nil, "", errors.Wrap(appErr, "failed to get channel")
+	}
+
+	if channel.TeamId != "" {
+		team, appErr := p.API.GetTeam(channel.TeamId)
+		if appErr != nil {
+			return nil, "", errors.Wrap(appErr, "failed to get team")
+		}
+		if policy, ok := policies[team.Name]; ok {
+			return policy, team.DisplayName, nil
+		}
+		return policies[defaultTeamPolicy], team.DisplayName, nil
+	}
+
+	return policies[defaultTeamPolicy], "", nil
+}
+
+// checkCanManageSubscriptions returns a denial message if the policy of the team only allows
+// channel admins to manage the subscriptions of the channel and the user isn't one. Direct and
+// group messages have no channel admins, so their members can always manage the subscriptions.
+func (p *Plugin) checkCanManageSubscriptions(userID, channelID string) (string, error) {
+	policy, teamName, err := p.getChannelSubscriptionPolicy(channelID)
+	if err != nil {
+		return "", err
+	}
+	if policy == nil || !policy.ChannelAdminsOnly {
+		return "", nil
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "failed to get channel")
+	}
+	if channel.IsGroupOrDirect() {
+		return "", nil
+	}
+
+	if p.API.HasPermissionToChannel(userID, channelID, model.PermissionManageChannelRoles) {
+		return "", nil
+	}
+
+	return fmt.Sprintf("Only channel admins can manage the subscriptions of the channels in the %s team.", teamName), nil
+}
+
+// checkTeamSubscriptionPolicy checks that the policy of the team of the channel allows subscribing
+// to the repository, given with the key of its project, or to the organization if repo is empty.
+func (p *Plugin) checkTeamSubscriptionPolicy(channelID, owner, repo, projectKey string) error {
+	policy, teamName, err := p.getChannelSubscriptionPolicy(channelID)
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+
+	if repo == "" {
+		if policy.allowsOrganization(owner) {
+			return nil
+		}
+	} else if policy.allowsRepository(owner, projectKey) {
+		return nil
+	}
+
+	where := "this channel"
+	if teamName != "" {
+		where = fmt.Sprintf("the %s team", teamName)
+	}
+	return errors.Errorf("subscriptions in %s are limited to %s", where, strings.Join(policy.Organizations, ", "))
+}
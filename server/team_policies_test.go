@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+)
+
+func TestTeamSubscriptionPolicies(t *testing.T) {
+	const policies = `{
+		"engineering": {"organizations": ["acme", "acme-labs/WEB"], "channel_admins_only": true},
+		"*": {"organizations": ["public"]}
+	}`
+
+	setup := func(t *testing.T, policies string) *Plugin {
+		api := &plugintest.API{}
+		api.On("GetChannel", "engineering-channel").Return(&model.Channel{Id: "engineering-channel", TeamId: "engineering-team"}, nil).Maybe()
+		api.On("GetChannel", "sales-channel").Return(&model.Channel{Id: "sales-channel", TeamId: "sales-team"}, nil).Maybe()
+		api.On("GetChannel", "dm-channel").Return(&model.Channel{Id: "dm-channel", Type: model.ChannelTypeDirect}, nil).Maybe()
+		api.On("GetTeam", "engineering-team").Return(&model.Team{Id: "engineering-team", Name: "engineering", DisplayName: "Engineering"}, nil).Maybe()
+		api.On("GetTeam", "sales-team").Return(&model.Team{Id: "sales-team", Name: "sales", DisplayName: "Sales"}, nil).Maybe()
+		api.On("HasPermissionToChannel", "admin", "engineering-channel", model.PermissionManageChannelRoles).Return(true).Maybe()
+		api.On("HasPermissionToChannel", "member", "engineering-channel", model.PermissionManageChannelRoles).Return(false).Maybe()
+		t.Cleanup(func() { api.AssertExpectations(t) })
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.setConfiguration(&Configuration{TeamSubscriptionPolicies: policies})
+		return p
+	}
+
+	t.Run("organizations", func(t *testing.T) {
+		p := setup(t, policies)
+
+		for name, tc := range map[string]struct {
+			ChannelID     string
+			Owner         string
+			Repo          string
+			ProjectKey    string
+			ExpectedError string
+		}{
+			"allowed organization":       {ChannelID: "engineering-channel", Owner: "ACME", Repo: "app"},
+			"allowed project":            {ChannelID: "engineering-channel", Owner: "acme-labs", Repo: "site", ProjectKey: "WEB"},
+			"whole organization allowed": {ChannelID: "engineering-channel", Owner: "acme"},
+			"other project": {
+				ChannelID: "engineering-channel", Owner: "acme-labs", Repo: "infra", ProjectKey: "OPS",
+				ExpectedError: "subscriptions in the Engineering team are limited to acme, acme-labs/WEB",
+			},
+			"organization with an allowed project": {
+				ChannelID:     "engineering-channel",
+				Owner:         "acme-labs",
+				ExpectedError: "subscriptions in the Engineering team are limited to acme, acme-labs/WEB",
+			},
+			"default policy": {
+				ChannelID: "sales-channel", Owner: "acme", Repo: "app",
+				ExpectedError: "subscriptions in the Sales team are limited to public",
+			},
+			"direct messages": {
+				ChannelID: "dm-channel", Owner: "acme", Repo: "app",
+				ExpectedError: "subscriptions in this channel are limited to public",
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				err := p.checkTeamSubscriptionPolicy(tc.ChannelID, tc.Owner, tc.Repo, tc.ProjectKey)
+				if tc.ExpectedError == "" {
+					assert.NoError(t, err)
+				} else {
+					assert.EqualError(t, err, tc.ExpectedError)
+				}
+			})
+		}
+	})
+
+	t.Run("channel admins only", func(t *testing.T) {
+		p := setup(t, policies)
+
+		denial, err := p.checkCanManageSubscriptions("admin", "engineering-channel")
+		require.NoError(t, err)
+		assert.Empty(t, denial)
+
+		denial, err = p.checkCanManageSubscriptions("member", "engineering-channel")
+		require.NoError(t, err)
+		assert.Equal(t, "Only channel admins can manage the subscriptions of the channels in the Engineering team.", denial)
+
+		denial, err = p.checkCanManageSubscriptions("member", "sales-channel")
+		require.NoError(t, err)
+		assert.Empty(t, denial)
+	})
+
+	t.Run("channel admins only in direct messages", func(t *testing.T) {
+		p := setup(t, `{"*": {"channel_admins_only": true}}`)
+
+		denial, err := p.checkCanManageSubscriptions("member", "dm-channel")
+		require.NoError(t, err)
+		assert.Empty(t, denial)
+	})
+
+	t.Run("channel admins only in a team without a display name", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", TeamId: "team", Type: model.ChannelTypeOpen}, nil)
+		api.On("GetTeam", "team").Return(&model.Team{Id: "team", Name: "team"}, nil)
+		api.On("HasPermissionToChannel", "member", "channel", model.PermissionManageChannelRoles).Return(false)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.setConfiguration(&Configuration{TeamSubscriptionPolicies: `{"*": {"channel_admins_only": true}}`})
+
+		denial, err := p.checkCanManageSubscriptions("member", "channel")
+		require.NoError(t, err)
+		assert.NotEmpty(t, denial)
+	})
+
+	t.Run("no policies", func(t *testing.T) {
+		p := setup(t, "")
+
+		assert.NoError(t, p.checkTeamSubscriptionPolicy("engineering-channel", "other", "app", ""))
+		denial, err := p.checkCanManageSubscriptions("member", "engineering-channel")
+		require.NoError(t, err)
+		assert.Empty(t, denial)
+	})
+
+	t.Run("invalid policies", func(t *testing.T) {
+		config := &Configuration{
+			BitbucketOAuthClientID:     "id",
+			BitbucketOAuthClientSecret: "secret",
+			EncryptionKey:              "key",
+			WebhookSecret:              "secret",
+			TeamSubscriptionPolicies:   `{"engineering": ["acme"]}`,
+		}
+		assert.Error(t, config.IsValid())
+
+		config.TeamSubscriptionPolicies = policies
+		assert.NoError(t, config.IsValid())
+	})
+}
@@ -0,0 +1,29 @@
+package templaterenderer
+
+import (
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func (tr *templateRenderer) RenderCommitStatusFailedEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitStatusPayload) (string, error) {
+	return tr.renderTemplate(pl, "commitStatusFailedEventNotificationForSubscribedChannels", `
+{{template "repo" .Repository}} Build {{template "commitStatus" .}} failed{{template "commitStatusRef" .}}
+{{- if .CommitStatus.Description}}
+{{.CommitStatus.Description | quote}}
+{{- end}}
+`)
+}
+
+func (tr *templateRenderer) RenderCommitStatusSuccessfulEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitStatusPayload) (string, error) {
+	return tr.renderTemplate(pl, "commitStatusSuccessfulEventNotificationForSubscribedChannels", `
+{{template "repo" .Repository}} Build {{template "commitStatus" .}} passed{{template "commitStatusRef" .}}
+`)
+}
+
+func (tr *templateRenderer) RenderCommitStatusFailedNotificationForAuthors(pl webhookpayload.RepoCommitStatusPayload) (string, error) {
+	return tr.renderTemplate(pl, "commitStatusFailedNotificationForAuthors", `
+Build {{template "commitStatus" .}} of {{template "repo" .Repository}} failed{{template "commitStatusRef" .}}
+{{- if .CommitStatus.Description}}
+{{.CommitStatus.Description | quote}}
+{{- end}}
+`)
+}
@@ -0,0 +1,48 @@
+package templaterenderer
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"testing"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func TestBuildTemplates(t *testing.T) {
+	tr := MakeTemplateRenderer()
+	tr.RegisterBitBucketAccountIDToUsernameMappingCallback(bitBucketAccountIDToUsernameMappingTestCallback)
+
+	build := "[Pipeline #42](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket/addon/pipelines/home#!/results/42)"
+	ref := " on `master` for commit [dca554](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket/commits/dca5546b6b1419ff71adcada81b457caf3dcbdcd)"
+
+	t.Run("RenderCommitStatusFailedEventNotificationForSubscribedChannels", func(t *testing.T) {
+		expected := "\n[\\[mattermost-plugin-bitbucket\\]](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket) " +
+			"Build " + build + " failed" + ref +
+			"\n>Tests failed\n"
+
+		actual, err := tr.RenderCommitStatusFailedEventNotificationForSubscribedChannels(getTestRepoCommitStatusPayload(webhookpayload.CommitStatusFailed))
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("RenderCommitStatusSuccessfulEventNotificationForSubscribedChannels", func(t *testing.T) {
+		expected := "\n[\\[mattermost-plugin-bitbucket\\]](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket) " +
+			"Build " + build + " passed" + ref + "\n"
+
+		actual, err := tr.RenderCommitStatusSuccessfulEventNotificationForSubscribedChannels(getTestRepoCommitStatusPayload(webhookpayload.CommitStatusSuccessful))
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("RenderCommitStatusFailedNotificationForAuthors", func(t *testing.T) {
+		expected := "\nBuild " + build + " of [\\[mattermost-plugin-bitbucket\\]](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket) failed" + ref +
+			"\n>Tests failed\n"
+
+		actual, err := tr.RenderCommitStatusFailedNotificationForAuthors(getTestRepoCommitStatusPayload(webhookpayload.CommitStatusFailed))
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+}
@@ -0,0 +1,26 @@
+package templaterenderer
+
+import (
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func (tr *templateRenderer) RenderCommitCommentCreatedEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitCommentCreatedPayload) (string, error) {
+	return tr.renderTemplate(pl, "commitCommentCreatedEventNotificationForSubscribedChannels", `
+{{template "repo" .Repository}} New comment by {{template "user" .Actor}} on commit {{template "commit" .}}:
+{{.Comment.Content.HTML | replaceAllBitBucketUsernames | quote}}
+`)
+}
+
+func (tr *templateRenderer) RenderCommitCommentNotificationForCommitAuthor(pl webhookpayload.RepoCommitCommentCreatedPayload) (string, error) {
+	return tr.renderTemplate(pl, "commitCommentNotificationForCommitAuthor", `
+{{template "user" .Actor}} commented on your commit {{template "commit" .}} in {{template "repo" .Repository}}:
+{{.Comment.Content.HTML | replaceAllBitBucketUsernames | quote}}
+`)
+}
+
+func (tr *templateRenderer) RenderCommitCommentMentionNotification(pl webhookpayload.RepoCommitCommentCreatedPayload) (string, error) {
+	return tr.renderTemplate(pl, "commitCommentMentionNotification", `
+{{template "user" .Actor}} mentioned you on commit {{template "commit" .}} in {{template "repo" .Repository}}:
+{{.Comment.Content.HTML | replaceAllBitBucketUsernames | quote}}
+`)
+}
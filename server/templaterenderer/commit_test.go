@@ -0,0 +1,45 @@
+package templaterenderer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitCommentTemplates(t *testing.T) {
+	tr := MakeTemplateRenderer()
+	tr.RegisterBitBucketAccountIDToUsernameMappingCallback(bitBucketAccountIDToUsernameMappingTestCallback)
+
+	repo := "[\\[mattermost-plugin-bitbucket\\]](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket)"
+	commit := "[dca554](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket/commits/dca5546b6b1419ff71adcada81b457caf3dcbdcd)"
+
+	t.Run("RenderCommitCommentCreatedEventNotificationForSubscribedChannels", func(t *testing.T) {
+		expected := "\n" + repo + " New comment by @testMmUser on commit " + commit + ":" +
+			"\n>this issue should be fixed by @testMmUser\n"
+
+		actual, err := tr.RenderCommitCommentCreatedEventNotificationForSubscribedChannels(getTestRepoCommitCommentCreatedPayload())
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("RenderCommitCommentNotificationForCommitAuthor", func(t *testing.T) {
+		expected := "\n@testMmUser commented on your commit " + commit + " in " + repo + ":" +
+			"\n>this issue should be fixed by @testMmUser\n"
+
+		actual, err := tr.RenderCommitCommentNotificationForCommitAuthor(getTestRepoCommitCommentCreatedPayload())
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("RenderCommitCommentMentionNotification", func(t *testing.T) {
+		expected := "\n@testMmUser mentioned you on commit " + commit + " in " + repo + ":" +
+			"\n>this issue should be fixed by @testMmUser\n"
+
+		actual, err := tr.RenderCommitCommentMentionNotification(getTestRepoCommitCommentCreatedPayload())
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+}
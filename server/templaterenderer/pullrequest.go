@@ -91,3 +91,34 @@ func (tr *templateRenderer) RenderPullRequestUnapprovedNotificationForPullReques
 {{template "user" .Actor}} unapproved your pull request {{template "repoPullRequestWithTitle" .}}
 `)
 }
+
+func (tr *templateRenderer) RenderPullRequestThreadRootMessage(repository webhookpayload.Repository, pullRequest webhookpayload.PullRequest) (string, error) {
+	pl := struct {
+		Repository  webhookpayload.Repository
+		PullRequest webhookpayload.PullRequest
+	}{repository, pullRequest}
+
+	return tr.renderTemplate(pl, "pullRequestThreadRootMessage", `
+#### {{template "repoPullRequestWithTitle" .}}
+**Status:** {{.PullRequest.State | lower | title}} | **Approvals:** {{.PullRequest.ApprovalCount}}
+`)
+}
+
+// RenderPullRequestCard renders the text of a pull request card, shown by clients that can't render the card.
+func (tr *templateRenderer) RenderPullRequestCard(repository webhookpayload.Repository, pullRequest webhookpayload.PullRequest, buildStatus string) (string, error) {
+	pl := struct {
+		Repository  webhookpayload.Repository
+		PullRequest webhookpayload.PullRequest
+		BuildStatus string
+	}{repository, pullRequest, buildStatus}
+
+	return tr.renderTemplate(pl, "pullRequestCard", `
+#### {{template "repoPullRequestWithTitle" .}}
+`+"`{{.PullRequest.Source.Branch.Name}}` → `{{.PullRequest.Destination.Branch.Name}}`"+` by {{template "user" .PullRequest.Author}}
+**Status:** {{.PullRequest.State | lower | title}} | **Approvals:** {{.PullRequest.ApprovalCount}}
+{{- if .BuildStatus}} | **Build:** {{.BuildStatus | lower | title}}{{end}} | **Comments:** {{.PullRequest.CommentCount}}
+{{- if .PullRequest.Reviewers}}
+**Reviewers:** {{range $i, $reviewer := .PullRequest.Reviewers}}{{if $i}}, {{end}}{{template "user" $reviewer}}{{end}}
+{{- end}}
+`)
+}
@@ -4,6 +4,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"testing"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
 )
 
 func TestPrTemplates(t *testing.T) {
@@ -161,4 +163,41 @@ func TestPrTemplates(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, expected, actual)
 	})
+
+	t.Run("RenderPullRequestThreadRootMessage", func(t *testing.T) {
+		expected := "\n#### [mattermost-plugin-bitbucket#1]" +
+			"(https://bitbucket.org/mattermost/mattermost-plugin-bitbucket/pull-requests/1) - Test title" +
+			"\n**Status:** Merged | **Approvals:** 1\n"
+
+		pullRequest := getTestPullRequest()
+		pullRequest.State = "MERGED"
+		pullRequest.Participants = []webhookpayload.Participant{{Approved: true}, {Approved: false}}
+
+		actual, err := tr.RenderPullRequestThreadRootMessage(getTestRepository(), pullRequest)
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("RenderPullRequestCard", func(t *testing.T) {
+		expected := "\n#### [mattermost-plugin-bitbucket#1]" +
+			"(https://bitbucket.org/mattermost/mattermost-plugin-bitbucket/pull-requests/1) - Test title" +
+			"\n`feature` → `master` by @testMmUser" +
+			"\n**Status:** Open | **Approvals:** 1 | **Build:** Failed | **Comments:** 3" +
+			"\n**Reviewers:** @testMmUser, [testnickname](https://bitbucket.org/test-testnickname-url/)\n"
+
+		pullRequest := getTestPullRequest()
+		pullRequest.State = "OPEN"
+		pullRequest.CommentCount = 3
+		pullRequest.Author = getTestOwnerThatHasMmAccount()
+		pullRequest.Source.Branch.Name = "feature"
+		pullRequest.Destination.Branch.Name = "master"
+		pullRequest.Reviewers = []webhookpayload.Owner{getTestOwnerThatHasMmAccount(), getTestOwnerThatDoesntHaveAccount()}
+		pullRequest.Participants = []webhookpayload.Participant{{Approved: true}}
+
+		actual, err := tr.RenderPullRequestCard(getTestRepository(), pullRequest, "FAILED")
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
 }
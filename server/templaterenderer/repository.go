@@ -0,0 +1,34 @@
+package templaterenderer
+
+import (
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func (tr *templateRenderer) RenderRepoForkEventNotificationForSubscribedChannels(pl webhookpayload.RepoForkPayload) (string, error) {
+	return tr.renderTemplate(pl, "repoForkEventNotificationForSubscribedChannels", `
+{{template "repo" .Repository}} was forked to {{template "repo" .Fork}} by {{template "user" .Actor}}
+`)
+}
+
+func (tr *templateRenderer) RenderRepoUpdatedEventNotificationForSubscribedChannels(pl webhookpayload.RepoUpdatedPayload) (string, error) {
+	return tr.renderTemplate(pl, "repoUpdatedEventNotificationForSubscribedChannels", `
+{{template "repo" .Repository}} settings were updated by {{template "user" .Actor}}:
+{{- with .Changes}}
+{{- if ne .FullName.Old .FullName.New}}
+* Renamed from `+"`{{.FullName.Old}}`"+` to `+"`{{.FullName.New}}`"+`
+{{- else if ne .Name.Old .Name.New}}
+* Name changed from `+"`{{.Name.Old}}`"+` to `+"`{{.Name.New}}`"+`
+{{- end}}
+{{- if ne .Description.Old .Description.New}}
+* Description {{if .Description.New}}changed to:
+{{.Description.New | quote}}{{else}}removed{{end}}
+{{- end}}
+{{- if ne .Website.Old .Website.New}}
+* Website {{if .Website.New}}changed to {{.Website.New}}{{else}}removed{{end}}
+{{- end}}
+{{- if ne .Language.Old .Language.New}}
+* Language {{if .Language.New}}changed to {{.Language.New}}{{else}}removed{{end}}
+{{- end}}
+{{- end}}
+`)
+}
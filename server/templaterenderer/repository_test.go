@@ -0,0 +1,37 @@
+package templaterenderer
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"testing"
+)
+
+func TestRepositoryTemplates(t *testing.T) {
+	tr := MakeTemplateRenderer()
+	tr.RegisterBitBucketAccountIDToUsernameMappingCallback(bitBucketAccountIDToUsernameMappingTestCallback)
+
+	t.Run("RenderRepoForkEventNotificationForSubscribedChannels", func(t *testing.T) {
+		expected := "\n[\\[mattermost-plugin-bitbucket\\]](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket) " +
+			"was forked to [\\[testnickname/mattermost-plugin-bitbucket\\]](https://bitbucket.org/testnickname/mattermost-plugin-bitbucket) " +
+			"by @testMmUser\n"
+
+		actual, err := tr.RenderRepoForkEventNotificationForSubscribedChannels(getTestRepoForkPayload())
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("RenderRepoUpdatedEventNotificationForSubscribedChannels", func(t *testing.T) {
+		expected := "\n[\\[mattermost-plugin-bitbucket\\]](https://bitbucket.org/mattermost/mattermost-plugin-bitbucket) " +
+			"settings were updated by @testMmUser:" +
+			"\n* Renamed from `mattermost/bitbucket-plugin` to `mattermost/mattermost-plugin-bitbucket`" +
+			"\n* Description changed to:" +
+			"\n>Bitbucket plugin for Mattermost" +
+			"\n* Website removed\n"
+
+		actual, err := tr.RenderRepoUpdatedEventNotificationForSubscribedChannels(getTestRepoUpdatedPayload())
+
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+}
@@ -41,7 +41,17 @@ type TemplateRenderer interface {
 	RenderPullRequestMergedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestMergedPayload) (string, error)
 	RenderPullRequestUnapprovedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestUnapprovedPayload) (string, error)
 	RenderPullRequestUnapprovedNotificationForPullRequestAuthor(pl webhookpayload.PullRequestUnapprovedPayload) (string, error)
+	RenderPullRequestThreadRootMessage(repository webhookpayload.Repository, pullRequest webhookpayload.PullRequest) (string, error)
+	RenderPullRequestCard(repository webhookpayload.Repository, pullRequest webhookpayload.PullRequest, buildStatus string) (string, error)
 	RenderRepoPushEventNotificationForSubscribedChannels(pl webhookpayload.RepoPushPayload) (string, error)
+	RenderRepoForkEventNotificationForSubscribedChannels(pl webhookpayload.RepoForkPayload) (string, error)
+	RenderCommitCommentCreatedEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitCommentCreatedPayload) (string, error)
+	RenderCommitCommentNotificationForCommitAuthor(pl webhookpayload.RepoCommitCommentCreatedPayload) (string, error)
+	RenderCommitCommentMentionNotification(pl webhookpayload.RepoCommitCommentCreatedPayload) (string, error)
+	RenderCommitStatusFailedEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitStatusPayload) (string, error)
+	RenderCommitStatusSuccessfulEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitStatusPayload) (string, error)
+	RenderCommitStatusFailedNotificationForAuthors(pl webhookpayload.RepoCommitStatusPayload) (string, error)
+	RenderRepoUpdatedEventNotificationForSubscribedChannels(pl webhookpayload.RepoUpdatedPayload) (string, error)
 }
 
 type templateRenderer struct {
@@ -137,6 +147,22 @@ func (tr *templateRenderer) init() {
 		`[\[{{.Repository.FullName}}#{{.Issue.ID}}\]]({{.Issue.Links.HTML.Href}})`,
 	))
 
+	// The commit template links to the commit of a commit comment.
+	template.Must(tr.masterTemplate.New("commit").Parse(
+		`[{{.Commit.Hash | substr 0 6}}]({{.Repository.Links.HTML.Href}}/commits/{{.Commit.Hash}})`,
+	))
+
+	// The commitStatus template links to the build of a commit status.
+	template.Must(tr.masterTemplate.New("commitStatus").Parse(
+		`{{if .CommitStatus.URL}}[{{.CommitStatus.Name}}]({{.CommitStatus.URL}}){{else}}{{.CommitStatus.Name}}{{end}}`,
+	))
+
+	// The commitStatusRef template describes the branch and commit of a commit status.
+	template.Must(tr.masterTemplate.New("commitStatusRef").Parse(
+		`{{if .CommitStatus.Refname}} on ` + "`{{.CommitStatus.Refname}}`" + `{{end}}` +
+			` for commit [{{.CommitStatus.Commit.Hash | substr 0 6}}]({{.Repository.Links.HTML.Href}}/commits/{{.CommitStatus.Commit.Hash}})`,
+	))
+
 	// The user template links to the corresponding user in Mattermost or in BitBucket.
 	template.Must(tr.masterTemplate.New("user").Parse(`
 {{- $mattermostUsername := .AccountID | lookupMattermostUsername}}
@@ -283,3 +283,58 @@ func getTestRepoPushChangeTagDeleted() webhookpayload.RepoPushChange {
 
 	return pushChange
 }
+
+func getTestRepoForkPayload() webhookpayload.RepoForkPayload {
+	fork := webhookpayload.Repository{FullName: "testnickname/mattermost-plugin-bitbucket"}
+	fork.Links.HTML.Href = "https://bitbucket.org/testnickname/mattermost-plugin-bitbucket"
+
+	return webhookpayload.RepoForkPayload{
+		Actor:      getTestOwnerThatHasMmAccount(),
+		Repository: getTestRepository(),
+		Fork:       fork,
+	}
+}
+
+func getTestRepoUpdatedPayload() webhookpayload.RepoUpdatedPayload {
+	pl := webhookpayload.RepoUpdatedPayload{
+		Actor:      getTestOwnerThatHasMmAccount(),
+		Repository: getTestRepository(),
+	}
+	pl.Changes.FullName.Old = "mattermost/bitbucket-plugin"
+	pl.Changes.FullName.New = "mattermost/mattermost-plugin-bitbucket"
+	pl.Changes.Name.Old = "bitbucket-plugin"
+	pl.Changes.Name.New = "mattermost-plugin-bitbucket"
+	pl.Changes.Description.Old = "A plugin"
+	pl.Changes.Description.New = "Bitbucket plugin for Mattermost"
+	pl.Changes.Website.Old = "https://example.com"
+
+	return pl
+}
+
+func getTestRepoCommitStatusPayload(state string) webhookpayload.RepoCommitStatusPayload {
+	pl := webhookpayload.RepoCommitStatusPayload{
+		Actor:      getTestOwnerThatDoesntHaveAccount(),
+		Repository: getTestRepository(),
+	}
+	pl.CommitStatus.Name = "Pipeline #42"
+	pl.CommitStatus.URL = "https://bitbucket.org/mattermost/mattermost-plugin-bitbucket/addon/pipelines/home#!/results/42"
+	pl.CommitStatus.State = state
+	pl.CommitStatus.Refname = "master"
+	pl.CommitStatus.Commit.Hash = "dca5546b6b1419ff71adcada81b457caf3dcbdcd"
+	if state == webhookpayload.CommitStatusFailed {
+		pl.CommitStatus.Description = "Tests failed"
+	}
+
+	return pl
+}
+
+func getTestRepoCommitCommentCreatedPayload() webhookpayload.RepoCommitCommentCreatedPayload {
+	pl := webhookpayload.RepoCommitCommentCreatedPayload{
+		Actor:      getTestOwnerThatHasMmAccount(),
+		Repository: getTestRepository(),
+		Comment:    getTestCommentWithMentionAboutMmUser(),
+	}
+	pl.Commit.Hash = "dca5546b6b1419ff71adcada81b457caf3dcbdcd"
+
+	return pl
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+)
+
+const (
+	// KeyThread prefixes the keys of the root posts of threads, per channel.
+	KeyThread = "thread_"
+
+	// PropThreadRoot marks the root posts of threads with the key of their thread.
+	PropThreadRoot = "bitbucket_thread_root"
+
+	// threadExpirySeconds limits how long later events are posted to a thread.
+	threadExpirySeconds = 90 * 24 * 60 * 60
+)
+
+// threadRoot is the root post of a thread in a channel.
+type threadRoot struct {
+	PostID string
+}
+
+func threadKey(channelID, key string) string {
+	hash := sha256.Sum256([]byte(channelID + "/" + key))
+	return KeyThread + hex.EncodeToString(hash[:])
+}
+
+// newThreadRootPost returns the root post of a thread in the channel of the post. It only
+// summarizes the state of the object, while the events are posted as replies.
+func newThreadRootPost(post *model.Post, thread *webhook.Thread) *model.Post {
+	root := &model.Post{
+		UserId:    post.UserId,
+		ChannelId: post.ChannelId,
+		Type:      post.Type,
+		Message:   strings.TrimSpace(thread.RootMessage),
+	}
+	root.AddProp(PropThreadRoot, thread.Key)
+	return root
+}
+
+func (p *Plugin) getThreadRoot(key string) (*threadRoot, []byte, error) {
+	value, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to get thread root")
+	}
+	if value == nil {
+		return nil, nil, nil
+	}
+
+	var root threadRoot
+	if err := json.Unmarshal(value, &root); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode thread root")
+	}
+
+	return &root, value, nil
+}
+
+// getThreadRootPost returns the root post of the thread, or nil if there is none or it was deleted.
+func (p *Plugin) getThreadRootPost(key string) (*threadRoot, *model.Post, []byte, error) {
+	root, value, err := p.getThreadRoot(key)
+	if err != nil || root == nil {
+		return nil, nil, value, err
+	}
+
+	post, appErr := p.API.GetPost(root.PostID)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			return nil, nil, value, nil
+		}
+		return nil, nil, nil, errors.Wrap(appErr, "failed to get thread root post")
+	}
+	if post.DeleteAt != 0 {
+		return nil, nil, value, nil
+	}
+
+	return root, post, value, nil
+}
+
+// createThreadedPost posts a reply to the thread in the channel of the post, and updates the
+// root post's state. The root post is created with the first reply.
+func (p *Plugin) createThreadedPost(post *model.Post, thread *webhook.Thread) (*model.Post, error) {
+	key := threadKey(post.ChannelId, thread.Key)
+
+	root, rootPost, oldValue, err := p.getThreadRootPost(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if root == nil {
+		root, err = p.createThreadRootPost(key, oldValue, newThreadRootPost(post, thread))
+		if err != nil {
+			return nil, err
+		}
+		rootPost = nil
+	}
+
+	reply := post.Clone()
+	reply.RootId = root.PostID
+	created, appErr := p.API.CreatePost(reply)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to create thread reply")
+	}
+
+	if rootPost != nil {
+		rootPost.Message = strings.TrimSpace(thread.RootMessage)
+		if _, appErr = p.API.UpdatePost(rootPost); appErr != nil {
+			p.API.LogWarn("Failed to update thread root post", "postID", rootPost.Id, "err", appErr.Error())
+		}
+	}
+
+	return created, nil
+}
+
+// createThreadRootPost creates the root post of the thread, unless another event started the
+// thread concurrently, and returns the thread's root.
+func (p *Plugin) createThreadRootPost(key string, oldValue []byte, rootPost *model.Post) (*threadRoot, error) {
+	created, appErr := p.API.CreatePost(rootPost)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to create thread root post")
+	}
+
+	value, err := json.Marshal(threadRoot{PostID: created.Id})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode thread root")
+	}
+
+	stored, appErr := p.API.KVSetWithOptions(key, value, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        oldValue,
+		ExpireInSeconds: threadExpirySeconds,
+	})
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to store thread root")
+	}
+	if stored {
+		return &threadRoot{PostID: created.Id}, nil
+	}
+
+	// Another event started the thread concurrently, so reply to that one instead
+	if appErr = p.API.DeletePost(created.Id); appErr != nil {
+		p.API.LogWarn("Failed to delete duplicate thread root post", "postID", created.Id, "err", appErr.Error())
+	}
+
+	root, _, _, err := p.getThreadRootPost(key)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, errors.New("thread root post disappeared")
+	}
+
+	return root, nil
+}
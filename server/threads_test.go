@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+)
+
+func TestCreateThreadedPost(t *testing.T) {
+	thread := &webhook.Thread{Key: "pr/owner/repo/1", RootMessage: "\n#### PR\n**Status:** Open\n", Channels: []string{"channel"}}
+	key := threadKey("channel", thread.Key)
+
+	t.Run("first post creates the root and replies to it", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return(nil, nil)
+		api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.RootId == "" && post.Message == "#### PR\n**Status:** Open" &&
+				post.GetProp(PropThreadRoot) == thread.Key && post.GetProp(PropPullRequestComment) == nil && len(post.Attachments()) == 0
+		})).Return(&model.Post{Id: "root"}, nil).Once()
+		api.On("KVSetWithOptions", key, []byte(`{"PostID":"root"}`), model.PluginKVSetOptions{
+			Atomic:          true,
+			ExpireInSeconds: threadExpirySeconds,
+		}).Return(true, nil)
+		api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.RootId == "root" && post.Message == "commented" && post.GetProp(PropPullRequestComment) != nil
+		})).Return(&model.Post{Id: "reply"}, nil).Once()
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		post := &model.Post{ChannelId: "channel", Message: "commented"}
+		post.AddProp(PropPullRequestComment, map[string]interface{}{"repository": "owner/repo"})
+		created, err := p.createThreadedPost(post, thread)
+
+		require.NoError(t, err)
+		assert.Equal(t, "reply", created.Id)
+		api.AssertExpectations(t)
+	})
+
+	t.Run("later posts reply and update the root", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return([]byte(`{"PostID":"root"}`), nil)
+		api.On("GetPost", "root").Return(&model.Post{Id: "root", Message: "old"}, nil)
+		api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.RootId == "root" && post.Message == "approved"
+		})).Return(&model.Post{Id: "reply"}, nil)
+		api.On("UpdatePost", &model.Post{Id: "root", Message: "#### PR\n**Status:** Open"}).Return(&model.Post{Id: "root"}, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		created, err := p.createThreadedPost(&model.Post{ChannelId: "channel", Message: "approved"}, thread)
+
+		require.NoError(t, err)
+		assert.Equal(t, "reply", created.Id)
+		api.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// userTokenSource refreshes the token of a connected user when it expires. Bitbucket rotates
+// refresh tokens, so every refreshed token is stored, and a user whose token can't be refreshed
+// anymore is disconnected and asked to reconnect.
+type userTokenSource struct {
+	p        *Plugin
+	userInfo *BitbucketUserInfo
+
+	mu   sync.Mutex
+	base oauth2.TokenSource
+}
+
+// userTokenSource returns a token source for the user. The token of userInfo is kept up to date,
+// so storing userInfo afterwards doesn't overwrite a refreshed token.
+func (p *Plugin) userTokenSource(userInfo *BitbucketUserInfo) oauth2.TokenSource {
+	return &userTokenSource{
+		p:        p,
+		userInfo: userInfo,
+		base:     p.getOAuthConfig().TokenSource(context.Background(), userInfo.Token),
+	}
+}
+
+func (s *userTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, err := s.base.Token()
+	if err != nil {
+		if token, err = s.handleRefreshError(err); err != nil {
+			return nil, err
+		}
+	}
+
+	if token.AccessToken != s.userInfo.Token.AccessToken {
+		s.userInfo.Token = token
+		if err := s.p.storeBitbucketUserInfo(s.userInfo); err != nil {
+			s.p.API.LogWarn("Failed to store refreshed token", "userID", s.userInfo.UserID, "err", err.Error())
+		}
+	}
+
+	return token, nil
+}
+
+func (s *userTokenSource) handleRefreshError(err error) (*oauth2.Token, error) {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || (retrieveErr.ErrorCode != "invalid_grant" && retrieveErr.ErrorCode != "unauthorized_client") {
+		return nil, err
+	}
+
+	// The refresh token is also rejected when another request rotated it first, in which case
+	// the token it stored is used instead. If that one expired too, it is refreshed, and Token
+	// stores the result like any other refreshed token.
+	stored, apiErr := s.p.getBitbucketUserInfo(s.userInfo.UserID)
+	if apiErr == nil && stored.Token.RefreshToken != s.userInfo.Token.RefreshToken {
+		s.userInfo.Token = stored.Token
+		s.base = s.p.getOAuthConfig().TokenSource(context.Background(), stored.Token)
+		return s.base.Token()
+	}
+
+	s.p.API.LogWarn("Bitbucket rejected the refresh token, disconnecting the user", "userID", s.userInfo.UserID, "err", err.Error())
+	s.p.disconnectBitbucketAccount(s.userInfo.UserID)
+	s.p.sendReconnectMessage(s.userInfo.UserID)
+
+	return nil, err
+}
+
+// sendReconnectMessage tells a user whose connection to Bitbucket expired how to reconnect.
+func (p *Plugin) sendReconnectMessage(userID string) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		return
+	}
+
+	message := fmt.Sprintf("Your connection to Bitbucket has expired or was revoked, so the plugin can't act on your behalf anymore. [Click here to reconnect your Bitbucket account.](%s/plugins/bitbucket/oauth/connect)", *siteURL)
+	p.CreateBotDMPost(userID, message, "custom_bitbucket_reconnect")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+)
+
+func TestUserTokenSource(t *testing.T) {
+	const encryptionKey = "0123456789abcdef0123456789abcdef"
+
+	setup := func(t *testing.T, tokenHandler http.HandlerFunc) (*Plugin, *plugintest.API, map[string][]byte) {
+		server := httptest.NewServer(tokenHandler)
+		t.Cleanup(server.Close)
+
+		kv := map[string][]byte{}
+		api := &plugintest.API{}
+		siteURL := "https://mattermost.example.com"
+		api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &siteURL}}).Maybe()
+		api.On("KVSet", mock.Anything, mock.Anything).Return(func(key string, value []byte) *model.AppError {
+			kv[key] = value
+			return nil
+		}).Maybe()
+		api.On("KVGet", mock.Anything).Return(func(key string) []byte {
+			return kv[key]
+		}, nil).Maybe()
+		api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+		p := NewPlugin()
+		p.SetAPI(api)
+		p.setConfiguration(&Configuration{EncryptionKey: encryptionKey, BitbucketSelfHostedURL: server.URL})
+
+		return p, api, kv
+	}
+
+	expiredUser := func() *BitbucketUserInfo {
+		return &BitbucketUserInfo{
+			UserID:             "user",
+			BitbucketAccountID: "account",
+			Token:              &oauth2.Token{AccessToken: "old-access", RefreshToken: "old-refresh", Expiry: time.Now().Add(-time.Hour)},
+		}
+	}
+
+	t.Run("both tokens are encrypted", func(t *testing.T) {
+		p, _, kv := setup(t, nil)
+
+		info := expiredUser()
+		require.NoError(t, p.storeBitbucketUserInfo(info))
+		assert.Equal(t, "old-access", info.Token.AccessToken, "the token of the caller is left as is")
+
+		var stored BitbucketUserInfo
+		require.NoError(t, json.Unmarshal(kv["user"+BitbucketTokenKey], &stored))
+		assert.NotContains(t, string(kv["user"+BitbucketTokenKey]), "old-access")
+		assert.NotContains(t, string(kv["user"+BitbucketTokenKey]), "old-refresh")
+		assert.True(t, stored.RefreshTokenEncrypted)
+
+		loaded, apiErr := p.getBitbucketUserInfo("user")
+		require.Nil(t, apiErr)
+		assert.Equal(t, "old-access", loaded.Token.AccessToken)
+		assert.Equal(t, "old-refresh", loaded.Token.RefreshToken)
+	})
+
+	t.Run("plaintext refresh tokens are still read", func(t *testing.T) {
+		p, _, kv := setup(t, nil)
+
+		accessToken, err := encrypt([]byte(encryptionKey), "old-access")
+		require.NoError(t, err)
+		legacy, err := json.Marshal(BitbucketUserInfo{UserID: "user", Token: &oauth2.Token{AccessToken: accessToken, RefreshToken: "old-refresh"}})
+		require.NoError(t, err)
+		kv["user"+BitbucketTokenKey] = legacy
+
+		loaded, apiErr := p.getBitbucketUserInfo("user")
+		require.Nil(t, apiErr)
+		assert.Equal(t, "old-refresh", loaded.Token.RefreshToken)
+	})
+
+	t.Run("refreshed tokens are stored", func(t *testing.T) {
+		p, _, _ := setup(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/rest/oauth2/latest/token", r.URL.Path)
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "old-refresh", r.Form.Get("refresh_token"))
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"access_token": "new-access", "refresh_token": "new-refresh", "token_type": "bearer", "expires_in": 3600}`))
+		})
+
+		info := expiredUser()
+		token, err := p.userTokenSource(info).Token()
+		require.NoError(t, err)
+		assert.Equal(t, "new-access", token.AccessToken)
+		assert.Equal(t, "new-refresh", info.Token.RefreshToken)
+
+		loaded, apiErr := p.getBitbucketUserInfo("user")
+		require.Nil(t, apiErr)
+		assert.Equal(t, "new-access", loaded.Token.AccessToken)
+		assert.Equal(t, "new-refresh", loaded.Token.RefreshToken)
+	})
+
+	t.Run("users whose refresh token is rejected are disconnected", func(t *testing.T) {
+		p, api, kv := setup(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+		})
+		info := expiredUser()
+		require.NoError(t, p.storeBitbucketUserInfo(info))
+
+		api.On("KVDelete", mock.Anything).Return(func(key string) *model.AppError {
+			delete(kv, key)
+			return nil
+		})
+		api.On("KVCompareAndSet", KeyRepoPermissionGeneration+"user", mock.Anything, mock.Anything).Return(true, nil)
+		api.On("PublishPluginClusterEvent", mock.Anything, mock.Anything).Return(nil)
+		api.On("PublishWebSocketEvent", WsEventDisconnect, mock.Anything, mock.Anything).Return()
+		api.On("GetDirectChannel", "user", mock.Anything).Return(&model.Channel{Id: "dm"}, nil)
+		api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.ChannelId == "dm" && post.Type == "custom_bitbucket_reconnect"
+		})).Return(&model.Post{}, nil)
+
+		_, err := p.userTokenSource(info).Token()
+		require.Error(t, err)
+
+		assert.NotContains(t, kv, "user"+BitbucketTokenKey)
+		api.AssertCalled(t, "CreatePost", mock.Anything)
+	})
+
+	t.Run("a token rotated by another request is used", func(t *testing.T) {
+		p, api, _ := setup(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+		})
+		require.NoError(t, p.storeBitbucketUserInfo(&BitbucketUserInfo{
+			UserID: "user",
+			Token:  &oauth2.Token{AccessToken: "other-access", RefreshToken: "other-refresh", Expiry: time.Now().Add(time.Hour)},
+		}))
+
+		info := expiredUser()
+		token, err := p.userTokenSource(info).Token()
+		require.NoError(t, err)
+
+		assert.Equal(t, "other-access", token.AccessToken)
+		api.AssertNotCalled(t, "KVDelete", mock.Anything)
+	})
+	t.Run("an expired token rotated by another request is refreshed and stored", func(t *testing.T) {
+		p, api, _ := setup(t, func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, r.ParseForm())
+			w.Header().Set("Content-Type", "application/json")
+			if r.Form.Get("refresh_token") != "other-refresh" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token": "new-access", "refresh_token": "new-refresh", "token_type": "bearer", "expires_in": 3600}`))
+		})
+		require.NoError(t, p.storeBitbucketUserInfo(&BitbucketUserInfo{
+			UserID: "user",
+			Token:  &oauth2.Token{AccessToken: "other-access", RefreshToken: "other-refresh", Expiry: time.Now().Add(-time.Minute)},
+		}))
+
+		info := expiredUser()
+		token, err := p.userTokenSource(info).Token()
+		require.NoError(t, err)
+		assert.Equal(t, "new-access", token.AccessToken)
+		assert.Equal(t, "new-refresh", info.Token.RefreshToken)
+
+		loaded, apiErr := p.getBitbucketUserInfo("user")
+		require.Nil(t, apiErr)
+		assert.Equal(t, "new-access", loaded.Token.AccessToken)
+		assert.Equal(t, "new-refresh", loaded.Token.RefreshToken)
+		api.AssertNotCalled(t, "KVDelete", mock.Anything)
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+)
+
+const (
+	// KeyTrackedPosts prefixes the keys of the posts created for a webhook post key, e.g. for a
+	// pull request comment.
+	KeyTrackedPosts = "tracked_posts_"
+
+	// trackedPostsExpirySeconds limits how long the posts can be updated by later events.
+	trackedPostsExpirySeconds = 90 * 24 * 60 * 60
+
+	// trackedPostsUpdateAttempts limits the compare-and-set retries of concurrent updates.
+	trackedPostsUpdateAttempts = 10
+)
+
+func trackedPostsKey(postKey string) string {
+	hash := sha256.Sum256([]byte(postKey))
+	return KeyTrackedPosts + hex.EncodeToString(hash[:])
+}
+
+// getTrackedPosts returns the IDs of the posts created for the post key.
+func (p *Plugin) getTrackedPosts(postKey string) ([]string, []byte, error) {
+	value, appErr := p.API.KVGet(trackedPostsKey(postKey))
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to get tracked posts")
+	}
+	if value == nil {
+		return nil, nil, nil
+	}
+
+	var postIDs []string
+	if err := json.Unmarshal(value, &postIDs); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode tracked posts")
+	}
+
+	return postIDs, value, nil
+}
+
+// trackPost records a post created for the post key.
+func (p *Plugin) trackPost(postKey, postID string) error {
+	key := trackedPostsKey(postKey)
+
+	for attempt := 0; attempt < trackedPostsUpdateAttempts; attempt++ {
+		postIDs, oldValue, err := p.getTrackedPosts(postKey)
+		if err != nil {
+			return err
+		}
+
+		newValue, err := json.Marshal(append(postIDs, postID))
+		if err != nil {
+			return errors.Wrap(err, "failed to encode tracked posts")
+		}
+
+		stored, appErr := p.API.KVSetWithOptions(key, newValue, model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        oldValue,
+			ExpireInSeconds: trackedPostsExpirySeconds,
+		})
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to store tracked posts")
+		}
+		if stored {
+			return nil
+		}
+	}
+
+	return errors.Errorf("could not track post after %d attempts", trackedPostsUpdateAttempts)
+}
+
+// applyPostAction updates or deletes the posts recorded for the post key of the handler. Posts
+// already handled in the job are skipped, and posts removed in the meantime are ignored.
+func (p *Plugin) applyPostAction(handlerIndex int, handler *webhook.HandleWebhook, job *webhookJob, markDelivered func(key string)) error {
+	postIDs, _, err := p.getTrackedPosts(handler.PostKey)
+	if err != nil {
+		return err
+	}
+
+	for _, postID := range postIDs {
+		key := deliveryKey(handlerIndex, "post", postID)
+		if job.Delivered[key] {
+			continue
+		}
+
+		switch handler.PostAction {
+		case webhook.PostActionUpdate:
+			post, appErr := p.API.GetPost(postID)
+			if appErr != nil && appErr.StatusCode != http.StatusNotFound {
+				return errors.Wrap(appErr, "failed to get tracked post")
+			}
+			if appErr == nil {
+				post.Message = handler.Message
+				if _, appErr = p.API.UpdatePost(post); appErr != nil {
+					return errors.Wrap(appErr, "failed to update tracked post")
+				}
+			}
+		case webhook.PostActionDelete:
+			if appErr := p.API.DeletePost(postID); appErr != nil && appErr.StatusCode != http.StatusNotFound {
+				return errors.Wrap(appErr, "failed to delete tracked post")
+			}
+		}
+
+		markDelivered(key)
+	}
+
+	if handler.PostAction == webhook.PostActionDelete {
+		if appErr := p.API.KVDelete(trackedPostsKey(handler.PostKey)); appErr != nil {
+			return errors.Wrap(appErr, "failed to delete tracked posts")
+		}
+	}
+
+	return nil
+}
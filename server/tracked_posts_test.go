@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func TestExecuteHandlersTracksPosts(t *testing.T) {
+	key := trackedPostsKey("pr_comment/owner/repo/1/channel")
+
+	api := &plugintest.API{}
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "post2"}, nil)
+	api.On("KVSet", KeyWebhookJob+"job", mock.Anything).Return(nil)
+	api.On("KVGet", key).Return([]byte(`["post1"]`), nil)
+	api.On("KVSetWithOptions", key, []byte(`["post1","post2"]`), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        []byte(`["post1"]`),
+		ExpireInSeconds: trackedPostsExpirySeconds,
+	}).Return(true, nil)
+
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	handlers := []*webhook.HandleWebhook{{
+		Message:    "message",
+		ToChannels: []string{"channel"},
+		PostKey:    "pr_comment/owner/repo/1/channel",
+	}}
+
+	err := p.executeHandlers(handlers, webhookpayload.PullRequestCommentCreatedPayload{}, &webhookJob{ID: "job", Delivered: map[string]bool{}})
+
+	assert.NoError(t, err)
+	api.AssertExpectations(t)
+}
+
+func TestApplyPostAction(t *testing.T) {
+	postKey := "pr_comment/owner/repo/1/channel"
+	key := trackedPostsKey(postKey)
+
+	t.Run("update", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return([]byte(`["post1","post2"]`), nil)
+		api.On("GetPost", "post1").Return(&model.Post{Id: "post1", Message: "old"}, nil)
+		api.On("GetPost", "post2").Return(nil, &model.AppError{StatusCode: http.StatusNotFound})
+		api.On("UpdatePost", &model.Post{Id: "post1", Message: "new"}).Return(&model.Post{Id: "post1"}, nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		job := &webhookJob{ID: "job", Delivered: map[string]bool{}}
+		handler := &webhook.HandleWebhook{Message: "new", PostKey: postKey, PostAction: webhook.PostActionUpdate}
+
+		err := p.applyPostAction(0, handler, job, func(key string) { job.Delivered[key] = true })
+
+		assert.NoError(t, err)
+		assert.True(t, job.Delivered[deliveryKey(0, "post", "post1")])
+		assert.True(t, job.Delivered[deliveryKey(0, "post", "post2")])
+		api.AssertExpectations(t)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		api := &plugintest.API{}
+		api.On("KVGet", key).Return([]byte(`["post1","post2"]`), nil)
+		api.On("DeletePost", "post2").Return(nil)
+		api.On("KVDelete", key).Return(nil)
+
+		p := NewPlugin()
+		p.SetAPI(api)
+
+		job := &webhookJob{ID: "job", Delivered: map[string]bool{deliveryKey(0, "post", "post1"): true}}
+		handler := &webhook.HandleWebhook{PostKey: postKey, PostAction: webhook.PostActionDelete}
+
+		err := p.applyPostAction(0, handler, job, func(key string) { job.Delivered[key] = true })
+
+		assert.NoError(t, err)
+		api.AssertExpectations(t)
+	})
+}
@@ -5,11 +5,14 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -45,6 +48,12 @@ func getSearchIssuesQuery(repoFullName, searchTerm string) string {
 		urlEncode("title ~ \""+searchTerm+"\"") + "&sort=-updated_on"
 }
 
+// ciphertextVersion prefixes the ciphertexts produced by encrypt. Ciphertexts without a version
+// prefix were produced by the legacy AES-CFB scheme.
+const ciphertextVersion = "v2"
+
+var errCiphertextKeyMismatch = errors.New("the ciphertext was encrypted with a different key")
+
 func pad(src []byte) []byte {
 	padding := aes.BlockSize - len(src)%aes.BlockSize
 	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
@@ -53,35 +62,95 @@ func pad(src []byte) []byte {
 
 func unpad(src []byte) ([]byte, error) {
 	length := len(src)
+	if length == 0 {
+		return nil, errors.New("unpad error. The message is empty")
+	}
 	unpadding := int(src[length-1])
 
-	if unpadding > length {
+	if unpadding == 0 || unpadding > length || !bytes.Equal(src[length-unpadding:], bytes.Repeat([]byte{byte(unpadding)}, unpadding)) {
 		return nil, errors.New("unpad error. This could happen when incorrect encryption key is used")
 	}
 
 	return src[:(length - unpadding)], nil
 }
 
+// encryptionKeyID identifies an encryption key in the ciphertexts without revealing it.
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// parseCiphertext splits a versioned ciphertext into the ID of the key it was encrypted with and
+// the encrypted message. ok is false for legacy ciphertexts.
+func parseCiphertext(text string) (keyID, msg string, ok bool) {
+	parts := strings.SplitN(text, ":", 3)
+	if len(parts) != 3 || parts[0] != ciphertextVersion {
+		return "", "", false
+	}
+
+	return parts[1], parts[2], true
+}
+
+// encrypt encrypts text with AES-GCM. The result is prefixed with the ciphertext version and the ID
+// of the key, so that it can be decrypted after the key was rotated.
 func encrypt(key []byte, text string) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
 
-	msg := pad([]byte(text))
-	ciphertext := make([]byte, aes.BlockSize+len(msg))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
-	cfb := cipher.NewCFBEncrypter(block, iv)
-	cfb.XORKeyStream(ciphertext[aes.BlockSize:], msg)
-	finalMsg := base64.URLEncoding.EncodeToString(ciphertext)
-	return finalMsg, nil
+	sealed := gcm.Seal(nonce, nonce, []byte(text), nil)
+	return ciphertextVersion + ":" + encryptionKeyID(key) + ":" + base64.URLEncoding.EncodeToString(sealed), nil
 }
 
+// decrypt decrypts a ciphertext produced by encrypt or by the legacy AES-CFB scheme.
 func decrypt(key []byte, text string) (string, error) {
+	keyID, msg, ok := parseCiphertext(text)
+	if !ok {
+		return decryptLegacy(key, text)
+	}
+	if keyID != encryptionKeyID(key) {
+		return "", errCiphertextKeyMismatch
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	decodedMsg, err := base64.URLEncoding.DecodeString(msg)
+	if err != nil {
+		return "", err
+	}
+
+	if len(decodedMsg) < gcm.NonceSize() {
+		return "", errors.New("the ciphertext is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, decodedMsg[:gcm.NonceSize()], decodedMsg[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func decryptLegacy(key []byte, text string) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -92,7 +161,7 @@ func decrypt(key []byte, text string) (string, error) {
 		return "", err
 	}
 
-	if (len(decodedMsg) % aes.BlockSize) != 0 {
+	if len(decodedMsg) < 2*aes.BlockSize || (len(decodedMsg)%aes.BlockSize) != 0 {
 		return "", errors.New("blocksize must be multiple of decoded message length")
 	}
 
@@ -115,6 +184,7 @@ func parseOwnerAndRepoAndReturnFullAlso(full, baseURL string) (string, string, s
 		baseURL = BitbucketBaseURL
 	}
 	full = strings.TrimSuffix(strings.TrimSpace(strings.Replace(full, baseURL, "", 1)), "/")
+	full = normalizeDataCenterPath(full)
 	splitStr := strings.Split(full, "/")
 
 	if len(splitStr) == 1 {
@@ -134,6 +204,7 @@ func parseOwnerAndRepo(full, baseURL string) (string, string) {
 		baseURL = BitbucketBaseURL
 	}
 	full = strings.TrimSuffix(strings.TrimSpace(strings.Replace(full, baseURL, "", 1)), "/")
+	full = normalizeDataCenterPath(full)
 	splitStr := strings.Split(full, "/")
 
 	if len(splitStr) == 1 {
@@ -148,10 +219,64 @@ func parseOwnerAndRepo(full, baseURL string) (string, string) {
 	return owner, repo
 }
 
+// parsePullRequestReference parses a pull request given as "owner/repo#123" or by its URL.
+func parsePullRequestReference(ref, baseURL string) (owner, repo string, id int64, err error) {
+	repoPart, idPart, found := strings.Cut(ref, "#")
+	if !found {
+		i := strings.Index(ref, "/pull-requests/")
+		if i == -1 {
+			return "", "", 0, errors.New("pull request must be given as owner/repo#id or by its URL")
+		}
+		repoPart = ref[:i]
+		idPart, _, _ = strings.Cut(ref[i+len("/pull-requests/"):], "/")
+	}
+
+	owner, repo = parseOwnerAndRepo(repoPart, baseURL)
+	if owner == "" || repo == "" {
+		return "", "", 0, fmt.Errorf("invalid repository %q", repoPart)
+	}
+
+	id, err = strconv.ParseInt(idPart, 10, 64)
+	if err != nil || id <= 0 {
+		return "", "", 0, fmt.Errorf("invalid pull request ID %q", idPart)
+	}
+
+	return owner, repo, id, nil
+}
+
+// normalizeDataCenterPath turns the path of a Bitbucket Data Center repository URL, e.g.
+// "projects/KEY/repos/slug" or "users/name/repos/slug", into the "owner/repo" form used for
+// Bitbucket Cloud. Personal repositories are owned by the "~NAME" project. Any other path is
+// returned unchanged.
+func normalizeDataCenterPath(path string) string {
+	splitStr := strings.Split(path, "/")
+	if len(splitStr) < 4 || splitStr[2] != "repos" {
+		return path
+	}
+
+	var owner string
+	switch splitStr[0] {
+	case "projects":
+		owner = splitStr[1]
+	case "users":
+		owner = "~" + strings.ToUpper(splitStr[1])
+	default:
+		return path
+	}
+
+	return strings.Join(append([]string{owner, splitStr[3]}, splitStr[4:]...), "/")
+}
+
 // getToDoDisplayText returns the text to be displayed in todo listings.
 func getToDoDisplayText(baseURL, title, url, notifType string) string {
 	owner, repo := parseOwnerAndRepo(url, baseURL)
 	repoURL := fmt.Sprintf("%s%s/%s", baseURL, owner, repo)
+	for _, itemPath := range []string{"/pull-requests/", "/issues/"} {
+		if i := strings.Index(url, itemPath); i != -1 {
+			repoURL = url[:i]
+			break
+		}
+	}
 	repoWords := strings.Split(repo, "-")
 	if len(repo) > 20 && len(repoWords) > 1 {
 		repo = "..." + repoWords[len(repoWords)-1]
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseOwnerAndRepo(t *testing.T) {
@@ -24,6 +30,9 @@ func TestParseOwnerAndRepo(t *testing.T) {
 		{Full: "", BaseURL: "", ExpectedOwner: "", ExpectedRepo: ""},
 		{Full: "mattermost/mattermost/invalid_repo_url", BaseURL: "", ExpectedOwner: "", ExpectedRepo: ""},
 		{Full: "https://github.com/mattermost/mattermost/invalid_repo_url", BaseURL: "", ExpectedOwner: "", ExpectedRepo: ""},
+		{Full: "https://bitbucket.example.com/projects/MM/repos/mattermost-server", BaseURL: "https://bitbucket.example.com/", ExpectedOwner: "MM", ExpectedRepo: "mattermost-server"},
+		{Full: "https://bitbucket.example.com/users/jdoe/repos/dotfiles", BaseURL: "https://bitbucket.example.com/", ExpectedOwner: "~JDOE", ExpectedRepo: "dotfiles"},
+		{Full: "MM/mattermost-server", BaseURL: "https://bitbucket.example.com/", ExpectedOwner: "MM", ExpectedRepo: "mattermost-server"},
 	}
 
 	for _, tc := range tcs {
@@ -34,8 +43,136 @@ func TestParseOwnerAndRepo(t *testing.T) {
 	}
 }
 
+func TestParsePullRequestReference(t *testing.T) {
+	tcs := []struct {
+		Ref           string
+		BaseURL       string
+		ExpectedOwner string
+		ExpectedRepo  string
+		ExpectedID    int64
+		ExpectedError bool
+	}{
+		{Ref: "mattermost/mattermost-server#123", ExpectedOwner: "mattermost", ExpectedRepo: "mattermost-server", ExpectedID: 123},
+		{Ref: "https://bitbucket.org/mattermost/mattermost-server/pull-requests/123", ExpectedOwner: "mattermost", ExpectedRepo: "mattermost-server", ExpectedID: 123},
+		{Ref: "https://bitbucket.org/mattermost/mattermost-server/pull-requests/123/diff", ExpectedOwner: "mattermost", ExpectedRepo: "mattermost-server", ExpectedID: 123},
+		{Ref: "https://bitbucket.example.com/projects/MM/repos/mattermost-server/pull-requests/7/overview", BaseURL: "https://bitbucket.example.com/", ExpectedOwner: "MM", ExpectedRepo: "mattermost-server", ExpectedID: 7},
+		{Ref: "mattermost/mattermost-server", ExpectedError: true},
+		{Ref: "mattermost#123", ExpectedError: true},
+		{Ref: "mattermost/mattermost-server#abc", ExpectedError: true},
+		{Ref: "mattermost/mattermost-server#0", ExpectedError: true},
+	}
+
+	for _, tc := range tcs {
+		owner, repo, id, err := parsePullRequestReference(tc.Ref, tc.BaseURL)
+
+		if tc.ExpectedError {
+			assert.Error(t, err, tc.Ref)
+			continue
+		}
+		assert.NoError(t, err, tc.Ref)
+		assert.Equal(t, tc.ExpectedOwner, owner)
+		assert.Equal(t, tc.ExpectedRepo, repo)
+		assert.Equal(t, tc.ExpectedID, id)
+	}
+}
+
 func TestGetYourAssigneeSearchQuery(t *testing.T) {
 	result := getYourAssigneeIssuesSearchQuery("123", "testworkspace/testrepo")
 	assert.Equal(t, "https://api.bitbucket.org/2.0/repositories/testworkspace/testrepo/issues?q=assignee.account_id%3D%22123%22%20AND%20state%21%3D%22closed%22",
 		result)
 }
+
+func TestGetToDoDisplayText(t *testing.T) {
+	tcs := []struct {
+		Name     string
+		BaseURL  string
+		URL      string
+		Expected string
+	}{
+		{
+			Name:     "cloud pull request",
+			BaseURL:  "https://bitbucket.org/",
+			URL:      "https://bitbucket.org/mattermost/mattermost-server/pull-requests/1",
+			Expected: "* [mattermost/mattermost-server](https://bitbucket.org/mattermost/mattermost-server) [Title](https://bitbucket.org/mattermost/mattermost-server/pull-requests/1)\n",
+		},
+		{
+			Name:     "data center pull request",
+			BaseURL:  "https://bitbucket.example.com/",
+			URL:      "https://bitbucket.example.com/projects/MM/repos/webapp/pull-requests/1",
+			Expected: "* [MM/webapp](https://bitbucket.example.com/projects/MM/repos/webapp) [Title](https://bitbucket.example.com/projects/MM/repos/webapp/pull-requests/1)\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, getToDoDisplayText(tc.BaseURL, "Title", tc.URL, ""))
+		})
+	}
+}
+
+func TestGetRepoOwnerAndNameFromURL(t *testing.T) {
+	owner, repo := getRepoOwnerAndNameFromURL("https://bitbucket.org/mattermost/mattermost-server")
+	assert.Equal(t, "mattermost", owner)
+	assert.Equal(t, "mattermost-server", repo)
+
+	owner, repo = getRepoOwnerAndNameFromURL("https://bitbucket.example.com/projects/MM/repos/webapp")
+	assert.Equal(t, "MM", owner)
+	assert.Equal(t, "webapp", repo)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+
+	t.Run("round trip", func(t *testing.T) {
+		ciphertext, err := encrypt(key, "token")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(ciphertext, "v2:"+encryptionKeyID(key)+":"))
+
+		plaintext, err := decrypt(key, ciphertext)
+		require.NoError(t, err)
+		assert.Equal(t, "token", plaintext)
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		ciphertext, err := encrypt(key, "token")
+		require.NoError(t, err)
+
+		_, err = decrypt(otherKey, ciphertext)
+		assert.ErrorIs(t, err, errCiphertextKeyMismatch)
+	})
+
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		ciphertext, err := encrypt(key, "token")
+		require.NoError(t, err)
+
+		keyID, msg, ok := parseCiphertext(ciphertext)
+		require.True(t, ok)
+		decoded, err := base64.URLEncoding.DecodeString(msg)
+		require.NoError(t, err)
+		decoded[len(decoded)-1] ^= 1
+
+		_, err = decrypt(key, "v2:"+keyID+":"+base64.URLEncoding.EncodeToString(decoded))
+		assert.Error(t, err)
+	})
+
+	t.Run("legacy ciphertext", func(t *testing.T) {
+		plaintext, err := decrypt(key, encryptLegacy(t, key, "token"))
+		require.NoError(t, err)
+		assert.Equal(t, "token", plaintext)
+	})
+}
+
+// encryptLegacy encrypts text the way tokens were encrypted before ciphertexts were versioned.
+func encryptLegacy(t *testing.T, key []byte, text string) string {
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+
+	msg := pad([]byte(text))
+	ciphertext := make([]byte, aes.BlockSize+len(msg))
+	_, err = rand.Read(ciphertext[:aes.BlockSize])
+	require.NoError(t, err)
+
+	cipher.NewCFBEncrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(ciphertext[aes.BlockSize:], msg)
+	return base64.URLEncoding.EncodeToString(ciphertext)
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
 	"encoding/json"
 	"net/http"
+	"slices"
 	"strconv"
 
+	"github.com/pkg/errors"
+
 	"github.com/mattermost/mattermost/server/public/model"
 
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/datacenter"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
@@ -16,23 +19,30 @@ import (
 
 const (
 	KeyAssignUserPr          = "pr_assigned_"
+	KeyWebhookDelivery       = "webhook_delivery_"
 	BitbucketWebhookPostType = "custom_bb_webhook"
+
+	// webhookDeliveryExpirySeconds is how long delivery IDs are remembered to drop redeliveries.
+	webhookDeliveryExpirySeconds = 24 * 60 * 60
 )
 
 func (p *Plugin) handleWebhook(w http.ResponseWriter, r *http.Request) {
-	secret := r.URL.Query().Get("secret")
 	config := p.getConfiguration()
 
-	if config.WebhookSecret == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-	if subtle.ConstantTimeCompare([]byte(config.WebhookSecret), []byte(secret)) == 0 {
+	// The delivery ID is recorded with the ID of the job processing it, see claimWebhookDelivery
+	jobID := model.NewId()
+	hook, err := webhookpayload.New(
+		webhookpayload.Options.Secrets(config.WebhookSecret, config.PreviousWebhookSecret),
+		webhookpayload.Options.ReplayGuard(func(deliveryID string) (bool, error) {
+			return p.recordWebhookDelivery(deliveryID, jobID)
+		}),
+	)
+	if err != nil {
 		http.Error(w, "Not authorized", http.StatusUnauthorized)
 		return
 	}
-	hook, _ := webhookpayload.New()
-	payload, err := hook.Parse(r,
+
+	delivery, err := hook.Read(r,
 		webhookpayload.RepoPushEvent,
 		webhookpayload.IssueCreatedEvent,
 		webhookpayload.IssueUpdatedEvent,
@@ -43,62 +53,199 @@ func (p *Plugin) handleWebhook(w http.ResponseWriter, r *http.Request) {
 		webhookpayload.PullRequestUnapprovedEvent,
 		webhookpayload.PullRequestDeclinedEvent,
 		webhookpayload.PullRequestMergedEvent,
-		webhookpayload.PullRequestCommentCreatedEvent)
-
-	if err != nil {
-		p.API.LogError(err.Error())
+		webhookpayload.PullRequestCommentCreatedEvent,
+		webhookpayload.PullRequestCommentUpdatedEvent,
+		webhookpayload.PullRequestCommentDeletedEvent,
+		webhookpayload.RepoForkEvent,
+		webhookpayload.RepoUpdatedEvent,
+		webhookpayload.RepoCommitCommentCreatedEvent,
+		webhookpayload.RepoCommitStatusCreatedEvent,
+		webhookpayload.RepoCommitStatusUpdatedEvent)
+
+	switch {
+	case errors.Is(err, webhookpayload.ErrMissingSignatureHeader), errors.Is(err, webhookpayload.ErrInvalidSignature),
+		errors.Is(err, webhookpayload.ErrUUIDVerificationFailed):
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	case errors.Is(err, webhookpayload.ErrReplayedRequest):
+		p.API.LogDebug("Ignoring replayed webhook delivery")
+		p.countDuplicateWebhookDelivery()
+		return
+	case errors.Is(err, webhookpayload.ErrInvalidHTTPMethod), errors.Is(err, webhookpayload.ErrMissingHookUUIDHeader),
+		errors.Is(err, webhookpayload.ErrMissingEventKeyHeader), errors.Is(err, webhookpayload.ErrEventNotFound),
+		errors.Is(err, webhookpayload.ErrParsingPayload), errors.Is(err, webhookpayload.ErrMissingRequestIDHeader):
+		p.API.LogWarn("Rejecting invalid webhook delivery", "err", err.Error())
+		http.Error(w, "Invalid webhook delivery", http.StatusBadRequest)
+		return
+	case err != nil:
+		// e.g. the delivery ID couldn't be recorded, so Bitbucket has to redeliver it
+		p.API.LogError("Failed to read webhook delivery", "err", err.Error())
+		http.Error(w, "Failed to read webhook delivery", http.StatusInternalServerError)
 		return
 	}
 
-	var handlers []*webhook.HandleWebhook
-	var handlerError error
+	// The delivery is processed in the background, so Bitbucket doesn't time out and redeliver it
+	if err := p.webhookQueue.enqueue(jobID, delivery); err != nil {
+		p.API.LogError("Failed to queue webhook delivery", "err", err.Error())
+
+		// Forget the delivery ID so the redelivery by Bitbucket isn't rejected as a replay
+		if appErr := p.API.KVDelete(KeyWebhookDelivery + delivery.ID); appErr != nil {
+			p.API.LogWarn("Failed to delete webhook delivery record", "err", appErr.Error())
+		}
+
+		http.Error(w, "Failed to queue webhook delivery", http.StatusInternalServerError)
+		return
+	}
+}
 
+// getWebhookHandlers returns the notifications to send for a parsed webhook payload.
+func (p *Plugin) getWebhookHandlers(payload interface{}) ([]*webhook.HandleWebhook, error) {
 	switch typedPayload := payload.(type) {
 	case webhookpayload.RepoPushPayload:
-		handlers, handlerError = p.webhookHandler.HandleRepoPushEvent(typedPayload)
+		return p.webhookHandler.HandleRepoPushEvent(typedPayload)
 	case webhookpayload.IssueCreatedPayload:
-		handlers, handlerError = p.webhookHandler.HandleIssueCreatedEvent(typedPayload)
+		return p.webhookHandler.HandleIssueCreatedEvent(typedPayload)
 	case webhookpayload.IssueUpdatedPayload:
-		handlers, handlerError = p.webhookHandler.HandleIssueUpdatedEvent(typedPayload)
+		return p.webhookHandler.HandleIssueUpdatedEvent(typedPayload)
 	case webhookpayload.IssueCommentCreatedPayload:
-		handlers, handlerError = p.webhookHandler.HandleIssueCommentCreatedEvent(typedPayload)
+		return p.webhookHandler.HandleIssueCommentCreatedEvent(typedPayload)
 	case webhookpayload.PullRequestCreatedPayload:
-		handlers, handlerError = p.webhookHandler.HandlePullRequestCreatedEvent(typedPayload)
+		return p.webhookHandler.HandlePullRequestCreatedEvent(typedPayload)
 	case webhookpayload.PullRequestUpdatedPayload:
-		handlers, handlerError = p.webhookHandler.HandlePullRequestUpdatedEvent(typedPayload)
+		return p.webhookHandler.HandlePullRequestUpdatedEvent(typedPayload)
 	case webhookpayload.PullRequestApprovedPayload:
-		handlers, handlerError = p.webhookHandler.HandlePullRequestApprovedEvent(typedPayload)
+		return p.webhookHandler.HandlePullRequestApprovedEvent(typedPayload)
 	case webhookpayload.PullRequestCommentCreatedPayload:
-		handlers, handlerError = p.webhookHandler.HandlePullRequestCommentCreatedEvent(typedPayload)
+		return p.webhookHandler.HandlePullRequestCommentCreatedEvent(typedPayload)
+	case webhookpayload.PullRequestCommentUpdatedPayload:
+		return p.webhookHandler.HandlePullRequestCommentUpdatedEvent(typedPayload)
+	case webhookpayload.PullRequestCommentDeletedPayload:
+		return p.webhookHandler.HandlePullRequestCommentDeletedEvent(typedPayload)
 	case webhookpayload.PullRequestDeclinedPayload:
-		handlers, handlerError = p.webhookHandler.HandlePullRequestDeclinedEvent(typedPayload)
+		return p.webhookHandler.HandlePullRequestDeclinedEvent(typedPayload)
 	case webhookpayload.PullRequestUnapprovedPayload:
-		handlers, handlerError = p.webhookHandler.HandlePullRequestUnapprovedEvent(typedPayload)
+		return p.webhookHandler.HandlePullRequestUnapprovedEvent(typedPayload)
 	case webhookpayload.PullRequestMergedPayload:
-		handlers, handlerError = p.webhookHandler.HandlePullRequestMergedEvent(typedPayload)
+		return p.webhookHandler.HandlePullRequestMergedEvent(typedPayload)
+	case webhookpayload.RepoForkPayload:
+		return p.webhookHandler.HandleRepoForkEvent(typedPayload)
+	case webhookpayload.RepoUpdatedPayload:
+		// Move the subscriptions first, so the notification reaches the channels subscribed to the old name
+		if typedPayload.Changes.FullName.Old != typedPayload.Changes.FullName.New {
+			if err := p.moveRepositorySubscriptions(typedPayload.Changes.FullName.Old, typedPayload.Changes.FullName.New); err != nil {
+				return nil, errors.Wrap(err, "failed to move subscriptions of renamed repository")
+			}
+		}
+		return p.webhookHandler.HandleRepoUpdatedEvent(typedPayload)
+	case webhookpayload.RepoCommitCommentCreatedPayload:
+		return p.webhookHandler.HandleRepoCommitCommentCreatedEvent(typedPayload)
+	case webhookpayload.RepoCommitStatusCreatedPayload:
+		return p.webhookHandler.HandleRepoCommitStatusCreatedEvent(typedPayload)
+	case webhookpayload.RepoCommitStatusUpdatedPayload:
+		return p.webhookHandler.HandleRepoCommitStatusUpdatedEvent(typedPayload)
 	}
 
-	if handlerError != nil {
-		p.API.LogError(handlerError.Error())
-		return
+	return nil, nil
+}
+
+// executeHandlers creates the posts of the webhook handlers. Posts already recorded as delivered
+// in the job are skipped, and every new post is recorded, so a failed job can be retried without
+// posting twice. Failures don't stop the remaining posts, but the first one is returned. Losing the
+// job's lease stops it right away.
+func (p *Plugin) executeHandlers(webhookHandlers []*webhook.HandleWebhook, pl webhookpayload.Payload, job *webhookJob) error {
+	var firstErr error
+	fail := func(err error) {
+		p.API.LogWarn("Failed to deliver webhook notification", "jobID", job.ID, "err", err.Error())
+		if firstErr == nil {
+			firstErr = err
+		}
 	}
 
-	p.executeHandlers(handlers, payload.(webhookpayload.Payload))
-}
+	markDelivered := func(key string) {
+		job.Delivered[key] = true
+		if err := p.storeWebhookJob(KeyWebhookJob, job); err != nil {
+			p.API.LogWarn("Failed to record webhook delivery progress", "jobID", job.ID, "err", err.Error())
+		}
+	}
+
+	trackPost := func(postKey string, post *model.Post) {
+		if postKey == "" {
+			return
+		}
+		if err := p.trackPost(postKey, post.Id); err != nil {
+			p.API.LogWarn("Failed to record webhook post", "jobID", job.ID, "err", err.Error())
+		}
+	}
+
+	for i, webhookHandler := range webhookHandlers {
+		if webhookHandler.PostAction != "" {
+			if err := p.renewWebhookJobLease(job); err != nil {
+				return err
+			}
+			if err := p.applyPostAction(i, webhookHandler, job, markDelivered); err != nil {
+				fail(err)
+			}
+			continue
+		}
 
-func (p *Plugin) executeHandlers(webhookHandlers []*webhook.HandleWebhook, pl webhookpayload.Payload) {
-	for _, webhookHandler := range webhookHandlers {
 		post := &model.Post{
 			UserId:  p.BotUserID,
 			Message: webhookHandler.Message,
 			Type:    BitbucketWebhookPostType,
 		}
+		if webhookHandler.PullRequestActions != nil {
+			model.ParseSlackAttachment(post, []*model.SlackAttachment{pullRequestActionsAttachment(webhookHandler.PullRequestActions)})
+		}
+		if webhookHandler.PullRequestComment != nil {
+			post.AddProp(PropPullRequestComment, pullRequestCommentProp(webhookHandler.PullRequestComment))
+		}
 
 		for _, channelID := range webhookHandler.ToChannels {
+			key := deliveryKey(i, "channel", channelID)
+			if job.Delivered[key] {
+				continue
+			}
+			if err := p.renewWebhookJobLease(job); err != nil {
+				return err
+			}
+
 			post.ChannelId = channelID
-			if _, err := p.API.CreatePost(post); err != nil {
-				p.API.LogError(err.Error())
+			if webhookHandler.Card != nil {
+				if err := p.upsertPullRequestCard(post.Clone(), webhookHandler.Card); err != nil {
+					fail(err)
+					continue
+				}
+				markDelivered(key)
+				continue
 			}
+
+			if webhookHandler.CollapseKey != "" {
+				if err := p.createOrCollapsePost(post, webhookHandler.CollapseKey); err != nil {
+					fail(err)
+					continue
+				}
+				markDelivered(key)
+				continue
+			}
+
+			if webhookHandler.Thread != nil && slices.Contains(webhookHandler.Thread.Channels, channelID) {
+				created, err := p.createThreadedPost(post, webhookHandler.Thread)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				markDelivered(key)
+				trackPost(webhookHandler.PostKey, created)
+				continue
+			}
+
+			created, err := p.API.CreatePost(post)
+			if err != nil {
+				fail(errors.Wrap(err, "failed to create channel post"))
+				continue
+			}
+			markDelivered(key)
+			trackPost(webhookHandler.PostKey, created)
 		}
 
 		for _, toBitbucketUser := range webhookHandler.ToBitbucketUsers {
@@ -107,9 +254,24 @@ func (p *Plugin) executeHandlers(webhookHandlers []*webhook.HandleWebhook, pl we
 				continue
 			}
 
-			if pl.GetRepository().IsPrivate && !p.permissionToRepo(userID, pl.GetRepository().FullName) {
+			key := deliveryKey(i, "user", userID)
+			if job.Delivered[key] {
 				continue
 			}
+			if err := p.renewWebhookJobLease(job); err != nil {
+				return err
+			}
+
+			if pl.GetRepository().IsPrivate {
+				hasPermission, err := p.checkPermissionToRepo(userID, pl.GetRepository().FullName)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				if !hasPermission {
+					continue
+				}
+			}
 
 			userInfo, userInfoErr := p.getBitbucketUserInfo(userID)
 			if userInfoErr != nil {
@@ -120,46 +282,116 @@ func (p *Plugin) executeHandlers(webhookHandlers []*webhook.HandleWebhook, pl we
 				continue
 			}
 
-			channel, err := p.API.GetDirectChannel(userID, p.BotUserID)
-			if err != nil {
+			channel, appErr := p.API.GetDirectChannel(userID, p.BotUserID)
+			if appErr != nil {
+				fail(errors.Wrap(appErr, "failed to get direct channel"))
 				continue
 			}
 
 			post.ChannelId = channel.Id
-			_, err = p.API.CreatePost(post)
-			if err != nil {
-				p.API.LogError(err.Error())
+			created, appErr := p.API.CreatePost(post)
+			if appErr != nil {
+				fail(errors.Wrap(appErr, "failed to create direct post"))
+				continue
 			}
+			markDelivered(key)
+			trackPost(webhookHandler.PostKey, created)
 			p.sendRefreshEvent(userID)
 		}
 	}
+
+	return firstErr
+}
+
+// recordWebhookDelivery stores the delivery ID with the ID of the job processing it, and reports
+// whether the delivery ID was stored before.
+func (p *Plugin) recordWebhookDelivery(deliveryID, jobID string) (bool, error) {
+	stored, appErr := p.API.KVSetWithOptions(KeyWebhookDelivery+deliveryID, []byte(jobID), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: webhookDeliveryExpirySeconds,
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to record webhook delivery")
+	}
+
+	return !stored, nil
 }
 
 func (p *Plugin) permissionToRepo(userID string, ownerAndRepo string) bool {
+	hasPermission, err := p.checkPermissionToRepo(userID, ownerAndRepo)
+	if err != nil {
+		p.API.LogError("Couldn't fetch repositories info", "err", err)
+		return false
+	}
+
+	return hasPermission
+}
+
+// checkPermissionToRepo reports whether the user can access the repository. An error is only
+// returned when this couldn't be determined, e.g. because Bitbucket isn't reachable.
+func (p *Plugin) checkPermissionToRepo(userID string, ownerAndRepo string) (bool, error) {
 	_, owner, repo := parseOwnerAndRepoAndReturnFullAlso(ownerAndRepo, p.getBaseURL())
 
 	if owner == "" {
-		return false
+		return false, nil
 	}
-	if err := p.checkOrg(owner); err != nil {
-		return false
+	if err := p.checkRepository(owner, repo); err != nil {
+		return false, nil
+	}
+
+	fullName := fullNameFromOwnerAndRepo(owner, repo)
+	if hasPermission, ok := p.getCachedRepoPermission(userID, fullName); ok {
+		return hasPermission, nil
 	}
 
 	info, apiErr := p.getBitbucketUserInfo(userID)
 	if apiErr != nil {
-		return false
+		return false, nil
+	}
+
+	hasPermission, err := p.fetchPermissionToRepo(info, owner, repo)
+	if err != nil {
+		return false, err
 	}
 
-	bitbucketClient := p.bitbucketConnect(*info.Token)
+	p.cacheRepoPermission(userID, fullName, hasPermission)
+	return hasPermission, nil
+}
 
-	if _, httpResponse, err := bitbucketClient.RepositoriesApi.RepositoriesUsernameRepoSlugGet(context.Background(), owner, repo); err != nil {
-		if httpResponse != nil {
-			_ = httpResponse.Body.Close()
+// fetchPermissionToRepo asks Bitbucket whether the user can access the repository.
+func (p *Plugin) fetchPermissionToRepo(info *BitbucketUserInfo, owner, repo string) (bool, error) {
+	if p.isDataCenter() {
+		_, err := p.dataCenterConnect(info).GetRepository(context.Background(), owner, repo)
+		var dcErr *datacenter.Error
+		if errors.As(err, &dcErr) && isAccessDeniedStatus(dcErr.StatusCode) {
+			return false, nil
 		}
-		p.API.LogError("Couldn't fetch repositories info", "err", err)
-		return false
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	bitbucketClient := p.bitbucketConnect(info)
+
+	_, httpResponse, err := bitbucketClient.RepositoriesApi.RepositoriesUsernameRepoSlugGet(context.Background(), owner, repo)
+	if httpResponse != nil {
+		_ = httpResponse.Body.Close()
 	}
-	return true
+	if err != nil {
+		if httpResponse != nil && isAccessDeniedStatus(httpResponse.StatusCode) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to fetch repository")
+	}
+
+	return true, nil
+}
+
+// isAccessDeniedStatus reports whether Bitbucket answered that the resource isn't accessible to the user.
+func isAccessDeniedStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden || statusCode == http.StatusNotFound
 }
 
 type pullRequestReviewHandler struct {
@@ -174,7 +406,7 @@ type subscriptionHandler struct {
 	p *Plugin
 }
 
-func (s subscriptionHandler) GetSubscribedChannelsForRepository(pl webhookpayload.Payload) []*subscription.Subscription {
+func (s subscriptionHandler) GetSubscribedChannelsForRepository(pl webhookpayload.Payload) ([]*subscription.Subscription, error) {
 	return s.p.GetSubscribedChannelsForRepository(pl)
 }
 
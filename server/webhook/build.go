@@ -0,0 +1,122 @@
+package webhook
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func (w *webhook) HandleRepoCommitStatusCreatedEvent(pl webhookpayload.RepoCommitStatusCreatedPayload) ([]*HandleWebhook, error) {
+	return w.handleCommitStatus(webhookpayload.RepoCommitStatusPayload(pl))
+}
+
+func (w *webhook) HandleRepoCommitStatusUpdatedEvent(pl webhookpayload.RepoCommitStatusUpdatedPayload) ([]*HandleWebhook, error) {
+	return w.handleCommitStatus(webhookpayload.RepoCommitStatusPayload(pl))
+}
+
+// handleCommitStatus notifies about failed builds, and about successful builds that follow a
+// failure of the same build on the branch.
+func (w *webhook) handleCommitStatus(pl webhookpayload.RepoCommitStatusPayload) ([]*HandleWebhook, error) {
+	var handlers []*HandleWebhook
+
+	previous := w.builds.RecordBuildStatus(pl.Repository.FullName, pl.CommitStatus.Refname, pl.CommitStatus)
+
+	switch pl.CommitStatus.State {
+	case webhookpayload.CommitStatusFailed:
+		handler1, err := w.createCommitStatusFailedEventNotificationForSubscribedChannels(pl)
+		if err != nil {
+			return nil, err
+		}
+
+		handler2, err := w.createCommitStatusFailedNotificationForAuthors(pl)
+		if err != nil {
+			return nil, err
+		}
+
+		handlers = append(handlers, handler1, handler2)
+	case webhookpayload.CommitStatusSuccessful:
+		if previous != webhookpayload.CommitStatusFailed {
+			break
+		}
+
+		handler, err := w.createCommitStatusSuccessfulEventNotificationForSubscribedChannels(pl)
+		if err != nil {
+			return nil, err
+		}
+
+		handlers = append(handlers, handler)
+	}
+
+	// the build status is shown on the cards of the pull requests from the branch
+	cardHandlers, err := w.createPullRequestCardHandlersForBranch(&pl, pl.CommitStatus.Refname)
+	if err != nil {
+		return nil, err
+	}
+	handlers = append(handlers, cardHandlers...)
+
+	return cleanWebhookHandlers(handlers), nil
+}
+
+func (w *webhook) createCommitStatusFailedEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitStatusPayload) (*HandleWebhook, error) {
+	message, err := w.templateRenderer.RenderCommitStatusFailedEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	// repeated failures of a branch are collapsed into one post, which other posts interrupt
+	handler := &HandleWebhook{
+		Message:     message,
+		CollapseKey: "build_failed/" + pl.Repository.FullName + "/" + pl.CommitStatus.Refname,
+	}
+	if handler.ToChannels, err = w.getBuildSubscriptionChannels(pl); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (w *webhook) createCommitStatusSuccessfulEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitStatusPayload) (*HandleWebhook, error) {
+	message, err := w.templateRenderer.RenderCommitStatusSuccessfulEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &HandleWebhook{Message: message}
+	if handler.ToChannels, err = w.getBuildSubscriptionChannels(pl); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (w *webhook) createCommitStatusFailedNotificationForAuthors(pl webhookpayload.RepoCommitStatusPayload) (*HandleWebhook, error) {
+	accountIDs := w.commitParticipants.GetCommitParticipants(pl.Repository.FullName, pl.CommitStatus.Commit.Hash, pl.CommitStatus.Refname)
+	if len(accountIDs) == 0 {
+		return nil, nil
+	}
+
+	message, err := w.templateRenderer.RenderCommitStatusFailedNotificationForAuthors(pl)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	return w.createPrivateMessageHandleWebhook(&pl, message, accountIDs), nil
+}
+
+func (w *webhook) getBuildSubscriptionChannels(pl webhookpayload.RepoCommitStatusPayload) ([]string, error) {
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []string
+	for _, sub := range subs {
+		if !sub.Builds() || !subscription.MatchesBranch(sub.Filters.Branches, pl.CommitStatus.Refname) {
+			continue
+		}
+		channels = append(channels, sub.ChannelID)
+	}
+
+	return channels, nil
+}
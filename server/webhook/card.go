@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+// createPullRequestCardHandler updates the card of the pull request in the channels subscribed
+// with cards. Author filters don't apply, as the card has to show the current state.
+func (w *webhook) createPullRequestCardHandler(pl webhookpayload.Payload, repository webhookpayload.Repository, pullRequest webhookpayload.PullRequest) (*HandleWebhook, error) {
+	subs, err := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []string
+	for _, sub := range subs {
+		if !sub.Cards || (!sub.Pulls() && !sub.PullReviews()) || !subscription.MatchesBranch(sub.Filters.TargetBranches, pullRequest.Destination.Branch.Name) {
+			continue
+		}
+		channels = append(channels, sub.ChannelID)
+	}
+
+	if len(channels) == 0 {
+		return nil, nil
+	}
+
+	buildStatus := w.builds.GetBuildStatus(repository.FullName, pullRequest.Source.Branch.Name)
+
+	message, err := w.templateRenderer.RenderPullRequestCard(repository, pullRequest, buildStatus)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	return &HandleWebhook{
+		Message:    message,
+		ToChannels: channels,
+		Card: &Card{
+			Key:   fmt.Sprintf("pr/%s/%d", repository.FullName, pullRequest.ID),
+			Props: pullRequestCardProps(repository, pullRequest, buildStatus),
+		},
+	}, nil
+}
+
+// pullRequestCardProps are the post props the webapp renders the card from.
+func pullRequestCardProps(repository webhookpayload.Repository, pullRequest webhookpayload.PullRequest, buildStatus string) map[string]interface{} {
+	approved := map[string]bool{}
+	for _, participant := range pullRequest.Participants {
+		if participant.Approved {
+			approved[participant.User.AccountID] = true
+		}
+	}
+
+	reviewers := []interface{}{}
+	for _, reviewer := range pullRequest.Reviewers {
+		reviewers = append(reviewers, map[string]interface{}{
+			"name":     reviewer.DisplayName,
+			"nickname": reviewer.NickName,
+			"url":      reviewer.Links.HTML.Href,
+			"approved": approved[reviewer.AccountID],
+		})
+	}
+
+	return map[string]interface{}{
+		"repository":     repository.FullName,
+		"repository_url": repository.Links.HTML.Href,
+		"id":             pullRequest.ID,
+		"title":          pullRequest.Title,
+		"url":            pullRequest.Links.HTML.Href,
+		"author":         pullRequest.Author.DisplayName,
+		"state":          pullRequest.State,
+		"source_branch":  pullRequest.Source.Branch.Name,
+		"target_branch":  pullRequest.Destination.Branch.Name,
+		"reviewers":      reviewers,
+		"approvals":      pullRequest.ApprovalCount(),
+		"build_status":   buildStatus,
+		"comment_count":  pullRequest.CommentCount,
+	}
+}
+
+// createPullRequestCardHandlersForBranch updates the cards of the open pull requests from the
+// branch. The pull requests are only looked up if a channel subscribed to the repository with cards.
+func (w *webhook) createPullRequestCardHandlersForBranch(pl webhookpayload.Payload, branch string) ([]*HandleWebhook, error) {
+	if branch == "" {
+		return nil, nil
+	}
+
+	subs, err := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(pl)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(subs, func(sub *subscription.Subscription) bool {
+		return sub.Cards
+	}) {
+		return nil, nil
+	}
+
+	repository := pl.GetRepository()
+
+	var handlers []*HandleWebhook
+	for _, pullRequest := range w.pullRequests.GetOpenPullRequests(repository.FullName, branch) {
+		handler, err := w.createPullRequestCardHandler(pl, repository, pullRequest)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, handler)
+	}
+
+	return handlers, nil
+}
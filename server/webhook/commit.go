@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func (w *webhook) HandleRepoCommitCommentCreatedEvent(pl webhookpayload.RepoCommitCommentCreatedPayload) ([]*HandleWebhook, error) {
+	var handlers []*HandleWebhook
+
+	// the commit author isn't part of the payload, so it has to be looked up
+	commitAuthors := w.commitParticipants.GetCommitParticipants(pl.Repository.FullName, pl.Commit.Hash, "")
+
+	handler1, err := w.createCommitCommentCreatedEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	handler2, err := w.createCommitCommentMentionNotification(pl, commitAuthors)
+	if err != nil {
+		return nil, err
+	}
+
+	handler3, err := w.createCommitCommentNotificationForCommitAuthor(pl, commitAuthors)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, handler2, handler3)), nil
+}
+
+func (w *webhook) createCommitCommentCreatedEventNotificationForSubscribedChannels(pl webhookpayload.RepoCommitCommentCreatedPayload) (*HandleWebhook, error) {
+	message, err := w.templateRenderer.RenderCommitCommentCreatedEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &HandleWebhook{Message: message}
+
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
+	if len(subs) == 0 {
+		return handler, nil
+	}
+
+	for _, sub := range subs {
+		if !sub.CommitComments() {
+			continue
+		}
+		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+	}
+
+	return handler, nil
+}
+
+func (w *webhook) createCommitCommentMentionNotification(pl webhookpayload.RepoCommitCommentCreatedPayload, commitAuthors []string) (*HandleWebhook, error) {
+	mentionedAccountIDs := w.parseBitbucketAcountIDsFromHTML(pl.Comment.Content.HTML)
+	message, err := w.templateRenderer.RenderCommitCommentMentionNotification(pl)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	// remove the commit author from the list as they will be notified in another message
+	for _, accountID := range commitAuthors {
+		mentionedAccountIDs = removeFromSlice(mentionedAccountIDs, accountID)
+	}
+
+	return w.createPrivateMessageHandleWebhook(&pl, message, mentionedAccountIDs), nil
+}
+
+func (w *webhook) createCommitCommentNotificationForCommitAuthor(pl webhookpayload.RepoCommitCommentCreatedPayload, commitAuthors []string) (*HandleWebhook, error) {
+	if len(commitAuthors) == 0 {
+		return nil, nil
+	}
+
+	message, err := w.templateRenderer.RenderCommitCommentNotificationForCommitAuthor(pl)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	return w.createPrivateMessageHandleWebhook(&pl, message, commitAuthors), nil
+}
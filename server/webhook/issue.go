@@ -1,6 +1,7 @@
 package webhook
 
 import (
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
 
 	"github.com/pkg/errors"
@@ -72,13 +73,16 @@ func (w *webhook) createIssueCommentCreatedEventNotificationForSubscribedChannel
 
 	handler := &HandleWebhook{Message: message}
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.IssueComments() {
+		if !sub.IssueComments() || !matchesIssueFilters(sub.Filters, pl.Issue) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
@@ -95,13 +99,16 @@ func (w *webhook) createIssueUpdatedEventNotificationForSubscribedChannels(pl we
 
 	handler := &HandleWebhook{Message: message}
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.Issues() {
+		if !sub.Issues() || !matchesIssueFilters(sub.Filters, pl.Issue) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
@@ -118,13 +125,16 @@ func (w *webhook) createIssueCreatedEventNotificationForSubscribedChannels(pl we
 
 	handler := &HandleWebhook{Message: message}
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.Issues() {
+		if !sub.Issues() || !matchesIssueFilters(sub.Filters, pl.Issue) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
@@ -193,3 +203,26 @@ func (w *webhook) createIssueCommentNotificationForIssueReporter(pl webhookpaylo
 
 	return w.createPrivateMessageHandleWebhook(&pl, message, []string{pl.Issue.Reporter.AccountID}), nil
 }
+
+// matchesIssueFilters reports whether the issue matches the issue filters of a subscription.
+// Labels match any of the issue's kind, priority, component, milestone or version.
+func matchesIssueFilters(filters subscription.Filters, issue webhookpayload.Issue) bool {
+	if len(filters.Labels) > 0 {
+		matched := false
+		for _, value := range []string{issue.Kind, issue.Priority, issue.Component.Name, issue.Milestone.Name, issue.Version.Name} {
+			if value != "" && subscription.MatchesAny(filters.Labels, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return subscription.MatchesAny(filters.Kinds, issue.Kind) &&
+		subscription.MatchesAny(filters.Priorities, issue.Priority) &&
+		subscription.MatchesAny(filters.Components, issue.Component.Name) &&
+		subscription.MatchesAny(filters.Milestones, issue.Milestone.Name) &&
+		subscription.MatchesAny(filters.Versions, issue.Version.Name)
+}
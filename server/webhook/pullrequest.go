@@ -1,6 +1,9 @@
 package webhook
 
 import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
 
 	"github.com/pkg/errors"
@@ -19,7 +22,12 @@ func (w *webhook) HandlePullRequestCreatedEvent(pl webhookpayload.PullRequestCre
 		return nil, err
 	}
 
-	return cleanWebhookHandlers(append(handlers, handler1, handler2)), nil
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, handler2, cardHandler)), nil
 }
 
 func (w *webhook) HandlePullRequestApprovedEvent(pl webhookpayload.PullRequestApprovedPayload) ([]*HandleWebhook, error) {
@@ -35,7 +43,12 @@ func (w *webhook) HandlePullRequestApprovedEvent(pl webhookpayload.PullRequestAp
 		return nil, err
 	}
 
-	return cleanWebhookHandlers(append(handlers, handler1, handler2)), nil
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, handler2, cardHandler)), nil
 }
 
 func (w *webhook) HandlePullRequestDeclinedEvent(pl webhookpayload.PullRequestDeclinedPayload) ([]*HandleWebhook, error) {
@@ -51,7 +64,12 @@ func (w *webhook) HandlePullRequestDeclinedEvent(pl webhookpayload.PullRequestDe
 		return nil, err
 	}
 
-	return cleanWebhookHandlers(append(handlers, handler1, handler2)), nil
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, handler2, cardHandler)), nil
 }
 
 func (w *webhook) HandlePullRequestUnapprovedEvent(pl webhookpayload.PullRequestUnapprovedPayload) ([]*HandleWebhook, error) {
@@ -67,7 +85,12 @@ func (w *webhook) HandlePullRequestUnapprovedEvent(pl webhookpayload.PullRequest
 		return nil, err
 	}
 
-	return cleanWebhookHandlers(append(handlers, handler1, handler2)), nil
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, handler2, cardHandler)), nil
 }
 
 func (w *webhook) HandlePullRequestMergedEvent(pl webhookpayload.PullRequestMergedPayload) ([]*HandleWebhook, error) {
@@ -83,7 +106,12 @@ func (w *webhook) HandlePullRequestMergedEvent(pl webhookpayload.PullRequestMerg
 		return nil, err
 	}
 
-	return cleanWebhookHandlers(append(handlers, handler1, handler2)), nil
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, handler2, cardHandler)), nil
 }
 
 func (w *webhook) HandlePullRequestCommentCreatedEvent(pl webhookpayload.PullRequestCommentCreatedPayload) ([]*HandleWebhook, error) {
@@ -104,13 +132,97 @@ func (w *webhook) HandlePullRequestCommentCreatedEvent(pl webhookpayload.PullReq
 		return nil, err
 	}
 
-	return cleanWebhookHandlers(append(handlers, handler1, handler2, handler3)), nil
+	handler1.PostKey = pullRequestCommentPostKey(pl, "channel")
+	handler2.PostKey = pullRequestCommentPostKey(pl, "mention")
+	handler3.PostKey = pullRequestCommentPostKey(pl, "author")
+
+	comment := &PullRequestComment{Repository: pl.Repository.FullName, PullRequestID: pl.PullRequest.ID, CommentID: pl.Comment.ID}
+	handler1.PullRequestComment = comment
+	handler2.PullRequestComment = comment
+	handler3.PullRequestComment = comment
+
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, handler2, handler3, cardHandler)), nil
+}
+
+// HandlePullRequestCommentUpdatedEvent updates the posts of the comment with the edited text.
+func (w *webhook) HandlePullRequestCommentUpdatedEvent(pl webhookpayload.PullRequestCommentUpdatedPayload) ([]*HandleWebhook, error) {
+	created := webhookpayload.PullRequestCommentCreatedPayload(pl)
+
+	message1, err := w.templateRenderer.RenderPullRequestCommentCreatedEventNotificationForSubscribedChannels(created)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	message2, err := w.templateRenderer.RenderPullRequestCommentMentionNotification(created)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	message3, err := w.templateRenderer.RenderPullRequestCommentNotificationForPullRequestAuthor(created)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers([]*HandleWebhook{
+		{Message: message1, PostKey: pullRequestCommentPostKey(created, "channel"), PostAction: PostActionUpdate},
+		{Message: message2, PostKey: pullRequestCommentPostKey(created, "mention"), PostAction: PostActionUpdate},
+		{Message: message3, PostKey: pullRequestCommentPostKey(created, "author"), PostAction: PostActionUpdate},
+		cardHandler,
+	}), nil
+}
+
+// HandlePullRequestCommentDeletedEvent removes the posts of the comment.
+func (w *webhook) HandlePullRequestCommentDeletedEvent(pl webhookpayload.PullRequestCommentDeletedPayload) ([]*HandleWebhook, error) {
+	created := webhookpayload.PullRequestCommentCreatedPayload(pl)
+
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers([]*HandleWebhook{
+		{PostKey: pullRequestCommentPostKey(created, "channel"), PostAction: PostActionDelete},
+		{PostKey: pullRequestCommentPostKey(created, "mention"), PostAction: PostActionDelete},
+		{PostKey: pullRequestCommentPostKey(created, "author"), PostAction: PostActionDelete},
+		cardHandler,
+	}), nil
+}
+
+// pullRequestCommentPostKey identifies the posts sent to the given recipients about a pull request comment.
+func pullRequestCommentPostKey(pl webhookpayload.PullRequestCommentCreatedPayload, recipients string) string {
+	return fmt.Sprintf("pr_comment/%s/%d/%s", pl.Repository.FullName, pl.Comment.ID, recipients)
 }
 
 func (w *webhook) HandlePullRequestUpdatedEvent(pl webhookpayload.PullRequestUpdatedPayload) ([]*HandleWebhook, error) {
+	var handlers []*HandleWebhook
+
+	handler1, err := w.createPullRequestAssignedNotification(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	cardHandler, err := w.createPullRequestCardHandler(&pl, pl.Repository, pl.PullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers(append(handlers, handler1, cardHandler)), nil
+}
+
+func (w *webhook) createPullRequestAssignedNotification(pl webhookpayload.PullRequestUpdatedPayload) (*HandleWebhook, error) {
 	// ignore if there are no reviewers
 	if len(pl.PullRequest.Reviewers) == 0 {
-		return []*HandleWebhook{}, nil
+		return nil, nil
 	}
 
 	thisPullRequestReviewers, err := w.reviewConfiguration.GetAlreadyNotifiedUsers(pl.PullRequest.ID)
@@ -139,7 +251,7 @@ func (w *webhook) HandlePullRequestUpdatedEvent(pl webhookpayload.PullRequestUpd
 	// save information about users that had been notified
 	w.reviewConfiguration.SaveNotifiedUsers(pl.PullRequest.ID, thisPullRequestReviewers)
 
-	return cleanWebhookHandlers([]*HandleWebhook{handler}), nil
+	return handler, nil
 }
 
 func (w *webhook) createPullRequestCreatedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestCreatedPayload) (*HandleWebhook, error) {
@@ -148,21 +260,32 @@ func (w *webhook) createPullRequestCreatedEventNotificationForSubscribedChannels
 		return nil, err
 	}
 
-	handler := &HandleWebhook{Message: message}
+	handler := &HandleWebhook{
+		Message:            message,
+		PullRequestActions: &PullRequestActions{Repository: pl.Repository.FullName, PullRequestID: pl.PullRequest.ID},
+	}
+	var threadedChannels []string
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.Pulls() {
+		// subscriptions with cards get the card instead, see createPullRequestCardHandler
+		if !sub.Pulls() || sub.Cards || !subscription.MatchesBranch(sub.Filters.TargetBranches, pl.PullRequest.Destination.Branch.Name) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+		if sub.Threaded {
+			threadedChannels = append(threadedChannels, sub.ChannelID)
+		}
 	}
 
-	return handler, nil
+	return w.addPullRequestThread(handler, threadedChannels, pl.Repository, pl.PullRequest)
 }
 
 func (w *webhook) createPullRequestApprovedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestApprovedPayload) (*HandleWebhook, error) {
@@ -172,20 +295,27 @@ func (w *webhook) createPullRequestApprovedEventNotificationForSubscribedChannel
 	}
 
 	handler := &HandleWebhook{Message: message}
+	var threadedChannels []string
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.PullReviews() {
+		if !sub.PullReviews() || sub.Cards || !subscription.MatchesBranch(sub.Filters.TargetBranches, pl.PullRequest.Destination.Branch.Name) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+		if sub.Threaded {
+			threadedChannels = append(threadedChannels, sub.ChannelID)
+		}
 	}
 
-	return handler, nil
+	return w.addPullRequestThread(handler, threadedChannels, pl.Repository, pl.PullRequest)
 }
 
 func (w *webhook) createPullRequestDeclinedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestDeclinedPayload) (*HandleWebhook, error) {
@@ -195,20 +325,27 @@ func (w *webhook) createPullRequestDeclinedEventNotificationForSubscribedChannel
 	}
 
 	handler := &HandleWebhook{Message: message}
+	var threadedChannels []string
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.PullReviews() {
+		if !sub.PullReviews() || sub.Cards || !subscription.MatchesBranch(sub.Filters.TargetBranches, pl.PullRequest.Destination.Branch.Name) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+		if sub.Threaded {
+			threadedChannels = append(threadedChannels, sub.ChannelID)
+		}
 	}
 
-	return handler, nil
+	return w.addPullRequestThread(handler, threadedChannels, pl.Repository, pl.PullRequest)
 }
 
 func (w *webhook) createPullRequestUnapprovedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestUnapprovedPayload) (*HandleWebhook, error) {
@@ -218,20 +355,27 @@ func (w *webhook) createPullRequestUnapprovedEventNotificationForSubscribedChann
 	}
 
 	handler := &HandleWebhook{Message: message}
+	var threadedChannels []string
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.PullReviews() {
+		if !sub.PullReviews() || sub.Cards || !subscription.MatchesBranch(sub.Filters.TargetBranches, pl.PullRequest.Destination.Branch.Name) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+		if sub.Threaded {
+			threadedChannels = append(threadedChannels, sub.ChannelID)
+		}
 	}
 
-	return handler, nil
+	return w.addPullRequestThread(handler, threadedChannels, pl.Repository, pl.PullRequest)
 }
 
 func (w *webhook) createPullRequestMergedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestMergedPayload) (*HandleWebhook, error) {
@@ -241,20 +385,27 @@ func (w *webhook) createPullRequestMergedEventNotificationForSubscribedChannels(
 	}
 
 	handler := &HandleWebhook{Message: message}
+	var threadedChannels []string
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.PullReviews() {
+		if !sub.PullReviews() || sub.Cards || !subscription.MatchesBranch(sub.Filters.TargetBranches, pl.PullRequest.Destination.Branch.Name) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+		if sub.Threaded {
+			threadedChannels = append(threadedChannels, sub.ChannelID)
+		}
 	}
 
-	return handler, nil
+	return w.addPullRequestThread(handler, threadedChannels, pl.Repository, pl.PullRequest)
 }
 
 func (w *webhook) createPullRequestCommentCreatedEventNotificationForSubscribedChannels(pl webhookpayload.PullRequestCommentCreatedPayload) (*HandleWebhook, error) {
@@ -264,20 +415,27 @@ func (w *webhook) createPullRequestCommentCreatedEventNotificationForSubscribedC
 	}
 
 	handler := &HandleWebhook{Message: message}
+	var threadedChannels []string
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.PullReviews() {
+		if !sub.PullReviews() || sub.Cards || !subscription.MatchesBranch(sub.Filters.TargetBranches, pl.PullRequest.Destination.Branch.Name) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+		if sub.Threaded {
+			threadedChannels = append(threadedChannels, sub.ChannelID)
+		}
 	}
 
-	return handler, nil
+	return w.addPullRequestThread(handler, threadedChannels, pl.Repository, pl.PullRequest)
 }
 
 func (w *webhook) createPullRequestDescriptionMentionNotification(pl webhookpayload.PullRequestCreatedPayload) (*HandleWebhook, error) {
@@ -356,3 +514,29 @@ func contains(s []string, e string) bool {
 	}
 	return false
 }
+
+// PullRequestThreadKey returns the key of the thread of the pull request.
+func PullRequestThreadKey(repository string, pullRequestID int64) string {
+	return fmt.Sprintf("pr/%s/%d", repository, pullRequestID)
+}
+
+// addPullRequestThread posts the message of the handler as a reply to the thread of the pull
+// request in the given channels. The root post shows the current state of the pull request.
+func (w *webhook) addPullRequestThread(handler *HandleWebhook, channels []string, repository webhookpayload.Repository, pullRequest webhookpayload.PullRequest) (*HandleWebhook, error) {
+	if len(channels) == 0 {
+		return handler, nil
+	}
+
+	rootMessage, err := w.templateRenderer.RenderPullRequestThreadRootMessage(repository, pullRequest)
+	if err != nil {
+		return nil, errors.Wrap(err, TemplateErrorText)
+	}
+
+	handler.Thread = &Thread{
+		Key:         PullRequestThreadKey(repository.FullName, pullRequest.ID),
+		RootMessage: rootMessage,
+		Channels:    channels,
+	}
+
+	return handler, nil
+}
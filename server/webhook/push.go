@@ -1,31 +1,46 @@
 package webhook
 
 import (
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
 	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
 )
 
+// HandleRepoPushEvent notifies about each pushed, created or deleted branch or tag of the push
+// separately, so that the branch filters and the messages apply to every ref.
 func (w *webhook) HandleRepoPushEvent(pl webhookpayload.RepoPushPayload) ([]*HandleWebhook, error) {
 	var handlers []*HandleWebhook
 
-	handler1, err := w.createRepoPushEventNotificationForSubscribedChannels(pl)
-	if err != nil {
-		return nil, err
-	}
+	for _, change := range pl.Push.Changes {
+		refPayload := pl
+		refPayload.Push.Changes = []webhookpayload.RepoPushChange{change}
 
-	handler2, err := w.createBranchOrTagCreatedEventNotificationForSubscribedChannels(pl)
-	if err != nil {
-		return nil, err
-	}
+		handler1, err := w.createRepoPushEventNotificationForSubscribedChannels(refPayload)
+		if err != nil {
+			return nil, err
+		}
 
-	handler3, err := w.createBranchOrTagDeletedEventNotificationForSubscribedChannels(pl)
-	if err != nil {
-		return nil, err
+		handler2, err := w.createBranchOrTagCreatedEventNotificationForSubscribedChannels(refPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		handler3, err := w.createBranchOrTagDeletedEventNotificationForSubscribedChannels(refPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		handlers = append(handlers, handler1, handler2, handler3)
 	}
 
-	return cleanWebhookHandlers(append(handlers, handler1, handler2, handler3)), nil
+	return cleanWebhookHandlers(handlers), nil
 }
 
 func (w *webhook) createRepoPushEventNotificationForSubscribedChannels(pl webhookpayload.RepoPushPayload) (*HandleWebhook, error) {
+	// deleted branches and tags have no new state to push to
+	if len(pl.Push.Changes) == 0 || pl.Push.Changes[0].New.Type == "" {
+		return nil, nil
+	}
+
 	message, err := w.templateRenderer.RenderRepoPushEventNotificationForSubscribedChannels(pl)
 	if err != nil {
 		return nil, err
@@ -33,13 +48,16 @@ func (w *webhook) createRepoPushEventNotificationForSubscribedChannels(pl webhoo
 
 	handler := &HandleWebhook{Message: message}
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.Pushes() {
+		if !sub.Pushes() || !subscription.MatchesBranch(sub.Filters.Branches, pushedRefName(pl)) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
@@ -64,13 +82,16 @@ func (w *webhook) createBranchOrTagCreatedEventNotificationForSubscribedChannels
 
 	handler := &HandleWebhook{Message: message}
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.Creates() {
+		if !sub.Creates() || !subscription.MatchesBranch(sub.Filters.Branches, pushedRefName(pl)) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
@@ -95,13 +116,16 @@ func (w *webhook) createBranchOrTagDeletedEventNotificationForSubscribedChannels
 
 	handler := &HandleWebhook{Message: message}
 
-	subs := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(&pl)
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
 	if len(subs) == 0 {
 		return handler, nil
 	}
 
 	for _, sub := range subs {
-		if !sub.Deletes() {
+		if !sub.Deletes() || !subscription.MatchesBranch(sub.Filters.Branches, pushedRefName(pl)) {
 			continue
 		}
 		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
@@ -109,3 +133,17 @@ func (w *webhook) createBranchOrTagDeletedEventNotificationForSubscribedChannels
 
 	return handler, nil
 }
+
+// pushedRefName returns the name of the pushed branch or tag, which is only in the old state when
+// it was deleted. The payload holds a single change, see HandleRepoPushEvent.
+func pushedRefName(pl webhookpayload.RepoPushPayload) string {
+	if len(pl.Push.Changes) == 0 {
+		return ""
+	}
+
+	change := pl.Push.Changes[0]
+	if change.New.Name != "" {
+		return change.New.Name
+	}
+	return change.Old.Name
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func (w *webhook) HandleRepoForkEvent(pl webhookpayload.RepoForkPayload) ([]*HandleWebhook, error) {
+	handler, err := w.createRepoForkEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers([]*HandleWebhook{handler}), nil
+}
+
+func (w *webhook) HandleRepoUpdatedEvent(pl webhookpayload.RepoUpdatedPayload) ([]*HandleWebhook, error) {
+	handler, err := w.createRepoUpdatedEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanWebhookHandlers([]*HandleWebhook{handler}), nil
+}
+
+func (w *webhook) createRepoForkEventNotificationForSubscribedChannels(pl webhookpayload.RepoForkPayload) (*HandleWebhook, error) {
+	message, err := w.templateRenderer.RenderRepoForkEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &HandleWebhook{Message: message}
+
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
+	if len(subs) == 0 {
+		return handler, nil
+	}
+
+	for _, sub := range subs {
+		if !sub.Forks() {
+			continue
+		}
+		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+	}
+
+	return handler, nil
+}
+
+func (w *webhook) createRepoUpdatedEventNotificationForSubscribedChannels(pl webhookpayload.RepoUpdatedPayload) (*HandleWebhook, error) {
+	// ignore changes that aren't rendered, e.g. of the avatar
+	changes := pl.Changes
+	if changes.FullName.Old == changes.FullName.New && changes.Name.Old == changes.Name.New &&
+		changes.Description.Old == changes.Description.New && changes.Website.Old == changes.Website.New &&
+		changes.Language.Old == changes.Language.New {
+		return nil, nil
+	}
+
+	message, err := w.templateRenderer.RenderRepoUpdatedEventNotificationForSubscribedChannels(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &HandleWebhook{Message: message}
+
+	subs, err := w.getSubscriptions(&pl)
+	if err != nil {
+		return nil, err
+	}
+	if len(subs) == 0 {
+		return handler, nil
+	}
+
+	for _, sub := range subs {
+		if !sub.RepoUpdates() {
+			continue
+		}
+		handler.ToChannels = append(handler.ToChannels, sub.ChannelID)
+	}
+
+	return handler, nil
+}
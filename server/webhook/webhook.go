@@ -18,10 +18,71 @@ type HandleWebhook struct {
 	Message          string
 	ToBitbucketUsers []string
 	ToChannels       []string
+
+	// CollapseKey, if set, replaces the previous channel post with the same key by this message,
+	// as long as nothing else was posted in the channel since.
+	CollapseKey string
+
+	// PostKey, if set, records the created posts, so that later events about the same object can
+	// update or delete them with PostAction.
+	PostKey string
+	// PostAction is applied to the posts recorded for PostKey. Handlers with an action don't create
+	// new posts.
+	PostAction PostAction
+
+	// Thread, if set, posts the message in some of the channels as a reply to a thread.
+	Thread *Thread
+
+	// Card, if set, creates or updates the card post of the object in all channels instead of
+	// posting the message. The message is the card's fallback text.
+	Card *Card
+
+	// PullRequestActions, if set, adds buttons to the channel posts to act on the pull request.
+	PullRequestActions *PullRequestActions
+
+	// PullRequestComment, if set, turns replies to the posts into replies to the comment in Bitbucket.
+	PullRequestComment *PullRequestComment
+}
+
+// PullRequestComment identifies the pull request comment a post is about.
+type PullRequestComment struct {
+	Repository    string
+	PullRequestID int64
+	CommentID     int64
 }
 
+// PullRequestActions identifies the pull request the buttons of a post act on.
+type PullRequestActions struct {
+	Repository    string
+	PullRequestID int64
+}
+
+// Card is a post per object, e.g. a pull request, and channel that shows the current state of the object.
+type Card struct {
+	Key   string
+	Props map[string]interface{}
+}
+
+// Thread groups the channel posts about an object, e.g. a pull request, under a root post.
+type Thread struct {
+	Key string
+	// RootMessage summarizes the current state of the object. It is shown on top of the root post.
+	RootMessage string
+	// Channels lists the channels of ToChannels in which the message is posted to the thread.
+	Channels []string
+}
+
+type PostAction string
+
+const (
+	PostActionUpdate PostAction = "update"
+	PostActionDelete PostAction = "delete"
+)
+
 type SubscriptionHandler interface {
-	GetSubscribedChannelsForRepository(webhookpayload.Payload) []*subscription.Subscription
+	// GetSubscribedChannelsForRepository returns the subscriptions to the repository of the payload.
+	// An error means they couldn't be determined, and the delivery has to be retried.
+	GetSubscribedChannelsForRepository(webhookpayload.Payload) ([]*subscription.Subscription, error)
 }
 
 type PullRequestReviewHandler interface {
@@ -29,6 +90,26 @@ type PullRequestReviewHandler interface {
 	SaveNotifiedUsers(int64, []string)
 }
 
+type CommitParticipantsProvider interface {
+	// GetCommitParticipants returns the account IDs of the commit author and, if a branch is
+	// given, of the authors of open pull requests from the branch.
+	GetCommitParticipants(repository, commitHash, branch string) []string
+}
+
+type BuildStatusStore interface {
+	// RecordBuildStatus stores the status of a build of the branch, and returns the last completed
+	// state of the same build before it, or an empty string if there is none.
+	RecordBuildStatus(repository, branch string, status webhookpayload.CommitStatus) string
+	// GetBuildStatus returns the combined state of the builds of the latest commit of the branch,
+	// or an empty string if there are none.
+	GetBuildStatus(repository, branch string) string
+}
+
+type PullRequestProvider interface {
+	// GetOpenPullRequests returns the open pull requests from the branch.
+	GetOpenPullRequests(repository, branch string) []webhookpayload.PullRequest
+}
+
 type Webhook interface {
 	HandleRepoPushEvent(webhookpayload.RepoPushPayload) ([]*HandleWebhook, error)
 	HandleIssueCreatedEvent(webhookpayload.IssueCreatedPayload) ([]*HandleWebhook, error)
@@ -40,17 +121,48 @@ type Webhook interface {
 	HandlePullRequestUnapprovedEvent(webhookpayload.PullRequestUnapprovedPayload) ([]*HandleWebhook, error)
 	HandlePullRequestMergedEvent(webhookpayload.PullRequestMergedPayload) ([]*HandleWebhook, error)
 	HandlePullRequestCommentCreatedEvent(webhookpayload.PullRequestCommentCreatedPayload) ([]*HandleWebhook, error)
+	HandlePullRequestCommentUpdatedEvent(webhookpayload.PullRequestCommentUpdatedPayload) ([]*HandleWebhook, error)
+	HandlePullRequestCommentDeletedEvent(webhookpayload.PullRequestCommentDeletedPayload) ([]*HandleWebhook, error)
 	HandlePullRequestUpdatedEvent(webhookpayload.PullRequestUpdatedPayload) ([]*HandleWebhook, error)
+	HandleRepoForkEvent(webhookpayload.RepoForkPayload) ([]*HandleWebhook, error)
+	HandleRepoUpdatedEvent(webhookpayload.RepoUpdatedPayload) ([]*HandleWebhook, error)
+	HandleRepoCommitCommentCreatedEvent(webhookpayload.RepoCommitCommentCreatedPayload) ([]*HandleWebhook, error)
+	HandleRepoCommitStatusCreatedEvent(webhookpayload.RepoCommitStatusCreatedPayload) ([]*HandleWebhook, error)
+	HandleRepoCommitStatusUpdatedEvent(webhookpayload.RepoCommitStatusUpdatedPayload) ([]*HandleWebhook, error)
 }
 
 type webhook struct {
 	subscriptionConfiguration SubscriptionHandler
 	reviewConfiguration       PullRequestReviewHandler
+	commitParticipants        CommitParticipantsProvider
+	pullRequests              PullRequestProvider
+	builds                    BuildStatusStore
 	templateRenderer          templaterenderer.TemplateRenderer
 }
 
-func NewWebhook(s SubscriptionHandler, r PullRequestReviewHandler, t templaterenderer.TemplateRenderer) Webhook {
-	return &webhook{subscriptionConfiguration: s, reviewConfiguration: r, templateRenderer: t}
+func NewWebhook(s SubscriptionHandler, r PullRequestReviewHandler, c CommitParticipantsProvider, pr PullRequestProvider, b BuildStatusStore, t templaterenderer.TemplateRenderer) Webhook {
+	return &webhook{subscriptionConfiguration: s, reviewConfiguration: r, commitParticipants: c, pullRequests: pr, builds: b, templateRenderer: t}
+}
+
+// getSubscriptions returns the subscriptions for the repository of the payload, except those
+// whose author filters exclude the user who triggered the event.
+func (w *webhook) getSubscriptions(pl webhookpayload.Payload) ([]*subscription.Subscription, error) {
+	repoSubs, err := w.subscriptionConfiguration.GetSubscribedChannelsForRepository(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	actor := pl.GetActor()
+
+	var subs []*subscription.Subscription
+	for _, sub := range repoSubs {
+		if !sub.Filters.MatchesAuthor(actor.AccountID, actor.NickName) {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, nil
 }
 
 func (w *webhook) createPrivateMessageHandleWebhook(pl webhookpayload.Payload, message string, accountIDs []string) *HandleWebhook {
@@ -96,8 +208,8 @@ func cleanWebhookHandlers(handlers []*HandleWebhook) []*HandleWebhook {
 		if handler == nil {
 			continue
 		}
-		// don't send handlers with empty messages
-		if handler.Message == "" {
+		// don't send handlers with empty messages, unless they delete posts
+		if handler.Message == "" && handler.PostAction != PostActionDelete {
 			continue
 		}
 		res = append(res, handler)
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+const (
+	KeyWebhookJob               = "webhook_job_"
+	KeyWebhookDeadLetter        = "webhook_deadletter_"
+	KeyWebhookDuplicatesDropped = "webhook_duplicates_dropped"
+
+	// KeyWebhookJobIndex and KeyWebhookDeadLetterIndex list the IDs of the pending and
+	// dead-lettered jobs, see getKVIndex.
+	KeyWebhookJobIndex        = "webhook_pending_jobs"
+	KeyWebhookDeadLetterIndex = "webhook_dead_letters"
+
+	webhookWorkers        = 4
+	webhookQueueSize      = 1000
+	webhookMaxAttempts    = 6
+	webhookRetryBaseDelay = 5 * time.Second
+	webhookRetryMaxDelay  = 10 * time.Minute
+	webhookJobLease       = 2 * time.Minute
+	webhookSweepInterval  = time.Minute
+
+	kvListPageSize = 1000
+)
+
+// webhookJob is a webhook delivery waiting to be processed. It is kept in the KV store until it
+// has been processed successfully or moved to the dead-letter list.
+type webhookJob struct {
+	ID            string
+	DeliveryID    string
+	EventKey      string
+	Body          []byte
+	Attempts      int
+	LastError     string
+	CreatedAt     int64
+	NextAttemptAt int64
+	// LeaseUntil is set while a worker on any node processes the job.
+	LeaseUntil int64
+	// Delivered records the posts already created, so that retries don't post them again.
+	Delivered map[string]bool
+}
+
+// errWebhookJobLeaseExpired stops processing a job whose lease expired, as another node may have
+// claimed it since.
+var errWebhookJobLeaseExpired = errors.New("webhook job lease expired")
+
+// permanentError marks a failure that retrying won't fix, e.g. a malformed payload.
+type permanentError struct {
+	error
+}
+
+// webhookQueue processes webhook deliveries in the background with a bounded number of workers.
+// Jobs are persisted in the KV store, so they survive restarts and can be picked up by any node.
+type webhookQueue struct {
+	p *Plugin
+
+	jobs chan string
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newWebhookQueue(p *Plugin) *webhookQueue {
+	return &webhookQueue{
+		p:    p,
+		jobs: make(chan string, webhookQueueSize),
+		stop: make(chan struct{}),
+	}
+}
+
+// start runs the workers and periodically sweeps the pending jobs for the ones that are due,
+// which also recovers jobs left over by a previous run.
+func (q *webhookQueue) start() {
+	for i := 0; i < webhookWorkers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+
+		ticker := time.NewTicker(webhookSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			q.sweep()
+
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (q *webhookQueue) close() {
+	close(q.stop)
+	q.wg.Wait()
+}
+
+// enqueue persists the delivery as the job with the given ID and schedules it for processing.
+func (q *webhookQueue) enqueue(jobID string, delivery *webhookpayload.Delivery) error {
+	now := model.GetMillis()
+	job := &webhookJob{
+		ID:            jobID,
+		DeliveryID:    delivery.ID,
+		EventKey:      delivery.EventKey,
+		Body:          delivery.Body,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		Delivered:     map[string]bool{},
+	}
+
+	if err := q.p.storeWebhookJob(KeyWebhookJob, job); err != nil {
+		return err
+	}
+
+	if err := q.p.addToKVIndex(KeyWebhookJobIndex, job.ID); err != nil {
+		if appErr := q.p.API.KVDelete(KeyWebhookJob + job.ID); appErr != nil {
+			q.p.API.LogWarn("Failed to delete unindexed webhook job", "jobID", job.ID, "error", appErr.Error())
+		}
+		return errors.Wrap(err, "failed to index webhook job")
+	}
+
+	q.schedule(job.ID)
+
+	return nil
+}
+
+// schedule hands the job to a worker. If all workers are busy and the buffer is full,
+// the job stays in the KV store and is picked up by the next sweep.
+func (q *webhookQueue) schedule(jobID string) {
+	select {
+	case q.jobs <- jobID:
+	default:
+	}
+}
+
+func (q *webhookQueue) sweep() {
+	jobIDs, err := q.p.getKVIndex(KeyWebhookJobIndex)
+	if err != nil {
+		q.p.API.LogWarn("Failed to list pending webhook jobs", "error", err.Error())
+		return
+	}
+
+	for _, jobID := range jobIDs {
+		q.schedule(jobID)
+	}
+}
+
+func (q *webhookQueue) work() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case jobID := <-q.jobs:
+			q.process(jobID)
+		}
+	}
+}
+
+func (q *webhookQueue) process(jobID string) {
+	job, err := q.p.claimWebhookJob(jobID)
+	if err != nil {
+		q.p.API.LogWarn("Failed to claim webhook job", "jobID", jobID, "error", err.Error())
+		return
+	}
+	if job == nil {
+		return
+	}
+
+	err = q.run(job)
+	if errors.Is(err, errWebhookJobLeaseExpired) {
+		q.p.API.LogWarn("Stopped processing webhook delivery after its lease expired", "jobID", job.ID, "event", job.EventKey)
+		return
+	}
+	if err == nil {
+		if err := q.p.deleteWebhookJob(job.ID); err != nil {
+			q.p.API.LogWarn("Failed to delete processed webhook job", "jobID", job.ID, "error", err.Error())
+		}
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	job.LeaseUntil = 0
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || job.Attempts >= webhookMaxAttempts {
+		q.p.API.LogError("Giving up on webhook delivery", "jobID", job.ID, "event", job.EventKey, "attempts", job.Attempts, "error", err.Error())
+		if err := q.p.moveWebhookJobToDeadLetters(job); err != nil {
+			q.p.API.LogError("Failed to move webhook job to the dead-letter list", "jobID", job.ID, "error", err.Error())
+		}
+		return
+	}
+
+	delay := webhookRetryDelay(job.Attempts)
+	job.NextAttemptAt = model.GetMillis() + delay.Milliseconds()
+	q.p.API.LogWarn("Failed to process webhook delivery, retrying", "jobID", job.ID, "event", job.EventKey, "attempts", job.Attempts, "retryIn", delay.String(), "error", err.Error())
+
+	if err := q.p.storeWebhookJob(KeyWebhookJob, job); err != nil {
+		q.p.API.LogError("Failed to store webhook job for retry", "jobID", job.ID, "error", err.Error())
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		q.schedule(job.ID)
+	})
+}
+
+func (q *webhookQueue) run(job *webhookJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &permanentError{errors.Errorf("panic while processing webhook: %v", r)}
+		}
+	}()
+
+	payload, err := webhookpayload.ParsePayload(job.EventKey, job.Body)
+	if err != nil {
+		return &permanentError{errors.Wrap(err, "failed to parse webhook payload")}
+	}
+
+	first, err := q.p.claimWebhookDelivery(job)
+	if err != nil {
+		return err
+	}
+	if !first {
+		q.p.API.LogDebug("Dropping duplicate webhook delivery", "jobID", job.ID, "deliveryID", job.DeliveryID)
+		q.p.countDuplicateWebhookDelivery()
+		return nil
+	}
+
+	// Building the handlers has side effects, e.g. moving the subscriptions of renamed
+	// repositories, so it only runs once the delivery is known not to be a duplicate
+	handlers, err := q.p.getWebhookHandlers(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to run webhook handlers")
+	}
+
+	if err := q.p.renewWebhookJobLease(job); err != nil {
+		return err
+	}
+
+	return q.p.executeHandlers(handlers, payload.(webhookpayload.Payload), job)
+}
+
+// claimWebhookDelivery reports whether the job handles its delivery ID. The delivery ID is recorded
+// with the job's ID when the request is received, and again here if that record expired, e.g. for
+// a dead-lettered delivery that is retried later. Retries of the same job are still allowed to run.
+func (p *Plugin) claimWebhookDelivery(job *webhookJob) (bool, error) {
+	if job.DeliveryID == "" {
+		return true, nil
+	}
+
+	seen, err := p.recordWebhookDelivery(job.DeliveryID, job.ID)
+	if err != nil {
+		return false, err
+	}
+	if !seen {
+		return true, nil
+	}
+
+	owner, appErr := p.API.KVGet(KeyWebhookDelivery + job.DeliveryID)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to load webhook delivery")
+	}
+
+	return string(owner) == job.ID, nil
+}
+
+// countDuplicateWebhookDelivery increments the cluster-wide count of dropped duplicate deliveries.
+func (p *Plugin) countDuplicateWebhookDelivery() {
+	if err := p.incrementKVCounter(KeyWebhookDuplicatesDropped); err != nil {
+		p.API.LogWarn("Failed to count duplicate webhook delivery", "error", err.Error())
+	}
+}
+
+// webhookRetryDelay returns the exponential backoff delay after the given number of attempts.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= webhookRetryMaxDelay {
+			return webhookRetryMaxDelay
+		}
+	}
+
+	return delay
+}
+
+// claimWebhookJob loads a job that is due and takes a lease on it, so that no other worker
+// in the cluster processes it at the same time. It returns nil if the job is gone, not due
+// or already leased.
+func (p *Plugin) claimWebhookJob(jobID string) (*webhookJob, error) {
+	oldValue, appErr := p.API.KVGet(KeyWebhookJob + jobID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load webhook job")
+	}
+	if oldValue == nil {
+		// Jobs are indexed after being stored, so the job was processed and only the index is left
+		if err := p.removeFromKVIndex(KeyWebhookJobIndex, jobID); err != nil {
+			return nil, errors.Wrap(err, "failed to unindex webhook job")
+		}
+		return nil, nil
+	}
+
+	var job webhookJob
+	if err := json.Unmarshal(oldValue, &job); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal webhook job")
+	}
+
+	now := model.GetMillis()
+	if job.NextAttemptAt > now || job.LeaseUntil > now {
+		return nil, nil
+	}
+
+	job.LeaseUntil = now + webhookJobLease.Milliseconds()
+	if job.Delivered == nil {
+		job.Delivered = map[string]bool{}
+	}
+
+	newValue, err := json.Marshal(job)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal webhook job")
+	}
+
+	claimed, appErr := p.API.KVCompareAndSet(KeyWebhookJob+jobID, oldValue, newValue)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to lease webhook job")
+	}
+	if !claimed {
+		return nil, nil
+	}
+
+	return &job, nil
+}
+
+// renewWebhookJobLease extends the lease of the job once half of it has passed, so that slow jobs
+// aren't claimed again by another node. It is called before each side effect of the job, and
+// fails if the lease already expired. Jobs without a lease aren't processed by the queue.
+func (p *Plugin) renewWebhookJobLease(job *webhookJob) error {
+	if job.LeaseUntil == 0 {
+		return nil
+	}
+
+	now := model.GetMillis()
+	if now >= job.LeaseUntil {
+		return errWebhookJobLeaseExpired
+	}
+	if job.LeaseUntil-now > webhookJobLease.Milliseconds()/2 {
+		return nil
+	}
+
+	job.LeaseUntil = now + webhookJobLease.Milliseconds()
+	return p.storeWebhookJob(KeyWebhookJob, job)
+}
+
+func (p *Plugin) storeWebhookJob(prefix string, job *webhookJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal webhook job")
+	}
+
+	if appErr := p.API.KVSet(prefix+job.ID, b); appErr != nil {
+		return errors.Wrap(appErr, "failed to store webhook job")
+	}
+
+	return nil
+}
+
+func (p *Plugin) getWebhookJob(prefix, jobID string) (*webhookJob, error) {
+	b, appErr := p.API.KVGet(prefix + jobID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load webhook job")
+	}
+	if b == nil {
+		return nil, nil
+	}
+
+	var job webhookJob
+	if err := json.Unmarshal(b, &job); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal webhook job")
+	}
+
+	return &job, nil
+}
+
+// deleteWebhookJob deletes a pending job and removes it from the index.
+func (p *Plugin) deleteWebhookJob(jobID string) error {
+	if appErr := p.API.KVDelete(KeyWebhookJob + jobID); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete webhook job")
+	}
+
+	return p.removeFromKVIndex(KeyWebhookJobIndex, jobID)
+}
+
+func (p *Plugin) moveWebhookJobToDeadLetters(job *webhookJob) error {
+	if err := p.storeWebhookJob(KeyWebhookDeadLetter, job); err != nil {
+		return err
+	}
+
+	if err := p.addToKVIndex(KeyWebhookDeadLetterIndex, job.ID); err != nil {
+		return errors.Wrap(err, "failed to index dead-lettered delivery")
+	}
+
+	return p.deleteWebhookJob(job.ID)
+}
+
+// getWebhookDeadLetters returns the deliveries that failed permanently, oldest first.
+func (p *Plugin) getWebhookDeadLetters() ([]*webhookJob, error) {
+	jobIDs, err := p.getKVIndex(KeyWebhookDeadLetterIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*webhookJob
+	for _, jobID := range jobIDs {
+		job, err := p.getWebhookJob(KeyWebhookDeadLetter, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt < jobs[j].CreatedAt
+	})
+
+	return jobs, nil
+}
+
+// retryWebhookDeadLetter puts a dead-lettered delivery back on the queue.
+func (p *Plugin) retryWebhookDeadLetter(jobID string) error {
+	job, err := p.getWebhookJob(KeyWebhookDeadLetter, jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return errors.Errorf("no dead-lettered delivery with ID %s", jobID)
+	}
+
+	job.Attempts = 0
+	job.LeaseUntil = 0
+	job.NextAttemptAt = model.GetMillis()
+	if err := p.storeWebhookJob(KeyWebhookJob, job); err != nil {
+		return err
+	}
+
+	if err := p.addToKVIndex(KeyWebhookJobIndex, jobID); err != nil {
+		return errors.Wrap(err, "failed to index webhook job")
+	}
+
+	if err := p.deleteWebhookDeadLetter(jobID); err != nil {
+		return err
+	}
+
+	if p.webhookQueue != nil {
+		p.webhookQueue.schedule(jobID)
+	}
+
+	return nil
+}
+
+func (p *Plugin) deleteWebhookDeadLetter(jobID string) error {
+	job, err := p.getWebhookJob(KeyWebhookDeadLetter, jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return errors.Errorf("no dead-lettered delivery with ID %s", jobID)
+	}
+
+	if appErr := p.API.KVDelete(KeyWebhookDeadLetter + jobID); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete dead-lettered delivery")
+	}
+
+	return p.removeFromKVIndex(KeyWebhookDeadLetterIndex, jobID)
+}
+
+// migrateWebhookJobIndexes indexes the jobs stored before the pending and dead-lettered jobs
+// were indexed.
+func (p *Plugin) migrateWebhookJobIndexes() error {
+	for indexKey, prefix := range map[string]string{
+		KeyWebhookJobIndex:        KeyWebhookJob,
+		KeyWebhookDeadLetterIndex: KeyWebhookDeadLetter,
+	} {
+		err := p.migrateKVIndex(indexKey, func() ([]string, error) {
+			keys, err := p.listKVKeysWithPrefix(prefix)
+			if err != nil {
+				return nil, err
+			}
+
+			jobIDs := make([]string, 0, len(keys))
+			for _, key := range keys {
+				jobIDs = append(jobIDs, strings.TrimPrefix(key, prefix))
+			}
+			return jobIDs, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to index %s", indexKey)
+		}
+	}
+
+	return nil
+}
+
+// listKVKeysWithPrefix returns all keys of the plugin KV store starting with prefix.
+func (p *Plugin) listKVKeysWithPrefix(prefix string) ([]string, error) {
+	var result []string
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, kvListPageSize)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to list keys")
+		}
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				result = append(result, key)
+			}
+		}
+
+		if len(keys) < kvListPageSize {
+			return result, nil
+		}
+	}
+}
+
+// deliveryKey identifies a single post of a webhook delivery.
+func deliveryKey(handlerIndex int, kind, id string) string {
+	return fmt.Sprintf("%d/%s/%s", handlerIndex, kind, id)
+}
+
+// webhookJobSummary is a one-line description of a job for the admin commands.
+func webhookJobSummary(job *webhookJob) string {
+	repo := ""
+	if payload, err := webhookpayload.ParsePayload(job.EventKey, job.Body); err == nil {
+		if pl, ok := payload.(webhookpayload.Payload); ok {
+			repo = pl.GetRepository().FullName
+		}
+	}
+
+	lastError := strings.NewReplacer("|", "\\|", "\n", " ").Replace(job.LastError)
+
+	return fmt.Sprintf("| `%s` | %s | %s | %s | %d | %s |",
+		job.ID, job.EventKey, repo, time.UnixMilli(job.CreatedAt).UTC().Format(time.RFC3339), job.Attempts, lastError)
+}
+
+// incrementKVCounter atomically increments the counter stored under key.
+func (p *Plugin) incrementKVCounter(key string) error {
+	for {
+		oldValue, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to load counter")
+		}
+
+		count := parseKVCounter(oldValue)
+		newValue := []byte(strconv.FormatInt(count+1, 10))
+
+		updated, appErr := p.API.KVCompareAndSet(key, oldValue, newValue)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to update counter")
+		}
+		if updated {
+			return nil
+		}
+	}
+}
+
+func (p *Plugin) getKVCounter(key string) (int64, error) {
+	value, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return 0, errors.Wrap(appErr, "failed to load counter")
+	}
+
+	return parseKVCounter(value), nil
+}
+
+func parseKVCounter(value []byte) int64 {
+	count, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return count
+}
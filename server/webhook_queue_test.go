@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	assert.Equal(t, 5*time.Second, webhookRetryDelay(1))
+	assert.Equal(t, 10*time.Second, webhookRetryDelay(2))
+	assert.Equal(t, 40*time.Second, webhookRetryDelay(4))
+	assert.Equal(t, webhookRetryMaxDelay, webhookRetryDelay(20))
+}
+
+func TestExecuteHandlersSkipsDeliveredPosts(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "channel2"
+	})).Return(&model.Post{}, nil).Once()
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "channel3"
+	})).Return(nil, &model.AppError{Message: "failed"}).Once()
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("KVSet", KeyWebhookJob+"job", mock.Anything).Return(nil)
+
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	job := &webhookJob{
+		ID:        "job",
+		Delivered: map[string]bool{deliveryKey(0, "channel", "channel1"): true},
+	}
+	handlers := []*webhook.HandleWebhook{{
+		Message:    "message",
+		ToChannels: []string{"channel1", "channel2", "channel3"},
+	}}
+
+	err := p.executeHandlers(handlers, webhookpayload.PullRequestCreatedPayload{}, job)
+
+	assert.Error(t, err)
+	assert.True(t, job.Delivered[deliveryKey(0, "channel", "channel2")])
+	assert.False(t, job.Delivered[deliveryKey(0, "channel", "channel3")])
+	api.AssertExpectations(t)
+}
+
+func TestClaimWebhookDelivery(t *testing.T) {
+	for name, test := range map[string]struct {
+		stored        bool
+		existingOwner string
+		expected      bool
+	}{
+		"first delivery": {
+			stored:   true,
+			expected: true,
+		},
+		"retry of the same job": {
+			stored:        false,
+			existingOwner: "job",
+			expected:      true,
+		},
+		"duplicate delivery": {
+			stored:        false,
+			existingOwner: "otherJob",
+			expected:      false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("KVSetWithOptions", KeyWebhookDelivery+"delivery", []byte("job"), mock.AnythingOfType("model.PluginKVSetOptions")).Return(test.stored, nil)
+			if !test.stored {
+				api.On("KVGet", KeyWebhookDelivery+"delivery").Return([]byte(test.existingOwner), nil)
+			}
+
+			p := NewPlugin()
+			p.SetAPI(api)
+
+			first, err := p.claimWebhookDelivery(&webhookJob{ID: "job", DeliveryID: "delivery"})
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, first)
+			api.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRunDropsDuplicateDeliveries(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("KVSetWithOptions", KeyWebhookDelivery+"delivery", []byte("job"), mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, nil)
+	api.On("KVGet", KeyWebhookDelivery+"delivery").Return([]byte("otherJob"), nil)
+	api.On("LogDebug", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("KVGet", KeyWebhookDuplicatesDropped).Return(nil, nil)
+	api.On("KVCompareAndSet", KeyWebhookDuplicatesDropped, []byte(nil), []byte("1")).Return(true, nil)
+
+	p := NewPlugin()
+	p.SetAPI(api)
+	q := newWebhookQueue(p)
+
+	// Building the handlers of a rename would move the subscriptions, which isn't mocked
+	err := q.run(&webhookJob{ID: "job", DeliveryID: "delivery", EventKey: string(webhookpayload.RepoUpdatedEvent), Body: []byte(`{}`)})
+
+	assert.NoError(t, err)
+	api.AssertExpectations(t)
+}
+
+func TestRenewWebhookJobLease(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("KVSet", KeyWebhookJob+"job", mock.Anything).Return(nil).Once()
+
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	job := &webhookJob{ID: "job", LeaseUntil: model.GetMillis() + webhookJobLease.Milliseconds()}
+	assert.NoError(t, p.renewWebhookJobLease(job))
+
+	job.LeaseUntil = model.GetMillis() + webhookJobLease.Milliseconds()/4
+	assert.NoError(t, p.renewWebhookJobLease(job))
+	assert.Greater(t, job.LeaseUntil, model.GetMillis()+webhookJobLease.Milliseconds()/2)
+
+	job.LeaseUntil = model.GetMillis() - 1
+	assert.ErrorIs(t, p.renewWebhookJobLease(job), errWebhookJobLeaseExpired)
+
+	api.AssertExpectations(t)
+}
+
+func TestCreateOrCollapsePost(t *testing.T) {
+	key := collapsedPostKey("channel", "build_failed/owner/repo/main")
+
+	for name, test := range map[string]struct {
+		stored         []byte
+		latestPostID   string
+		expectUpdate   bool
+		expectedStored string
+	}{
+		"first notification": {
+			expectedStored: `{"PostID":"new","Count":0}`,
+		},
+		"previous post is the latest": {
+			stored:         []byte(`{"PostID":"previous","Count":1}`),
+			latestPostID:   "previous",
+			expectUpdate:   true,
+			expectedStored: `{"PostID":"previous","Count":2}`,
+		},
+		"channel moved on": {
+			stored:         []byte(`{"PostID":"previous","Count":1}`),
+			latestPostID:   "other",
+			expectedStored: `{"PostID":"new","Count":0}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("KVGet", key).Return(test.stored, nil)
+			if test.stored != nil {
+				posts := model.NewPostList()
+				posts.AddPost(&model.Post{Id: test.latestPostID})
+				posts.AddOrder(test.latestPostID)
+				api.On("GetPostsForChannel", "channel", 0, 1).Return(posts, nil)
+			}
+			if test.expectUpdate {
+				api.On("UpdatePost", mock.MatchedBy(func(post *model.Post) bool {
+					return post.Id == "previous" && post.Message == "message\n_+2 earlier similar notifications_"
+				})).Return(&model.Post{Id: "previous"}, nil)
+			} else {
+				api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "new"}, nil)
+			}
+			api.On("KVSetWithOptions", key, []byte(test.expectedStored), mock.AnythingOfType("model.PluginKVSetOptions")).Return(true, nil)
+
+			p := NewPlugin()
+			p.SetAPI(api)
+
+			err := p.createOrCollapsePost(&model.Post{ChannelId: "channel", Message: "message"}, "build_failed/owner/repo/main")
+
+			assert.NoError(t, err)
+			api.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/subscription"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/templaterenderer"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhook"
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/webhookpayload"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleWebhookSignature(t *testing.T) {
+	body := []byte(`{}`)
+
+	for name, test := range map[string]struct {
+		signature          string
+		expectedStatusCode int
+		expectKVCall       bool
+	}{
+		"missing signature": {
+			signature:          "",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		"invalid signature": {
+			signature:          sign("wrongSecret", body),
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		"malformed signature": {
+			signature:          "sha1=abc",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		"replayed delivery signed with the previous secret": {
+			signature:          sign("previousSecret", body),
+			expectedStatusCode: http.StatusOK,
+			expectKVCall:       true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			if test.expectKVCall {
+				api.On("KVSetWithOptions", KeyWebhookDelivery+"delivery-id", mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, (*model.AppError)(nil))
+				api.On("LogDebug", mock.Anything).Return()
+				api.On("KVGet", KeyWebhookDuplicatesDropped).Return([]byte("1"), nil)
+				api.On("KVCompareAndSet", KeyWebhookDuplicatesDropped, []byte("1"), []byte("2")).Return(true, nil)
+			}
+
+			p := NewPlugin()
+			p.setConfiguration(&Configuration{
+				BitbucketOAuthClientID:     "mockID",
+				BitbucketOAuthClientSecret: "mockSecret",
+				EncryptionKey:              "mockKey",
+				WebhookSecret:              "currentSecret",
+				PreviousWebhookSecret:      "previousSecret",
+			})
+			p.initializeAPI()
+			p.SetAPI(api)
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+			req.Header.Set("X-Event-Key", "pullrequest:created")
+			req.Header.Set("X-Request-UUID", "delivery-id")
+			if test.signature != "" {
+				req.Header.Set("X-Hub-Signature", test.signature)
+			}
+
+			rr := httptest.NewRecorder()
+			p.ServeHTTP(&plugin.Context{}, rr, req)
+
+			assert.Equal(t, test.expectedStatusCode, rr.Code)
+			api.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandleWebhookErrors(t *testing.T) {
+	body := []byte(`{}`)
+
+	for name, test := range map[string]struct {
+		eventKey           string
+		recordErr          *model.AppError
+		expectedStatusCode int
+	}{
+		"missing event key": {
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"unsupported event": {
+			eventKey:           "repo:transfer",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"delivery ID can't be recorded": {
+			eventKey:           "pullrequest:created",
+			recordErr:          model.NewAppError("KVSetWithOptions", "", nil, "", http.StatusInternalServerError),
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything).Return().Maybe()
+			api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Return().Maybe()
+			if test.recordErr != nil {
+				api.On("KVSetWithOptions", KeyWebhookDelivery+"delivery-id", mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(false, test.recordErr)
+			}
+
+			p := NewPlugin()
+			p.setConfiguration(&Configuration{
+				BitbucketOAuthClientID:     "mockID",
+				BitbucketOAuthClientSecret: "mockSecret",
+				EncryptionKey:              "mockKey",
+				WebhookSecret:              "currentSecret",
+			})
+			p.initializeAPI()
+			p.SetAPI(api)
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+			if test.eventKey != "" {
+				req.Header.Set("X-Event-Key", test.eventKey)
+			}
+			req.Header.Set("X-Request-UUID", "delivery-id")
+			req.Header.Set("X-Hub-Signature", sign("currentSecret", body))
+
+			rr := httptest.NewRecorder()
+			p.ServeHTTP(&plugin.Context{}, rr, req)
+
+			assert.Equal(t, test.expectedStatusCode, rr.Code)
+			api.AssertExpectations(t)
+		})
+	}
+}
+
+func TestParseDataCenterCommentMentions(t *testing.T) {
+	body := []byte(`{
+		"actor": {"name": "author"},
+		"pullRequest": {"id": 1, "toRef": {"repository": {"slug": "repo", "project": {"key": "MM"}}}},
+		"comment": {"id": 2, "text": "@reviewer and @\"Jane Doe\" <b>please</b> look"}
+	}`)
+
+	payload, err := webhookpayload.ParsePayload("pr:comment:added", body)
+	require.NoError(t, err)
+
+	pl, ok := payload.(webhookpayload.PullRequestCommentCreatedPayload)
+	require.True(t, ok)
+	assert.Equal(t, `<p><span class="ap-mention" data-atlassian-id="reviewer">@reviewer</span> and <span class="ap-mention" data-atlassian-id="Jane Doe">@Jane Doe</span> &lt;b&gt;please&lt;/b&gt; look</p>`, pl.Comment.Content.HTML)
+}
+
+// staticSubscriptions returns the same subscriptions for every repository.
+type staticSubscriptions []*subscription.Subscription
+
+func (s staticSubscriptions) GetSubscribedChannelsForRepository(webhookpayload.Payload) ([]*subscription.Subscription, error) {
+	return s, nil
+}
+
+func TestHandleRepoPushEventMatchesEveryRef(t *testing.T) {
+	templateRenderer := templaterenderer.MakeTemplateRenderer()
+	templateRenderer.RegisterBitBucketAccountIDToUsernameMappingCallback(func(string) string { return "" })
+	hook := webhook.NewWebhook(staticSubscriptions{{
+		ChannelID: "channel",
+		Features:  subscription.Features{subscription.FeaturePushes, subscription.FeatureDeletes},
+		Filters:   subscription.Filters{Branches: []string{"release/*"}},
+	}}, nil, nil, nil, nil, templateRenderer)
+
+	var pl webhookpayload.RepoPushPayload
+	pl.Repository.FullName = "owner/repo"
+	var pushed, deleted, released webhookpayload.RepoPushChange
+	pushed.New.Type, pushed.New.Name = "branch", "main"
+	deleted.Old.Type, deleted.Old.Name = "branch", "release/1.0"
+	released.New.Type, released.New.Name = "branch", "release/2.0"
+	pl.Push.Changes = []webhookpayload.RepoPushChange{pushed, deleted, released}
+
+	handlers, err := hook.HandleRepoPushEvent(pl)
+	require.NoError(t, err)
+
+	var messages []string
+	for _, handler := range handlers {
+		if len(handler.ToChannels) > 0 {
+			assert.Equal(t, []string{"channel"}, handler.ToChannels)
+			messages = append(messages, handler.Message)
+		}
+	}
+	require.Len(t, messages, 2, "the deletion of release/1.0 and the push to release/2.0")
+	assert.Contains(t, messages[0], "release/1.0")
+	assert.Contains(t, messages[0], "was deleted")
+	assert.Contains(t, messages[1], "release/2.0")
+	assert.Contains(t, messages[1], "pushed")
+}
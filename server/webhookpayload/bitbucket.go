@@ -1,11 +1,15 @@
 package webhookpayload
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 // This is a copy of gopkg.in/go-playground/webhooks.v5/bitbucket with some necessary modifications
@@ -19,11 +23,22 @@ var (
 	ErrEventNotFound            = errors.New("event not defined to be parsed")
 	ErrParsingPayload           = errors.New("error parsing payload")
 	ErrUUIDVerificationFailed   = errors.New("UUID verification failed")
+	ErrMissingSignatureHeader   = errors.New("missing X-Hub-Signature Header")
+	ErrInvalidSignature         = errors.New("HMAC signature verification failed")
+	ErrMissingRequestIDHeader   = errors.New("missing X-Request-UUID Header")
+	ErrReplayedRequest          = errors.New("request was already delivered")
 )
 
+const signaturePrefix = "sha256="
+
+// ReplayGuard records the delivery ID of a request and reports whether it was already seen.
+type ReplayGuard func(deliveryID string) (seen bool, err error)
+
 // Webhook instance contains all methods needed to process events
 type Webhook struct {
-	uuid string
+	uuid        string
+	secrets     []string
+	replayGuard ReplayGuard
 }
 
 // Event defines a Bitbucket hook event type
@@ -68,6 +83,30 @@ func (WebhookOptions) UUID(uuid string) Option {
 	}
 }
 
+// Secrets registers the secrets deliveries are signed with. A signature made with any of
+// them is accepted, which allows rotating the secret without dropping deliveries.
+func (WebhookOptions) Secrets(secrets ...string) Option {
+	return func(hook *Webhook) error {
+		for _, secret := range secrets {
+			if secret != "" {
+				hook.secrets = append(hook.secrets, secret)
+			}
+		}
+		if len(hook.secrets) == 0 {
+			return errors.New("at least one secret is required")
+		}
+		return nil
+	}
+}
+
+// ReplayGuard registers the callback used to reject deliveries that were already received
+func (WebhookOptions) ReplayGuard(guard ReplayGuard) Option {
+	return func(hook *Webhook) error {
+		hook.replayGuard = guard
+		return nil
+	}
+}
+
 // New creates and returns a WebHook instance denoted by the Provider type
 func New(options ...Option) (*Webhook, error) {
 	hook := new(Webhook)
@@ -79,8 +118,27 @@ func New(options ...Option) (*Webhook, error) {
 	return hook, nil
 }
 
+// Delivery is a verified webhook request whose payload hasn't been parsed yet
+type Delivery struct {
+	// ID is the unique delivery ID sent by Bitbucket, if any
+	ID string
+	// EventKey is the raw X-Event-Key header
+	EventKey string
+	Body     []byte
+}
+
 // Parse verifies and parses the events specified and returns the payload object or an error
 func (hook Webhook) Parse(r *http.Request, events ...Event) (interface{}, error) {
+	delivery, err := hook.Read(r, events...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePayload(delivery.EventKey, delivery.Body)
+}
+
+// Read verifies the request for the events specified and returns the unparsed delivery or an error
+func (hook Webhook) Read(r *http.Request, events ...Event) (*Delivery, error) {
 	defer func() {
 		_, _ = io.Copy(io.Discard, r.Body)
 		_ = r.Body.Close()
@@ -107,7 +165,15 @@ func (hook Webhook) Parse(r *http.Request, events ...Event) (interface{}, error)
 		return nil, ErrUUIDVerificationFailed
 	}
 
+	signature := r.Header.Get("X-Hub-Signature")
+	if len(hook.secrets) > 0 && signature == "" {
+		return nil, ErrMissingSignatureHeader
+	}
+
 	bitbucketEvent := Event(event)
+	if dataCenterEvent, ok := dataCenterEvents[event]; ok {
+		bitbucketEvent = dataCenterEvent
+	}
 
 	var found bool
 	for _, evt := range events {
@@ -126,6 +192,45 @@ func (hook Webhook) Parse(r *http.Request, events ...Event) (interface{}, error)
 		return nil, ErrParsingPayload
 	}
 
+	if len(hook.secrets) > 0 && !hook.verifySignature(signature, payload) {
+		return nil, ErrInvalidSignature
+	}
+
+	// Bitbucket Cloud sends X-Request-UUID, Bitbucket Data Center sends X-Request-Id
+	deliveryID := r.Header.Get("X-Request-UUID")
+	if deliveryID == "" {
+		deliveryID = r.Header.Get("X-Request-Id")
+	}
+
+	if hook.replayGuard != nil {
+		if deliveryID == "" {
+			return nil, ErrMissingRequestIDHeader
+		}
+
+		seen, err := hook.replayGuard(deliveryID)
+		if err != nil {
+			return nil, err
+		}
+		if seen {
+			return nil, ErrReplayedRequest
+		}
+	}
+
+	return &Delivery{
+		ID:       deliveryID,
+		EventKey: event,
+		Body:     payload,
+	}, nil
+}
+
+// ParsePayload parses the body of a delivery of the given event, as sent in the X-Event-Key header
+func ParsePayload(eventKey string, payload []byte) (interface{}, error) {
+	bitbucketEvent := Event(eventKey)
+	if dataCenterEvent, ok := dataCenterEvents[eventKey]; ok {
+		return parseDataCenterPayload(dataCenterEvent, payload)
+	}
+
+	var err error
 	switch bitbucketEvent {
 	case RepoPushEvent:
 		var pl RepoPushPayload
@@ -203,3 +308,25 @@ func (hook Webhook) Parse(r *http.Request, events ...Event) (interface{}, error)
 		return nil, fmt.Errorf("unknown event %s", bitbucketEvent)
 	}
 }
+
+// verifySignature checks the "sha256=<hex digest>" signature of the payload against all secrets
+func (hook Webhook) verifySignature(signature string, payload []byte) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return false
+	}
+
+	for _, secret := range hook.secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		_, _ = mac.Write(payload)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,341 @@
+package webhookpayload
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/mattermost/mattermost-plugin-bitbucket/server/datacenter"
+)
+
+// dataCenterEvents maps Bitbucket Data Center event keys to the equivalent Bitbucket Cloud event.
+// Data Center payloads are converted to the Cloud payload types, so they go through the same handlers.
+var dataCenterEvents = map[string]Event{
+	"repo:refs_changed":      RepoPushEvent,
+	"repo:forked":            RepoForkEvent,
+	"repo:modified":          RepoUpdatedEvent,
+	"repo:comment:added":     RepoCommitCommentCreatedEvent,
+	"pr:opened":              PullRequestCreatedEvent,
+	"pr:modified":            PullRequestUpdatedEvent,
+	"pr:reviewer:updated":    PullRequestUpdatedEvent,
+	"pr:from_ref_updated":    PullRequestUpdatedEvent,
+	"pr:reviewer:approved":   PullRequestApprovedEvent,
+	"pr:reviewer:unapproved": PullRequestUnapprovedEvent,
+	"pr:merged":              PullRequestMergedEvent,
+	"pr:declined":            PullRequestDeclinedEvent,
+	"pr:comment:added":       PullRequestCommentCreatedEvent,
+	"pr:comment:edited":      PullRequestCommentUpdatedEvent,
+	"pr:comment:deleted":     PullRequestCommentDeletedEvent,
+}
+
+// mentionRegexp matches @username and @"user name" mentions in Data Center markdown.
+var mentionRegexp = regexp.MustCompile(`(^|\s)@(?:"([^"]+)"|([\w.\-]+))`)
+
+type dataCenterRepoPayload struct {
+	Actor      datacenter.User       `json:"actor"`
+	Repository datacenter.Repository `json:"repository"`
+}
+
+type dataCenterRefsChangedPayload struct {
+	dataCenterRepoPayload
+	Changes []datacenter.RefChange `json:"changes"`
+}
+
+type dataCenterForkPayload struct {
+	Actor      datacenter.User       `json:"actor"`
+	Repository datacenter.Repository `json:"repository"`
+	Origin     datacenter.Repository `json:"origin"`
+}
+
+type dataCenterModifiedPayload struct {
+	Actor datacenter.User       `json:"actor"`
+	Old   datacenter.Repository `json:"old"`
+	New   datacenter.Repository `json:"new"`
+}
+
+type dataCenterCommitCommentPayload struct {
+	dataCenterRepoPayload
+	Comment datacenter.Comment `json:"comment"`
+	Commit  string             `json:"commit"`
+}
+
+type dataCenterPullRequestPayload struct {
+	Actor       datacenter.User        `json:"actor"`
+	PullRequest datacenter.PullRequest `json:"pullRequest"`
+	Comment     datacenter.Comment     `json:"comment"`
+	ParentID    int64                  `json:"commentParentId"`
+}
+
+// parseDataCenterPayload converts a Data Center webhook body to the payload type of the mapped Cloud event.
+func parseDataCenterPayload(event Event, body []byte) (interface{}, error) {
+	switch event {
+	case RepoPushEvent:
+		var dc dataCenterRefsChangedPayload
+		if err := json.Unmarshal(body, &dc); err != nil {
+			return nil, err
+		}
+		return dc.toRepoPushPayload(), nil
+	case RepoForkEvent:
+		var dc dataCenterForkPayload
+		if err := json.Unmarshal(body, &dc); err != nil {
+			return nil, err
+		}
+		return RepoForkPayload{
+			Actor:      toOwner(dc.Actor),
+			Repository: toRepository(dc.Origin),
+			Fork:       toRepository(dc.Repository),
+		}, nil
+	case RepoUpdatedEvent:
+		var dc dataCenterModifiedPayload
+		if err := json.Unmarshal(body, &dc); err != nil {
+			return nil, err
+		}
+		return dc.toRepoUpdatedPayload(), nil
+	case RepoCommitCommentCreatedEvent:
+		var dc dataCenterCommitCommentPayload
+		if err := json.Unmarshal(body, &dc); err != nil {
+			return nil, err
+		}
+		pl := RepoCommitCommentCreatedPayload{
+			Actor:      toOwner(dc.Actor),
+			Repository: toRepository(dc.Repository),
+			Comment:    toComment(dc.Comment, 0, ""),
+		}
+		pl.Commit.Hash = dc.Commit
+		return pl, nil
+	}
+
+	var dc dataCenterPullRequestPayload
+	if err := json.Unmarshal(body, &dc); err != nil {
+		return nil, err
+	}
+
+	actor := toOwner(dc.Actor)
+	pr := toPullRequest(dc.PullRequest)
+	repo := pr.Destination.Repository
+
+	switch event {
+	case PullRequestCreatedEvent:
+		return PullRequestCreatedPayload{Actor: actor, PullRequest: pr, Repository: repo}, nil
+	case PullRequestUpdatedEvent:
+		return PullRequestUpdatedPayload{Actor: actor, PullRequest: pr, Repository: repo}, nil
+	case PullRequestApprovedEvent:
+		pl := PullRequestApprovedPayload{Actor: actor, PullRequest: pr, Repository: repo}
+		pl.Approval.User = actor
+		return pl, nil
+	case PullRequestUnapprovedEvent:
+		pl := PullRequestUnapprovedPayload{Actor: actor, PullRequest: pr, Repository: repo}
+		pl.Approval.User = actor
+		return pl, nil
+	case PullRequestMergedEvent:
+		return PullRequestMergedPayload{Actor: actor, PullRequest: pr, Repository: repo}, nil
+	case PullRequestDeclinedEvent:
+		return PullRequestDeclinedPayload{Actor: actor, PullRequest: pr, Repository: repo}, nil
+	case PullRequestCommentCreatedEvent:
+		comment := toComment(dc.Comment, dc.ParentID, pr.Links.HTML.Href)
+		return PullRequestCommentCreatedPayload{Actor: actor, PullRequest: pr, Repository: repo, Comment: comment}, nil
+	case PullRequestCommentUpdatedEvent:
+		comment := toComment(dc.Comment, dc.ParentID, pr.Links.HTML.Href)
+		return PullRequestCommentUpdatedPayload{Actor: actor, PullRequest: pr, Repository: repo, Comment: comment}, nil
+	case PullRequestCommentDeletedEvent:
+		comment := toComment(dc.Comment, dc.ParentID, pr.Links.HTML.Href)
+		return PullRequestCommentDeletedPayload{Actor: actor, PullRequest: pr, Repository: repo, Comment: comment}, nil
+	default:
+		return nil, fmt.Errorf("unknown event %s", event)
+	}
+}
+
+func (dc dataCenterRefsChangedPayload) toRepoPushPayload() RepoPushPayload {
+	pl := RepoPushPayload{
+		Actor:      toOwner(dc.Actor),
+		Repository: toRepository(dc.Repository),
+	}
+
+	repoURL := dc.Repository.WebURL()
+	for _, c := range dc.Changes {
+		refType := "branch"
+		if c.Ref.Type == "TAG" {
+			refType = "tag"
+		}
+
+		change := RepoPushChange{}
+		if c.Type != "DELETE" {
+			change.New.Type = refType
+			change.New.Name = c.Ref.DisplayID
+			change.New.Target.Hash = c.ToHash
+			change.New.Links.HTML.Href = repoURL + "/browse?at=" + c.Ref.ID
+		}
+		if c.Type != "ADD" {
+			change.Old.Type = refType
+			change.Old.Name = c.Ref.DisplayID
+			change.Old.Target.Hash = c.FromHash
+			change.Old.Links.HTML.Href = repoURL + "/browse?at=" + c.Ref.ID
+		}
+
+		change.Created = c.Type == "ADD"
+		change.Closed = c.Type == "DELETE"
+		// Data Center doesn't send the pushed commits, only the old and new head
+		change.Truncated = true
+		change.Links.HTML.Href = repoURL + "/commits?until=" + c.Ref.ID
+
+		pl.Push.Changes = append(pl.Push.Changes, change)
+	}
+
+	return pl
+}
+
+func (dc dataCenterModifiedPayload) toRepoUpdatedPayload() RepoUpdatedPayload {
+	pl := RepoUpdatedPayload{
+		Actor:      toOwner(dc.Actor),
+		Repository: toRepository(dc.New),
+	}
+
+	if dc.Old.Name != dc.New.Name {
+		pl.Changes.Name.Old = dc.Old.Name
+		pl.Changes.Name.New = dc.New.Name
+	}
+	if dc.Old.Description != dc.New.Description {
+		pl.Changes.Description.Old = dc.Old.Description
+		pl.Changes.Description.New = dc.New.Description
+	}
+	if dc.Old.FullName() != dc.New.FullName() {
+		pl.Changes.FullName.Old = dc.Old.FullName()
+		pl.Changes.FullName.New = dc.New.FullName()
+		pl.Changes.Links.Old.HTML.Href = dc.Old.WebURL()
+		pl.Changes.Links.New.HTML.Href = dc.New.WebURL()
+	}
+
+	return pl
+}
+
+func toOwner(u datacenter.User) Owner {
+	owner := Owner{
+		Type:        "user",
+		NickName:    u.Name,
+		DisplayName: u.DisplayName,
+		AccountID:   u.Name,
+	}
+	owner.Links.HTML.Href = u.Links.Href()
+
+	return owner
+}
+
+func toRepository(r datacenter.Repository) Repository {
+	repo := Repository{
+		Type:      "repository",
+		FullName:  r.FullName(),
+		Name:      r.Name,
+		Scm:       r.ScmID,
+		IsPrivate: !r.Public && !r.Project.Public,
+	}
+	repo.Links.HTML.Href = r.WebURL()
+	repo.Project.Type = "project"
+	repo.Project.Key = r.Project.Key
+	repo.Project.Project = r.Project.Name
+	repo.Owner.NickName = r.Project.Key
+	repo.Owner.DisplayName = r.Project.Name
+
+	return repo
+}
+
+func toParticipants(participants []datacenter.Participant) []Owner {
+	var owners []Owner
+	for _, p := range participants {
+		owners = append(owners, toOwner(p.User))
+	}
+
+	return owners
+}
+
+func toPullRequestParticipants(participants []datacenter.Participant) []Participant {
+	var result []Participant
+	for _, p := range participants {
+		result = append(result, Participant{
+			User:     toOwner(p.User),
+			Role:     p.Role,
+			Approved: p.Approved,
+			State:    p.Status,
+		})
+	}
+
+	return result
+}
+
+func toPullRequest(pr datacenter.PullRequest) PullRequest {
+	result := PullRequest{
+		ID:           pr.ID,
+		Title:        pr.Title,
+		Description:  pr.Description,
+		State:        pr.State,
+		Author:       toOwner(pr.Author.User),
+		Reviewers:    toParticipants(pr.Reviewers),
+		Participants: toPullRequestParticipants(append(pr.Reviewers, pr.Participants...)),
+		CommentCount: pr.Properties.CommentCount,
+		CreatedOn:    datacenter.Time(pr.CreatedDate),
+		UpdatedOn:    datacenter.Time(pr.UpdatedDate),
+	}
+
+	result.Source.Branch.Name = pr.FromRef.DisplayID
+	result.Source.Commit.Hash = pr.FromRef.LatestCommit
+	result.Source.Repository = toRepository(pr.FromRef.Repository)
+	result.Destination.Branch.Name = pr.ToRef.DisplayID
+	result.Destination.Commit.Hash = pr.ToRef.LatestCommit
+	result.Destination.Repository = toRepository(pr.ToRef.Repository)
+	result.Rendered.Description.HTML = renderDataCenterMarkdown(pr.Description)
+	result.Links.HTML.Href = strings.TrimSuffix(pr.Links.Href(), "/overview")
+
+	return result
+}
+
+func toComment(c datacenter.Comment, parentID int64, pullRequestURL string) Comment {
+	comment := Comment{
+		ID:        c.ID,
+		CreatedOn: datacenter.Time(c.CreatedDate),
+		UpdatedOn: datacenter.Time(c.UpdatedDate),
+	}
+
+	comment.Parent.ID = parentID
+	comment.Content.Raw = c.Text
+	comment.Content.Markup = "markdown"
+	comment.Content.HTML = renderDataCenterMarkdown(c.Text)
+	if c.Anchor != nil {
+		comment.Inline.Path = c.Anchor.Path
+		comment.Inline.To = c.Anchor.Line
+	}
+	if pullRequestURL != "" {
+		comment.Links.HTML.Href = fmt.Sprintf("%s/overview?commentId=%d", pullRequestURL, c.ID)
+	}
+
+	return comment
+}
+
+// renderDataCenterMarkdown turns Data Center markdown into the minimal HTML the templates expect,
+// wrapping mentions the same way Bitbucket Cloud does so mentioned users can be notified.
+func renderDataCenterMarkdown(text string) string {
+	if text == "" {
+		return ""
+	}
+
+	// Mentions are matched before escaping, as escaping the quotes of @"user name" would hide them
+	var b strings.Builder
+	last := 0
+	for _, match := range mentionRegexp.FindAllStringSubmatchIndex(text, -1) {
+		// match holds the bounds of the leading space, then of the quoted or the plain username
+		mentionStart := match[3]
+		var username string
+		if match[4] != -1 {
+			username = text[match[4]:match[5]]
+		} else {
+			username = text[match[6]:match[7]]
+		}
+
+		b.WriteString(html.EscapeString(text[last:mentionStart]))
+		fmt.Fprintf(&b, `<span class="ap-mention" data-atlassian-id="%s">@%s</span>`, html.EscapeString(username), html.EscapeString(username))
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+
+	return "<p>" + b.String() + "</p>"
+}
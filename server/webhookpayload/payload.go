@@ -84,54 +84,51 @@ type RepoCommitCommentCreatedPayload struct {
 	} `json:"commit"`
 }
 
-// RepoCommitStatusCreatedPayload is the Bitbucket repo:commit_status_created payload
-type RepoCommitStatusCreatedPayload struct {
-	Actor        Owner      `json:"actor"`
-	Repository   Repository `json:"repository"`
-	CommitStatus struct {
-		Name        string    `json:"name"`
-		Description string    `json:"description"`
-		State       string    `json:"state"`
-		Key         string    `json:"key"`
-		URL         string    `json:"url"`
-		Type        string    `json:"type"`
-		CreatedOn   time.Time `json:"created_on"`
-		UpdatedOn   time.Time `json:"updated_on"`
-		Links       struct {
-			Commit struct {
-				Href string `json:"href"`
-			} `json:"commit"`
-			Self struct {
-				Href string `json:"href"`
-			} `json:"self"`
-		} `json:"links"`
-	} `json:"commit_status"`
+// RepoCommitStatusPayload holds the fields shared by the Bitbucket repo:commit_status_* payloads
+type RepoCommitStatusPayload struct {
+	Actor        Owner        `json:"actor"`
+	Repository   Repository   `json:"repository"`
+	CommitStatus CommitStatus `json:"commit_status"`
 }
 
+// RepoCommitStatusCreatedPayload is the Bitbucket repo:commit_status_created payload
+type RepoCommitStatusCreatedPayload RepoCommitStatusPayload
+
 // RepoCommitStatusUpdatedPayload is the Bitbucket repo:commit_status_updated payload
-type RepoCommitStatusUpdatedPayload struct {
-	Actor        Owner      `json:"actor"`
-	Repository   Repository `json:"repository"`
-	CommitStatus struct {
-		Name        string    `json:"name"`
-		Description string    `json:"description"`
-		State       string    `json:"state"`
-		Key         string    `json:"key"`
-		URL         string    `json:"url"`
-		Type        string    `json:"type"`
-		CreatedOn   time.Time `json:"created_on"`
-		UpdatedOn   time.Time `json:"updated_on"`
-		Links       struct {
-			Commit struct {
-				Href string `json:"href"`
-			} `json:"commit"`
-			Self struct {
-				Href string `json:"href"`
-			} `json:"self"`
-		} `json:"links"`
-	} `json:"commit_status"`
+type RepoCommitStatusUpdatedPayload RepoCommitStatusPayload
+
+// CommitStatus is a part of the Bitbucket repo:commit_status_* payloads
+type CommitStatus struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	State       string    `json:"state"`
+	Key         string    `json:"key"`
+	URL         string    `json:"url"`
+	Type        string    `json:"type"`
+	Refname     string    `json:"refname"`
+	CreatedOn   time.Time `json:"created_on"`
+	UpdatedOn   time.Time `json:"updated_on"`
+	Commit      struct {
+		Hash string `json:"hash"`
+	} `json:"commit"`
+	Links struct {
+		Commit struct {
+			Href string `json:"href"`
+		} `json:"commit"`
+		Self struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
 }
 
+// Commit status states
+const (
+	CommitStatusSuccessful = "SUCCESSFUL"
+	CommitStatusFailed     = "FAILED"
+	CommitStatusInProgress = "INPROGRESS"
+	CommitStatusStopped    = "STOPPED"
+)
+
 // IssueCreatedPayload is the Bitbucket issue:created payload
 type IssueCreatedPayload struct {
 	Actor      Owner      `json:"actor"`
@@ -292,14 +289,17 @@ type Project struct {
 
 // Issue is the common Bitbucket Issue Sub Entity
 type Issue struct {
-	ID        int64  `json:"id"`
-	Component string `json:"component"`
-	Title     string `json:"title"`
-	Content   struct {
+	ID        int64 `json:"id"`
+	Component struct {
+		Name string `json:"name"`
+	} `json:"component"`
+	Title   string `json:"title"`
+	Content struct {
 		Raw    string `json:"raw"`
 		HTML   string `json:"html"`
 		Markup string `json:"markup"`
 	} `json:"content"`
+	Kind      string `json:"kind"`
 	Priority  string `json:"priority"`
 	State     string `json:"state"`
 	Type      string `json:"type"`
@@ -350,6 +350,14 @@ type Comment struct {
 	} `json:"links"`
 }
 
+// Participant is a participant of a Bitbucket Pull Request
+type Participant struct {
+	User     Owner  `json:"user"`
+	Role     string `json:"role"`
+	Approved bool   `json:"approved"`
+	State    string `json:"state"`
+}
+
 // PullRequest is the common Bitbucket Pull Request Sub Entity
 type PullRequest struct {
 	ID          int64  `json:"id"`
@@ -378,11 +386,12 @@ type PullRequest struct {
 	MergeCommit struct {
 		Hash string `json:"hash"`
 	} `json:"merge_commit"`
-	Participants      []Owner `json:"participants"`
-	Reviewers         []Owner `json:"reviewers"`
-	CloseSourceBranch bool    `json:"close_source_branch"`
-	ClosedBy          Owner   `json:"closed_by"`
-	Reason            string  `json:"reason"`
+	Participants      []Participant `json:"participants"`
+	Reviewers         []Owner       `json:"reviewers"`
+	CommentCount      int64         `json:"comment_count"`
+	CloseSourceBranch bool          `json:"close_source_branch"`
+	ClosedBy          Owner         `json:"closed_by"`
+	Reason            string        `json:"reason"`
 	Rendered          struct {
 		Description struct {
 			HTML string `json:"html"`
@@ -400,6 +409,17 @@ type PullRequest struct {
 	} `json:"links"`
 }
 
+// ApprovalCount returns the number of participants who approved the pull request.
+func (pr PullRequest) ApprovalCount() int {
+	count := 0
+	for _, participant := range pr.Participants {
+		if participant.Approved {
+			count++
+		}
+	}
+	return count
+}
+
 // RepoPushChange is a part of the Bitbucket repo:push payload
 type RepoPushChange struct {
 	New       RepoPushChangeState    `json:"new"`
@@ -529,6 +549,10 @@ func (pl RepoCommitCommentCreatedPayload) GetRepository() Repository {
 	return pl.Repository
 }
 
+func (pl RepoCommitStatusPayload) GetRepository() Repository {
+	return pl.Repository
+}
+
 func (pl RepoCommitStatusCreatedPayload) GetRepository() Repository {
 	return pl.Repository
 }
@@ -601,6 +625,10 @@ func (pl RepoCommitCommentCreatedPayload) GetActor() Owner {
 	return pl.Actor
 }
 
+func (pl RepoCommitStatusPayload) GetActor() Owner {
+	return pl.Actor
+}
+
 func (pl RepoCommitStatusCreatedPayload) GetActor() Owner {
 	return pl.Actor
 }
@@ -18,4 +18,7 @@ export default {
     CLOSE_ATTACH_COMMENT_TO_ISSUE_MODAL: pluginId + '_close_attach_modal',
     OPEN_ATTACH_COMMENT_TO_ISSUE_MODAL: pluginId + '_open_attach_modal',
     RECEIVED_ATTACH_COMMENT_RESULT: pluginId + '_received_attach_comment',
+    CLOSE_ATTACH_COMMENT_TO_PR_MODAL: pluginId + '_close_attach_pr_modal',
+    OPEN_ATTACH_COMMENT_TO_PR_MODAL: pluginId + '_open_attach_pr_modal',
+    RECEIVED_ATTACH_PR_COMMENT_RESULT: pluginId + '_received_attach_pr_comment',
 };
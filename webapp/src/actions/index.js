@@ -305,3 +305,40 @@ export function attachCommentToIssue(payload) {
         return {data};
     };
 }
+
+export function openAttachCommentToPullRequestModal(postId) {
+    return {
+        type: ActionTypes.OPEN_ATTACH_COMMENT_TO_PR_MODAL,
+        data: {
+            postId,
+        },
+    };
+}
+
+export function closeAttachCommentToPullRequestModal() {
+    return {
+        type: ActionTypes.CLOSE_ATTACH_COMMENT_TO_PR_MODAL,
+    };
+}
+
+export function attachCommentToPullRequest(payload) {
+    return async (dispatch) => {
+        let data;
+        try {
+            data = await Client.attachCommentToPullRequest(payload);
+        } catch (error) {
+            return {error};
+        }
+
+        const connected = await dispatch(checkAndHandleNotConnected(data));
+        if (!connected) {
+            return {error: data};
+        }
+
+        dispatch({
+            type: ActionTypes.RECEIVED_ATTACH_PR_COMMENT_RESULT,
+            data,
+        });
+        return {data};
+    };
+}
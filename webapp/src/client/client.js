@@ -46,6 +46,10 @@ export default class Client {
         return this.doPost(`${this.url}/createissuecomment`, payload);
     };
 
+    attachCommentToPullRequest = async (payload) => {
+        return this.doPost(`${this.url}/createprcomment`, payload);
+    };
+
     getIssue = async (owner, repo, issueId) => {
         return this.doGet(`${this.url}/issue?owner=${owner}&repo=${repo}&id=${issueId}`);
     };
@@ -4,12 +4,15 @@ import {bindActionCreators} from 'redux';
 import manifest from 'manifest';
 
 import {getRepos} from '../../actions';
+import {isRepositoryAllowed} from '../../utils/utils';
 
 import BitbucketRepoSelector from './bitbucket_repo_selector.jsx';
 
 function mapStateToProps(state) {
+    const {yourRepos, organizations, deniedRepositories} = state[`plugins-${manifest.id}`];
+
     return {
-        yourRepos: state[`plugins-${manifest.id}`].yourRepos,
+        yourRepos: (yourRepos || []).filter((repo) => isRepositoryAllowed(repo.full_name, organizations, deniedRepositories)),
     };
 }
 
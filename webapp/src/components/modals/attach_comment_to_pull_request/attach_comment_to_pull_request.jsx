@@ -0,0 +1,235 @@
+import React, {PureComponent} from 'react';
+import PropTypes from 'prop-types';
+import {Modal} from 'react-bootstrap';
+
+import ReactSelectSetting from '../../react_select_setting';
+import Input from '../../input';
+import FormButton from '../../form_button';
+
+const initialState = {
+    submitting: false,
+    pullRequestValue: null,
+    path: '',
+    line: '',
+    error: null,
+};
+
+export default class AttachPullRequestModal extends PureComponent {
+    static propTypes = {
+        close: PropTypes.func.isRequired,
+        create: PropTypes.func.isRequired,
+        getReviews: PropTypes.func.isRequired,
+        getYourPrs: PropTypes.func.isRequired,
+        post: PropTypes.object,
+        reviews: PropTypes.array.isRequired,
+        theme: PropTypes.object.isRequired,
+        visible: PropTypes.bool.isRequired,
+        yourPrs: PropTypes.array.isRequired,
+    };
+
+    constructor(props) {
+        super(props);
+        this.state = initialState;
+    }
+
+    componentDidUpdate(prevProps) {
+        if (this.props.visible && !prevProps.visible) {
+            this.props.getYourPrs();
+            this.props.getReviews();
+        }
+    }
+
+    getPullRequestOptions = () => {
+        const options = [];
+        for (const pr of [...this.props.yourPrs, ...this.props.reviews]) {
+            const repository = pr.destination ? pr.destination.repository : pr.repository;
+            const value = `${repository.full_name}#${pr.id}`;
+            if (!options.some((option) => option.value === value)) {
+                options.push({value, label: `${value} ${pr.title}`});
+            }
+        }
+        return options;
+    };
+
+    handleCreate = (e) => {
+        if (e && e.preventDefault) {
+            e.preventDefault();
+        }
+
+        if (!this.state.pullRequestValue) {
+            return;
+        }
+
+        const line = this.state.line || 0;
+        if (line && !this.state.path.trim()) {
+            this.setState({error: 'Please enter the file of the line to comment on.'});
+            return;
+        }
+
+        const [fullName, number] = this.state.pullRequestValue.split('#');
+        const [owner, repo] = fullName.split('/');
+
+        const pullRequestComment = {
+            owner,
+            repo,
+            number: parseInt(number, 10),
+            comment: this.props.post.message,
+            post_id: this.props.post.id,
+            path: this.state.path.trim(),
+            line,
+        };
+
+        this.setState({submitting: true});
+
+        this.props.create(pullRequestComment).then((created) => {
+            if (created.error) {
+                let errMessage = created.error.message;
+                if (created.error.response &&
+                    created.error.response.body &&
+                    created.error.response.body.message) {
+                    errMessage = created.error.response.body.message;
+                }
+                this.setState({error: errMessage, submitting: false});
+                return;
+            }
+
+            this.handleClose(e);
+        });
+    };
+
+    handleClose = (e) => {
+        if (e && e.preventDefault) {
+            e.preventDefault();
+        }
+        const {close} = this.props;
+        this.setState(initialState, close);
+    };
+
+    handlePullRequestChange = (name, label) => {
+        const option = this.getPullRequestOptions().find((o) => o.label === label);
+        this.setState({
+            pullRequestValue: option ? option.value : null,
+        });
+    };
+
+    handlePathChange = (path) => {
+        this.setState({
+            path,
+        });
+    };
+
+    handleLineChange = (line) => {
+        this.setState({
+            line: isNaN(line) ? '' : line,
+        });
+    };
+
+    render() {
+        const {visible, theme} = this.props;
+        const {error, submitting} = this.state;
+        const style = getStyle(theme);
+
+        if (!visible) {
+            return null;
+        }
+
+        const pullRequestOptions = this.getPullRequestOptions();
+
+        const component = (
+            <div>
+                <div className={'form-group margin-bottom x3'}>
+                    <ReactSelectSetting
+                        name={'pull_request'}
+                        label={'Pull Request'}
+                        limitOptions={true}
+                        required={true}
+                        onChange={this.handlePullRequestChange}
+                        options={pullRequestOptions}
+                        isMulti={false}
+                        theme={theme}
+                        value={pullRequestOptions.find((option) => option.value === this.state.pullRequestValue)}
+                    />
+                    <div className={'help-text'}>
+                        {'Returns your open pull requests and the ones you are reviewing'} <br/>
+                    </div>
+                </div>
+                <Input
+                    label='File'
+                    placeholder='Optional, e.g. server/api.go'
+                    value={this.state.path}
+                    onChange={this.handlePathChange}
+                />
+                <Input
+                    label='Line'
+                    type='number'
+                    placeholder='Optional, a line of the new version of the file'
+                    value={this.state.line}
+                    onChange={this.handleLineChange}
+                />
+                <Input
+                    label='Message Attached to Bitbucket Pull Request'
+                    type='textarea'
+                    isDisabled={true}
+                    value={this.props.post.message}
+                    disabled={false}
+                    readOnly={true}
+                />
+                {error && <p className='help-text error-text'>{error}</p>}
+            </div>
+        );
+
+        return (
+
+            <Modal
+                dialogClassName='modal--scroll'
+                show={true}
+                onHide={this.handleClose}
+                onExited={this.handleClose}
+                bsSize='large'
+                backdrop='static'
+            >
+                <Modal.Header closeButton={true}>
+                    <Modal.Title>
+                        {'Attach Message to Bitbucket Pull Request'}
+                    </Modal.Title>
+                </Modal.Header>
+                <form
+                    role='form'
+                    onSubmit={this.handleCreate}
+                >
+                    <Modal.Body
+                        style={style.modal}
+                        ref='modalBody'
+                    >
+                        {component}
+                    </Modal.Body>
+                    <Modal.Footer>
+                        <FormButton
+                            type='button'
+                            btnClass='btn-link'
+                            defaultMessage='Cancel'
+                            onClick={this.handleClose}
+                        />
+                        <FormButton
+                            type='submit'
+                            btnClass='btn btn-primary'
+                            saving={submitting}
+                            defaultMessage='Attach'
+                            savingMessage='Attaching'
+                        >
+                            {'Attach'}
+                        </FormButton>
+                    </Modal.Footer>
+                </form>
+            </Modal>
+        );
+    }
+}
+
+const getStyle = (theme) => ({
+    modal: {
+        padding: '2em 2em 3em',
+        color: theme.centerChannelColor,
+        backgroundColor: theme.centerChannelBg,
+    },
+});
@@ -0,0 +1,37 @@
+import {connect} from 'react-redux';
+import {bindActionCreators} from 'redux';
+import {getPost} from 'mattermost-redux/selectors/entities/posts';
+
+import manifest from 'manifest';
+
+import {closeAttachCommentToPullRequestModal, attachCommentToPullRequest, getReviews, getYourPrs} from 'actions';
+import {isRepositoryAllowed} from 'utils/utils';
+
+import AttachCommentToPullRequest from './attach_comment_to_pull_request';
+
+const mapStateToProps = (state) => {
+    const {id: pluginId} = manifest;
+    const postId = state[`plugins-${pluginId}`].attachCommentToPullRequestModalForPostId;
+    const post = getPost(state, postId);
+    const {organizations, deniedRepositories} = state[`plugins-${pluginId}`];
+    const isAllowed = (pr) => {
+        const repository = pr.destination ? pr.destination.repository : pr.repository;
+        return isRepositoryAllowed(repository.full_name, organizations, deniedRepositories);
+    };
+
+    return {
+        visible: state[`plugins-${pluginId}`].attachCommentToPullRequestModalVisible,
+        post,
+        yourPrs: (state[`plugins-${pluginId}`].yourPrs || []).filter(isAllowed),
+        reviews: (state[`plugins-${pluginId}`].reviews || []).filter(isAllowed),
+    };
+};
+
+const mapDispatchToProps = (dispatch) => bindActionCreators({
+    close: closeAttachCommentToPullRequestModal,
+    create: attachCommentToPullRequest,
+    getReviews,
+    getYourPrs,
+}, dispatch);
+
+export default connect(mapStateToProps, mapDispatchToProps)(AttachCommentToPullRequest);
@@ -0,0 +1,45 @@
+import React, {PureComponent} from 'react';
+import PropTypes from 'prop-types';
+
+import BitbucketIcon from '../../icon';
+
+export default class AttachCommentToPullRequestPostMenuAction extends PureComponent {
+    static propTypes = {
+        isSystemMessage: PropTypes.bool.isRequired,
+        open: PropTypes.func.isRequired,
+        postId: PropTypes.string,
+        connected: PropTypes.bool.isRequired,
+    };
+
+    handleClick = (e) => {
+        const {open, postId} = this.props;
+        e.preventDefault();
+        open(postId);
+    };
+
+    render() {
+        if (this.props.isSystemMessage || !this.props.connected) {
+            return null;
+        }
+
+        const content = (
+            <button
+                className='style--none'
+                role='presentation'
+                onClick={this.handleClick}
+            >
+                <BitbucketIcon/>
+                {'Attach to Bitbucket Pull Request'}
+            </button>
+        );
+
+        return (
+            <li
+                className='MenuItem'
+                role='menuitem'
+            >
+                {content}
+            </li>
+        );
+    }
+}
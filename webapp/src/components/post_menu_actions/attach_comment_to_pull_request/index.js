@@ -0,0 +1,26 @@
+import {connect} from 'react-redux';
+import {bindActionCreators} from 'redux';
+import {getPost} from 'mattermost-redux/selectors/entities/posts';
+import {isSystemMessage} from 'mattermost-redux/utils/post_utils';
+
+import manifest from 'manifest';
+
+import {openAttachCommentToPullRequestModal} from 'actions';
+
+import AttachCommentToPullRequestPostMenuAction from './attach_comment_to_pull_request';
+
+const mapStateToProps = (state, ownProps) => {
+    const post = getPost(state, ownProps.postId);
+    const systemMessage = post ? isSystemMessage(post) : true;
+
+    return {
+        isSystemMessage: systemMessage,
+        connected: state[`plugins-${manifest.id}`].connected,
+    };
+};
+
+const mapDispatchToProps = (dispatch) => bindActionCreators({
+    open: openAttachCommentToPullRequestModal,
+}, dispatch);
+
+export default connect(mapStateToProps, mapDispatchToProps)(AttachCommentToPullRequestPostMenuAction);
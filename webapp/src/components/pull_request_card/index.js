@@ -0,0 +1,3 @@
+import PullRequestCard from './pull_request_card.jsx';
+
+export default PullRequestCard;
@@ -0,0 +1,125 @@
+import React from 'react';
+import PropTypes from 'prop-types';
+import Octicon, {Check, GitMerge, GitPullRequest} from '@primer/octicons-react';
+
+import {hexToRGB} from '../../utils/styles';
+
+const stateColors = {
+    OPEN: '#28a745',
+    MERGED: '#6f42c1',
+    DECLINED: '#cb2431',
+    SUPERSEDED: '#cb2431',
+};
+
+const buildStatusColors = {
+    SUCCESSFUL: '#28a745',
+    INPROGRESS: '#dbab09',
+    STOPPED: '#6a737d',
+    FAILED: '#cb2431',
+};
+
+const capitalize = (s) => s.charAt(0) + s.slice(1).toLowerCase();
+
+// PullRequestCard renders the card the server keeps up to date with the current state of a pull request.
+const PullRequestCard = ({post, theme}) => {
+    const props = post.props || {};
+    const reviewers = props.reviewers || [];
+    const state = props.state || 'OPEN';
+    const mutedColor = hexToRGB(theme.centerChannelColor, '0.64');
+
+    return (
+        <div
+            className='bitbucket-pr-card'
+            style={{
+                border: `1px solid ${hexToRGB(theme.centerChannelColor, '0.16')}`,
+                borderLeft: `4px solid ${stateColors[state] || mutedColor}`,
+                borderRadius: '4px',
+                padding: '12px',
+                marginTop: '4px',
+                maxWidth: '600px',
+            }}
+        >
+            <div style={{color: mutedColor}}>
+                <a
+                    href={props.repository_url}
+                    target='_blank'
+                    rel='noopener noreferrer'
+                >
+                    {props.repository}
+                </a>
+            </div>
+            <div style={{fontWeight: 600, margin: '4px 0'}}>
+                <span style={{color: stateColors[state], marginRight: '6px'}}>
+                    <Octicon
+                        icon={state === 'MERGED' ? GitMerge : GitPullRequest}
+                        size='small'
+                        verticalAlign='middle'
+                    />
+                </span>
+                <a
+                    href={props.url}
+                    target='_blank'
+                    rel='noopener noreferrer'
+                >
+                    {`#${props.id} ${props.title}`}
+                </a>
+            </div>
+            <div style={{color: mutedColor}}>
+                <span className='commit-ref'>{props.source_branch}</span>
+                <span className='mx-1'>{' → '}</span>
+                <span className='commit-ref'>{props.target_branch}</span>
+                {props.author && ` by ${props.author}`}
+            </div>
+            <div style={{marginTop: '8px'}}>
+                <b>{'Status: '}</b>
+                <span style={{color: stateColors[state]}}>{capitalize(state)}</span>
+                {props.build_status && (
+                    <span>
+                        {' | '}
+                        <b>{'Build: '}</b>
+                        <span style={{color: buildStatusColors[props.build_status]}}>{capitalize(props.build_status)}</span>
+                    </span>
+                )}
+                {' | '}
+                <b>{'Comments: '}</b>
+                {props.comment_count || 0}
+            </div>
+            {reviewers.length > 0 && (
+                <div style={{marginTop: '4px'}}>
+                    <b>{'Reviewers: '}</b>
+                    {reviewers.map((reviewer, i) => (
+                        <span key={reviewer.url || reviewer.name}>
+                            {i > 0 && ', '}
+                            <a
+                                href={reviewer.url}
+                                target='_blank'
+                                rel='noopener noreferrer'
+                            >
+                                {reviewer.name}
+                            </a>
+                            {reviewer.approved && (
+                                <span
+                                    title='Approved'
+                                    style={{color: stateColors.OPEN, marginLeft: '2px'}}
+                                >
+                                    <Octicon
+                                        icon={Check}
+                                        size='small'
+                                        verticalAlign='middle'
+                                    />
+                                </span>
+                            )}
+                        </span>
+                    ))}
+                </div>
+            )}
+        </div>
+    );
+};
+
+PullRequestCard.propTypes = {
+    post: PropTypes.object.isRequired,
+    theme: PropTypes.object.isRequired,
+};
+
+export default PullRequestCard;
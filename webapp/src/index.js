@@ -1,5 +1,7 @@
 import AttachCommentToIssuePostMenuAction from 'components/post_menu_actions/attach_comment_to_issue';
 import AttachCommentToIssueModal from 'components/modals/attach_comment_to_issue';
+import AttachCommentToPullRequestPostMenuAction from 'components/post_menu_actions/attach_comment_to_pull_request';
+import AttachCommentToPullRequestModal from 'components/modals/attach_comment_to_pull_request';
 
 import CreateIssueModal from './components/modals/create_issue';
 
@@ -9,6 +11,7 @@ import TeamSidebar from './components/team_sidebar';
 import UserAttribute from './components/user_attribute';
 import SidebarRight from './components/sidebar_right';
 import LinkTooltip from './components/link_tooltip';
+import PullRequestCard from './components/pull_request_card';
 import Reducer from './reducers';
 import {getConnected, setShowRHSAction} from './actions';
 import {handleConnect, handleDisconnect, handleReconnect, handleRefresh} from './websocket';
@@ -30,7 +33,10 @@ class PluginClass {
         registry.registerPostDropdownMenuComponent(CreateIssuePostMenuAction);
         registry.registerRootComponent(AttachCommentToIssueModal);
         registry.registerPostDropdownMenuComponent(AttachCommentToIssuePostMenuAction);
+        registry.registerRootComponent(AttachCommentToPullRequestModal);
+        registry.registerPostDropdownMenuComponent(AttachCommentToPullRequestPostMenuAction);
         registry.registerLinkTooltipComponent(LinkTooltip);
+        registry.registerPostTypeComponent('custom_bb_pr_card', PullRequestCard);
 
         const {showRHSPlugin} = registry.registerRightHandSidebarComponent(SidebarRight, 'Bitbucket');
         store.dispatch(setShowRHSAction(() => store.dispatch(showRHSPlugin)));
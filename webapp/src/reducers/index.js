@@ -36,6 +36,30 @@ function organization(state = '', action) {
     }
 }
 
+function organizations(state = [], action) {
+    switch (action.type) {
+    case ActionTypes.RECEIVED_CONNECTED:
+        if (action.data && action.data.organizations) {
+            return action.data.organizations;
+        }
+        return [];
+    default:
+        return state;
+    }
+}
+
+function deniedRepositories(state = [], action) {
+    switch (action.type) {
+    case ActionTypes.RECEIVED_CONNECTED:
+        if (action.data && action.data.denied_repositories) {
+            return action.data.denied_repositories;
+        }
+        return [];
+    default:
+        return state;
+    }
+}
+
 function username(state = '', action) {
     switch (action.type) {
     case ActionTypes.RECEIVED_CONNECTED:
@@ -182,10 +206,34 @@ const attachCommentToIssueModalForPostId = (state = '', action) => {
     }
 };
 
+const attachCommentToPullRequestModalVisible = (state = false, action) => {
+    switch (action.type) {
+    case ActionTypes.OPEN_ATTACH_COMMENT_TO_PR_MODAL:
+        return true;
+    case ActionTypes.CLOSE_ATTACH_COMMENT_TO_PR_MODAL:
+        return false;
+    default:
+        return state;
+    }
+};
+
+const attachCommentToPullRequestModalForPostId = (state = '', action) => {
+    switch (action.type) {
+    case ActionTypes.OPEN_ATTACH_COMMENT_TO_PR_MODAL:
+        return action.data.postId;
+    case ActionTypes.CLOSE_ATTACH_COMMENT_TO_PR_MODAL:
+        return '';
+    default:
+        return state;
+    }
+};
+
 export default combineReducers({
     connected,
     enterpriseURL,
     organization,
+    organizations,
+    deniedRepositories,
     username,
     settings,
     reviews,
@@ -201,4 +249,6 @@ export default combineReducers({
     createIssueModalForPostId,
     attachCommentToIssueModalVisible,
     attachCommentToIssueModalForPostId,
+    attachCommentToPullRequestModalVisible,
+    attachCommentToPullRequestModalForPostId,
 });
@@ -6,3 +6,16 @@ export function getErrorMessage(str) {
         return str;
     }
 }
+
+// isRepositoryAllowed reports whether a repository, given as owner/repo, belongs to one of the
+// organizations the plugin is restricted to and isn't denied.
+export function isRepositoryAllowed(fullName, organizations, deniedRepositories) {
+    const name = fullName.toLowerCase();
+    const owner = name.split('/')[0];
+
+    if (organizations.length && !organizations.some((org) => org.toLowerCase() === owner)) {
+        return false;
+    }
+
+    return !deniedRepositories.some((repo) => repo.toLowerCase() === name);
+}